@@ -0,0 +1,169 @@
+// Command idp-access-matrix prints the access matrix of an IdP realm: every
+// client × scope × role with the last time a token carrying it was issued.
+// Grants unused for -stale-days are candidates for removal:
+//
+//	idp-access-matrix -issuer https://login.example.com -format csv > matrix.csv
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/login"
+)
+
+type accessMatrix struct {
+	Realm       string    `json:"realm"`
+	GeneratedAt time.Time `json:"generated_at"`
+	StaleDays   int       `json:"stale_days"`
+	Entries     []struct {
+		Client       string     `json:"client"`
+		Scope        string     `json:"scope"`
+		Role         string     `json:"role"`
+		GrantedAt    *time.Time `json:"granted_at"`
+		LastIssuedAt *time.Time `json:"last_issued_at"`
+		Stale        bool       `json:"stale"`
+	} `json:"entries"`
+}
+
+func main() {
+	issuer := flag.String("issuer", os.Getenv("IDP_LOGIN_ISSUER"), "upstream OIDC issuer")
+	clientID := flag.String("client-id", envOr("IDP_LOGIN_CLIENT_ID", "idp-cli"), "upstream client id")
+	tokenFile := flag.String("token-file", "", "file with the bearer token, e.g. a service account token, instead of a login")
+	idpAddress := flag.String("idp", envOr("IDP_LOGIN_IDP_ADDRESS", config.IdPAddress), "IdP base address")
+	realm := flag.String("realm", config.DefaultRealm, "IdP realm")
+	staleDays := flag.Int("stale-days", 30, "days without issued tokens after which a grant is stale")
+	format := flag.String("format", "table", "output format: table, csv or json")
+	staleOnly := flag.Bool("stale", false, "print stale grants only, table format")
+	listen := flag.String("listen", "127.0.0.1:0", "loopback address of the login redirect")
+	timeout := flag.Duration("timeout", 5*time.Minute, "time to complete the login")
+	flag.Parse()
+
+	log.SetFlags(0)
+	if (*issuer == "" && *tokenFile == "") || *staleDays <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "csv" && *format != "json" {
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	cfg := &config.Config{IdPAddress: *idpAddress, Realm: *realm}
+
+	var token string
+	if *tokenFile != "" {
+		raw, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatalf("failed to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	} else {
+		flow := &login.Flow{
+			Issuer:        *issuer,
+			ClientID:      *clientID,
+			ListenAddress: *listen,
+		}
+
+		idToken, err := flow.IDToken(ctx)
+		if err != nil {
+			log.Fatalf("login failed: %v", err)
+		}
+		token = idToken
+	}
+
+	serverFormat := *format
+	if serverFormat == "table" {
+		serverFormat = "json"
+	}
+
+	query := url.Values{}
+	query.Set("stale_days", strconv.Itoa(*staleDays))
+	query.Set("format", serverFormat)
+	body, err := fetch(ctx, cfg.RealmAddress()+"/access_matrix?"+query.Encode(), token)
+	if err != nil {
+		log.Fatalf("failed to get access matrix: %v", err)
+	}
+	defer body.Close()
+
+	if *format != "table" {
+		if _, err := io.Copy(os.Stdout, body); err != nil {
+			log.Fatalf("failed to write access matrix: %v", err)
+		}
+		return
+	}
+
+	var matrix accessMatrix
+	if err := json.NewDecoder(body).Decode(&matrix); err != nil {
+		log.Fatalf("failed to decode access matrix: %v", err)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "CLIENT\tSCOPE\tROLE\tGRANTED\tLAST ISSUED\tSTALE")
+	stale := 0
+	for _, entry := range matrix.Entries {
+		if entry.Stale {
+			stale++
+		} else if *staleOnly {
+			continue
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%t\n",
+			entry.Client, entry.Scope, entry.Role, formatTime(entry.GrantedAt), formatTime(entry.LastIssuedAt), entry.Stale)
+	}
+	out.Flush()
+
+	log.Printf("%d of %d grants of realm %s unused for %d days", stale, len(matrix.Entries), matrix.Realm, matrix.StaleDays)
+}
+
+func fetch(ctx context.Context, endpoint, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return resp.Body, nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.Local().Format(time.DateTime)
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
@@ -0,0 +1,64 @@
+// Command idp-login logs an engineer in at the upstream OIDC provider and
+// prints an IdP token of the scope, to be sent to a sidecar as X-S2I-Token:
+//
+//	curl -H "X-S2I-Token: $(idp-login -scope postgres-a)" ...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/login"
+)
+
+func main() {
+	issuer := flag.String("issuer", os.Getenv("IDP_LOGIN_ISSUER"), "upstream OIDC issuer")
+	clientID := flag.String("client-id", envOr("IDP_LOGIN_CLIENT_ID", "idp-cli"), "upstream client id")
+	idpAddress := flag.String("idp", envOr("IDP_LOGIN_IDP_ADDRESS", config.IdPAddress), "IdP base address")
+	realm := flag.String("realm", config.DefaultRealm, "IdP realm")
+	scope := flag.String("scope", "", "scope of the token, e.g. postgres-a")
+	listen := flag.String("listen", "127.0.0.1:0", "loopback address of the login redirect")
+	timeout := flag.Duration("timeout", 5*time.Minute, "time to complete the login")
+	flag.Parse()
+
+	log.SetFlags(0)
+	if *issuer == "" || *scope == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	cfg := &config.Config{IdPAddress: *idpAddress, Realm: *realm}
+	flow := &login.Flow{
+		Issuer:        *issuer,
+		ClientID:      *clientID,
+		TokenEndpoint: cfg.RealmAddress() + "/protocol/openid-connect/token",
+		ListenAddress: *listen,
+	}
+
+	token, err := flow.Login(ctx, *scope)
+	if err != nil {
+		log.Fatalf("login failed: %v", err)
+	}
+
+	log.Printf("token of %s scope expires at %s", *scope, token.ExpiresAt.Format(time.RFC3339))
+	fmt.Println(token.AccessToken)
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return fallback
+}
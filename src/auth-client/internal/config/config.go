@@ -1,20 +1,88 @@
 package config
 
 import (
+	"net/http"
 	"sync/atomic"
 	"time"
 )
 
 const (
-	IdPIssuer = "http://idp.idp.svc.cluster.local"
+	IdPIssuer    = "http://idp.idp.svc.cluster.local"
+	IdPAddress   = IdPIssuer + ":80"
+	DefaultRealm = "service2infra"
+
+	// ServiceAccountTokenFile is the projected token of the pod service
+	// account.
+	ServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 )
 
 type Config struct {
 	ClientID string
+	Realm    string
+
+	// IdPAddress is the base URL the realm endpoints are requested on,
+	// IssuerBase is the issuer URL tokens are expected to be signed with. Both
+	// default to plain http inside the cluster, TLS is opt-in.
+	IdPAddress string
+	IssuerBase string
+
+	// CABundleFile verifies the IdP certificate instead of the system roots,
+	// ClientCertFile and ClientKeyFile are presented when the IdP asks for mTLS.
+	CABundleFile   string
+	ClientCertFile string
+	ClientKeyFile  string
+
+	HTTPClient *http.Client
+
+	// SubjectTokenFile holds the service account token the signer exchanges
+	// at the IdP, ServiceAccountTokenFile is read if it is empty.
+	SubjectTokenFile string
+
+	// CertificateBoundTokens asks the IdP to bind the tokens to the client
+	// certificate (RFC 8705), the signer then presents it to the resource
+	// servers as well.
+	CertificateBoundTokens bool
+
+	// DPoPEnabled makes the signer prove possession of a per-process key
+	// (RFC 9449), DPoPProofWindow bounds the age of proofs the verifier accepts.
+	DPoPEnabled     bool
+	DPoPProofWindow time.Duration
+
+	// PermissionEventsEnabled makes the signer subscribe to permission
+	// changes of its client and reissue the affected tokens right away.
+	PermissionEventsEnabled bool
+
+	// PermissionsVersionsInterval makes the verifier poll the minimum
+	// permissions versions of its scope and reject tokens issued before a
+	// downgrade, zero disables the check.
+	PermissionsVersionsInterval time.Duration
+
+	// IntrospectionCacheTTL bounds how long the verifier reuses the
+	// introspection of an opaque token, a revoked token is accepted for at
+	// most this long.
+	IntrospectionCacheTTL time.Duration
+	// IntrospectionTokenFile holds the service account token the verifier
+	// authenticates to the introspection and permissions versions endpoints
+	// with, it is reread on every request since the kubelet rotates it.
+	IntrospectionTokenFile string
+
+	// DecryptionKeyFile is the PEM private key the verifier decrypts tokens
+	// encrypted to its scope with, EncryptionRequired rejects signed JWTs
+	// which are not encrypted.
+	DecryptionKeyFile  string
+	EncryptionRequired bool
 
 	TokenEndpointAddress  string
 	CertsEndpointAddress  string
 	ConfigEndpointAddress string
+	EventsEndpointAddress string
+
+	VersionsEndpointAddress      string
+	IntrospectionEndpointAddress string
+
+	// BatchTokenEndpointAddress issues the tokens of all the scopes in one
+	// request, tokens are issued one by one if it is empty.
+	BatchTokenEndpointAddress string
 
 	SignAuthEnabled   atomic.Pointer[bool]
 	VerifyAuthEnabled atomic.Pointer[bool]
@@ -22,3 +90,13 @@ type Config struct {
 	RequestTimeout  time.Duration
 	ErrTokenBackoff time.Duration
 }
+
+// RealmIssuer returns the issuer of tokens signed in the configured realm.
+func (c *Config) RealmIssuer() string {
+	return c.IssuerBase + "/realms/" + c.Realm
+}
+
+// RealmAddress returns the base address of the configured realm endpoints.
+func (c *Config) RealmAddress() string {
+	return c.IdPAddress + "/realms/" + c.Realm
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// SetupHTTPClient builds the client used for all IdP requests, it trusts the
+// configured CA bundle and presents the client certificate if one is set.
+func (c *Config) SetupHTTPClient() error {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CABundleFile != "" {
+		caBundle, err := os.ReadFile(c.CABundleFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca bundle: %w", err)
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caBundle) {
+			return fmt.Errorf("no certificates found in ca bundle %s", c.CABundleFile)
+		}
+		tlsCfg.RootCAs = roots
+	}
+
+	if c.ClientCertFile != "" {
+		// check the pair once, later it is read on every handshake to pick up
+		// rotated certificates
+		if _, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile); err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsCfg.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+
+			return &cert, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	c.HTTPClient = &http.Client{
+		Timeout:   c.RequestTimeout,
+		Transport: transport,
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/testpki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTLSServer(t *testing.T, pki *testpki.PKI, requireClientCert bool) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = pki.ServerTLSConfig(requireClientCert)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestSetupHTTPClient_CABundle(t *testing.T) {
+	pki := testpki.New(t)
+	ts := startTLSServer(t, pki, false)
+
+	cfg := &Config{RequestTimeout: 5 * time.Second, CABundleFile: pki.CAFile}
+	require.NoError(t, cfg.SetupHTTPClient())
+
+	resp, err := cfg.HTTPClient.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSetupHTTPClient_UnknownAuthority(t *testing.T) {
+	pki := testpki.New(t)
+	ts := startTLSServer(t, pki, false)
+
+	cfg := &Config{RequestTimeout: 5 * time.Second}
+	require.NoError(t, cfg.SetupHTTPClient())
+
+	_, err := cfg.HTTPClient.Get(ts.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
+func TestSetupHTTPClient_MutualTLS(t *testing.T) {
+	pki := testpki.New(t)
+	ts := startTLSServer(t, pki, true)
+
+	withoutCert := &Config{RequestTimeout: 5 * time.Second, CABundleFile: pki.CAFile}
+	require.NoError(t, withoutCert.SetupHTTPClient())
+	_, err := withoutCert.HTTPClient.Get(ts.URL)
+	assert.Error(t, err)
+
+	withCert := &Config{
+		RequestTimeout: 5 * time.Second,
+		CABundleFile:   pki.CAFile,
+		ClientCertFile: pki.ClientCertFile,
+		ClientKeyFile:  pki.ClientKeyFile,
+	}
+	require.NoError(t, withCert.SetupHTTPClient())
+
+	resp, err := withCert.HTTPClient.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSetupHTTPClient_InvalidFiles(t *testing.T) {
+	pki := testpki.New(t)
+
+	cfg := &Config{CABundleFile: pki.ClientKeyFile}
+	assert.ErrorContains(t, cfg.SetupHTTPClient(), "no certificates found")
+
+	cfg = &Config{ClientCertFile: pki.ClientCertFile, ClientKeyFile: pki.CAFile}
+	assert.ErrorContains(t, cfg.SetupHTTPClient(), "failed to load client certificate")
+}
@@ -0,0 +1,137 @@
+package tokens
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+)
+
+const permissionsEvent = "permissions"
+
+type permissionEvent struct {
+	Client string    `json:"client"`
+	Scope  string    `json:"scope"`
+	Roles  []string  `json:"roles"`
+	Time   time.Time `json:"time"`
+}
+
+// errEventsNotSupported is returned by an IdP without the permission events
+// endpoint, there is nothing to reconnect to.
+var errEventsNotSupported = errors.New("idp does not stream permission events")
+
+// runEventsSubscriber keeps a stream of the client permission changes open and
+// reissues the tokens of the changed scopes. After a reconnect all tokens are
+// reissued, as events could be missed while the stream was down.
+func (t *TokenSet) runEventsSubscriber(ctx context.Context, cfg *config.Config) {
+	// the stream outlives the request timeout of the idp client
+	client := &http.Client{Transport: cfg.HTTPClient.Transport}
+
+	reconnect := false
+	for {
+		err := t.streamEvents(ctx, cfg, client, reconnect)
+		if ctx.Err() != nil {
+			return
+		} else if errors.Is(err, errEventsNotSupported) {
+			log.Printf("permission events are disabled, new grants apply on the next refresh: %v", err)
+			return
+		}
+
+		log.Printf("permission events stream interrupted, reconnecting in %s: %v", cfg.ErrTokenBackoff, err)
+		reconnect = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.ErrTokenBackoff):
+		}
+	}
+}
+
+func (t *TokenSet) streamEvents(ctx context.Context, cfg *config.Config, client *http.Client, reconnect bool) error {
+	k8sToken, err := getK8SToken(cfg)
+	if err != nil {
+		return fmt.Errorf("getting k8s token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.EventsEndpointAddress, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create events request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k8sToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to permission events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errEventsNotSupported
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to subscribe to permission events, status: %s", resp.Status)
+	}
+
+	log.Printf("subscribed to permission events of client %s", cfg.ClientID)
+	if reconnect {
+		t.RefreshTokens()
+	}
+
+	return readEvents(bufio.NewScanner(resp.Body), func(name, data string) {
+		if name != permissionsEvent {
+			return
+		}
+
+		var event permissionEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.Printf("failed to unmarshal permission event: %v; data: %s", err, data)
+			return
+		}
+
+		log.Printf("permissions of client %s on %s scope changed, roles: %v", event.Client, event.Scope, event.Roles)
+		t.RefreshScopes(event.Scope)
+	})
+}
+
+// readEvents parses a server-sent events stream until it ends, comments and
+// fields other than event and data are skipped.
+func readEvents(scanner *bufio.Scanner, handle func(name, data string)) error {
+	var name string
+	var data []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				handle(name, strings.Join(data, "\n"))
+			}
+			name, data = "", nil
+		case strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+
+			switch field {
+			case "event":
+				name = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("events stream closed")
+}
@@ -0,0 +1,176 @@
+package tokens
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSet_RefreshesScopesOnPermissionEvent(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var mu sync.Mutex
+	issued := make(map[string]int)
+	issuedCount := func(scope string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return issued[scope]
+	}
+
+	subscribed := make(chan struct{})
+	publish := make(chan string)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		scope := r.PostFormValue("scope")
+
+		mu.Lock()
+		issued[scope]++
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(TokenResp{
+			AccessToken: fmt.Sprintf("%s-%d", scope, issuedCount(scope)),
+			ExpiresIn:   int64(1000 * time.Hour / time.Second),
+		})
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer sa-token", r.Header.Get("Authorization"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": subscribed\n\n")
+		w.(http.Flusher).Flush()
+		close(subscribed)
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case scope := <-publish:
+				fmt.Fprintf(w, "event: permissions\ndata: {\"client\":\"client1\",\"scope\":%q,\"roles\":[\"RW\"]}\n\n", scope)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{
+		ClientID:                "client1",
+		HTTPClient:              srv.Client(),
+		TokenEndpointAddress:    srv.URL + "/token",
+		EventsEndpointAddress:   srv.URL + "/events",
+		PermissionEventsEnabled: true,
+		ErrTokenBackoff:         time.Second,
+	}
+
+	set, err := NewTokenSet(context.Background(), cfg, []string{"scope1", "scope2"})
+	require.NoError(t, err)
+	defer set.Close()
+
+	require.Eventually(t, func() bool {
+		return issuedCount("scope1") == 1 && issuedCount("scope2") == 1
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("token set is not subscribed to permission events")
+	}
+
+	publish <- "scope2"
+	publish <- "unknown"
+
+	require.Eventually(t, func() bool {
+		token, err := set.Token("scope2")
+		return err == nil && token == "scope2-2"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, issuedCount("scope1"))
+}
+
+func TestTokenSet_StopsSubscribingWithoutEvents(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var mu sync.Mutex
+	subscriptions := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(TokenResp{AccessToken: "token", ExpiresIn: int64(1000 * time.Hour / time.Second)})
+	})
+	// an IdP before permission events
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		subscriptions++
+		mu.Unlock()
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{
+		HTTPClient:              srv.Client(),
+		TokenEndpointAddress:    srv.URL + "/token",
+		EventsEndpointAddress:   srv.URL + "/events",
+		PermissionEventsEnabled: true,
+		ErrTokenBackoff:         10 * time.Millisecond,
+	}
+
+	set, err := NewTokenSet(context.Background(), cfg, []string{"scope1"})
+	require.NoError(t, err)
+	defer set.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, subscriptions)
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := strings.Join([]string{
+		": subscribed",
+		"",
+		"event: permissions",
+		`data: {"scope":`,
+		`data: "scope1"}`,
+		"",
+		": keepalive",
+		"",
+		"data: unnamed",
+		"",
+	}, "\n") + "\n"
+
+	type event struct{ name, data string }
+	var got []event
+
+	err := readEvents(bufio.NewScanner(strings.NewReader(stream)), func(name, data string) {
+		got = append(got, event{name, data})
+	})
+
+	assert.EqualError(t, err, "events stream closed")
+	assert.Equal(t, []event{
+		{"permissions", "{\"scope\":\n\"scope1\"}"},
+		{"", "unnamed"},
+	}, got)
+}
@@ -3,24 +3,37 @@ package tokens
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"maps"
 	"net/http"
 	"net/url"
-	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
-	saSecretTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount"
-)
+// saTokenFile is the projected service account token, tests point it to a
+// temporary file.
+var saTokenFile = config.ServiceAccountTokenFile
 
 type Issuer struct {
 	cfg *config.Config
+
+	// batchUnsupported is set once the IdP did not find the batch endpoint.
+	batchUnsupported atomic.Bool
 }
 
 func NewIssuer(cfg *config.Config) *Issuer {
@@ -28,7 +41,101 @@ func NewIssuer(cfg *config.Config) *Issuer {
 }
 
 func (i *Issuer) IssueToken(ctx context.Context, scope string) (*TokenResp, error) {
-	k8sToken, err := getK8SToken()
+	ctx, span := tracing.Tracer().Start(ctx, "Issuer.IssueToken",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("auth.scope", scope)),
+	)
+	tokenResp, err := i.issueToken(ctx, scope)
+	tracing.End(span, err)
+
+	return tokenResp, err
+}
+
+func (i *Issuer) issueToken(ctx context.Context, scope string) (*TokenResp, error) {
+	respBytes, err := i.exchange(ctx, i.cfg.TokenEndpointAddress, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResp TokenResp
+	if err := json.Unmarshal(respBytes, &tokenResp); err != nil {
+		log.Printf("failed to unmarshal token: %v; body: %s", err, string(respBytes))
+		return nil, fmt.Errorf("failed to unmarshal token response: %w", err)
+	}
+
+	return &tokenResp, nil
+}
+
+// IssueTokens exchanges the SA token for tokens of all the scopes in a single
+// request. IdPs without the batch endpoint are asked for every scope in turn.
+// Every scope gets either a token or an error, an error of the whole request
+// is reported for all the scopes.
+func (i *Issuer) IssueTokens(ctx context.Context, scopes []string) (map[string]*TokenResp, map[string]error) {
+	ctx, span := tracing.Tracer().Start(ctx, "Issuer.IssueTokens",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.StringSlice("auth.scopes", scopes)),
+	)
+	tokens, errs := i.issueTokens(ctx, scopes)
+	tracing.End(span, errors.Join(slices.Collect(maps.Values(errs))...))
+
+	return tokens, errs
+}
+
+func (i *Issuer) issueTokens(ctx context.Context, scopes []string) (map[string]*TokenResp, map[string]error) {
+	tokens := make(map[string]*TokenResp, len(scopes))
+	errs := make(map[string]error)
+	failAll := func(err error) (map[string]*TokenResp, map[string]error) {
+		for _, scope := range scopes {
+			errs[scope] = err
+		}
+		return tokens, errs
+	}
+
+	if i.cfg.BatchTokenEndpointAddress == "" || i.batchUnsupported.Load() {
+		for _, scope := range scopes {
+			token, err := i.issueToken(ctx, scope)
+			if err != nil {
+				errs[scope] = err
+				continue
+			}
+			tokens[scope] = token
+		}
+		return tokens, errs
+	}
+
+	respBytes, err := i.exchange(ctx, i.cfg.BatchTokenEndpointAddress, strings.Join(scopes, " "))
+	var oauthErr *oauth.Error
+	if errors.As(err, &oauthErr) && (oauthErr.StatusCode == http.StatusNotFound || oauthErr.StatusCode == http.StatusMethodNotAllowed) {
+		log.Printf("idp does not serve batch token requests, issuing tokens one by one")
+		i.batchUnsupported.Store(true)
+		return i.issueTokens(ctx, scopes)
+	} else if err != nil {
+		return failAll(err)
+	}
+
+	var batchResp oauth.BatchTokenResponse
+	if err := json.Unmarshal(respBytes, &batchResp); err != nil {
+		log.Printf("failed to unmarshal batch token response: %v", err)
+		return failAll(fmt.Errorf("failed to unmarshal batch token response: %w", err))
+	}
+
+	for _, scope := range scopes {
+		if token, ok := batchResp.Tokens[scope]; ok && token != nil {
+			tokens[scope] = token
+		} else if scopeErr, ok := batchResp.Errors[scope]; ok {
+			errs[scope] = fmt.Errorf("failed to get idp token: %w", scopeErr)
+		} else {
+			errs[scope] = errors.New("idp did not return a token")
+		}
+	}
+
+	return tokens, errs
+}
+
+// exchange posts the token exchange of the SA token for the scope to the
+// endpoint and returns the body of a successful response.
+func (i *Issuer) exchange(ctx context.Context, endpoint, scope string) ([]byte, error) {
+	k8sToken, err := getK8SToken(i.cfg)
 	if err != nil {
 		return nil, fmt.Errorf("getting k8s token: %w", err)
 	}
@@ -38,39 +145,115 @@ func (i *Issuer) IssueToken(ctx context.Context, scope string) (*TokenResp, erro
 	v.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt:kubernetes")
 	v.Set("subject_token", k8sToken)
 	v.Set("scope", scope)
-	body := v.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.TokenEndpointAddress, strings.NewReader(body))
+	return i.postExchange(ctx, endpoint, v)
+}
+
+// postExchange posts the token exchange form to the endpoint and returns the
+// body of a successful response.
+func (i *Issuer) postExchange(ctx context.Context, endpoint string, form url.Values) ([]byte, error) {
+	scope := form.Get("scope")
+	if i.cfg.CertificateBoundTokens {
+		form.Set("bind_certificate", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create idp token request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tracing.Inject(ctx, req.Header)
 
-	client := &http.Client{Timeout: i.cfg.RequestTimeout}
-	resp, err := client.Do(req)
-
-	var respBytes []byte
-	if resp != nil && resp.Body != nil {
-		respBytes, _ = io.ReadAll(resp.Body)
+	if i.cfg.DPoPEnabled {
+		proof, err := newDPoPProof(http.MethodPost, endpoint, "")
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(dpop.HeaderName, proof)
 	}
+
+	resp, err := i.cfg.HTTPClient.Do(req)
 	if err != nil {
-		log.Printf("failed to get idp token: %v; respBody: %s", err, string(respBytes))
 		return nil, fmt.Errorf("failed to get idp token: %w", err)
 	}
 	defer resp.Body.Close()
 
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := oauth.ParseError(resp, respBytes)
+		log.Printf("idp rejected token request to %s scope: %v", scope, oauthErr)
+		return nil, fmt.Errorf("failed to get idp token: %w", oauthErr)
+	}
+
+	return respBytes, nil
+}
+
+// Downscope exchanges an access token of the IdP for one limited to the roles
+// and the lifetime. No roles keep the roles of the access token and a zero ttl
+// keeps its expiry, the IdP never exceeds either of them.
+func (i *Issuer) Downscope(ctx context.Context, accessToken, scope string, roles []string, ttl time.Duration) (*TokenResp, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "Issuer.Downscope",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("auth.scope", scope), attribute.StringSlice("auth.roles", roles)),
+	)
+	tokenResp, err := i.downscope(ctx, accessToken, scope, roles, ttl)
+	tracing.End(span, err)
+
+	return tokenResp, err
+}
+
+func (i *Issuer) downscope(ctx context.Context, accessToken, scope string, roles []string, ttl time.Duration) (*TokenResp, error) {
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	v.Set("subject_token_type", oauth.TokenTypeAccessToken)
+	v.Set("subject_token", accessToken)
+	v.Set("scope", scope)
+	if len(roles) > 0 {
+		v.Set("roles", strings.Join(roles, " "))
+	}
+	if ttl > 0 {
+		v.Set("expires_in", strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+
+	respBytes, err := i.postExchange(ctx, i.cfg.TokenEndpointAddress, v)
+	if err != nil {
+		return nil, err
+	}
+
 	var tokenResp TokenResp
-	if marshalErr := json.Unmarshal(respBytes, &tokenResp); marshalErr != nil {
-		log.Printf("failed to unmarshal token: %v; body: %s", marshalErr, string(respBytes))
+	if err := json.Unmarshal(respBytes, &tokenResp); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal token response: %w", err)
 	}
 
 	return &tokenResp, nil
 }
 
-func getK8SToken() (string, error) {
-	tokenPath := filepath.Join(saSecretTokenPath, "token")
-	token, err := ioutil.ReadFile(tokenPath)
+// newDPoPProof signs a proof with the key of the process, so the token bound
+// at the IdP can be presented by any signer of the process.
+func newDPoPProof(method, uri, accessToken string) (string, error) {
+	proofer, err := dpop.ProcessProofer()
+	if err != nil {
+		return "", err
+	}
+
+	proof, err := proofer.Proof(method, uri, accessToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to create dpop proof: %w", err)
+	}
+
+	return proof, nil
+}
+
+func getK8SToken(cfg *config.Config) (string, error) {
+	tokenFile := cfg.SubjectTokenFile
+	if tokenFile == "" {
+		tokenFile = saTokenFile
+	}
+
+	token, err := ioutil.ReadFile(tokenFile)
 	if err != nil {
 		return "", fmt.Errorf("failed to read k8s token: %v", err)
 	}
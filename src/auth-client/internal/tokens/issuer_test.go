@@ -0,0 +1,166 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuer_IssueTokenError(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":"slow_down","error_description":"too many token requests, retry later"}`)
+	}))
+	defer srv.Close()
+
+	issuer := NewIssuer(&config.Config{HTTPClient: srv.Client(), TokenEndpointAddress: srv.URL})
+
+	_, err := issuer.IssueToken(context.Background(), "scope1")
+	require.ErrorIs(t, err, oauth.ErrSlowDown)
+
+	var oauthErr *oauth.Error
+	require.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, 30*time.Second, oauthErr.RetryAfter)
+
+	assert.Equal(t, 30*time.Second, errBackoff(err, time.Second))
+	assert.Equal(t, time.Minute, errBackoff(err, time.Minute))
+	assert.Equal(t, time.Second, errBackoff(fmt.Errorf("connection refused"), time.Second))
+}
+
+func TestIssuer_IssueTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var batchRequests, singleRequests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token/batch", func(w http.ResponseWriter, r *http.Request) {
+		batchRequests.Add(1)
+		assert.Equal(t, "sa-token", r.PostFormValue("subject_token"))
+		assert.Equal(t, "scope1 scope2", r.PostFormValue("scope"))
+
+		fmt.Fprint(w, `{
+			"tokens": {"scope1": {"access_token": "token1", "token_type": "Bearer", "expires_in": 300}},
+			"errors": {"scope2": {"error": "server_error", "error_description": "failed to issue token"}}
+		}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		singleRequests.Add(1)
+		fmt.Fprintf(w, `{"access_token": "single-%s", "token_type": "Bearer", "expires_in": 300}`, r.PostFormValue("scope"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	issuer := NewIssuer(&config.Config{
+		HTTPClient:                srv.Client(),
+		TokenEndpointAddress:      srv.URL + "/token",
+		BatchTokenEndpointAddress: srv.URL + "/token/batch",
+	})
+
+	tokens, errs := issuer.IssueTokens(context.Background(), []string{"scope1", "scope2"})
+	require.Len(t, tokens, 1)
+	assert.Equal(t, "token1", tokens["scope1"].AccessToken)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), tokens["scope1"].ExpiresAt, time.Second)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs["scope2"], oauth.ErrServerError)
+	assert.Equal(t, int32(1), batchRequests.Load())
+	assert.Zero(t, singleRequests.Load())
+
+	t.Run("idp without batch endpoint", func(t *testing.T) {
+		issuer := NewIssuer(&config.Config{
+			HTTPClient:                srv.Client(),
+			TokenEndpointAddress:      srv.URL + "/token",
+			BatchTokenEndpointAddress: srv.URL + "/unknown",
+		})
+
+		for range 2 {
+			tokens, errs := issuer.IssueTokens(context.Background(), []string{"scope1", "scope2"})
+			assert.Empty(t, errs)
+			require.Len(t, tokens, 2)
+			assert.Equal(t, "single-scope2", tokens["scope2"].AccessToken)
+		}
+		assert.True(t, issuer.batchUnsupported.Load())
+		assert.Equal(t, int32(4), singleRequests.Load())
+	})
+}
+
+func TestIssuer_Downscope(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, oauth.TokenTypeAccessToken, r.PostFormValue("subject_token_type"))
+		assert.Equal(t, "broad-token", r.PostFormValue("subject_token"))
+		assert.Equal(t, "postgres-a", r.PostFormValue("scope"))
+
+		if r.PostFormValue("roles") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_scope","error_description":"role \"DDL\" is not granted by the subject token"}`)
+			return
+		}
+
+		assert.Equal(t, "RO", r.PostFormValue("roles"))
+		assert.Equal(t, "30", r.PostFormValue("expires_in"))
+		fmt.Fprint(w, `{"access_token": "narrow-token", "token_type": "Bearer", "expires_in": 30}`)
+	}))
+	defer srv.Close()
+
+	issuer := NewIssuer(&config.Config{HTTPClient: srv.Client(), TokenEndpointAddress: srv.URL})
+
+	tokenResp, err := issuer.Downscope(context.Background(), "broad-token", "postgres-a", []string{"RO"}, 30*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "narrow-token", tokenResp.AccessToken)
+	assert.Equal(t, int64(30), tokenResp.ExpiresIn)
+
+	_, err = issuer.Downscope(context.Background(), "broad-token", "postgres-a", nil, 0)
+	assert.ErrorIs(t, err, oauth.ErrInvalidScope)
+}
+
+func TestIssuer_CertificateBoundTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var bindCertificate atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bindCertificate.Store(r.PostFormValue("bind_certificate"))
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": 300}`)
+	}))
+	defer srv.Close()
+
+	for _, bound := range []bool{false, true} {
+		issuer := NewIssuer(&config.Config{
+			HTTPClient:             srv.Client(),
+			TokenEndpointAddress:   srv.URL,
+			CertificateBoundTokens: bound,
+		})
+
+		_, err := issuer.IssueToken(context.Background(), "scope1")
+		require.NoError(t, err)
+		if bound {
+			assert.Equal(t, "true", bindCertificate.Load())
+		} else {
+			assert.Empty(t, bindCertificate.Load())
+		}
+	}
+}
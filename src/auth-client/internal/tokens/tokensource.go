@@ -2,31 +2,25 @@ package tokens
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"math/rand"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
 )
 
-type TokenResp struct {
-	AccessToken string    `json:"access_token"`
-	Type        string    `json:"token_type"`
-	ExpiresIn   time.Time `json:"expires_in"`
-}
+type TokenResp = oauth.TokenResponse
 
+// TokenSource keeps the current token of a scope of the set.
 type TokenSource struct {
-	cfg *config.Config
-
-	scope  string
-	token  atomic.Pointer[string]
-	issuer *Issuer
-
-	refreshCh chan struct{}
-	closeCh   chan struct{}
+	token atomic.Pointer[string]
 }
 
 func (ts *TokenSource) Token() string {
@@ -38,28 +32,57 @@ func (ts *TokenSource) Token() string {
 	return *token
 }
 
+// TokenSet keeps the tokens of several scopes. They are issued together by a
+// batch request and refreshed together once the earliest of them is due.
 type TokenSet struct {
 	sync.RWMutex
 
 	set map[string]*TokenSource
+
+	cfg    *config.Config
+	issuer *Issuer
+	// refreshCh wakes the scheduler up to reissue the pending scopes, requests
+	// made while it is busy are coalesced.
+	refreshCh chan struct{}
+	// pending scopes are reissued on the next wake up, all of them if
+	// pendingAll is set. They are guarded by the embedded mutex.
+	pending    map[string]struct{}
+	pendingAll bool
+
+	cancel context.CancelFunc
 }
 
+// NewTokenSet issues the tokens of the scopes and keeps them fresh until the
+// set is closed, the context only carries the values of the caller.
 func NewTokenSet(ctx context.Context, cfg *config.Config, scopes []string) (*TokenSet, error) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
 	set := &TokenSet{
-		set: make(map[string]*TokenSource),
+		set:       make(map[string]*TokenSource),
+		cfg:       cfg,
+		issuer:    NewIssuer(cfg),
+		refreshCh: make(chan struct{}, 1),
+		pending:   make(map[string]struct{}),
+		cancel:    cancel,
 	}
 	for _, scope := range scopes {
-		ts, err := NewTokenSource(ctx, cfg, scope)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create tokensource for %s scope: %w", scope, err)
-		}
+		set.set[scope] = &TokenSource{}
+	}
+
+	go set.runScheduler(ctx)
 
-		set.set[scope] = ts
+	if cfg.PermissionEventsEnabled && cfg.EventsEndpointAddress != "" {
+		go set.runEventsSubscriber(ctx, cfg)
 	}
 
 	return set, nil
 }
 
+// Close stops refreshing the tokens and the subscription to permission
+// events, the last issued tokens are still returned.
+func (t *TokenSet) Close() {
+	t.cancel()
+}
+
 func (t *TokenSet) Token(scope string) (string, error) {
 	ts, ok := t.set[scope]
 	if !ok {
@@ -74,59 +97,134 @@ func (t *TokenSet) Token(scope string) (string, error) {
 	return token, nil
 }
 
-func (t *TokenSet) RefreshTokens() {
-	for _, ts := range t.set {
-		ts.refreshCh <- struct{}{}
+// Downscope exchanges the current token of the scope for a narrower one, see
+// Issuer.Downscope.
+func (t *TokenSet) Downscope(ctx context.Context, scope string, roles []string, ttl time.Duration) (*TokenResp, error) {
+	token, err := t.Token(scope)
+	if err != nil {
+		return nil, err
 	}
+
+	return t.issuer.Downscope(ctx, token, scope, roles, ttl)
 }
 
-func NewTokenSource(ctx context.Context, cfg *config.Config, scope string) (*TokenSource, error) {
-	issuer := NewIssuer(cfg)
+// RefreshTokens reissues all the tokens, it does not wait for the scheduler.
+func (t *TokenSet) RefreshTokens() {
+	t.Lock()
+	t.pendingAll = true
+	t.Unlock()
 
-	ts := &TokenSource{
-		cfg:       cfg,
-		scope:     scope,
-		issuer:    issuer,
-		token:     atomic.Pointer[string]{},
-		refreshCh: make(chan struct{}),
-		closeCh:   make(chan struct{}),
+	t.wakeScheduler()
+}
+
+// RefreshScopes reissues the tokens of the given scopes, scopes outside of the
+// set are ignored. It does not wait for the scheduler.
+func (t *TokenSet) RefreshScopes(scopes ...string) {
+	t.Lock()
+	added := false
+	for _, scope := range scopes {
+		if _, ok := t.set[scope]; ok {
+			t.pending[scope] = struct{}{}
+			added = true
+		}
 	}
+	t.Unlock()
 
-	go ts.runScheduler(context.WithoutCancel(ctx))
+	if added {
+		t.wakeScheduler()
+	}
+}
 
-	return ts, nil
+func (t *TokenSet) wakeScheduler() {
+	select {
+	case t.refreshCh <- struct{}{}:
+	default:
+		// the scheduler is woken up already and takes the pending scopes
+	}
 }
 
-func (ts *TokenSource) runScheduler(ctx context.Context) {
+// takePending returns the scopes requested since the last call, all is set if
+// all the tokens were requested.
+func (t *TokenSet) takePending() (scopes []string, all bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	scopes, all = slices.Sorted(maps.Keys(t.pending)), t.pendingAll
+	clear(t.pending)
+	t.pendingAll = false
+
+	return scopes, all
+}
+
+// runScheduler reissues all the tokens at a random point of the lifetime of
+// the earliest expiring one. Tokens refreshed on request keep the schedule
+// unless they fail, then all of them are retried after the backoff.
+func (t *TokenSet) runScheduler(ctx context.Context) {
+	expiries := make(map[string]time.Time, len(t.set))
 	planner := time.NewTimer(0)
 	defer planner.Stop()
 
 	for {
+		var scopes []string
+		all := true
 		select {
-		case <-ts.closeCh:
+		case <-ctx.Done():
 			return
-		case <-ts.refreshCh:
 		case <-planner.C:
+		case <-t.refreshCh:
+			if scopes, all = t.takePending(); !all && len(scopes) == 0 {
+				continue
+			}
 		}
 
-		delay := func() (delay time.Duration) {
-			tokenResp, err := ts.issuer.IssueToken(ctx, ts.scope)
-			if err != nil {
-				log.Printf("failed to issue token to %s scope: %v", ts.scope, err)
-				return ts.cfg.ErrTokenBackoff
-			}
+		if all {
+			scopes = slices.Collect(maps.Keys(t.set))
+		}
 
-			accessToken := tokenResp.AccessToken
-			ts.token.Store(&accessToken)
+		if err := t.refresh(ctx, scopes, expiries); err != nil {
+			resetTimer(planner, errBackoff(err, t.cfg.ErrTokenBackoff))
+		} else if all && len(expiries) > 0 {
+			earliest := slices.MinFunc(slices.Collect(maps.Values(expiries)), time.Time.Compare)
+			newDelay := calcDelay(time.Until(earliest))
+			log.Printf("Tokens to %d scopes have been issued, until_next: %s", len(scopes), newDelay)
+			resetTimer(planner, newDelay)
+		}
+	}
+}
 
-			expiry := tokenResp.ExpiresIn
-			newDelay := calcDelay(time.Until(expiry))
-			log.Printf("New token to %s scope has been issued, expiry: %s, until_next: %s", ts.scope, expiry, newDelay)
-			return newDelay
-		}()
+// refresh issues the tokens of the scopes in a single request and returns the
+// error of one of the failed scopes.
+func (t *TokenSet) refresh(ctx context.Context, scopes []string, expiries map[string]time.Time) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	tokens, errs := t.issuer.IssueTokens(ctx, scopes)
+	for scope, tokenResp := range tokens {
+		accessToken := tokenResp.AccessToken
+		t.set[scope].token.Store(&accessToken)
+		expiries[scope] = tokenResp.ExpiresAt
+		log.Printf("New token to %s scope has been issued, expiry: %s", scope, tokenResp.ExpiresAt)
+	}
 
-		resetTimer(planner, delay)
+	var failed error
+	for scope, err := range errs {
+		log.Printf("failed to issue token to %s scope: %v", scope, err)
+		failed = err
 	}
+
+	return failed
+}
+
+// errBackoff waits for the Retry-After delay of a rate limited request when
+// it is longer than the configured backoff.
+func errBackoff(err error, backoff time.Duration) time.Duration {
+	var oauthErr *oauth.Error
+	if errors.As(err, &oauthErr) && oauthErr.RetryAfter > backoff {
+		return oauthErr.RetryAfter
+	}
+
+	return backoff
 }
 
 func calcDelay(ttl time.Duration) time.Duration {
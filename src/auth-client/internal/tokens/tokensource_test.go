@@ -0,0 +1,157 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSet_IssuesTokensInBatches(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var mu sync.Mutex
+	var batches []string
+	requested := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), batches...)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token/batch", func(w http.ResponseWriter, r *http.Request) {
+		scopes := strings.Fields(r.PostFormValue("scope"))
+
+		mu.Lock()
+		batches = append(batches, strings.Join(scopes, " "))
+		n := len(batches)
+		mu.Unlock()
+
+		tokens := make([]string, 0, len(scopes))
+		for _, scope := range scopes {
+			tokens = append(tokens, fmt.Sprintf(`%q: {"access_token": "%s-%d", "token_type": "Bearer", "expires_in": 3600000}`, scope, scope, n))
+		}
+		fmt.Fprintf(w, `{"tokens": {%s}}`, strings.Join(tokens, ","))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("token of %s scope requested outside of a batch", r.PostFormValue("scope"))
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := &config.Config{
+		HTTPClient:                srv.Client(),
+		TokenEndpointAddress:      srv.URL + "/token",
+		BatchTokenEndpointAddress: srv.URL + "/token/batch",
+		ErrTokenBackoff:           time.Second,
+	}
+
+	set, err := NewTokenSet(context.Background(), cfg, []string{"scope1", "scope2", "scope3"})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		token, err := set.Token("scope3")
+		return err == nil && token == "scope3-1"
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, requested(), 1)
+	assert.ElementsMatch(t, []string{"scope1", "scope2", "scope3"}, strings.Fields(requested()[0]))
+
+	set.RefreshScopes("scope2", "unknown", "scope3")
+	require.Eventually(t, func() bool { return len(requested()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "scope2 scope3", requested()[1])
+
+	set.RefreshTokens()
+	require.Eventually(t, func() bool {
+		token, err := set.Token("scope1")
+		return err == nil && token == "scope1-3"
+	}, time.Second, 10*time.Millisecond)
+	assert.Len(t, requested(), 3)
+}
+
+func TestTokenSet_CoalescesRefreshes(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token"), 0o600))
+	prevTokenFile := saTokenFile
+	saTokenFile = tokenFile
+	t.Cleanup(func() { saTokenFile = prevTokenFile })
+
+	var mu sync.Mutex
+	var batches []string
+	requested := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), batches...)
+	}
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes := strings.Fields(r.PostFormValue("scope"))
+
+		mu.Lock()
+		batches = append(batches, strings.Join(scopes, " "))
+		mu.Unlock()
+		<-release
+
+		tokens := make([]string, 0, len(scopes))
+		for _, scope := range scopes {
+			tokens = append(tokens, fmt.Sprintf(`%q: {"access_token": "%s", "token_type": "Bearer", "expires_in": 3600000}`, scope, scope))
+		}
+		fmt.Fprintf(w, `{"tokens": {%s}}`, strings.Join(tokens, ","))
+	}))
+	defer srv.Close()
+
+	cfg := &config.Config{
+		HTTPClient:                srv.Client(),
+		BatchTokenEndpointAddress: srv.URL,
+		RequestTimeout:            5 * time.Second,
+		ErrTokenBackoff:           time.Second,
+	}
+
+	set, err := NewTokenSet(context.Background(), cfg, []string{"scope1", "scope2", "scope3"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(requested()) == 1 }, time.Second, 10*time.Millisecond)
+
+	// requests made while the scheduler is busy do not block and are issued
+	// in a single batch
+	refreshed := make(chan struct{})
+	go func() {
+		set.RefreshScopes("scope1")
+		set.RefreshScopes("scope2")
+		set.RefreshScopes("scope1")
+		close(refreshed)
+	}()
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("refresh blocks while the tokens are issued")
+	}
+
+	close(release)
+	require.Eventually(t, func() bool { return len(requested()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "scope1 scope2", requested()[1])
+
+	// a closed set no longer refreshes its tokens
+	set.Close()
+	time.Sleep(50 * time.Millisecond)
+	set.RefreshTokens()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, requested(), 2)
+	token, err := set.Token("scope1")
+	require.NoError(t, err)
+	assert.Equal(t, "scope1", token)
+}
@@ -12,20 +12,10 @@ import (
 	"github.com/go-jose/go-jose/v3"
 	"github.com/go-jose/go-jose/v3/jwt"
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
 	"github.com/samber/lo"
 )
 
-type tokenClaims struct {
-	Exp      time.Time `json:"exp"`
-	Iat      time.Time `json:"iat"`
-	Iss      string    `json:"iss"`
-	Sub      string    `json:"sub"`
-	Aud      string    `json:"aud"`
-	Scope    string    `json:"scope"`
-	Roles    []string  `json:"roles"`
-	ClientID string    `json:"clientID"`
-}
-
 type Verifier struct {
 	cfg *config.Config
 
@@ -51,10 +41,10 @@ func NewVerifier(ctx context.Context, cfg *config.Config) (*Verifier, error) {
 }
 
 func (v *Verifier) fetchIdPEndpoints(_ context.Context) error {
-	idpAddress := fmt.Sprintf("%s:80", config.IdPIssuer)
-	v.cfg.TokenEndpointAddress = idpAddress + "/realms/service2infra/protocol/openid-connect/token"
-	v.cfg.CertsEndpointAddress = idpAddress + "/realms/serviceinfra/protocol/openid-connect/certs"
-	v.cfg.ConfigEndpointAddress = idpAddress + "/realms/service2infra/.well-known/openid-configuration"
+	realmAddress := v.cfg.RealmAddress()
+	v.cfg.TokenEndpointAddress = realmAddress + "/protocol/openid-connect/token"
+	v.cfg.CertsEndpointAddress = realmAddress + "/protocol/openid-connect/certs"
+	v.cfg.ConfigEndpointAddress = realmAddress + "/.well-known/openid-configuration"
 
 	return nil
 }
@@ -73,13 +63,13 @@ func (v *Verifier) VerifyToken(rawToken string, needRoles []string) error {
 	return nil
 }
 
-func (v *Verifier) verifyClaims(claims *tokenClaims, needRoles []string) error {
+func (v *Verifier) verifyClaims(claims *tokens.Claims, needRoles []string) error {
 	if claims.Scope != claims.Aud || claims.Scope != v.cfg.ClientID {
 		return fmt.Errorf("scope or aud is unexpected, service: %s, scope: %s, aud: %s", v.cfg.ClientID, claims.Scope, claims.Aud)
-	} else if claims.Iss != config.IdPIssuer {
-		return fmt.Errorf("unexpected issuer, expected: %s, got: %s", config.IdPIssuer, claims.Iss)
-	} else if expired := claims.Exp.Before(time.Now()); expired {
-		return fmt.Errorf("token is expired, exp: %s, now: %s", claims.Exp, time.Now())
+	} else if claims.Iss != v.cfg.RealmIssuer() {
+		return fmt.Errorf("unexpected issuer, expected: %s, got: %s", v.cfg.RealmIssuer(), claims.Iss)
+	} else if err := claims.ValidAt(time.Now(), 0); err != nil {
+		return err
 	} else if rolesOk := lo.Every(claims.Roles, needRoles); !rolesOk {
 		return fmt.Errorf("roles mismatched, want: %v, got: %v", needRoles, claims.Roles)
 	}
@@ -87,14 +77,14 @@ func (v *Verifier) verifyClaims(claims *tokenClaims, needRoles []string) error {
 	return nil
 }
 
-func verifyToken(rawToken string, certs *jose.JSONWebKeySet) (*tokenClaims, error) {
+func verifyToken(rawToken string, certs *jose.JSONWebKeySet) (*tokens.Claims, error) {
 	token, err := jwt.ParseSigned(rawToken)
 	if err != nil {
 		log.Printf("failed to parse token: %v", err)
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
-	var claims tokenClaims
+	var claims tokens.Claims
 	for _, header := range token.Headers {
 		keys := certs.Key(header.KeyID)
 		if len(keys) == 0 {
@@ -120,8 +110,7 @@ func (v *Verifier) fetchJWKs(ctx context.Context) (*jose.JSONWebKeySet, error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: v.cfg.RequestTimeout}
-	resp, err := client.Do(req)
+	resp, err := v.cfg.HTTPClient.Do(req)
 
 	var respBytes []byte
 	if resp != nil && resp.Body != nil {
@@ -0,0 +1,100 @@
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+var (
+	processOnce    sync.Once
+	processProofer *Proofer
+	processErr     error
+)
+
+// Proofer signs DPoP proofs with a key that never leaves the process.
+type Proofer struct {
+	signer jose.Signer
+	jkt    string
+	now    func() time.Time
+}
+
+// ProcessProofer returns the proofer of the process, its key is generated on
+// the first call and shared by the token requests and the signed requests.
+func ProcessProofer() (*Proofer, error) {
+	processOnce.Do(func() {
+		processProofer, processErr = NewProofer()
+	})
+
+	return processProofer, processErr
+}
+
+func NewProofer() (*Proofer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dpop key: %w", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(proofType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dpop signer: %w", err)
+	}
+
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute dpop key thumbprint: %w", err)
+	}
+
+	return &Proofer{
+		signer: signer,
+		jkt:    base64.RawURLEncoding.EncodeToString(thumbprint),
+		now:    time.Now,
+	}, nil
+}
+
+// JKT returns the thumbprint tokens bound to this proofer carry in cnf.jkt.
+func (p *Proofer) JKT() string {
+	return p.jkt
+}
+
+// Proof returns a fresh proof for a request to method and uri, accessToken is
+// empty for token requests and is hashed into ath otherwise.
+func (p *Proofer) Proof(method, uri, accessToken string) (string, error) {
+	htu, err := normalizeURI(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid dpop htu %q: %w", uri, err)
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("failed to generate dpop jti: %w", err)
+	}
+
+	claims := proofClaims{
+		JTI: base64.RawURLEncoding.EncodeToString(jti),
+		HTM: method,
+		HTU: htu,
+		IAT: jwt.NewNumericDate(p.now()),
+	}
+	if accessToken != "" {
+		claims.ATH = AccessTokenHash(accessToken)
+	}
+
+	proof, err := jwt.Signed(p.signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to sign dpop proof: %w", err)
+	}
+
+	return proof, nil
+}
@@ -0,0 +1,63 @@
+package dpop
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers the proofs accepted within the window. Replicas of a
+// service behind one endpoint must share it, or a proof replayed to another
+// replica is accepted.
+type ReplayCache interface {
+	// Remember stores key until expiresAt and reports false when it is
+	// already stored.
+	Remember(ctx context.Context, key string, expiresAt time.Time) (bool, error)
+}
+
+// memoryReplays is the replay cache of a single replica. Expired keys are
+// swept at most once per sweep interval, not on every proof.
+type memoryReplays struct {
+	now           func() time.Time
+	sweepInterval time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	nextSweep time.Time
+}
+
+// NewMemoryReplayCache returns a replay cache of this process, expired keys are
+// swept every sweepInterval.
+func NewMemoryReplayCache(sweepInterval time.Duration) ReplayCache {
+	return newMemoryReplays(sweepInterval, time.Now)
+}
+
+func newMemoryReplays(sweepInterval time.Duration, now func() time.Time) *memoryReplays {
+	return &memoryReplays{
+		now:           now,
+		sweepInterval: sweepInterval,
+		seen:          make(map[string]time.Time),
+	}
+}
+
+func (m *memoryReplays) Remember(_ context.Context, key string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.After(m.nextSweep) {
+		for seenKey, seenExp := range m.seen {
+			if now.After(seenExp) {
+				delete(m.seen, seenKey)
+			}
+		}
+		m.nextSweep = now.Add(m.sweepInterval)
+	}
+
+	if seenExp, ok := m.seen[key]; ok && !now.After(seenExp) {
+		return false, nil
+	}
+	m.seen[key] = expiresAt
+
+	return true, nil
+}
@@ -0,0 +1,188 @@
+package dpop
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	// HeaderName is the request header carrying the proof.
+	HeaderName = "DPoP"
+	// TokenType is the token_type of DPoP-bound access tokens.
+	TokenType = "DPoP"
+
+	proofType = "dpop+jwt"
+)
+
+// SigningAlgorithms are the asymmetric algorithms accepted for proofs.
+var SigningAlgorithms = []string{
+	string(jose.ES256), string(jose.ES384), string(jose.RS256), string(jose.PS256), string(jose.EdDSA),
+}
+
+type proofClaims struct {
+	JTI string           `json:"jti"`
+	HTM string           `json:"htm"`
+	HTU string           `json:"htu"`
+	IAT *jwt.NumericDate `json:"iat"`
+	ATH string           `json:"ath,omitempty"`
+}
+
+// Proof is a validated DPoP proof.
+type Proof struct {
+	// JKT is the base64url SHA-256 JWK thumbprint of the proof key (RFC 7638).
+	JKT      string
+	JTI      string
+	IssuedAt time.Time
+}
+
+// Verifier validates DPoP proofs (RFC 9449). Proofs are accepted within window
+// of their iat, and every jti is remembered for that window to reject replays.
+type Verifier struct {
+	window  time.Duration
+	now     func() time.Time
+	replays ReplayCache
+}
+
+// NewVerifier returns a verifier remembering proofs in this process.
+func NewVerifier(window time.Duration) *Verifier {
+	v := &Verifier{window: window, now: time.Now}
+	v.replays = newMemoryReplays(window, func() time.Time { return v.now() })
+
+	return v
+}
+
+// NewSharedVerifier returns a verifier remembering proofs in replays, which is
+// shared by the replicas.
+func NewSharedVerifier(window time.Duration, replays ReplayCache) *Verifier {
+	return &Verifier{window: window, now: time.Now, replays: replays}
+}
+
+// Verify checks the proof presented for a request to method and uri. The
+// access token is empty at the token endpoint, otherwise the proof must carry
+// its hash in ath.
+func (v *Verifier) Verify(ctx context.Context, rawProof, method, uri, accessToken string) (*Proof, error) {
+	if rawProof == "" {
+		return nil, errors.New("missing dpop proof")
+	}
+
+	token, err := jwt.ParseSigned(rawProof)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dpop proof: %w", err)
+	} else if len(token.Headers) != 1 {
+		return nil, errors.New("dpop proof must have exactly one signature")
+	}
+
+	header := token.Headers[0]
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != proofType {
+		return nil, fmt.Errorf("unexpected dpop proof typ: %q", typ)
+	} else if !isSupportedAlgorithm(header.Algorithm) {
+		return nil, fmt.Errorf("unsupported dpop proof alg: %q", header.Algorithm)
+	} else if header.JSONWebKey == nil || !header.JSONWebKey.IsPublic() {
+		return nil, errors.New("dpop proof must carry a public jwk")
+	}
+
+	var claims proofClaims
+	if err := token.Claims(header.JSONWebKey.Key, &claims); err != nil {
+		return nil, fmt.Errorf("invalid dpop proof signature: %w", err)
+	}
+
+	if claims.JTI == "" {
+		return nil, errors.New("dpop proof has no jti")
+	} else if claims.HTM != method {
+		return nil, fmt.Errorf("dpop proof htm mismatch, expected: %s, got: %s", method, claims.HTM)
+	} else if !sameURI(claims.HTU, uri) {
+		return nil, fmt.Errorf("dpop proof htu mismatch, expected: %s, got: %s", uri, claims.HTU)
+	} else if claims.IAT == nil {
+		return nil, errors.New("dpop proof has no iat")
+	}
+
+	if accessToken != "" && claims.ATH != AccessTokenHash(accessToken) {
+		return nil, errors.New("dpop proof ath does not match the access token")
+	}
+
+	issuedAt := claims.IAT.Time()
+	if now := v.now(); issuedAt.Before(now.Add(-v.window)) || issuedAt.After(now.Add(v.window)) {
+		return nil, fmt.Errorf("dpop proof iat %s is outside of the accepted window", issuedAt)
+	}
+
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute dpop key thumbprint: %w", err)
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	fresh, err := v.replays.Remember(ctx, jkt+":"+claims.JTI, issuedAt.Add(v.window))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check dpop proof replay: %w", err)
+	} else if !fresh {
+		return nil, errors.New("dpop proof jti has already been used")
+	}
+
+	return &Proof{JKT: jkt, JTI: claims.JTI, IssuedAt: issuedAt}, nil
+}
+
+// AccessTokenHash is the ath value of a proof presented with accessToken.
+func AccessTokenHash(accessToken string) string {
+	h := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// RequestURI returns the htu the client is expected to have signed for r.
+func RequestURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+func isSupportedAlgorithm(alg string) bool {
+	for _, supported := range SigningAlgorithms {
+		if alg == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameURI compares URIs without query and fragment, after syntax based
+// normalization of scheme, host and default port (RFC 9449, section 4.3).
+func sameURI(a, b string) bool {
+	normA, errA := normalizeURI(a)
+	normB, errB := normalizeURI(b)
+
+	return errA == nil && errB == nil && normA == normB
+}
+
+func normalizeURI(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return scheme + "://" + host + path, nil
+}
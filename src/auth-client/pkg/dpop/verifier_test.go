@@ -0,0 +1,190 @@
+package dpop
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tokenURI = "https://idp.test/realms/service2infra/protocol/openid-connect/token"
+
+func newProof(t *testing.T, key *ecdsa.PrivateKey, typ string, claims proofClaims) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(jose.ContentType(typ)),
+	)
+	require.NoError(t, err)
+
+	raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+
+	return raw
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func validClaims(jti string) proofClaims {
+	return proofClaims{JTI: jti, HTM: "POST", HTU: tokenURI, IAT: jwt.NewNumericDate(time.Now())}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	key := newKey(t)
+	v := NewVerifier(time.Minute)
+
+	proof, err := v.Verify(context.Background(), newProof(t, key, proofType, validClaims("jti-1")), "POST", tokenURI, "")
+	require.NoError(t, err)
+
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(thumbprint), proof.JKT)
+	assert.Equal(t, "jti-1", proof.JTI)
+}
+
+func TestVerifier_Verify_Invalid(t *testing.T) {
+	key := newKey(t)
+
+	tests := []struct {
+		name    string
+		typ     string
+		claims  func(c *proofClaims)
+		method  string
+		uri     string
+		token   string
+		wantErr string
+	}{
+		{name: "wrong typ", typ: "JWT", wantErr: "typ"},
+		{name: "wrong method", method: "GET", wantErr: "htm mismatch"},
+		{name: "wrong uri", uri: "https://idp.test/other", wantErr: "htu mismatch"},
+		{name: "no jti", claims: func(c *proofClaims) { c.JTI = "" }, wantErr: "no jti"},
+		{
+			name:    "stale iat",
+			claims:  func(c *proofClaims) { c.IAT = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute)) },
+			wantErr: "outside of the accepted window",
+		},
+		{
+			name:    "future iat",
+			claims:  func(c *proofClaims) { c.IAT = jwt.NewNumericDate(time.Now().Add(2 * time.Minute)) },
+			wantErr: "outside of the accepted window",
+		},
+		{name: "missing ath", token: "access-token", wantErr: "ath"},
+		{
+			name:    "wrong ath",
+			claims:  func(c *proofClaims) { c.ATH = AccessTokenHash("other-token") },
+			token:   "access-token",
+			wantErr: "ath",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims("jti")
+			if tt.claims != nil {
+				tt.claims(&claims)
+			}
+			typ, method, uri := proofType, "POST", tokenURI
+			if tt.typ != "" {
+				typ = tt.typ
+			}
+			if tt.method != "" {
+				method = tt.method
+			}
+			if tt.uri != "" {
+				uri = tt.uri
+			}
+
+			_, err := NewVerifier(time.Minute).Verify(context.Background(), newProof(t, key, typ, claims), method, uri, tt.token)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestVerifier_Verify_AccessTokenHash(t *testing.T) {
+	claims := validClaims("jti")
+	claims.ATH = AccessTokenHash("access-token")
+
+	_, err := NewVerifier(time.Minute).Verify(context.Background(), newProof(t, newKey(t), proofType, claims), "POST", tokenURI, "access-token")
+	assert.NoError(t, err)
+}
+
+func TestVerifier_Verify_Replay(t *testing.T) {
+	key := newKey(t)
+	v := NewVerifier(time.Minute)
+	proof := newProof(t, key, proofType, validClaims("jti-1"))
+
+	_, err := v.Verify(context.Background(), proof, "POST", tokenURI, "")
+	require.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), proof, "POST", tokenURI, "")
+	assert.ErrorContains(t, err, "already been used")
+
+	// the jti is forgotten once the proof could no longer be accepted
+	later := time.Now().Add(2 * time.Minute)
+	v.now = func() time.Time { return later }
+	claims := validClaims("jti-2")
+	claims.IAT = jwt.NewNumericDate(later)
+
+	_, err = v.Verify(context.Background(), newProof(t, key, proofType, claims), "POST", tokenURI, "")
+	require.NoError(t, err)
+	assert.Len(t, v.replays.(*memoryReplays).seen, 1)
+}
+
+func TestSameURI(t *testing.T) {
+	assert.True(t, sameURI("HTTP://IdP.test:80/token", "http://idp.test/token"))
+	assert.True(t, sameURI("https://idp.test/token?a=b#c", "https://idp.test:443/token"))
+	assert.False(t, sameURI("https://idp.test:8443/token", "https://idp.test/token"))
+	assert.False(t, sameURI("http://idp.test/token", "https://idp.test/token"))
+}
+
+func TestVerifier_SharedReplayCache(t *testing.T) {
+	replays := NewMemoryReplayCache(time.Minute)
+	replicaA := NewSharedVerifier(time.Minute, replays)
+	replicaB := NewSharedVerifier(time.Minute, replays)
+	proof := newProof(t, newKey(t), proofType, validClaims("jti-1"))
+
+	_, err := replicaA.Verify(context.Background(), proof, "POST", tokenURI, "")
+	require.NoError(t, err)
+
+	_, err = replicaB.Verify(context.Background(), proof, "POST", tokenURI, "")
+	assert.ErrorContains(t, err, "already been used")
+}
+
+func TestMemoryReplays_SweepsPeriodically(t *testing.T) {
+	now := time.Now()
+	replays := newMemoryReplays(time.Minute, func() time.Time { return now })
+	ctx := context.Background()
+
+	fresh, err := replays.Remember(ctx, "a", now.Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	now = now.Add(2 * time.Second)
+	fresh, err = replays.Remember(ctx, "a", now.Add(time.Second))
+	require.NoError(t, err)
+	assert.True(t, fresh, "expired keys are not replays before they are swept")
+	_, err = replays.Remember(ctx, "b", now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, replays.seen, 2)
+
+	now = now.Add(2 * time.Minute)
+	_, err = replays.Remember(ctx, "c", now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, replays.seen, 1)
+}
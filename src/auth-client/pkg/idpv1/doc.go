@@ -0,0 +1,4 @@
+// Package idpv1 contains the gRPC services and client stubs of the IdP API,
+// shared by the IdP and its clients. It is generated from
+// src/idp/proto/idp/v1/idp.proto with `make -C src/idp proto`.
+package idpv1
@@ -0,0 +1,29 @@
+package login
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// OpenBrowser opens the URL in the default browser, the URL is printed as
+// well for terminals without one.
+func OpenBrowser(authURL string) error {
+	fmt.Fprintf(os.Stderr, "Open the following URL to log in:\n\n  %s\n\n", authURL)
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", authURL)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", authURL)
+	default:
+		cmd = exec.Command("xdg-open", authURL)
+	}
+
+	// the printed URL is enough when there is no browser
+	_ = cmd.Start()
+
+	return nil
+}
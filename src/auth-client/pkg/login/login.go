@@ -0,0 +1,242 @@
+// Package login authenticates engineers at the upstream OIDC provider and
+// exchanges their ID token for an IdP token of a scope, so a user queries the
+// sidecars with the same kind of token a service does.
+package login
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+
+	discoveryPath = "/.well-known/openid-configuration"
+	callbackPath  = "/callback"
+)
+
+// Token is an IdP token issued to the user.
+type Token = oauth.TokenResponse
+
+// Flow runs the authorization code flow with PKCE on a loopback redirect
+// (RFC 8252), the browser is the only place the user enters credentials.
+type Flow struct {
+	// Issuer and ClientID identify the upstream provider and the public
+	// client the IdP expects as the ID token audience.
+	Issuer   string
+	ClientID string
+	// TokenEndpoint is the token endpoint of the IdP realm.
+	TokenEndpoint string
+
+	// ListenAddress of the redirect listener, a random loopback port is
+	// used when empty.
+	ListenAddress string
+	HTTPClient    *http.Client
+	// OpenBrowser shows the authorization page to the user.
+	OpenBrowser func(authURL string) error
+}
+
+type upstreamMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// Login returns the IdP token of the scope for the user logged in at the
+// upstream provider.
+func (f *Flow) Login(ctx context.Context, scope string) (*Token, error) {
+	idToken, err := f.IDToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.Exchange(ctx, idToken, scope)
+}
+
+// IDToken logs the user in at the upstream provider.
+func (f *Flow) IDToken(ctx context.Context) (string, error) {
+	metadata, err := f.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	listenAddress := f.ListenAddress
+	if listenAddress == "" {
+		listenAddress = "127.0.0.1:0"
+	}
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for the redirect: %w", err)
+	}
+	defer listener.Close()
+
+	redirectURI := "http://" + listener.Addr().String() + callbackPath
+	state := randomString()
+	verifier := randomString()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", f.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", "openid email groups")
+	query.Set("state", state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	codeCh := make(chan string, 1)
+	errCh := make(chan error, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != callbackPath {
+				http.NotFound(w, r)
+				return
+			}
+
+			query := r.URL.Query()
+			switch {
+			case query.Get("state") != state:
+				http.Error(w, "unexpected state", http.StatusBadRequest)
+				return
+			case query.Get("error") != "":
+				errCh <- fmt.Errorf("authorization failed: %s %s", query.Get("error"), query.Get("error_description"))
+				fmt.Fprintln(w, "Login failed, see the terminal.")
+			default:
+				codeCh <- query.Get("code")
+				fmt.Fprintln(w, "Login succeeded, you can close this window.")
+			}
+		}),
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	openBrowser := f.OpenBrowser
+	if openBrowser == nil {
+		openBrowser = OpenBrowser
+	}
+	if err := openBrowser(authURL.String()); err != nil {
+		return "", fmt.Errorf("failed to open browser: %w", err)
+	}
+
+	var code string
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err := <-errCh:
+		return "", err
+	case code = <-codeCh:
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", f.ClientID)
+	form.Set("code_verifier", verifier)
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := f.postForm(ctx, metadata.TokenEndpoint, form, &tokenResp); err != nil {
+		return "", fmt.Errorf("failed to redeem authorization code: %w", err)
+	} else if tokenResp.IDToken == "" {
+		return "", errors.New("upstream returned no id_token")
+	}
+
+	return tokenResp.IDToken, nil
+}
+
+// Exchange trades the ID token for an IdP token of the scope (RFC 8693).
+func (f *Flow) Exchange(ctx context.Context, idToken, scope string) (*Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", grantTypeTokenExchange)
+	form.Set("subject_token_type", tokenTypeIDToken)
+	form.Set("subject_token", idToken)
+	form.Set("scope", scope)
+
+	var token Token
+	if err := f.postForm(ctx, f.TokenEndpoint, form, &token); err != nil {
+		return nil, fmt.Errorf("failed to exchange id token: %w", err)
+	}
+
+	return &token, nil
+}
+
+func (f *Flow) discover(ctx context.Context) (*upstreamMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(f.Issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover upstream, status: %s", resp.Status)
+	}
+
+	var metadata upstreamMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode upstream metadata: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+func (f *Flow) postForm(ctx context.Context, endpoint string, form url.Values, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return oauth.ParseError(resp, body)
+	}
+
+	return json.Unmarshal(body, dst)
+}
+
+func (f *Flow) httpClient() *http.Client {
+	if f.HTTPClient != nil {
+		return f.HTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
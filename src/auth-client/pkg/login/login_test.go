@@ -0,0 +1,153 @@
+package login
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpstream authorizes every request right away, as a user who is already
+// logged in at the provider.
+func fakeUpstream(t *testing.T, authError string) *httptest.Server {
+	t.Helper()
+
+	var challenge, redirectURI string
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(upstreamMetadata{
+			Issuer:                srv.URL,
+			AuthorizationEndpoint: srv.URL + "/authorize",
+			TokenEndpoint:         srv.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, "code", query.Get("response_type"))
+		assert.Equal(t, "idp-cli", query.Get("client_id"))
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		challenge, redirectURI = query.Get("code_challenge"), query.Get("redirect_uri")
+
+		callback := url.Values{"state": {query.Get("state")}}
+		if authError != "" {
+			callback.Set("error", authError)
+		} else {
+			callback.Set("code", "auth-code")
+		}
+		http.Redirect(w, r, redirectURI+"?"+callback.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "auth-code" ||
+			r.PostFormValue("redirect_uri") != redirectURI ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": "upstream-id-token"})
+	})
+
+	return srv
+}
+
+func fakeIdP(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != grantTypeTokenExchange ||
+			r.PostFormValue("subject_token_type") != tokenTypeIDToken ||
+			r.PostFormValue("subject_token") != "upstream-id-token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"subject token is invalid or expired"}`)
+			return
+		}
+
+		json.NewEncoder(w).Encode(Token{
+			AccessToken: "idp-token-" + r.PostFormValue("scope"),
+			Type:        "Bearer",
+			ExpiresIn:   300,
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// browser follows the authorization redirect to the loopback listener.
+func browser(t *testing.T) func(string) error {
+	return func(authURL string) error {
+		go func() {
+			resp, err := http.Get(authURL)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}
+}
+
+func TestFlow_Login(t *testing.T) {
+	upstream := fakeUpstream(t, "")
+	idp := fakeIdP(t)
+
+	flow := &Flow{
+		Issuer:        upstream.URL,
+		ClientID:      "idp-cli",
+		TokenEndpoint: idp.URL,
+		OpenBrowser:   browser(t),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	token, err := flow.Login(ctx, "postgres-a")
+	require.NoError(t, err)
+	assert.Equal(t, "idp-token-postgres-a", token.AccessToken)
+	assert.Equal(t, "Bearer", token.Type)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), token.ExpiresAt, time.Second)
+}
+
+func TestFlow_LoginDenied(t *testing.T) {
+	upstream := fakeUpstream(t, "access_denied")
+
+	flow := &Flow{
+		Issuer:      upstream.URL,
+		ClientID:    "idp-cli",
+		OpenBrowser: browser(t),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := flow.IDToken(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "access_denied")
+}
+
+func TestFlow_ExchangeRejected(t *testing.T) {
+	idp := fakeIdP(t)
+	flow := &Flow{TokenEndpoint: idp.URL}
+
+	_, err := flow.Exchange(context.Background(), "forged-id-token", "postgres-a")
+	require.ErrorIs(t, err, oauth.ErrInvalidGrant)
+
+	var oauthErr *oauth.Error
+	require.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, http.StatusBadRequest, oauthErr.StatusCode)
+	assert.Equal(t, "subject token is invalid or expired", oauthErr.Description)
+}
@@ -0,0 +1,108 @@
+// Package oauth parses the error responses of the IdP token endpoint (RFC
+// 6749 section 5.2, RFC 8693 section 2.2.2) into typed errors, so callers
+// tell a rejected subject token from a rate limited client with errors.Is.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinels of the error codes returned by the IdP, they match any *Error of
+// the same code.
+var (
+	// ErrInvalidRequest is a missing or unsupported parameter, e.g. a subject
+	// token type the realm does not accept.
+	ErrInvalidRequest = &Error{Code: "invalid_request"}
+	// ErrInvalidGrant is a subject token which is invalid or expired.
+	ErrInvalidGrant = &Error{Code: "invalid_grant"}
+	// ErrInvalidScope is a missing scope or several scopes for a single token.
+	ErrInvalidScope = &Error{Code: "invalid_scope"}
+	// ErrUnauthorizedClient is a client which is not authorized for the
+	// requested scope, it holds no roles on it.
+	ErrUnauthorizedClient   = &Error{Code: "unauthorized_client"}
+	ErrUnsupportedGrantType = &Error{Code: "unsupported_grant_type"}
+	ErrInvalidDPoPProof     = &Error{Code: "invalid_dpop_proof"}
+	ErrSlowDown             = &Error{Code: "slow_down"}
+	ErrServerError          = &Error{Code: "server_error"}
+)
+
+// Error is an error response of the token endpoint.
+type Error struct {
+	// StatusCode of the response, zero for the sentinels.
+	StatusCode  int
+	Code        string
+	Description string
+	URI         string
+	// RetryAfter is the Retry-After delay of rate limited requests.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Code
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	if e.StatusCode != 0 {
+		msg = fmt.Sprintf("%s (status %d)", msg, e.StatusCode)
+	}
+
+	return msg
+}
+
+// Is reports whether the target is an error of the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Temporary reports whether the request may succeed when retried.
+func (e *Error) Temporary() bool {
+	return e.Code == ErrSlowDown.Code || e.Code == ErrServerError.Code
+}
+
+// ParseError returns the error of a non-2xx token endpoint response with the
+// given body. Bodies which are not JSON errors, e.g. of a proxy in front of
+// the IdP, are reported as invalid_request or server_error by status.
+func ParseError(resp *http.Response, body []byte) *Error {
+	var errResp struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		ErrorURI         string `json:"error_uri"`
+	}
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error == "" {
+		errResp.Error = ErrInvalidRequest.Code
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errResp.Error = ErrServerError.Code
+		}
+		errResp.ErrorDescription = strings.TrimSpace(string(body))
+	}
+
+	return &Error{
+		StatusCode:  resp.StatusCode,
+		Code:        errResp.Error,
+		Description: errResp.ErrorDescription,
+		URI:         errResp.ErrorURI,
+		RetryAfter:  retryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// retryAfter parses delay seconds and HTTP dates of the Retry-After header.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
+}
@@ -0,0 +1,94 @@
+package oauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		body   string
+		want   *Error
+		is     error
+	}{
+		{
+			name:   "json error",
+			status: http.StatusBadRequest,
+			body:   `{"error":"invalid_grant","error_description":"subject token is invalid or expired"}`,
+			want: &Error{
+				StatusCode:  http.StatusBadRequest,
+				Code:        "invalid_grant",
+				Description: "subject token is invalid or expired",
+			},
+			is: ErrInvalidGrant,
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"7"}},
+			body:   `{"error":"slow_down","error_description":"too many token requests, retry later"}`,
+			want: &Error{
+				StatusCode:  http.StatusTooManyRequests,
+				Code:        "slow_down",
+				Description: "too many token requests, retry later",
+				RetryAfter:  7 * time.Second,
+			},
+			is: ErrSlowDown,
+		},
+		{
+			name:   "unsupported subject token type",
+			status: http.StatusBadRequest,
+			body:   `{"error":"invalid_request","error_description":"subject token type is not accepted by the realm"}`,
+			want: &Error{
+				StatusCode:  http.StatusBadRequest,
+				Code:        "invalid_request",
+				Description: "subject token type is not accepted by the realm",
+			},
+			is: ErrInvalidRequest,
+		},
+		{
+			name:   "plain text client error",
+			status: http.StatusBadRequest,
+			body:   "bad request\n",
+			want:   &Error{StatusCode: http.StatusBadRequest, Code: "invalid_request", Description: "bad request"},
+			is:     ErrInvalidRequest,
+		},
+		{
+			name:   "plain text server error",
+			status: http.StatusBadGateway,
+			body:   "upstream connect error",
+			want:   &Error{StatusCode: http.StatusBadGateway, Code: "server_error", Description: "upstream connect error"},
+			is:     ErrServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+
+			got := ParseError(resp, []byte(tt.body))
+			assert.Equal(t, tt.want, got)
+
+			wrapped := fmt.Errorf("failed to get idp token: %w", got)
+			assert.ErrorIs(t, wrapped, tt.is)
+			assert.False(t, errors.Is(wrapped, ErrUnauthorizedClient))
+		})
+	}
+}
+
+func TestError_Temporary(t *testing.T) {
+	assert.True(t, (&Error{Code: "slow_down"}).Temporary())
+	assert.True(t, (&Error{Code: "server_error"}).Temporary())
+	assert.False(t, (&Error{Code: "invalid_grant"}).Temporary())
+}
@@ -0,0 +1,84 @@
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TokenTypeAccessToken is the issued_token_type of IdP tokens (RFC 8693).
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// TokenResponse is a successful token endpoint response (RFC 6749 section
+// 5.1, RFC 8693 section 2.2.1).
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	Type            string `json:"token_type"`
+	// ExpiresIn is the lifetime of the token in seconds.
+	ExpiresIn int64 `json:"expires_in"`
+
+	// ExpiresAt is the expiry time computed on receipt of the response.
+	ExpiresAt time.Time `json:"-"`
+}
+
+// UnmarshalJSON accepts the expires_in timestamp of IdP realms issuing the
+// v1 token format as well.
+func (r *TokenResponse) UnmarshalJSON(data []byte) error {
+	type response TokenResponse
+	var parsed struct {
+		response
+		ExpiresIn any `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	*r = TokenResponse(parsed.response)
+	switch expiresIn := parsed.ExpiresIn.(type) {
+	case float64:
+		r.ExpiresIn = int64(expiresIn)
+		r.ExpiresAt = time.Now().Add(time.Duration(expiresIn * float64(time.Second)))
+	case string:
+		expiresAt, err := time.Parse(time.RFC3339Nano, expiresIn)
+		if err != nil {
+			return fmt.Errorf("invalid expires_in %q: %w", expiresIn, err)
+		}
+		r.ExpiresAt = expiresAt
+		r.ExpiresIn = int64(time.Until(expiresAt) / time.Second)
+	case nil:
+	default:
+		return fmt.Errorf("invalid expires_in %v", expiresIn)
+	}
+
+	return nil
+}
+
+// BatchTokenResponse is a response of the IdP batch token endpoint, every
+// requested scope is either in Tokens or in Errors.
+type BatchTokenResponse struct {
+	Tokens map[string]*TokenResponse
+	Errors map[string]*Error
+}
+
+func (r *BatchTokenResponse) UnmarshalJSON(data []byte) error {
+	var parsed struct {
+		Tokens map[string]*TokenResponse `json:"tokens"`
+		Errors map[string]struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+			ErrorURI         string `json:"error_uri"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	r.Tokens = parsed.Tokens
+	r.Errors = make(map[string]*Error, len(parsed.Errors))
+	for scope, scopeErr := range parsed.Errors {
+		r.Errors[scope] = &Error{Code: scopeErr.Error, Description: scopeErr.ErrorDescription, URI: scopeErr.ErrorURI}
+	}
+
+	return nil
+}
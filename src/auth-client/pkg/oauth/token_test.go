@@ -0,0 +1,53 @@
+package oauth
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenResponse_UnmarshalJSON(t *testing.T) {
+	var resp TokenResponse
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"access_token": "token",
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type": "Bearer",
+		"expires_in": 600
+	}`), &resp))
+	assert.Equal(t, "token", resp.AccessToken)
+	assert.Equal(t, TokenTypeAccessToken, resp.IssuedTokenType)
+	assert.Equal(t, int64(600), resp.ExpiresIn)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), resp.ExpiresAt, time.Second)
+
+	// IdP realms issuing the v1 token format
+	expiresAt := time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	var legacy TokenResponse
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"access_token": "token",
+		"token_type": "Bearer",
+		"expires_in": "`+expiresAt.Format(time.RFC3339Nano)+`"
+	}`), &legacy))
+	assert.True(t, expiresAt.Equal(legacy.ExpiresAt))
+	assert.InDelta(t, 300, legacy.ExpiresIn, 1)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"expires_in": "soon"}`), &legacy))
+}
+
+func TestBatchTokenResponse_UnmarshalJSON(t *testing.T) {
+	var resp BatchTokenResponse
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"tokens": {"postgres-a": {"access_token": "token", "token_type": "Bearer", "expires_in": 600}},
+		"errors": {"postgres-b": {"error": "server_error", "error_description": "failed to issue token"}}
+	}`), &resp))
+
+	require.Contains(t, resp.Tokens, "postgres-a")
+	assert.Equal(t, "token", resp.Tokens["postgres-a"].AccessToken)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), resp.Tokens["postgres-a"].ExpiresAt, time.Second)
+
+	require.Contains(t, resp.Errors, "postgres-b")
+	assert.ErrorIs(t, resp.Errors["postgres-b"], ErrServerError)
+	assert.True(t, resp.Errors["postgres-b"].Temporary())
+}
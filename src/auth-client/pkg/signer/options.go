@@ -0,0 +1,76 @@
+package signer
+
+import "github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+
+type Option func(cfg *config.Config)
+
+// WithRealm selects the IdP realm, config.DefaultRealm is used otherwise.
+func WithRealm(realm string) Option {
+	return func(cfg *config.Config) {
+		cfg.Realm = realm
+	}
+}
+
+// WithIdPAddress overrides the base URL the IdP endpoints are requested on.
+func WithIdPAddress(address string) Option {
+	return func(cfg *config.Config) {
+		cfg.IdPAddress = address
+	}
+}
+
+// WithIssuer overrides the base issuer URL the IdP signs tokens with.
+func WithIssuer(issuer string) Option {
+	return func(cfg *config.Config) {
+		cfg.IssuerBase = issuer
+	}
+}
+
+// WithCABundle makes IdP requests trust only the CA certificates in the PEM file.
+func WithCABundle(caBundleFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.CABundleFile = caBundleFile
+	}
+}
+
+// WithClientCertificate presents the certificate when the IdP requires mTLS,
+// the files are reread on every handshake.
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.ClientCertFile = certFile
+		cfg.ClientKeyFile = keyFile
+	}
+}
+
+// WithSubjectToken overrides the file of the service account token the signer
+// exchanges at the IdP.
+func WithSubjectToken(tokenFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.SubjectTokenFile = tokenFile
+	}
+}
+
+// WithCertificateBoundTokens binds the issued tokens to the certificate of
+// WithClientCertificate, the signed requests present it on their connections.
+// Resource servers have to verify client certificates of the IdP CA.
+func WithCertificateBoundTokens() Option {
+	return func(cfg *config.Config) {
+		cfg.CertificateBoundTokens = true
+	}
+}
+
+// WithDPoP binds the issued tokens to a per-process key and sends a DPoP proof
+// with every signed request, for workloads without mTLS.
+func WithDPoP() Option {
+	return func(cfg *config.Config) {
+		cfg.DPoPEnabled = true
+	}
+}
+
+// WithPermissionEvents toggles the subscription to permission changes, which
+// is disabled by default since older IdPs do not stream them. Without it new
+// grants apply on the next scheduled refresh or an explicit refresh request.
+func WithPermissionEvents(enabled bool) Option {
+	return func(cfg *config.Config) {
+		cfg.PermissionEventsEnabled = enabled
+	}
+}
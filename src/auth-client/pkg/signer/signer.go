@@ -2,12 +2,14 @@ package signer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync/atomic"
 	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/tokens"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/oauth"
 )
 
 type TokenSigner struct {
@@ -16,14 +18,28 @@ type TokenSigner struct {
 	tokenSet *tokens.TokenSet
 }
 
-func NewTokenSigner(ctx context.Context, clientID string, scopes []string, initSign bool) (*TokenSigner, error) {
+func NewTokenSigner(ctx context.Context, clientID string, scopes []string, initSign bool, opts ...Option) (*TokenSigner, error) {
 	cfg := &config.Config{
 		ClientID:        clientID,
+		IdPAddress:      config.IdPAddress,
+		IssuerBase:      config.IdPIssuer,
+		Realm:           config.DefaultRealm,
 		RequestTimeout:  5 * time.Second,
 		ErrTokenBackoff: 10 * time.Second,
 		SignAuthEnabled: atomic.Pointer[bool]{},
 	}
 	cfg.SignAuthEnabled.Store(&initSign)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.CertificateBoundTokens && cfg.ClientCertFile == "" {
+		return nil, errors.New("certificate-bound tokens require a client certificate")
+	}
+
+	if err := cfg.SetupHTTPClient(); err != nil {
+		return nil, fmt.Errorf("failed to setup idp http client: %w", err)
+	}
 
 	s := &TokenSigner{
 		cfg: cfg,
@@ -43,11 +59,32 @@ func NewTokenSigner(ctx context.Context, clientID string, scopes []string, initS
 	return s, nil
 }
 
+// Close stops refreshing the tokens of the signer.
+func (s *TokenSigner) Close() {
+	s.tokenSet.Close()
+}
+
 func (s *TokenSigner) fetchIdPEndpoints(_ context.Context) error {
-	idpAddress := fmt.Sprintf("%s:80", config.IdPIssuer)
-	s.cfg.TokenEndpointAddress = idpAddress + "/realms/service2infra/protocol/openid-connect/token"
-	s.cfg.CertsEndpointAddress = idpAddress + "/realms/service2infra/protocol/openid-connect/certs"
-	s.cfg.ConfigEndpointAddress = idpAddress + "/realms/service2infra/.well-known/openid-configuration"
+	realmAddress := s.cfg.RealmAddress()
+	s.cfg.TokenEndpointAddress = realmAddress + "/protocol/openid-connect/token"
+	s.cfg.BatchTokenEndpointAddress = realmAddress + "/protocol/openid-connect/token/batch"
+	s.cfg.CertsEndpointAddress = realmAddress + "/protocol/openid-connect/certs"
+	s.cfg.ConfigEndpointAddress = realmAddress + "/.well-known/openid-configuration"
+	s.cfg.EventsEndpointAddress = realmAddress + "/permissions/events"
 
 	return nil
 }
+
+// Downscope returns a token of the scope limited to the roles and the
+// lifetime, e.g. for a worker which needs only some of the roles of the
+// service. No roles keep all the roles of the signer token and a zero ttl
+// keeps its expiry. The IdP realm has to accept access tokens as subject
+// tokens.
+func (s *TokenSigner) Downscope(ctx context.Context, scope string, roles []string, ttl time.Duration) (*oauth.TokenResponse, error) {
+	tokenResp, err := s.tokenSet.Downscope(ctx, scope, roles, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to downscope token of %s scope: %w", scope, err)
+	}
+
+	return tokenResp, nil
+}
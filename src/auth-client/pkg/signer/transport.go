@@ -3,13 +3,20 @@ package signer
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/metrics"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// SignerTransport sets the token of its scope on every request as it was
+// issued, JWTs and opaque reference tokens of the realm are carried alike.
 type SignerTransport struct {
 	signer *TokenSigner
 	scope  string
@@ -18,10 +25,17 @@ type SignerTransport struct {
 }
 
 func NewAuthTransport(signer *TokenSigner, scope string) *SignerTransport {
+	defaultRT := http.DefaultTransport
+	if signer.cfg.ClientCertFile != "" {
+		// certificate-bound tokens are only accepted over a connection
+		// authenticated with the same client certificate
+		defaultRT = signer.cfg.HTTPClient.Transport
+	}
+
 	return &SignerTransport{
 		signer:    signer,
 		scope:     scope,
-		defaultRT: http.DefaultTransport,
+		defaultRT: defaultRT,
 	}
 }
 
@@ -29,23 +43,80 @@ func (t *SignerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	var signEnabled bool
 	var signResult = "ok"
 
+	ctx, span := tracing.Tracer().Start(r.Context(), "SignerTransport.RoundTrip",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("auth.scope", t.scope),
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.full", spanURL(r.URL)),
+		),
+	)
+
 	signEnabled = getSignAuth(t.signer.cfg)
 	signStart := time.Now()
 	if signEnabled {
+		_, tokenSpan := tracing.Tracer().Start(ctx, "TokenSet.Token")
 		token, err := t.signer.tokenSet.Token(t.scope)
+		tracing.End(tokenSpan, err)
 		if err != nil {
 			log.Printf("failed to issue token in auth client on scope %s: %v", t.scope, err)
 			signResult = "error"
 		} else {
 			r.Header.Set("X-S2I-Token", token)
 		}
+
+		if err == nil && t.signer.cfg.DPoPEnabled {
+			if proofErr := setDPoPProof(r, token); proofErr != nil {
+				log.Printf("failed to create dpop proof in auth client on scope %s: %v", t.scope, proofErr)
+				signResult = "error"
+			}
+		}
 	}
 	signDuration := float64(time.Since(signStart).Milliseconds())
 
 	metrics.TokenSignedTotal.WithLabelValues(t.scope, signResult, strconv.FormatBool(signEnabled), t.signer.cfg.ClientID).Inc()
 	metrics.TokenSignDuration.WithLabelValues(t.scope, signResult, strconv.FormatBool(signEnabled), t.signer.cfg.ClientID).Observe(signDuration)
 
-	return t.defaultRT.RoundTrip(r)
+	span.SetAttributes(attribute.String("auth.sign_result", signResult))
+	tracing.Inject(ctx, r.Header)
+
+	resp, err := t.defaultRT.RoundTrip(r)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	tracing.End(span, err)
+
+	return resp, err
+}
+
+// spanURL drops the query, fragment and credentials of the URL, they may carry
+// secrets the trace backend must not store.
+func spanURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = ""
+	redacted.ForceQuery = false
+	redacted.Fragment = ""
+	redacted.RawFragment = ""
+
+	return redacted.String()
+}
+
+// setDPoPProof attaches a proof covering the method and URL of this request,
+// a proof is never reused, as the verifier rejects replayed ones.
+func setDPoPProof(r *http.Request, token string) error {
+	proofer, err := dpop.ProcessProofer()
+	if err != nil {
+		return err
+	}
+
+	proof, err := proofer.Proof(r.Method, r.URL.String(), token)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(dpop.HeaderName, proof)
+
+	return nil
 }
 
 func getSignAuth(cfg *config.Config) bool {
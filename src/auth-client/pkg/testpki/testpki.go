@@ -0,0 +1,150 @@
+// Package testpki generates a throwaway CA with server and client
+// certificates for TLS tests, of the auth client and of the IdP.
+package testpki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type PKI struct {
+	Dir string
+
+	CAFile         string
+	ServerCert     tls.Certificate
+	ClientCertFile string
+	ClientKeyFile  string
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+func New(t *testing.T) *PKI {
+	t.Helper()
+
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	p := &PKI{Dir: t.TempDir(), ca: ca, caKey: caKey}
+	p.CAFile = p.write(t, "ca.crt", pemBlock("CERTIFICATE", caDER))
+
+	serverCert, serverKey := p.Issue(t, "idp", x509.ExtKeyUsageServerAuth)
+	p.ServerCert, err = tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("failed to load server cert: %v", err)
+	}
+
+	clientCert, clientKey := p.Issue(t, "service-a", x509.ExtKeyUsageClientAuth)
+	p.ClientCertFile = p.write(t, "client.crt", clientCert)
+	p.ClientKeyFile = p.write(t, "client.key", clientKey)
+
+	return p
+}
+
+// Issue returns a PEM encoded certificate and key signed by the CA, valid for
+// localhost.
+func (p *PKI) Issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	return p.IssueUntil(t, cn, time.Now().Add(time.Hour), usage)
+}
+
+// IssueUntil is Issue with the expiry of the certificate, a past one issues an
+// expired certificate.
+func (p *PKI) IssueUntil(t *testing.T, cn string, notAfter time.Time, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+
+	key := newKey(t)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, key.Public(), p.caKey)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	return pemBlock("CERTIFICATE", der), pemBlock("PRIVATE KEY", keyDER)
+}
+
+// CertPool returns a pool holding the CA certificate.
+func (p *PKI) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+
+	return pool
+}
+
+// ServerTLSConfig returns a server config, requireClientCert turns on mTLS
+// against the test CA.
+func (p *PKI) ServerTLSConfig(requireClientCert bool) *tls.Config {
+	cfg := &tls.Config{Certificates: []tls.Certificate{p.ServerCert}}
+	if requireClientCert {
+		cfg.ClientCAs = p.CertPool()
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg
+}
+
+func (p *PKI) write(t *testing.T, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(p.Dir, name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+
+	return path
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	return key
+}
+
+func pemBlock(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
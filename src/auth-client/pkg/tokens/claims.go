@@ -0,0 +1,144 @@
+// Package tokens holds the access token claims shared by the IdP and its
+// clients.
+package tokens
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AccessTokenType is the typ header of access tokens (RFC 9068).
+const AccessTokenType = "at+jwt"
+
+// Claims of an access token in the RFC 9068 format, tokens issued in the
+// legacy format are accepted on parsing.
+type Claims struct {
+	Exp      NumericDate `json:"exp"`
+	Iat      NumericDate `json:"iat"`
+	Nbf      NumericDate `json:"nbf,omitempty"`
+	Jti      string      `json:"jti,omitempty"`
+	Iss      string      `json:"iss"`
+	Sub      string      `json:"sub"`
+	Aud      string      `json:"aud"`
+	Scope    string      `json:"scope"`
+	Roles    []string    `json:"roles"`
+	ClientID string      `json:"client_id"`
+	// PermVer is the permissions version of the client on the scope at the
+	// time of issuance, zero if the repository is not versioned.
+	PermVer int64 `json:"perm_ver,omitempty"`
+	// GroupPermVer are the permissions versions of the group clients whose
+	// roles the token inherits, keyed by group client.
+	GroupPermVer map[string]int64 `json:"grp_perm_ver,omitempty"`
+
+	Cnf *Confirmation `json:"cnf,omitempty"`
+}
+
+// LegacyClaims are the claims of the v1 token format read by auth-client
+// builds before RFC 9068 support.
+type LegacyClaims struct {
+	Exp      time.Time `json:"exp"`
+	Iat      time.Time `json:"iat"`
+	Iss      string    `json:"iss"`
+	Sub      string    `json:"sub"`
+	Aud      string    `json:"aud"`
+	Scope    string    `json:"scope"`
+	Roles    []string  `json:"roles"`
+	ClientID string    `json:"clientID"`
+	PermVer  int64     `json:"perm_ver,omitempty"`
+
+	GroupPermVer map[string]int64 `json:"grp_perm_ver,omitempty"`
+
+	Cnf *Confirmation `json:"cnf,omitempty"`
+}
+
+// Legacy returns the claims in the v1 format, which has no nbf and jti.
+func (c Claims) Legacy() LegacyClaims {
+	return LegacyClaims{
+		Exp:      c.Exp.Time(),
+		Iat:      c.Iat.Time(),
+		Iss:      c.Iss,
+		Sub:      c.Sub,
+		Aud:      c.Aud,
+		Scope:    c.Scope,
+		Roles:    c.Roles,
+		ClientID: c.ClientID,
+		PermVer:  c.PermVer,
+
+		GroupPermVer: c.GroupPermVer,
+		Cnf:          c.Cnf,
+	}
+}
+
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	var parsed struct {
+		claims
+		LegacyClientID string `json:"clientID"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	*c = Claims(parsed.claims)
+	if c.ClientID == "" {
+		c.ClientID = parsed.LegacyClientID
+	}
+
+	return nil
+}
+
+// ValidAt checks exp and nbf, leeway allows for clock skew to the IdP.
+func (c *Claims) ValidAt(now time.Time, leeway time.Duration) error {
+	if exp := c.Exp.Time(); now.After(exp.Add(leeway)) {
+		return fmt.Errorf("token is expired, exp: %s, now: %s", exp, now)
+	} else if nbf := c.Nbf.Time(); c.Nbf != 0 && now.Add(leeway).Before(nbf) {
+		return fmt.Errorf("token is not valid yet, nbf: %s, now: %s", nbf, now)
+	}
+
+	return nil
+}
+
+// Confirmation binds the token to a key held by the client.
+type Confirmation struct {
+	// X5tS256 is the thumbprint of the mTLS client certificate (RFC 8705).
+	X5tS256 string `json:"x5t#S256,omitempty"`
+	// Jkt is the JWK thumbprint of the DPoP proof key (RFC 9449).
+	Jkt string `json:"jkt,omitempty"`
+}
+
+// NumericDate is the number of seconds since the epoch (RFC 7519 section 2).
+// RFC 3339 strings of legacy tokens are accepted on parsing.
+type NumericDate int64
+
+func NewNumericDate(t time.Time) NumericDate {
+	return NumericDate(t.Unix())
+}
+
+func (d NumericDate) Time() time.Time {
+	return time.Unix(int64(d), 0)
+}
+
+func (d *NumericDate) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*d = NumericDate(value)
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("invalid date %q: %w", value, err)
+		}
+		*d = NewNumericDate(t)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid date %s", data)
+	}
+
+	return nil
+}
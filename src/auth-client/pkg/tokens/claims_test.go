@@ -0,0 +1,58 @@
+package tokens
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaims_JSON(t *testing.T) {
+	iat := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	claims := Claims{
+		Exp:      NewNumericDate(iat.Add(time.Minute)),
+		Iat:      NewNumericDate(iat),
+		Nbf:      NewNumericDate(iat),
+		Jti:      "id",
+		ClientID: "service-a",
+	}
+
+	raw, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(raw, &fields))
+	assert.Equal(t, float64(iat.Unix()+60), fields["exp"])
+	assert.Equal(t, "service-a", fields["client_id"])
+	assert.NotContains(t, fields, "clientID")
+
+	var parsed Claims
+	require.NoError(t, json.Unmarshal(raw, &parsed))
+	assert.Equal(t, claims, parsed)
+}
+
+func TestClaims_ParsesLegacyFormat(t *testing.T) {
+	iat := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	legacy := Claims{
+		Exp:      NewNumericDate(iat.Add(time.Minute)),
+		Iat:      NewNumericDate(iat),
+		Sub:      "service-a",
+		ClientID: "service-a",
+	}.Legacy()
+
+	raw, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), `"exp":"2026-01-02T03:05:05`)
+	assert.Contains(t, string(raw), `"clientID":"service-a"`)
+
+	var parsed Claims
+	require.NoError(t, json.Unmarshal(raw, &parsed))
+	assert.Equal(t, "service-a", parsed.ClientID)
+	assert.Equal(t, iat.Add(time.Minute), parsed.Exp.Time().UTC())
+	assert.Equal(t, iat, parsed.Iat.Time().UTC())
+
+	var invalid Claims
+	assert.Error(t, json.Unmarshal([]byte(`{"exp":"tomorrow"}`), &invalid))
+}
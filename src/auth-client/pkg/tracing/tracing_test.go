@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("TRACING_EXPORTER", ExporterOTLP)
+	t.Setenv("TRACING_ENDPOINT", "http://collector:4318/v1/traces")
+	t.Setenv("TRACING_SAMPLE_RATIO", "0.25")
+
+	cfg, err := ConfigFromEnv("postgres-a")
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		ServiceName: "postgres-a",
+		Exporter:    ExporterOTLP,
+		Endpoint:    "http://collector:4318/v1/traces",
+		SampleRatio: 0.25,
+	}, cfg)
+
+	t.Setenv("TRACING_SAMPLE_RATIO", "half")
+	_, err = ConfigFromEnv("postgres-a")
+	assert.ErrorContains(t, err, "TRACING_SAMPLE_RATIO")
+}
+
+func TestSetup_FilePropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), Config{
+		ServiceName: "service-a",
+		Exporter:    ExporterFile,
+		File:        path,
+		SampleRatio: 1,
+	})
+	require.NoError(t, err)
+
+	incoming, err := http.NewRequest("GET", "http://service-a/", nil)
+	require.NoError(t, err)
+	incoming.Header.Set("traceparent", traceparent)
+
+	ctx, span := StartServerSpan(incoming, "handler")
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	span.End()
+
+	assert.Contains(t, outgoing.Get("traceparent"), traceID)
+	assert.Contains(t, outgoing.Get("traceparent"), span.SpanContext().SpanID().String())
+
+	require.NoError(t, shutdown(context.Background()))
+
+	spans, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(spans), `"Name":"handler"`)
+	assert.Contains(t, string(spans), "service-a")
+}
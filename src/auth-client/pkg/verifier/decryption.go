@@ -0,0 +1,78 @@
+package verifier
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// isEncryptedToken tells JWE compact tokens, five parts, from JWS ones.
+func isEncryptedToken(rawToken string) bool {
+	return strings.Count(rawToken, ".") == 4
+}
+
+// loadDecryptionKey reads a PEM encoded RSA or EC private key (PKCS#1, SEC 1
+// or PKCS#8).
+func loadDecryptionKey(keyFile string) (crypto.PrivateKey, error) {
+	raw, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decryption key: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", keyFile)
+	}
+
+	var key crypto.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decryption key: %w", err)
+	}
+
+	return key, nil
+}
+
+// decrypt returns the signed token nested in an encrypted one (RFC 7519
+// section 5.2). Only the key algorithms the IdP encrypts with are accepted.
+func (v *Verifier) decrypt(rawToken string) (string, error) {
+	if v.decryptionKey == nil {
+		return "", errors.New("token is encrypted, but no decryption key is configured")
+	}
+
+	jwe, err := jose.ParseEncrypted(rawToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse encrypted token: %w", err)
+	}
+
+	switch alg := jose.KeyAlgorithm(jwe.Header.Algorithm); alg {
+	case jose.RSA_OAEP_256, jose.ECDH_ES_A256KW:
+	default:
+		return "", fmt.Errorf("unexpected key algorithm %q", alg)
+	}
+	if cty, _ := jwe.Header.ExtraHeaders[jose.HeaderContentType].(string); !strings.EqualFold(cty, "JWT") {
+		return "", fmt.Errorf("encrypted token does not nest a JWT, cty: %q", cty)
+	}
+
+	nested, err := jwe.Decrypt(v.decryptionKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	return string(nested), nil
+}
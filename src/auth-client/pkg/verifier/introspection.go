@@ -0,0 +1,148 @@
+package verifier
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// introspectionCacheSize bounds the cached introspections, no more are cached
+// while it is full of unexpired ones.
+const introspectionCacheSize = 10000
+
+// introspection resolves opaque reference tokens at the IdP (RFC 7662). Only
+// active tokens are cached, a token is accepted as soon as it is issued.
+type introspection struct {
+	cfg *config.Config
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedIntrospection
+}
+
+type cachedIntrospection struct {
+	claims *tokens.Claims
+	until  time.Time
+}
+
+func newIntrospection(cfg *config.Config) *introspection {
+	return &introspection{
+		cfg:   cfg,
+		cache: make(map[[sha256.Size]byte]cachedIntrospection),
+	}
+}
+
+// isReferenceToken tells opaque tokens from JWTs, the base64url alphabet of
+// reference tokens has no dots.
+func isReferenceToken(rawToken string) bool {
+	return !strings.Contains(rawToken, ".")
+}
+
+// claims returns the claims of an active token, the cache is keyed by the
+// hash of the token, so tokens are not kept in memory.
+func (i *introspection) claims(ctx context.Context, rawToken string) (*tokens.Claims, error) {
+	key := sha256.Sum256([]byte(rawToken))
+	now := time.Now()
+
+	i.mu.Lock()
+	cached, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && now.Before(cached.until) {
+		return cached.claims, nil
+	}
+
+	claims, err := i.introspect(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	i.store(key, claims, now)
+
+	return claims, nil
+}
+
+func (i *introspection) store(key [sha256.Size]byte, claims *tokens.Claims, now time.Time) {
+	if i.cfg.IntrospectionCacheTTL <= 0 {
+		return
+	}
+
+	until := now.Add(i.cfg.IntrospectionCacheTTL)
+	if exp := claims.Exp.Time(); exp.Before(until) {
+		until = exp
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.cache) >= introspectionCacheSize {
+		for cachedKey, cached := range i.cache {
+			if !now.Before(cached.until) {
+				delete(i.cache, cachedKey)
+			}
+		}
+		if len(i.cache) >= introspectionCacheSize {
+			return
+		}
+	}
+	i.cache[key] = cachedIntrospection{claims: claims, until: until}
+}
+
+// introspect asks the IdP for the claims of the token, the verifier
+// authenticates with its service account token and the IdP only reports
+// tokens issued to its scope.
+func (i *introspection) introspect(ctx context.Context, rawToken string) (*tokens.Claims, error) {
+	saToken, err := os.ReadFile(i.cfg.IntrospectionTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, i.cfg.RequestTimeout)
+	defer cancel()
+
+	form := url.Values{"token": {rawToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.cfg.IntrospectionEndpointAddress, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(saToken)))
+
+	resp, err := i.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introspect token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read introspection: %w", err)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected introspection status %d: %s", resp.StatusCode, body)
+	}
+
+	var active struct {
+		Active bool `json:"active"`
+	}
+	if err := json.Unmarshal(body, &active); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal introspection: %w", err)
+	} else if !active.Active {
+		return nil, errors.New("token is not active")
+	}
+
+	var claims tokens.Claims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal introspected claims: %w", err)
+	}
+
+	return &claims, nil
+}
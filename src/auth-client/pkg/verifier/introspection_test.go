@@ -0,0 +1,108 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startIntrospectionIdP(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		require.NoError(t, r.ParseForm())
+
+		resp := map[string]any{"active": false}
+		switch r.PostFormValue("token") {
+		case "opaque-ro":
+			resp = map[string]any{
+				"active":    true,
+				"exp":       time.Now().Add(time.Minute).Unix(),
+				"iat":       time.Now().Unix(),
+				"iss":       "https://idp.test/realms/service2infra",
+				"aud":       "postgres-a",
+				"scope":     "postgres-a",
+				"roles":     []string{"RO"},
+				"client_id": "service-a",
+			}
+		case "unavailable":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func newIntrospectingVerifier(t *testing.T, cacheTTL time.Duration) (*Verifier, *atomic.Int32) {
+	t.Helper()
+
+	calls := new(atomic.Int32)
+	ts := startIntrospectionIdP(t, calls)
+
+	v, _ := newTestVerifier(t)
+	v.cfg.HTTPClient = ts.Client()
+	v.cfg.RequestTimeout = time.Second
+	v.cfg.IntrospectionEndpointAddress = ts.URL
+	v.cfg.IntrospectionCacheTTL = cacheTTL
+	v.cfg.IntrospectionTokenFile = filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(v.cfg.IntrospectionTokenFile, []byte("sa-token\n"), 0o600))
+	v.introspection = newIntrospection(v.cfg)
+
+	return v, calls
+}
+
+func TestVerifier_OpaqueToken(t *testing.T) {
+	ctx := context.Background()
+	v, calls := newIntrospectingVerifier(t, time.Minute)
+
+	require.NoError(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}))
+	require.NoError(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}))
+	assert.ErrorContains(t, v.verifyToken(ctx, "opaque-ro", []string{"RW"}, possession{}), "roles mismatched")
+	assert.Equal(t, int32(1), calls.Load(), "active tokens are cached")
+
+	assert.ErrorContains(t, v.verifyToken(ctx, "opaque-revoked", []string{"RO"}, possession{}), "token is not active")
+	assert.Error(t, v.verifyToken(ctx, "opaque-revoked", []string{"RO"}, possession{}))
+	assert.Equal(t, int32(3), calls.Load(), "inactive tokens are not cached")
+
+	assert.ErrorContains(t, v.verifyToken(ctx, "unavailable", []string{"RO"}, possession{}), "unexpected introspection status 500")
+}
+
+func TestVerifier_OpaqueTokenCredentials(t *testing.T) {
+	ctx := context.Background()
+	v, _ := newIntrospectingVerifier(t, 0)
+
+	require.NoError(t, os.WriteFile(v.cfg.IntrospectionTokenFile, []byte("other-token"), 0o600))
+	assert.ErrorContains(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}), "unexpected introspection status 401")
+
+	require.NoError(t, os.Remove(v.cfg.IntrospectionTokenFile))
+	assert.ErrorContains(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}), "failed to read service account token")
+}
+
+func TestVerifier_OpaqueTokenWithoutCache(t *testing.T) {
+	ctx := context.Background()
+	v, calls := newIntrospectingVerifier(t, 0)
+
+	require.NoError(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}))
+	require.NoError(t, v.verifyToken(ctx, "opaque-ro", []string{"RO"}, possession{}))
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,98 @@
+package verifier
+
+import (
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+)
+
+type Option func(cfg *config.Config)
+
+// WithRealm selects the IdP realm, config.DefaultRealm is used otherwise.
+func WithRealm(realm string) Option {
+	return func(cfg *config.Config) {
+		cfg.Realm = realm
+	}
+}
+
+// WithIdPAddress overrides the base URL the IdP endpoints are requested on.
+func WithIdPAddress(address string) Option {
+	return func(cfg *config.Config) {
+		cfg.IdPAddress = address
+	}
+}
+
+// WithIssuer overrides the base issuer URL the IdP signs tokens with.
+func WithIssuer(issuer string) Option {
+	return func(cfg *config.Config) {
+		cfg.IssuerBase = issuer
+	}
+}
+
+// WithCABundle makes IdP requests trust only the CA certificates in the PEM file.
+func WithCABundle(caBundleFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.CABundleFile = caBundleFile
+	}
+}
+
+// WithClientCertificate presents the certificate when the IdP requires mTLS,
+// the files are reread on every handshake.
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.ClientCertFile = certFile
+		cfg.ClientKeyFile = keyFile
+	}
+}
+
+// WithPermissionsVersions polls the permissions versions of the verifier scope
+// every interval, tokens issued before roles were taken away are rejected
+// then. Versions which could not be fetched yet do not reject any token.
+func WithPermissionsVersions(interval time.Duration) Option {
+	return func(cfg *config.Config) {
+		cfg.PermissionsVersionsInterval = interval
+	}
+}
+
+// WithDPoPProofWindow overrides how old a DPoP proof may be, replayed proofs
+// are detected within the same window.
+func WithDPoPProofWindow(window time.Duration) Option {
+	return func(cfg *config.Config) {
+		cfg.DPoPProofWindow = window
+	}
+}
+
+// WithIntrospectionCacheTTL overrides how long introspections of opaque tokens
+// are reused, zero introspects every request.
+func WithIntrospectionCacheTTL(ttl time.Duration) Option {
+	return func(cfg *config.Config) {
+		cfg.IntrospectionCacheTTL = ttl
+	}
+}
+
+// WithIntrospectionToken overrides the file of the service account token the
+// verifier authenticates to the introspection and permissions versions
+// endpoints with.
+func WithIntrospectionToken(tokenFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.IntrospectionTokenFile = tokenFile
+	}
+}
+
+// WithDecryptionKey makes the verifier accept tokens the IdP encrypted to its
+// scope, keyFile is the PEM RSA or EC private key of the registered public
+// key.
+func WithDecryptionKey(keyFile string) Option {
+	return func(cfg *config.Config) {
+		cfg.DecryptionKeyFile = keyFile
+	}
+}
+
+// WithEncryptionRequired rejects JWTs which are only signed, once the
+// encryption key of the scope is registered at the IdP every token should be
+// encrypted. It needs WithDecryptionKey.
+func WithEncryptionRequired() Option {
+	return func(cfg *config.Config) {
+		cfg.EncryptionRequired = true
+	}
+}
@@ -0,0 +1,37 @@
+package verifier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ServerTLSConfig is the TLS config of a resource server accepting
+// certificate-bound tokens (RFC 8705). Client certificates are requested but
+// not required, callers without one are served and only their bound tokens
+// fail. The handshake proves possession of the key of the certificate, the
+// chain is additionally verified against clientCAFile if it is set.
+func ServerTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequestClientCert,
+	}
+	if clientCAFile == "" {
+		return tlsCfg, nil
+	}
+
+	caBundle, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca bundle: %w", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificates found in client ca bundle %s", clientCAFile)
+	}
+	tlsCfg.ClientCAs = clientCAs
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return tlsCfg, nil
+}
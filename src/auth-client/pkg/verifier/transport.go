@@ -3,6 +3,7 @@ package verifier
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -12,68 +13,108 @@ import (
 
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/metrics"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func VerifySQLMiddleware(next http.HandlerFunc, verifier *Verifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cfg := verifier.cfg
-
-		var verifyEnabled bool
-		var verifyResult = "ok"
-		verifyEnabled = getVerifyEnabled(cfg)
-		verifyStart := time.Now()
-		defer func() {
-			verifyDuration := float64(time.Since(verifyStart).Milliseconds())
-			metrics.TokenVerifyTotal.WithLabelValues(verifyResult, strconv.FormatBool(verifyEnabled), cfg.ClientID).Inc()
-			metrics.TokenVerifyDuration.WithLabelValues(verifyResult, strconv.FormatBool(verifyEnabled), cfg.ClientID).Observe(verifyDuration)
-
+		// next continues the trace of the caller, next to the verify span
+		r = r.WithContext(tracing.Extract(r))
+		if verifySQLRequest(w, r, verifier) {
 			next(w, r)
-		}()
-
-		if !verifyEnabled {
-			verifyResult = "disabled"
-			return
 		}
+	}
+}
 
-		origBody, _ := io.ReadAll(r.Body)
-		r.Body = io.NopCloser(bytes.NewBuffer(origBody))
-
-		var reqBody SqlQueryRequest
-		if err := json.Unmarshal(origBody, &reqBody); err != nil {
-			log.Printf("req body is invalid: %v", err)
-			verifyResult = "invalid_request"
-			respondError(w, "missing token", http.StatusBadRequest)
-			return
-		} else if reqBody.SQL == "" {
-			verifyResult = "missing_sql_query"
-			respondError(w, "missing sql query", http.StatusBadRequest)
-			return
+// verifySQLRequest checks the token of the query against the roles it needs,
+// the request is answered with an error if it reports false.
+func verifySQLRequest(w http.ResponseWriter, r *http.Request, verifier *Verifier) bool {
+	cfg := verifier.cfg
+
+	var verifyEnabled bool
+	var verifyResult = "ok"
+	var verifyErr error
+
+	_, span := tracing.Tracer().Start(r.Context(), "VerifySQLMiddleware", trace.WithSpanKind(trace.SpanKindServer))
+
+	verifyEnabled = getVerifyEnabled(cfg)
+	verifyStart := time.Now()
+	defer func() {
+		span.SetAttributes(
+			attribute.String("auth.verify_result", verifyResult),
+			attribute.Bool("auth.verify_enabled", verifyEnabled),
+		)
+		if verifyErr == nil && verifyResult != "ok" && verifyResult != "disabled" {
+			verifyErr = errors.New(verifyResult)
 		}
+		tracing.End(span, verifyErr)
+
+		verifyDuration := float64(time.Since(verifyStart).Milliseconds())
+		metrics.TokenVerifyTotal.WithLabelValues(verifyResult, strconv.FormatBool(verifyEnabled), cfg.ClientID).Inc()
+		metrics.TokenVerifyDuration.WithLabelValues(verifyResult, strconv.FormatBool(verifyEnabled), cfg.ClientID).Observe(verifyDuration)
+	}()
+
+	if !verifyEnabled {
+		verifyResult = "disabled"
+		return true
+	}
+
+	origBody, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewBuffer(origBody))
+
+	var reqBody SqlQueryRequest
+	if err := json.Unmarshal(origBody, &reqBody); err != nil {
+		log.Printf("req body is invalid: %v", err)
+		verifyResult = "invalid_request"
+		respondError(w, "missing token", http.StatusBadRequest)
+		return false
+	} else if reqBody.SQL == "" {
+		verifyResult = "missing_sql_query"
+		respondError(w, "missing sql query", http.StatusBadRequest)
+		return false
+	}
+
+	dbQuery := strings.ToUpper(reqBody.SQL)
+	requiredRoles := []string{"RO"}
+	if strings.Contains(dbQuery, "INSERT") || strings.Contains(dbQuery, "UPDATE") || strings.Contains(dbQuery, "DELETE") {
+		requiredRoles = []string{"RW"}
+	}
 
-		dbQuery := strings.ToUpper(reqBody.SQL)
-		requiredRoles := []string{"RO"}
-		if strings.Contains(dbQuery, "INSERT") || strings.Contains(dbQuery, "UPDATE") || strings.Contains(dbQuery, "DELETE") {
-			requiredRoles = []string{"RW"}
+	log.Printf("query: %s, required_roles=%v", dbQuery, requiredRoles)
+
+	if verifyEnabled {
+		token := r.Header.Get("X-S2I-Token")
+		if token == "" {
+			verifyResult = "missing_token"
+			respondError(w, "missing token", http.StatusUnauthorized)
+			return false
 		}
 
-		log.Printf("query: %s, required_roles=%v", dbQuery, requiredRoles)
-
-		if verifyEnabled {
-			token := r.Header.Get("X-S2I-Token")
-			if token == "" {
-				verifyResult = "missing_token"
-				respondError(w, "missing token", http.StatusUnauthorized)
-				return
-			}
-
-			if verifyErr := verifier.verifyToken(token, requiredRoles); verifyErr != nil {
-				log.Printf("failed to verify token: %v", verifyErr)
-				verifyResult = "permissions_denied"
-				respondError(w, "forbidden: token has no required roles", http.StatusUnauthorized)
-				return
-			}
+		if verifyErr = verifier.verifyToken(r.Context(), token, requiredRoles, possessionFromRequest(r)); verifyErr != nil {
+			log.Printf("failed to verify token: %v", verifyErr)
+			verifyResult = "permissions_denied"
+			respondError(w, "forbidden: token has no required roles", http.StatusUnauthorized)
+			return false
 		}
 	}
+
+	return true
+}
+
+func possessionFromRequest(r *http.Request) possession {
+	pop := possession{
+		dpopProof: r.Header.Get(dpop.HeaderName),
+		method:    r.Method,
+		uri:       dpop.RequestURI(r),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		pop.peerCert = r.TLS.PeerCertificates[0]
+	}
+
+	return pop
 }
 
 func getVerifyEnabled(cfg *config.Config) bool {
@@ -0,0 +1,118 @@
+package verifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestVerifySQLMiddleware_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	v, signer := newTestVerifier(t)
+	enabled := true
+	v.cfg.VerifyAuthEnabled.Store(&enabled)
+
+	var nextCalled bool
+	var nextParent trace.SpanContext
+	next := func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+		nextParent = trace.SpanContextFromContext(r.Context())
+	}
+
+	req := httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT 1"}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	VerifySQLMiddleware(next, v).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.False(t, nextCalled)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "VerifySQLMiddleware", spans[0].Name())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "missing_token", spans[0].Status().Description)
+
+	req = httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT 1"}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("X-S2I-Token", signTestToken(t, signer, nil))
+	w = httptest.NewRecorder()
+	VerifySQLMiddleware(next, v).ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.True(t, nextCalled)
+
+	// the handler continues the trace of the caller
+	assert.Equal(t, spans[0].Parent().SpanID(), nextParent.SpanID())
+}
+
+func TestVerifySQLMiddleware_RejectedRequestsSkipNext(t *testing.T) {
+	v, signer := newTestVerifier(t)
+	enabled := true
+	v.cfg.VerifyAuthEnabled.Store(&enabled)
+
+	tests := []struct {
+		name     string
+		body     string
+		token    string
+		wantCode int
+	}{
+		{name: "invalid body", body: `{`, wantCode: http.StatusBadRequest},
+		{name: "missing sql query", body: `{}`, wantCode: http.StatusBadRequest},
+		{name: "missing token", body: `{"sql":"SELECT 1"}`, wantCode: http.StatusUnauthorized},
+		{name: "invalid signature", body: `{"sql":"SELECT 1"}`, token: signTestToken(t, signer, nil) + "x", wantCode: http.StatusUnauthorized},
+		{name: "missing role", body: `{"sql":"DELETE FROM t"}`, token: signTestToken(t, signer, nil), wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nextCalled bool
+			next := func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+				w.WriteHeader(http.StatusOK)
+			}
+
+			req := httptest.NewRequest("POST", "/query", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("X-S2I-Token", tt.token)
+			}
+			w := httptest.NewRecorder()
+			VerifySQLMiddleware(next, v).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			assert.False(t, nextCalled)
+		})
+	}
+
+	t.Run("verify disabled", func(t *testing.T) {
+		disabled := false
+		v.cfg.VerifyAuthEnabled.Store(&disabled)
+		t.Cleanup(func() { v.cfg.VerifyAuthEnabled.Store(&enabled) })
+
+		var nextCalled bool
+		next := func(w http.ResponseWriter, r *http.Request) { nextCalled = true }
+
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT 1"}`))
+		VerifySQLMiddleware(next, v).ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.True(t, nextCalled)
+	})
+}
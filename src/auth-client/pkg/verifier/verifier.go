@@ -2,48 +2,89 @@ package verifier
 
 import (
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/go-jose/go-jose/v3/jwt"
 	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
 	"github.com/samber/lo"
 )
 
-type tokenClaims struct {
-	Exp      time.Time `json:"exp"`
-	Iat      time.Time `json:"iat"`
-	Iss      string    `json:"iss"`
-	Sub      string    `json:"sub"`
-	Aud      string    `json:"aud"`
-	Scope    string    `json:"scope"`
-	Roles    []string  `json:"roles"`
-	ClientID string    `json:"clientID"`
+// clockSkewLeeway tolerates clocks of the IdP and the service drifting apart
+// when exp and nbf are checked.
+const clockSkewLeeway = 5 * time.Second
+
+// possession is what the caller presented next to the token to prove it holds
+// the key the token is bound to.
+type possession struct {
+	peerCert *x509.Certificate
+
+	dpopProof string
+	method    string
+	uri       string
 }
 
 type Verifier struct {
 	cfg *config.Config
 
-	certs *jose.JSONWebKeySet
+	certs         *jose.JSONWebKeySet
+	dpop          *dpop.Verifier
+	versions      *permissionsVersions
+	introspection *introspection
+	decryptionKey crypto.PrivateKey
 }
 
-func NewVerifier(ctx context.Context, clientID string, initVerify bool) (*Verifier, error) {
+func NewVerifier(ctx context.Context, clientID string, initVerify bool, opts ...Option) (*Verifier, error) {
 	cfg := &config.Config{
 		ClientID:          clientID,
+		IdPAddress:        config.IdPAddress,
+		IssuerBase:        config.IdPIssuer,
+		Realm:             config.DefaultRealm,
 		RequestTimeout:    5 * time.Second,
 		ErrTokenBackoff:   10 * time.Second,
+		DPoPProofWindow:   time.Minute,
 		VerifyAuthEnabled: atomic.Pointer[bool]{},
+
+		IntrospectionCacheTTL:  10 * time.Second,
+		IntrospectionTokenFile: config.ServiceAccountTokenFile,
 	}
 	cfg.VerifyAuthEnabled.Store(&initVerify)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if err := cfg.SetupHTTPClient(); err != nil {
+		return nil, fmt.Errorf("failed to setup idp http client: %w", err)
+	}
 
 	v := &Verifier{
-		cfg: cfg,
+		cfg:           cfg,
+		dpop:          dpop.NewVerifier(cfg.DPoPProofWindow),
+		introspection: newIntrospection(cfg),
+	}
+
+	if cfg.DecryptionKeyFile != "" {
+		key, err := loadDecryptionKey(cfg.DecryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token decryption key: %w", err)
+		}
+		v.decryptionKey = key
+	} else if cfg.EncryptionRequired {
+		return nil, errors.New("encryption is required, but no decryption key is set")
 	}
 
 	if err := v.fetchIdPEndpoints(ctx); err != nil {
@@ -56,20 +97,34 @@ func NewVerifier(ctx context.Context, clientID string, initVerify bool) (*Verifi
 	}
 	v.certs = certs
 
+	if cfg.PermissionsVersionsInterval > 0 {
+		v.versions = newPermissionsVersions(cfg)
+		if err := v.versions.fetch(ctx); err != nil {
+			log.Printf("failed to fetch permissions versions, tokens are not checked until the next poll: %v", err)
+		}
+		go v.versions.run(ctx, cfg.PermissionsVersionsInterval)
+	}
+
 	return v, nil
 }
 
 func (v *Verifier) fetchIdPEndpoints(_ context.Context) error {
-	idpAddress := fmt.Sprintf("%s:80", config.IdPIssuer)
-	v.cfg.TokenEndpointAddress = idpAddress + "/realms/service2infra/protocol/openid-connect/token"
-	v.cfg.CertsEndpointAddress = idpAddress + "/realms/service2infra/protocol/openid-connect/certs"
-	v.cfg.ConfigEndpointAddress = idpAddress + "/realms/service2infra/.well-known/openid-configuration"
+	realmAddress := v.cfg.RealmAddress()
+	v.cfg.TokenEndpointAddress = realmAddress + "/protocol/openid-connect/token"
+	v.cfg.CertsEndpointAddress = realmAddress + "/protocol/openid-connect/certs"
+	v.cfg.ConfigEndpointAddress = realmAddress + "/.well-known/openid-configuration"
+	v.cfg.VersionsEndpointAddress = realmAddress + "/permissions/versions"
+	v.cfg.IntrospectionEndpointAddress = realmAddress + "/protocol/openid-connect/token/introspect"
 
 	return nil
 }
 
-func (v *Verifier) verifyToken(rawToken string, needRoles []string) error {
-	claims, err := verifyToken(rawToken, v.certs)
+// verifyToken checks the signature, the claims and, for sender-constrained
+// tokens, that the caller holds the key the token was issued to. Claims of
+// opaque tokens are introspected and encrypted tokens are decrypted first,
+// they are checked the same way.
+func (v *Verifier) verifyToken(ctx context.Context, rawToken string, needRoles []string, pop possession) error {
+	claims, err := v.tokenClaims(ctx, rawToken)
 	if err != nil {
 		return err
 	}
@@ -79,31 +134,97 @@ func (v *Verifier) verifyToken(rawToken string, needRoles []string) error {
 		return fmt.Errorf("verify claims error: %w", err)
 	}
 
+	if err = v.verifyConfirmation(ctx, claims.Cnf, rawToken, pop); err != nil {
+		return fmt.Errorf("verify token binding error: %w", err)
+	}
+
+	return nil
+}
+
+func (v *Verifier) tokenClaims(ctx context.Context, rawToken string) (*tokens.Claims, error) {
+	if isEncryptedToken(rawToken) {
+		nested, err := v.decrypt(rawToken)
+		if err != nil {
+			log.Printf("failed to decrypt token: %v", err)
+			return nil, err
+		}
+		return verifyToken(nested, v.certs)
+	} else if !isReferenceToken(rawToken) {
+		if v.cfg.EncryptionRequired {
+			return nil, errors.New("token is not encrypted")
+		}
+		return verifyToken(rawToken, v.certs)
+	}
+
+	claims, err := v.introspection.claims(ctx, rawToken)
+	if err != nil {
+		log.Printf("failed to introspect opaque token: %v", err)
+		return nil, fmt.Errorf("failed to introspect token: %w", err)
+	}
+
+	return claims, nil
+}
+
+// verifyConfirmation enforces RFC 8705 and RFC 9449 binding, unbound tokens
+// are accepted.
+func (v *Verifier) verifyConfirmation(ctx context.Context, cnf *tokens.Confirmation, rawToken string, pop possession) error {
+	if cnf == nil {
+		return nil
+	}
+
+	if cnf.X5tS256 != "" {
+		if pop.peerCert == nil {
+			return fmt.Errorf("token is bound to a client certificate, but none was presented")
+		}
+
+		thumbprint := sha256.Sum256(pop.peerCert.Raw)
+		if got := base64.RawURLEncoding.EncodeToString(thumbprint[:]); got != cnf.X5tS256 {
+			return fmt.Errorf("client certificate mismatch, token bound to: %s, presented: %s", cnf.X5tS256, got)
+		}
+	}
+
+	if cnf.Jkt != "" {
+		proof, err := v.dpop.Verify(ctx, pop.dpopProof, pop.method, pop.uri, rawToken)
+		if err != nil {
+			return err
+		} else if proof.JKT != cnf.Jkt {
+			return fmt.Errorf("dpop key mismatch, token bound to: %s, presented: %s", cnf.Jkt, proof.JKT)
+		}
+	}
+
 	return nil
 }
 
-func (v *Verifier) verifyClaims(claims *tokenClaims, needRoles []string) error {
+func (v *Verifier) verifyClaims(claims *tokens.Claims, needRoles []string) error {
 	if claims.Scope != claims.Aud || claims.Scope != v.cfg.ClientID {
 		return fmt.Errorf("scope or aud is unexpected, service: %s, scope: %s, aud: %s", v.cfg.ClientID, claims.Scope, claims.Aud)
-	} else if claims.Iss != config.IdPIssuer {
-		return fmt.Errorf("unexpected issuer, expected: %s, got: %s", config.IdPIssuer, claims.Iss)
-	} else if expired := claims.Exp.Before(time.Now()); expired {
-		return fmt.Errorf("token is expired, exp: %s, now: %s", claims.Exp, time.Now())
+	} else if claims.Iss != v.cfg.RealmIssuer() {
+		return fmt.Errorf("unexpected issuer, expected: %s, got: %s", v.cfg.RealmIssuer(), claims.Iss)
+	} else if err := claims.ValidAt(time.Now(), clockSkewLeeway); err != nil {
+		return err
 	} else if rolesOk := lo.Every(claims.Roles, needRoles); !rolesOk {
 		return fmt.Errorf("roles mismatched, want: %v, got: %v", needRoles, claims.Roles)
+	} else if v.versions != nil {
+		return v.versions.verify(claims)
 	}
 
 	return nil
 }
 
-func verifyToken(rawToken string, certs *jose.JSONWebKeySet) (*tokenClaims, error) {
+func verifyToken(rawToken string, certs *jose.JSONWebKeySet) (*tokens.Claims, error) {
 	token, err := jwt.ParseSigned(rawToken)
 	if err != nil {
 		log.Printf("failed to parse token: %v", err)
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
-	var claims tokenClaims
+	for _, header := range token.Headers {
+		if err := verifyTokenType(header); err != nil {
+			return nil, err
+		}
+	}
+
+	var claims tokens.Claims
 	for _, header := range token.Headers {
 		keys := certs.Key(header.KeyID)
 		if len(keys) == 0 {
@@ -121,6 +242,19 @@ func verifyToken(rawToken string, certs *jose.JSONWebKeySet) (*tokenClaims, erro
 	return nil, fmt.Errorf("no certificate found to parse token")
 }
 
+// verifyTokenType rejects JWTs other than access tokens (RFC 9068 section 4),
+// e.g. ID tokens signed with the same key. Tokens of IdP releases before RFC
+// 9068 support are typed JWT or not typed at all.
+func verifyTokenType(header jose.Header) error {
+	typ, _ := header.ExtraHeaders[jose.HeaderType].(string)
+	switch strings.ToLower(typ) {
+	case "at+jwt", "application/at+jwt", "jwt", "":
+		return nil
+	default:
+		return fmt.Errorf("unexpected token type %q", typ)
+	}
+}
+
 func (v *Verifier) fetchJWKs(ctx context.Context) (*jose.JSONWebKeySet, error) {
 	idpCertEndpoint := v.cfg.CertsEndpointAddress
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, idpCertEndpoint, nil)
@@ -129,8 +263,7 @@ func (v *Verifier) fetchJWKs(ctx context.Context) (*jose.JSONWebKeySet, error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: v.cfg.RequestTimeout}
-	resp, err := client.Do(req)
+	resp, err := v.cfg.HTTPClient.Do(req)
 
 	var respBytes []byte
 	if resp != nil && resp.Body != nil {
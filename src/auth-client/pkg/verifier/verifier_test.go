@@ -0,0 +1,332 @@
+package verifier
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/testpki"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startIdP(t *testing.T, pki *testpki.PKI, jwks jose.JSONWebKeySet) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/service2service/protocol/openid-connect/certs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks)
+	})
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = pki.ServerTLSConfig(true)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestNewVerifier_FetchesCertsOverMutualTLS(t *testing.T) {
+	pki := testpki.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "kid-1", Algorithm: "RS256", Use: "sig"}}}
+
+	ts := startIdP(t, pki, jwks)
+
+	v, err := NewVerifier(context.Background(), "service-b", true,
+		WithRealm("service2service"),
+		WithIdPAddress(ts.URL),
+		WithIssuer("https://idp.test"),
+		WithCABundle(pki.CAFile),
+		WithClientCertificate(pki.ClientCertFile, pki.ClientKeyFile),
+	)
+	require.NoError(t, err)
+
+	assert.Len(t, v.certs.Key("kid-1"), 1)
+	assert.Equal(t, "https://idp.test/realms/service2service", v.cfg.RealmIssuer())
+}
+
+func TestNewVerifier_RejectsUntrustedIdP(t *testing.T) {
+	pki := testpki.New(t)
+	ts := startIdP(t, pki, jose.JSONWebKeySet{})
+
+	_, err := NewVerifier(context.Background(), "service-b", true,
+		WithRealm("service2service"),
+		WithIdPAddress(ts.URL),
+		WithClientCertificate(pki.ClientCertFile, pki.ClientKeyFile),
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get idp certificates")
+}
+
+func newTestVerifier(t *testing.T) (*Verifier, jose.Signer) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "kid-1"))
+	require.NoError(t, err)
+
+	v := &Verifier{
+		cfg: &config.Config{ClientID: "postgres-a", IssuerBase: "https://idp.test", Realm: "service2infra"},
+		certs: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: key.Public(), KeyID: "kid-1", Algorithm: "RS256", Use: "sig"},
+		}},
+		dpop: dpop.NewVerifier(time.Minute),
+	}
+
+	return v, signer
+}
+
+func signTestToken(t *testing.T, signer jose.Signer, cnf *tokens.Confirmation) string {
+	t.Helper()
+
+	raw, err := jwt.Signed(signer).Claims(tokens.Claims{
+		Exp:      tokens.NewNumericDate(time.Now().Add(time.Minute)),
+		Iat:      tokens.NewNumericDate(time.Now()),
+		Nbf:      tokens.NewNumericDate(time.Now()),
+		Iss:      "https://idp.test/realms/service2infra",
+		Sub:      "service-a",
+		Aud:      "postgres-a",
+		Scope:    "postgres-a",
+		Roles:    []string{"RO"},
+		ClientID: "service-a",
+		Cnf:      cnf,
+	}).CompactSerialize()
+	require.NoError(t, err)
+
+	return raw
+}
+
+func x5tS256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifier_CertificateBoundToken(t *testing.T) {
+	v, signer := newTestVerifier(t)
+
+	clientCert := &x509.Certificate{Raw: []byte("service-a certificate")}
+	otherCert := &x509.Certificate{Raw: []byte("service-b certificate")}
+	bound := signTestToken(t, signer, &tokens.Confirmation{X5tS256: x5tS256(clientCert)})
+	unbound := signTestToken(t, signer, nil)
+
+	tests := []struct {
+		name     string
+		token    string
+		peerCert *x509.Certificate
+		wantErr  string
+	}{
+		{name: "bound token, same certificate", token: bound, peerCert: clientCert},
+		{name: "bound token, other certificate", token: bound, peerCert: otherCert, wantErr: "client certificate mismatch"},
+		{name: "bound token, no certificate", token: bound, wantErr: "none was presented"},
+		{name: "unbound token", token: unbound},
+		{name: "unbound token with certificate", token: unbound, peerCert: otherCert},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verifyToken(context.Background(), tt.token, []string{"RO"}, possession{peerCert: tt.peerCert})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifier_DPoPBoundToken(t *testing.T) {
+	const uri = "http://postgres-a.test/query"
+
+	v, signer := newTestVerifier(t)
+
+	proofer, err := dpop.NewProofer()
+	require.NoError(t, err)
+	otherProofer, err := dpop.NewProofer()
+	require.NoError(t, err)
+
+	token := signTestToken(t, signer, &tokens.Confirmation{Jkt: proofer.JKT()})
+	newProof := func(p *dpop.Proofer, method, uri, token string) string {
+		proof, err := p.Proof(method, uri, token)
+		require.NoError(t, err)
+		return proof
+	}
+	replayed := newProof(proofer, "POST", uri, token)
+	require.NoError(t, v.verifyToken(context.Background(), token, []string{"RO"}, possession{dpopProof: replayed, method: "POST", uri: uri}))
+
+	tests := []struct {
+		name    string
+		proof   string
+		wantErr string
+	}{
+		{name: "fresh proof", proof: newProof(proofer, "POST", uri, token)},
+		{name: "replayed proof", proof: replayed, wantErr: "already been used"},
+		{name: "no proof", wantErr: "missing dpop proof"},
+		{name: "proof of another key", proof: newProof(otherProofer, "POST", uri, token), wantErr: "dpop key mismatch"},
+		{name: "proof for another request", proof: newProof(proofer, "GET", uri, token), wantErr: "htm mismatch"},
+		{name: "proof for another token", proof: newProof(proofer, "POST", uri, "other"), wantErr: "ath"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verifyToken(context.Background(), token, []string{"RO"}, possession{dpopProof: tt.proof, method: "POST", uri: uri})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifier_TokenFormats(t *testing.T) {
+	v, signer := newTestVerifier(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	v.certs.Keys = append(v.certs.Keys, jose.JSONWebKey{Key: key.Public(), KeyID: "kid-2", Algorithm: "RS256", Use: "sig"})
+	typedSigner := func(typ string) jose.Signer {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{}).WithHeader("kid", "kid-2").WithType(jose.ContentType(typ)))
+		require.NoError(t, err)
+		return signer
+	}
+
+	sign := func(t *testing.T, signer jose.Signer, claims any) string {
+		raw, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+	claims := func(nbf time.Time) map[string]any {
+		return map[string]any{
+			"exp":       time.Now().Add(time.Minute).Unix(),
+			"iat":       time.Now().Unix(),
+			"nbf":       nbf.Unix(),
+			"iss":       "https://idp.test/realms/service2infra",
+			"aud":       "postgres-a",
+			"scope":     "postgres-a",
+			"roles":     []string{"RO"},
+			"client_id": "service-a",
+		}
+	}
+
+	// v1 tokens of IdP realms with token_format v1
+	legacy := sign(t, signer, map[string]any{
+		"exp":      time.Now().Add(time.Minute).Format(time.RFC3339Nano),
+		"iat":      time.Now().Format(time.RFC3339Nano),
+		"iss":      "https://idp.test/realms/service2infra",
+		"aud":      "postgres-a",
+		"scope":    "postgres-a",
+		"roles":    []string{"RO"},
+		"clientID": "service-a",
+	})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "rfc 9068 token", token: sign(t, typedSigner("at+jwt"), claims(time.Now()))},
+		{name: "legacy token", token: legacy},
+		{name: "not valid yet", token: sign(t, signer, claims(time.Now().Add(time.Hour))), wantErr: "not valid yet"},
+		{name: "id token", token: sign(t, typedSigner("id_token+jwt"), claims(time.Now())), wantErr: "unexpected token type"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verifyToken(context.Background(), tt.token, []string{"RO"}, possession{})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifier_EncryptedToken(t *testing.T) {
+	v, signer := newTestVerifier(t)
+
+	sidecarKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "decryption.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(sidecarKey),
+	}), 0o600))
+	v.decryptionKey, err = loadDecryptionKey(keyFile)
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, alg jose.KeyAlgorithm, key any, cty string) string {
+		opts := &jose.EncrypterOptions{}
+		if cty != "" {
+			opts = opts.WithContentType(jose.ContentType(cty))
+		}
+		encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: key}, opts)
+		require.NoError(t, err)
+
+		jwe, err := encrypter.Encrypt([]byte(signTestToken(t, signer, nil)))
+		require.NoError(t, err)
+		raw, err := jwe.CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "encrypted to the verifier", token: encrypt(t, jose.RSA_OAEP_256, sidecarKey.Public(), "JWT")},
+		{name: "signed only", token: signTestToken(t, signer, nil)},
+		{name: "encrypted to another key", token: encrypt(t, jose.RSA_OAEP_256, otherKey.Public(), "JWT"), wantErr: "failed to decrypt token"},
+		{name: "weak key algorithm", token: encrypt(t, jose.RSA1_5, sidecarKey.Public(), "JWT"), wantErr: "unexpected key algorithm"},
+		{name: "no nested jwt", token: encrypt(t, jose.RSA_OAEP_256, sidecarKey.Public(), ""), wantErr: "does not nest a JWT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.verifyToken(context.Background(), tt.token, []string{"RO"}, possession{})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	v.cfg.EncryptionRequired = true
+	require.NoError(t, v.verifyToken(context.Background(), tests[0].token, []string{"RO"}, possession{}))
+	err = v.verifyToken(context.Background(), tests[1].token, []string{"RO"}, possession{})
+	assert.ErrorContains(t, err, "token is not encrypted")
+	v.cfg.EncryptionRequired = false
+
+	v.decryptionKey = nil
+	err = v.verifyToken(context.Background(), tests[0].token, []string{"RO"}, possession{})
+	assert.ErrorContains(t, err, "no decryption key is configured")
+}
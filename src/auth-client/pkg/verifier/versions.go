@@ -0,0 +1,126 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/internal/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// permissionsVersions keeps the minimum permissions versions of the clients of
+// the verifier scope, as polled from the IdP.
+type permissionsVersions struct {
+	cfg *config.Config
+
+	mu  sync.RWMutex
+	min map[string]int64
+}
+
+type versionsResp struct {
+	Scope    string `json:"scope"`
+	Versions map[string]struct {
+		Version    int64 `json:"version"`
+		MinVersion int64 `json:"min_version"`
+	} `json:"versions"`
+}
+
+func newPermissionsVersions(cfg *config.Config) *permissionsVersions {
+	return &permissionsVersions{cfg: cfg}
+}
+
+// verify rejects tokens issued before the latest downgrade of their client or
+// of a group client they inherit roles from. A client unknown to the IdP never
+// lost roles, so its tokens are accepted.
+func (p *permissionsVersions) verify(claims *tokens.Claims) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if minVersion := p.min[claims.ClientID]; claims.PermVer < minVersion {
+		return fmt.Errorf("permissions of client %s changed after the token was issued, token version: %d, min version: %d",
+			claims.ClientID, claims.PermVer, minVersion)
+	}
+	for group, version := range claims.GroupPermVer {
+		if minVersion := p.min[group]; version < minVersion {
+			return fmt.Errorf("permissions of group %s changed after the token was issued, token version: %d, min version: %d",
+				group, version, minVersion)
+		}
+	}
+
+	return nil
+}
+
+// run polls the versions until ctx is done, the last fetched versions are kept
+// when the IdP is not available.
+func (p *permissionsVersions) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.fetch(ctx); err != nil {
+				log.Printf("failed to fetch permissions versions: %v", err)
+			}
+		}
+	}
+}
+
+// fetch authenticates with the service account token of the verifier, the IdP
+// only reports the versions of its own scope.
+func (p *permissionsVersions) fetch(ctx context.Context) error {
+	saToken, err := os.ReadFile(p.cfg.IntrospectionTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.RequestTimeout)
+	defer cancel()
+
+	endpoint := p.cfg.VersionsEndpointAddress + "?" + url.Values{"scope": {p.cfg.ClientID}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create permissions versions request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(saToken)))
+
+	resp, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get permissions versions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read permissions versions: %w", err)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected permissions versions status %d: %s", resp.StatusCode, body)
+	}
+
+	var versions versionsResp
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return fmt.Errorf("failed to unmarshal permissions versions: %w", err)
+	}
+
+	minVersions := make(map[string]int64, len(versions.Versions))
+	for client, version := range versions.Versions {
+		minVersions[client] = version.MinVersion
+	}
+
+	p.mu.Lock()
+	p.min = minVersions
+	p.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_PermissionsVersions(t *testing.T) {
+	var minVersion atomic.Int64
+	var available atomic.Bool
+	available.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "postgres-a", r.URL.Query().Get("scope"))
+		assert.Equal(t, "Bearer sa-token", r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]any{
+			"scope": "postgres-a",
+			"versions": map[string]any{
+				"service-a":      map[string]int64{"version": 3, "min_version": minVersion.Load()},
+				"group:platform": map[string]int64{"version": 5, "min_version": minVersion.Load() + 2},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	v, signer := newTestVerifier(t)
+	v.cfg.VersionsEndpointAddress = srv.URL
+	v.cfg.HTTPClient = srv.Client()
+	v.cfg.RequestTimeout = time.Second
+	v.cfg.IntrospectionTokenFile = filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(v.cfg.IntrospectionTokenFile, []byte("sa-token\n"), 0o600))
+	v.versions = newPermissionsVersions(v.cfg)
+
+	signVersion := func(client string, version int64, groupVersions map[string]int64) string {
+		raw, err := jwt.Signed(signer).Claims(tokens.Claims{
+			Exp:      tokens.NewNumericDate(time.Now().Add(time.Minute)),
+			Iat:      tokens.NewNumericDate(time.Now()),
+			Iss:      "https://idp.test/realms/service2infra",
+			Aud:      "postgres-a",
+			Scope:    "postgres-a",
+			Roles:    []string{"RO"},
+			ClientID: client,
+			PermVer:  version,
+
+			GroupPermVer: groupVersions,
+		}).CompactSerialize()
+		require.NoError(t, err)
+		return raw
+	}
+	old := signVersion("service-a", 1, nil)
+	current := signVersion("service-a", 3, nil)
+	otherClient := signVersion("service-b", 0, nil)
+	// roles inherited from a group are checked against the group versions
+	oldGroup := signVersion("user-a", 0, map[string]int64{"group:platform": 3})
+	currentGroup := signVersion("user-a", 0, map[string]int64{"group:platform": 5})
+
+	// no versions fetched yet
+	require.NoError(t, v.verifyToken(context.Background(), old, []string{"RO"}, possession{}))
+
+	minVersion.Store(2)
+	require.NoError(t, v.versions.fetch(context.Background()))
+	assert.ErrorContains(t, v.verifyToken(context.Background(), old, []string{"RO"}, possession{}), "permissions of client service-a changed")
+	assert.NoError(t, v.verifyToken(context.Background(), current, []string{"RO"}, possession{}))
+	assert.NoError(t, v.verifyToken(context.Background(), otherClient, []string{"RO"}, possession{}))
+	assert.ErrorContains(t, v.verifyToken(context.Background(), oldGroup, []string{"RO"}, possession{}), "permissions of group group:platform changed")
+	assert.NoError(t, v.verifyToken(context.Background(), currentGroup, []string{"RO"}, possession{}))
+
+	// the last versions are kept while the IdP is not available
+	available.Store(false)
+	require.Error(t, v.versions.fetch(context.Background()))
+	assert.Error(t, v.verifyToken(context.Background(), old, []string{"RO"}, possession{}))
+}
@@ -14,6 +14,13 @@ SERVICES = os.getenv("SERVICES", "service-a,service-b,postgres-a,postgres-b").sp
 settings_cache = {service: {"verify": True} for service in SERVICES}
 
 IDP_SERVICE_URL = "http://idp.idp.svc.cluster.local:80"
+SA_TOKEN_PATH = os.getenv("SA_TOKEN_PATH", "/var/run/secrets/kubernetes.io/serviceaccount/token")
+
+def idp_headers():
+    # IdP авторизует изменение прав по токену сервисного аккаунта, клиент панели - auth-ui.
+    # Токен читается на каждый запрос, kubelet его ротирует.
+    with open(SA_TOKEN_PATH) as f:
+        return {"Authorization": f"Bearer {f.read().strip()}"}
 
 def fetch_current_settings(service):
     try:
@@ -200,8 +207,11 @@ def update_permissions():
         response = requests.post(
             f"{IDP_SERVICE_URL}/update_permissions",
             json={"client": client_id, "scope": scope, "roles": roles},
+            headers=idp_headers(),
             timeout=5
         )
+        if response.status_code != 200:
+            return jsonify(response.json()), response.status_code
         return jsonify({"message": "Права успешно применены"}), response.status_code
     except Exception as e:
         return jsonify({"error": str(e)}), 500
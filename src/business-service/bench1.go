@@ -130,7 +130,8 @@ func (s *Service) sendBenchmarkQuery(queryType string) (int, error) {
 		return http.StatusOK, nil
 	}
 
-	target := fmt.Sprintf("http://%s:%s%s",
+	target := fmt.Sprintf("%s://%s:%s%s",
+		s.cfg.SidecarScheme,
 		s.cfg.PostgresService,
 		s.cfg.SidecarPort,
 		s.cfg.ServiceEndpoint,
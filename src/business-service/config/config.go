@@ -11,9 +11,21 @@ type Config struct {
 	Namespace       string
 	PostgresService string
 	InitTarget      string
+	SidecarScheme   string
 	SidecarPort     string
 	ServiceEndpoint string
 	SignAuthEnabled bool
+
+	// TLS to the IdP is opt-in: IdPAddress switches to https, IdPCABundleFile
+	// verifies the IdP certificate and the client certificate answers mTLS.
+	IdPAddress        string
+	IdPCABundleFile   string
+	IdPClientCertFile string
+	IdPClientKeyFile  string
+
+	// CertificateBoundTokens binds the tokens to the client certificate, the
+	// sidecars then have to serve https with a certificate of the IdP CA.
+	CertificateBoundTokens bool
 }
 
 var (
@@ -28,9 +40,17 @@ func NewConfig() *Config {
 			Namespace:       getEnv("POD_NAMESPACE", "default"),
 			PostgresService: getEnv("POSTGRES_SERVICE", ""),
 			InitTarget:      getEnv("INIT_TARGET", ""),
+			SidecarScheme:   getEnv("SIDECAR_SCHEME", "http"),
 			SidecarPort:     getEnv("SIDECAR_PORT", "8080"),
 			ServiceEndpoint: getEnv("SERVICE_ENDPOINT", "/query"),
 			SignAuthEnabled: getEnv("SIGN_AUTH_ENABLED", "true") == "true",
+
+			IdPAddress:        getEnv("IDP_ADDRESS", ""),
+			IdPCABundleFile:   getEnv("IDP_CA_BUNDLE_FILE", ""),
+			IdPClientCertFile: getEnv("IDP_CLIENT_CERT_FILE", ""),
+			IdPClientKeyFile:  getEnv("IDP_CLIENT_KEY_FILE", ""),
+
+			CertificateBoundTokens: getEnv("CERTIFICATE_BOUND_TOKENS", "false") == "true",
 		}
 	})
 	log.Printf("Service config initialized: %+v", instance)
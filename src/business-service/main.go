@@ -8,6 +8,7 @@ import (
 
 	"github.com/perpetua1g0d/bmstu-diploma/business-service/config"
 	auth_signer "github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/signer"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "github.com/lib/pq"
@@ -19,14 +20,25 @@ func main() {
 
 	cfg := config.NewConfig()
 
+	tracingCfg, err := tracing.ConfigFromEnv(cfg.ServiceName)
+	if err != nil {
+		log.Fatalf("failed to read tracing config: %v", err)
+	}
+	shutdownTracing, err := tracing.Setup(ctx, tracingCfg)
+	if err != nil {
+		log.Fatalf("failed to setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 
 	scopes := []string{cfg.InitTarget}
-	signer, err := auth_signer.NewTokenSigner(ctx, cfg.ServiceName, scopes, cfg.SignAuthEnabled)
+	signer, err := auth_signer.NewTokenSigner(ctx, cfg.ServiceName, scopes, cfg.SignAuthEnabled, signerOptions(cfg)...)
 	if err != nil {
 		log.Fatalf("failed to create signer: %v", err)
 	}
+	defer signer.Close()
 
 	service := NewService(cfg, signer)
 	defer service.db.Close()
@@ -58,3 +70,23 @@ func (s *Service) sendRegularQuery() {
 		log.Printf("Regular query completed")
 	}
 }
+
+// signerOptions enables TLS to the IdP when it is configured.
+func signerOptions(cfg *config.Config) []auth_signer.Option {
+	// the IdP of the deployment streams permission changes
+	opts := []auth_signer.Option{auth_signer.WithPermissionEvents(true)}
+	if cfg.IdPAddress != "" {
+		opts = append(opts, auth_signer.WithIdPAddress(cfg.IdPAddress))
+	}
+	if cfg.IdPCABundleFile != "" {
+		opts = append(opts, auth_signer.WithCABundle(cfg.IdPCABundleFile))
+	}
+	if cfg.IdPClientCertFile != "" {
+		opts = append(opts, auth_signer.WithClientCertificate(cfg.IdPClientCertFile, cfg.IdPClientKeyFile))
+	}
+	if cfg.CertificateBoundTokens {
+		opts = append(opts, auth_signer.WithCertificateBoundTokens())
+	}
+
+	return opts
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/handlers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+)
+
+// grpcServer serves the gRPC API next to the HTTP server.
+type grpcServer struct {
+	server *grpc.Server
+	health *health.Server
+}
+
+// startGRPC listens on address and serves the API in the background, a
+// failure of the server is sent to serveErr. TLS is used if tlsConfig is set.
+func startGRPC(address string, api *handlers.GRPCServer, tlsConfig *tls.Config, serveErr chan<- error) (*grpcServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	opts := api.ServerOptions()
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(opts...)
+	healthServer := api.Register(server)
+
+	go func() {
+		log.Printf("idp gRPC server started on %s (tls: %t)", address, tlsConfig != nil)
+		serveErr <- server.Serve(listener)
+	}()
+
+	return &grpcServer{server: server, health: healthServer}, nil
+}
+
+// Shutdown reports the services as not serving and waits for the running
+// calls, they are cancelled once ctx is done.
+func (s *grpcServer) Shutdown(ctx context.Context) {
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.server.Stop()
+	}
+}
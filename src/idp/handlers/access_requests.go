@@ -0,0 +1,566 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/oidc"
+)
+
+// AccessRequestsPath is the collection of access requests, relative to the
+// realm issuer. A request is reviewed on {id}/approve and {id}/deny.
+const AccessRequestsPath = "/access_requests"
+
+// grantExpiryInterval is how often time-bound grants are checked for expiry.
+var grantExpiryInterval = time.Minute
+
+var (
+	errCallerNotSupported = errors.New("callers cannot be authenticated in this realm")
+	errNotPending         = errors.New("access request is not pending")
+	errNotApproved        = errors.New("access request is not approved")
+)
+
+// systemActor is recorded in the audit trail for changes the IdP makes on its
+// own, e.g. when a grant expires.
+const systemActor = "system"
+
+// caller is the authenticated principal of an API request: a workload by its
+// service account token or a user by an upstream ID token.
+type caller struct {
+	ID string
+	// Groups are the group clients of a user.
+	Groups []string
+	// Workload callers may only act for themselves.
+	Workload bool
+}
+
+// is reports whether the principal of the permission model is the caller or
+// one of its groups.
+func (c *caller) is(principal string) bool {
+	return c.ID == principal || slices.Contains(c.Groups, principal)
+}
+
+// authenticateCaller verifies the bearer token of the request, ID tokens of
+// the upstream provider are told apart from service account tokens by issuer.
+func (ctl *Controller) authenticateCaller(r *http.Request) (*caller, error) {
+	return ctl.authenticateBearer(r.Context(), r.Header.Get("Authorization"))
+}
+
+// authenticateBearer verifies the bearer token of an Authorization header or
+// of the authorization metadata of a gRPC call.
+func (ctl *Controller) authenticateBearer(ctx context.Context, authorization string) (*caller, error) {
+	rawToken, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || rawToken == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	if ctl.upstream != nil {
+		if issuer, _ := oidc.UnverifiedIssuer(rawToken); issuer == ctl.realm.Upstream.Issuer {
+			identity, err := ctl.upstream.Verify(ctx, rawToken)
+			if err != nil {
+				return nil, fmt.Errorf("failed to verify upstream id token: %w", err)
+			}
+
+			return &caller{ID: identity.ClientID(), Groups: identity.GroupClientIDs()}, nil
+		}
+	}
+
+	if ctl.k8sVerifier == nil {
+		return nil, errCallerNotSupported
+	}
+
+	clientID, _, err := ctl.k8sVerifier.VerifyWithClient(rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify k8s token: %w", err)
+	}
+
+	return &caller{ID: clientID, Workload: true}, nil
+}
+
+func respondCallerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCallerNotSupported) {
+		respondError(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	log.Printf("failed to authenticate caller: %v", err)
+	respondError(w, "caller is not authenticated", http.StatusUnauthorized)
+}
+
+type CreateAccessRequestReq struct {
+	// Client defaults to the caller, users may also request roles for their
+	// groups.
+	Client        string   `json:"client"`
+	Scope         string   `json:"scope"`
+	Roles         []string `json:"roles"`
+	Justification string   `json:"justification"`
+	// TTLSeconds asks for a time-bound grant.
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+type ReviewAccessRequestReq struct {
+	Comment string `json:"comment"`
+}
+
+// accessRequestsCaller authenticates the caller of an access requests
+// endpoint, the response is written if the caller may not proceed.
+func (ctl *Controller) accessRequestsCaller(w http.ResponseWriter, r *http.Request) (*caller, bool) {
+	if ctl.realm.AccessRequests == nil || ctl.requests == nil {
+		respondError(w, "access requests are not enabled in this realm", http.StatusNotImplemented)
+		return nil, false
+	}
+
+	caller, err := ctl.authenticateCaller(r)
+	if err != nil {
+		respondCallerError(w, err)
+		return nil, false
+	}
+
+	return caller, true
+}
+
+// NewCreateAccessRequestHandler files a request for roles on a scope, it is
+// pending until an approver of the scope reviews it.
+func (ctl *Controller) NewCreateAccessRequestHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := ctl.accessRequestsCaller(w, r)
+		if !ok {
+			return
+		}
+
+		var body CreateAccessRequestReq
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if body.Client == "" {
+			body.Client = caller.ID
+		}
+		if !caller.is(body.Client) {
+			respondError(w, "callers may only request roles for themselves or their groups", http.StatusForbidden)
+			return
+		}
+
+		if err := ctl.validateAccessRequest(&body); err != nil {
+			respondError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := &db.AccessRequest{
+			ID:            newTokenID(),
+			Realm:         ctl.realm.Name,
+			Client:        body.Client,
+			Scope:         body.Scope,
+			Roles:         body.Roles,
+			Justification: body.Justification,
+			TTLSeconds:    body.TTLSeconds,
+			Requester:     caller.ID,
+			CreatedAt:     time.Now().UTC(),
+			Status:        db.AccessRequestPending,
+		}
+		if err := ctl.requests.Create(r.Context(), req); err != nil {
+			log.Printf("failed to create access request in realm %s: %v", ctl.realm.Name, err)
+			respondError(w, "failed to store access request", http.StatusInternalServerError)
+			return
+		}
+
+		ctl.recordAudit(r.Context(), db.AuditEvent{
+			Actor:     caller.ID,
+			Action:    AuditAccessRequestCreated,
+			Client:    req.Client,
+			Scope:     req.Scope,
+			Roles:     req.Roles,
+			RequestID: req.ID,
+			Comment:   req.Justification,
+		})
+		log.Printf("access request %s created, realm: %s, client: %s, scope: %s, roles: %v, requester: %s",
+			req.ID, ctl.realm.Name, req.Client, req.Scope, req.Roles, req.Requester)
+
+		respondJSON(w, http.StatusCreated, req)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+func (ctl *Controller) validateAccessRequest(body *CreateAccessRequestReq) error {
+	switch {
+	case body.Client == "":
+		return errors.New("client is required")
+	case body.Scope == "":
+		return errors.New("scope is required")
+	case len(body.Roles) == 0 || slices.Contains(body.Roles, ""):
+		return errors.New("roles must not be empty")
+	case strings.TrimSpace(body.Justification) == "":
+		return errors.New("justification is required")
+	case body.TTLSeconds < 0:
+		return errors.New("ttl_seconds must not be negative")
+	case len(ctl.realm.AccessRequests.Approvers[body.Scope]) == 0:
+		return fmt.Errorf("no approvers are designated for scope %s", body.Scope)
+	}
+
+	if maxTTL := ctl.realm.AccessRequests.MaxGrantTTL; maxTTL > 0 {
+		if body.TTLSeconds == 0 || time.Duration(body.TTLSeconds)*time.Second > maxTTL {
+			return fmt.Errorf("ttl_seconds must be set and not exceed %d", int64(maxTTL/time.Second))
+		}
+	}
+
+	return nil
+}
+
+// NewListAccessRequestsHandler lists the requests of the realm from the oldest
+// one, they are filtered by the status, client and scope query parameters.
+func (ctl *Controller) NewListAccessRequestsHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.accessRequestsCaller(w, r); !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		filter := db.AccessRequestFilter{
+			Realm:  ctl.realm.Name,
+			Status: db.AccessRequestStatus(query.Get("status")),
+			Client: query.Get("client"),
+			Scope:  query.Get("scope"),
+		}
+		switch filter.Status {
+		case "", db.AccessRequestPending, db.AccessRequestApproved, db.AccessRequestDenied, db.AccessRequestExpired:
+		default:
+			respondError(w, fmt.Sprintf("unknown status %q", filter.Status), http.StatusBadRequest)
+			return
+		}
+
+		reqs, err := ctl.requests.List(r.Context(), filter)
+		if err != nil {
+			log.Printf("failed to list access requests of realm %s: %v", ctl.realm.Name, err)
+			respondError(w, "failed to list access requests", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, reqs)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+func (ctl *Controller) NewGetAccessRequestHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.accessRequestsCaller(w, r); !ok {
+			return
+		}
+
+		req, ok := ctl.accessRequest(w, r)
+		if !ok {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, req)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// accessRequest returns the request of the {id} path parameter, requests of
+// other realms sharing the namespace are not found.
+func (ctl *Controller) accessRequest(w http.ResponseWriter, r *http.Request) (*db.AccessRequest, bool) {
+	req, err := ctl.requests.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, db.ErrNotFound) || (err == nil && req.Realm != ctl.realm.Name) {
+		respondError(w, "access request not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("failed to get access request of realm %s: %v", ctl.realm.Name, err)
+		respondError(w, "failed to get access request", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return req, true
+}
+
+// NewReviewAccessRequestHandler approves or denies a pending request, only the
+// approvers of its scope other than the requester may review it. An approval
+// grants the roles right away.
+func (ctl *Controller) NewReviewAccessRequestHandler(approve bool) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := ctl.accessRequestsCaller(w, r)
+		if !ok {
+			return
+		}
+
+		var body ReviewAccessRequestReq
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				respondError(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		req, ok := ctl.accessRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if !ctl.isApprover(caller, req.Scope) {
+			respondError(w, fmt.Sprintf("%s is not an approver of scope %s", caller.ID, req.Scope), http.StatusForbidden)
+			return
+		} else if caller.ID == req.Requester {
+			respondError(w, "access requests cannot be reviewed by their requester", http.StatusForbidden)
+			return
+		}
+
+		reviewed, err := ctl.reviewAccessRequest(r.Context(), caller.ID, req.ID, approve, body.Comment)
+		if errors.Is(err, errNotPending) {
+			respondError(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("failed to review access request %s of realm %s: %v", req.ID, ctl.realm.Name, err)
+			respondError(w, "failed to review access request", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, reviewed)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// reviewAccessRequest moves the request out of pending, so concurrent reviews
+// do not both succeed, and then grants the roles of an approved one. The
+// request is pending again if the grant fails.
+func (ctl *Controller) reviewAccessRequest(ctx context.Context, reviewer, id string, approve bool, comment string) (*db.AccessRequest, error) {
+	reviewed, err := ctl.requests.Update(ctx, id, func(req *db.AccessRequest) error {
+		if req.Status != db.AccessRequestPending {
+			return errNotPending
+		}
+
+		now := time.Now().UTC()
+		req.Reviewer = reviewer
+		req.ReviewComment = comment
+		req.ReviewedAt = &now
+		if !approve {
+			req.Status = db.AccessRequestDenied
+			return nil
+		}
+
+		req.Status = db.AccessRequestApproved
+		if req.TTLSeconds > 0 {
+			expiresAt := now.Add(time.Duration(req.TTLSeconds) * time.Second)
+			req.GrantExpiresAt = &expiresAt
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !approve {
+		ctl.recordAudit(ctx, db.AuditEvent{
+			Actor:     reviewer,
+			Action:    AuditAccessRequestDenied,
+			Client:    reviewed.Client,
+			Scope:     reviewed.Scope,
+			Roles:     reviewed.Roles,
+			RequestID: reviewed.ID,
+			Comment:   comment,
+		})
+		log.Printf("access request %s denied by %s, realm: %s", reviewed.ID, reviewer, ctl.realm.Name)
+		return reviewed, nil
+	}
+
+	added, err := ctl.grantRoles(ctx, reviewer, reviewed.Client, reviewed.Scope, reviewed.Roles)
+	if err != nil {
+		if _, revertErr := ctl.requests.Update(ctx, id, func(req *db.AccessRequest) error {
+			req.Status = db.AccessRequestPending
+			req.Reviewer, req.ReviewComment, req.ReviewedAt = "", "", nil
+			req.GrantExpiresAt, req.AddedRoles = nil, nil
+			return nil
+		}); revertErr != nil {
+			log.Printf("failed to revert approval of access request %s: %v", id, revertErr)
+		}
+
+		return nil, fmt.Errorf("failed to grant roles: %w", err)
+	}
+
+	// the added roles are taken away when the grant expires
+	reviewed, err = ctl.requests.Update(ctx, id, func(req *db.AccessRequest) error {
+		req.AddedRoles = added
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the roles granted by access request %s: %w", id, err)
+	}
+
+	ctl.recordAudit(ctx, db.AuditEvent{
+		Actor:     reviewer,
+		Action:    AuditAccessRequestApproved,
+		Client:    reviewed.Client,
+		Scope:     reviewed.Scope,
+		Roles:     reviewed.Roles,
+		RequestID: reviewed.ID,
+		Comment:   comment,
+	})
+	log.Printf("access request %s approved by %s, realm: %s, added roles: %v, expires at: %v",
+		reviewed.ID, reviewer, ctl.realm.Name, reviewed.AddedRoles, reviewed.GrantExpiresAt)
+
+	return reviewed, nil
+}
+
+// maxGrantAttempts bounds the retries of a grant racing other permission
+// changes.
+const maxGrantAttempts = 5
+
+// grantRoles adds the roles to those of the client on the scope and returns
+// the ones it did not have. The merge is stored under the permissions revision
+// of the repository, so a concurrent change of the roles is not overwritten.
+func (ctl *Controller) grantRoles(ctx context.Context, actor, client, scope string, roles []string) ([]string, error) {
+	batch, ok := ctl.repository.(BatchRepository)
+	if !ok {
+		current := ctl.repository.GetPermissions(client, scope)
+		return missingRoles(current, roles), ctl.updatePermissions(ctx, actor, client, scope, mergeRoles(current, roles))
+	}
+
+	for attempt := 1; ; attempt++ {
+		revision, err := batch.PermissionsRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		current := ctl.repository.GetPermissions(client, scope)
+		update := db.PermissionUpdate{Client: client, Scope: scope, Roles: mergeRoles(current, roles)}
+		err = batch.CompareAndSwapPermissions(ctx, revision, []db.PermissionUpdate{update})
+		if errors.Is(err, db.ErrConflict) && attempt < maxGrantAttempts {
+			continue
+		} else if err != nil {
+			log.Printf("failed to grant roles (%s -> %s: %v): %v", client, scope, roles, err)
+			return nil, err
+		}
+
+		ctl.permissionsChanged(ctx, actor, "", update)
+		ctl.takeSnapshot(ctx, actor, fmt.Sprintf("roles of %s on %s set to %v", client, scope, update.Roles))
+
+		return missingRoles(current, roles), nil
+	}
+}
+
+// missingRoles returns the roles which are not in current.
+func missingRoles(current, roles []string) []string {
+	var missing []string
+	for _, role := range roles {
+		if !slices.Contains(current, role) {
+			missing = append(missing, role)
+		}
+	}
+
+	return missing
+}
+
+// RunGrantExpiry takes away the roles of expired time-bound grants until ctx
+// is done.
+func (ctl *Controller) RunGrantExpiry(ctx context.Context) {
+	if ctl.realm.AccessRequests == nil || ctl.requests == nil {
+		return
+	}
+
+	ticker := time.NewTicker(grantExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := ctl.expireGrants(ctx, now); err != nil {
+				log.Printf("failed to expire grants of realm %s: %v", ctl.realm.Name, err)
+			}
+		}
+	}
+}
+
+// expireGrants removes the roles added by approved requests which expired by
+// now. Roles still granted by another approved request of the client on the
+// scope are kept.
+func (ctl *Controller) expireGrants(ctx context.Context, now time.Time) error {
+	approved, err := ctl.requests.List(ctx, db.AccessRequestFilter{Realm: ctl.realm.Name, Status: db.AccessRequestApproved})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, req := range approved {
+		if req.GrantExpiresAt == nil || req.GrantExpiresAt.After(now) {
+			continue
+		}
+
+		// another replica may expire the same grant, only one moves it
+		expired, err := ctl.requests.Update(ctx, req.ID, func(req *db.AccessRequest) error {
+			if req.Status != db.AccessRequestApproved {
+				return errNotApproved
+			}
+			req.Status = db.AccessRequestExpired
+			return nil
+		})
+		if errors.Is(err, errNotApproved) {
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := ctl.revokeGrant(ctx, expired, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (ctl *Controller) revokeGrant(ctx context.Context, expired *db.AccessRequest, now time.Time) error {
+	active, err := ctl.requests.List(ctx, db.AccessRequestFilter{
+		Realm:  ctl.realm.Name,
+		Status: db.AccessRequestApproved,
+		Client: expired.Client,
+		Scope:  expired.Scope,
+	})
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	for _, req := range active {
+		if req.GrantExpiresAt == nil || req.GrantExpiresAt.After(now) {
+			kept = append(kept, req.Roles...)
+		}
+	}
+
+	current := ctl.repository.GetPermissions(expired.Client, expired.Scope)
+	roles := slices.DeleteFunc(slices.Clone(current), func(role string) bool {
+		return slices.Contains(expired.AddedRoles, role) && !slices.Contains(kept, role)
+	})
+
+	if len(roles) != len(current) {
+		if err := ctl.updatePermissions(ctx, systemActor, expired.Client, expired.Scope, roles); err != nil {
+			return fmt.Errorf("failed to revoke roles of access request %s: %w", expired.ID, err)
+		}
+	}
+
+	ctl.recordAudit(ctx, db.AuditEvent{
+		Actor:     systemActor,
+		Action:    AuditAccessRequestExpired,
+		Client:    expired.Client,
+		Scope:     expired.Scope,
+		Roles:     expired.AddedRoles,
+		RequestID: expired.ID,
+	})
+	log.Printf("grant of access request %s expired, realm: %s, client: %s, scope: %s, roles: %v",
+		expired.ID, ctl.realm.Name, expired.Client, expired.Scope, roles)
+
+	return nil
+}
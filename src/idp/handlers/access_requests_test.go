@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	josejwt "github.com/go-jose/go-jose/v3/jwt"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUpstreamIssuer = "https://login.example.com"
+
+// userIDToken is an unsigned ID token of the upstream issuer, the upstream
+// verifier is mocked.
+func userIDToken(t *testing.T, user string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("test-secret-test-secret-test-sec")}, nil)
+	require.NoError(t, err)
+
+	raw, err := josejwt.Signed(signer).Claims(josejwt.Claims{Issuer: testUpstreamIssuer, Subject: user}).CompactSerialize()
+	require.NoError(t, err)
+
+	return raw
+}
+
+type accessRequestsTest struct {
+	t    *testing.T
+	ctl  *Controller
+	repo *db.Repository
+
+	tokens map[string]string
+}
+
+func newAccessRequestsTest(t *testing.T) *accessRequestsTest {
+	t.Helper()
+
+	realm := testRealm()
+	realm.Upstream = &config.UpstreamConfig{Issuer: testUpstreamIssuer}
+	realm.AccessRequests = &config.AccessRequestsConfig{
+		Approvers: map[string][]string{"postgres-a": {"group:dba", "user:carol"}},
+	}
+
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "service-a-token").Return("service-a", testClaims{}, nil)
+
+	tokens := map[string]string{"service-a": "service-a-token"}
+	upstream := new(mockUpstreamVerifier)
+	for user, groups := range map[string][]string{"alice": {"dba"}, "bob": nil, "carol": nil, "dave": nil} {
+		tokens[user] = userIDToken(t, user)
+		upstream.On("Verify", tokens[user]).Return(&oidc.Identity{User: user, Groups: groups}, nil)
+	}
+
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO"}}})
+	ctl := &Controller{
+		realm:       realm,
+		k8sVerifier: k8sVerifier,
+		upstream:    upstream,
+		repository:  repo,
+		requests:    db.NewAccessRequests(),
+		audit:       db.NewAuditLog(),
+	}
+
+	return &accessRequestsTest{t: t, ctl: ctl, repo: repo, tokens: tokens}
+}
+
+func (at *accessRequestsTest) do(handler http.HandlerFunc, caller, method, target, id string, body any) *httptest.ResponseRecorder {
+	at.t.Helper()
+
+	var raw []byte
+	if body != nil {
+		var err error
+		raw, err = json.Marshal(body)
+		require.NoError(at.t, err)
+	}
+
+	req := httptest.NewRequest(method, target, bytes.NewReader(raw))
+	if caller != "" {
+		req.Header.Set("Authorization", "Bearer "+at.tokens[caller])
+	}
+	req.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func (at *accessRequestsTest) create(caller string, body CreateAccessRequestReq) (*db.AccessRequest, *httptest.ResponseRecorder) {
+	at.t.Helper()
+
+	w := at.do(at.ctl.NewCreateAccessRequestHandler(), caller, "POST", AccessRequestsPath, "", body)
+	if w.Code != http.StatusCreated {
+		return nil, w
+	}
+
+	var req db.AccessRequest
+	require.NoError(at.t, json.NewDecoder(w.Body).Decode(&req))
+	return &req, w
+}
+
+func (at *accessRequestsTest) review(caller, id string, approve bool) (*db.AccessRequest, *httptest.ResponseRecorder) {
+	at.t.Helper()
+
+	w := at.do(at.ctl.NewReviewAccessRequestHandler(approve), caller, "POST", AccessRequestsPath+"/"+id, id, ReviewAccessRequestReq{Comment: "ok"})
+	if w.Code != http.StatusOK {
+		return nil, w
+	}
+
+	var req db.AccessRequest
+	require.NoError(at.t, json.NewDecoder(w.Body).Decode(&req))
+	return &req, w
+}
+
+func (at *accessRequestsTest) list(query string) []db.AccessRequest {
+	at.t.Helper()
+
+	w := at.do(at.ctl.NewListAccessRequestsHandler(), "bob", "GET", AccessRequestsPath+query, "", nil)
+	require.Equal(at.t, http.StatusOK, w.Code)
+
+	var reqs []db.AccessRequest
+	require.NoError(at.t, json.NewDecoder(w.Body).Decode(&reqs))
+	return reqs
+}
+
+func TestAccessRequests_ApprovalGrantsRoles(t *testing.T) {
+	at := newAccessRequestsTest(t)
+
+	req, w := at.create("service-a", CreateAccessRequestReq{
+		Scope:         "postgres-a",
+		Roles:         []string{"RO", "RW"},
+		Justification: "migration of the orders table",
+		TTLSeconds:    3600,
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "service-a", req.Client)
+	assert.Equal(t, "service-a", req.Requester)
+	assert.Equal(t, db.AccessRequestPending, req.Status)
+
+	pending := at.list("?status=pending")
+	require.Len(t, pending, 1)
+	assert.Equal(t, req.ID, pending[0].ID)
+
+	_, w = at.review("bob", req.ID, true)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{"RO"}, at.repo.GetPermissions("service-a", "postgres-a"))
+
+	approved, w := at.review("alice", req.ID, true)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, db.AccessRequestApproved, approved.Status)
+	assert.Equal(t, "user:alice", approved.Reviewer)
+	assert.Equal(t, []string{"RW"}, approved.AddedRoles)
+	require.NotNil(t, approved.GrantExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *approved.GrantExpiresAt, 5*time.Second)
+	assert.Equal(t, []string{"RO", "RW"}, at.repo.GetPermissions("service-a", "postgres-a"))
+
+	_, w = at.review("carol", req.ID, false)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	assert.Empty(t, at.list("?status=pending"))
+	assert.Len(t, at.list("?status=approved&client=service-a"), 1)
+}
+
+func TestAccessRequests_Denial(t *testing.T) {
+	at := newAccessRequestsTest(t)
+
+	req, w := at.create("dave", CreateAccessRequestReq{
+		Scope:         "postgres-a",
+		Roles:         []string{"RW"},
+		Justification: "debugging",
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, "user:dave", req.Client)
+	assert.Equal(t, "user:dave", req.Requester)
+
+	denied, w := at.review("carol", req.ID, false)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, db.AccessRequestDenied, denied.Status)
+	assert.Equal(t, "ok", denied.ReviewComment)
+	assert.Empty(t, at.repo.GetPermissions("user:dave", "postgres-a"))
+
+	w = at.do(at.ctl.NewGetAccessRequestHandler(), "bob", "GET", AccessRequestsPath+"/"+req.ID, req.ID, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"denied"`)
+
+	w = at.do(at.ctl.NewGetAccessRequestHandler(), "bob", "GET", AccessRequestsPath+"/unknown", "unknown", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAccessRequests_Validation(t *testing.T) {
+	at := newAccessRequestsTest(t)
+
+	valid := CreateAccessRequestReq{Scope: "postgres-a", Roles: []string{"RW"}, Justification: "why"}
+	tests := []struct {
+		name   string
+		caller string
+		change func(body *CreateAccessRequestReq)
+		status int
+	}{
+		{name: "not authenticated", change: func(*CreateAccessRequestReq) {}, status: http.StatusUnauthorized},
+		{name: "workload for another client", caller: "service-a", change: func(b *CreateAccessRequestReq) { b.Client = "service-b" }, status: http.StatusForbidden},
+		{name: "user for a workload", caller: "dave", change: func(b *CreateAccessRequestReq) { b.Client = "service-a" }, status: http.StatusForbidden},
+		{name: "user for another group", caller: "dave", change: func(b *CreateAccessRequestReq) { b.Client = "group:dba" }, status: http.StatusForbidden},
+		{name: "user for own group", caller: "alice", change: func(b *CreateAccessRequestReq) { b.Client = "group:dba" }, status: http.StatusCreated},
+		{name: "no justification", caller: "dave", change: func(b *CreateAccessRequestReq) { b.Justification = " " }, status: http.StatusBadRequest},
+		{name: "no roles", caller: "dave", change: func(b *CreateAccessRequestReq) { b.Roles = nil }, status: http.StatusBadRequest},
+		{name: "scope without approvers", caller: "dave", change: func(b *CreateAccessRequestReq) { b.Scope = "postgres-b" }, status: http.StatusBadRequest},
+		{name: "negative ttl", caller: "dave", change: func(b *CreateAccessRequestReq) { b.TTLSeconds = -1 }, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := valid
+			tt.change(&body)
+
+			_, w := at.create(tt.caller, body)
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+		})
+	}
+
+	t.Run("requester reviews own request", func(t *testing.T) {
+		req, w := at.create("carol", valid)
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		_, w = at.review("carol", req.ID, true)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("ttl above the maximum", func(t *testing.T) {
+		at.ctl.realm.AccessRequests.MaxGrantTTL = time.Hour
+		defer func() { at.ctl.realm.AccessRequests.MaxGrantTTL = 0 }()
+
+		for _, ttl := range []int64{0, 7200} {
+			body := valid
+			body.TTLSeconds = ttl
+			_, w := at.create("dave", body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("not enabled in realm", func(t *testing.T) {
+		realm := testRealm()
+		ctl := &Controller{realm: realm, requests: db.NewAccessRequests()}
+
+		w := at.do(ctl.NewListAccessRequestsHandler(), "bob", "GET", AccessRequestsPath, "", nil)
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+// grantRaceRepository changes the permissions right after the roles of a
+// client are read, like a concurrent update while a grant is merged.
+type grantRaceRepository struct {
+	*db.Repository
+	race func()
+}
+
+func (r *grantRaceRepository) GetPermissions(client, scope string) []string {
+	roles := r.Repository.GetPermissions(client, scope)
+	if r.race != nil {
+		r.race()
+		r.race = nil
+	}
+	return roles
+}
+
+func TestAccessRequests_ApprovalKeepsConcurrentUpdate(t *testing.T) {
+	at := newAccessRequestsTest(t)
+
+	req, w := at.create("service-a", CreateAccessRequestReq{Scope: "postgres-a", Roles: []string{"RW"}, Justification: "migration"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	at.ctl.repository = &grantRaceRepository{Repository: at.repo, race: func() {
+		require.NoError(t, at.repo.UpdatePermissions("service-a", "postgres-a", []string{"RO", "DDL"}))
+	}}
+
+	approved, w := at.review("alice", req.ID, true)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"RW"}, approved.AddedRoles)
+	assert.Equal(t, []string{"RO", "DDL", "RW"}, at.repo.GetPermissions("service-a", "postgres-a"))
+}
+
+func TestAccessRequests_GrantExpiry(t *testing.T) {
+	at := newAccessRequestsTest(t)
+	ctx := context.Background()
+
+	temporary, w := at.create("service-a", CreateAccessRequestReq{Scope: "postgres-a", Roles: []string{"RW", "DDL"}, Justification: "release", TTLSeconds: 60})
+	require.Equal(t, http.StatusCreated, w.Code)
+	permanent, w := at.create("service-a", CreateAccessRequestReq{Scope: "postgres-a", Roles: []string{"DDL"}, Justification: "schema owner"})
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	_, w = at.review("alice", temporary.ID, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	_, w = at.review("alice", permanent.ID, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.ElementsMatch(t, []string{"RO", "RW", "DDL"}, at.repo.GetPermissions("service-a", "postgres-a"))
+
+	require.NoError(t, at.ctl.expireGrants(ctx, time.Now()))
+	assert.Empty(t, at.list("?status=expired"))
+
+	require.NoError(t, at.ctl.expireGrants(ctx, time.Now().Add(2*time.Minute)))
+
+	// DDL is still granted by the permanent request, RO was there before
+	assert.ElementsMatch(t, []string{"RO", "DDL"}, at.repo.GetPermissions("service-a", "postgres-a"))
+	expired := at.list("?status=expired")
+	require.Len(t, expired, 1)
+	assert.Equal(t, temporary.ID, expired[0].ID)
+
+	// an expired grant is not taken away twice
+	require.NoError(t, at.ctl.expireGrants(ctx, time.Now().Add(time.Hour)))
+	assert.ElementsMatch(t, []string{"RO", "DDL"}, at.repo.GetPermissions("service-a", "postgres-a"))
+}
+
+func TestAuditHandler(t *testing.T) {
+	at := newAccessRequestsTest(t)
+
+	req, w := at.create("service-a", CreateAccessRequestReq{Scope: "postgres-a", Roles: []string{"RW"}, Justification: "migration"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	_, w = at.review("alice", req.ID, true)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = at.do(at.ctl.NewAuditHandler(), "bob", "GET", AuditPath+"?limit=10", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var events []db.AuditEvent
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&events))
+	require.Len(t, events, 3)
+
+	assert.Equal(t, AuditAccessRequestApproved, events[0].Action)
+	assert.Equal(t, "user:alice", events[0].Actor)
+	assert.Equal(t, req.ID, events[0].RequestID)
+	assert.Equal(t, AuditPermissionsUpdated, events[1].Action)
+	assert.Equal(t, []string{"RO", "RW"}, events[1].Roles)
+	assert.Equal(t, AuditAccessRequestCreated, events[2].Action)
+	assert.Equal(t, "migration", events[2].Comment)
+	assert.Equal(t, "service2infra", events[2].Realm)
+
+	w = at.do(at.ctl.NewAuditHandler(), "", "GET", AuditPath, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = at.do(at.ctl.NewAuditHandler(), "bob", "GET", AuditPath+"?limit=-1", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -3,19 +3,30 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/events"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/k8s"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/oidc"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/webhooks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
 )
 
 type K8sVerifier interface {
 	VerifyWithClient(k8sToken string) (string, jwt.Claims, error)
 }
 
+// UpstreamVerifier checks ID tokens of human users.
+type UpstreamVerifier interface {
+	Verify(ctx context.Context, rawIDToken string) (*oidc.Identity, error)
+}
+
 type Issuer interface {
-	IssueToken(clientID, scope string) (*IssueResp, error)
+	IssueToken(clientID, scope string, opts *IssueOpts) (*IssueResp, error)
 }
 
 type Repository interface {
@@ -23,43 +34,259 @@ type Repository interface {
 	GetPermissions(client, scope string) []string
 }
 
+// VersionedRepository is implemented by repositories which version the roles
+// of every client on a scope, tokens then carry the version they were issued
+// at and are rejected once a downgrade raises the minimum version.
+type VersionedRepository interface {
+	GetVersionedPermissions(client, scope string) ([]string, db.PermissionsVersion)
+	ScopeVersions(ctx context.Context, scope string) (map[string]db.PermissionsVersion, error)
+}
+
+// RevocationList keeps revoked tokens until they expire on their own.
+type RevocationList interface {
+	Revoke(ctx context.Context, rawToken string, exp time.Time) error
+	IsRevoked(ctx context.Context, rawToken string) (bool, error)
+}
+
+// ReferenceTokenStore keeps the claims of the opaque tokens of a realm until
+// they expire, Claims returns db.ErrNotFound for unknown tokens.
+type ReferenceTokenStore interface {
+	Save(ctx context.Context, rawToken string, claims []byte, exp time.Time) error
+	Claims(ctx context.Context, rawToken string) ([]byte, error)
+}
+
+// PermissionsLister is implemented by repositories which can list every
+// grant, the access matrix report requires it.
+type PermissionsLister interface {
+	AllPermissions(ctx context.Context) (map[string]map[string][]string, error)
+}
+
+// BatchRepository is implemented by repositories which change the roles of
+// several clients atomically, rollbacks to a snapshot require it. The swap
+// fails with db.ErrConflict once the permission set has left the revision.
+type BatchRepository interface {
+	PermissionsRevision(ctx context.Context) (int64, error)
+	CompareAndSwapPermissions(ctx context.Context, revision int64, updates []db.PermissionUpdate) error
+}
+
+// SnapshotStore keeps the numbered snapshots of the permission set of a
+// namespace, Save assigns the number.
+type SnapshotStore interface {
+	Save(ctx context.Context, snapshot *db.Snapshot) error
+	Get(ctx context.Context, number int64) (*db.Snapshot, error)
+	List(ctx context.Context, limit int) ([]db.Snapshot, error)
+}
+
+// Webhooks sends IdP events to the configured endpoints, Publish must not
+// block.
+type Webhooks interface {
+	Publish(event webhooks.Event)
+}
+
+// KeyHistory keeps the signing key id each realm last started with.
+type KeyHistory interface {
+	SwapKeyID(ctx context.Context, realm, keyID string) (string, error)
+}
+
+// GrantUsage keeps when a token carrying a grant was last issued, and since
+// when issuances are recorded.
+type GrantUsage interface {
+	RecordIssued(ctx context.Context, grants []db.GrantKey, at time.Time) error
+	LastIssued(ctx context.Context) (map[db.GrantKey]time.Time, error)
+	TrackedSince(ctx context.Context) (time.Time, error)
+}
+
+// AccessRequestStore keeps the access requests of a permissions namespace,
+// Update changes a request atomically.
+type AccessRequestStore interface {
+	Create(ctx context.Context, req *db.AccessRequest) error
+	Get(ctx context.Context, id string) (*db.AccessRequest, error)
+	List(ctx context.Context, filter db.AccessRequestFilter) ([]*db.AccessRequest, error)
+	Update(ctx context.Context, id string, change func(req *db.AccessRequest) error) (*db.AccessRequest, error)
+}
+
+// AuditLog is the audit trail of permission changes of a namespace.
+type AuditLog interface {
+	Record(ctx context.Context, event db.AuditEvent) error
+	List(ctx context.Context, limit int) ([]db.AuditEvent, error)
+}
+
+// RateLimiter counts token requests per key, it reports when the next request
+// is allowed once the limit is reached.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
 type ControllerOpts struct {
-	Cfg  *config.Config
-	Keys *jwks.KeyPair
+	Cfg   *config.Config
+	Realm *config.Realm
+	Keys  *jwks.KeyPair
 
 	Repository Repository
+	// K8sVerifier may be shared between realms, it is created if nil.
+	K8sVerifier K8sVerifier
+	// Events is shared by the realms of a permissions namespace, it is
+	// created if nil.
+	Events *events.Broker
+	// Revocations, ReferenceTokens, RateLimiter and DPoPReplays are kept in
+	// memory of the replica if nil.
+	Revocations     RevocationList
+	ReferenceTokens ReferenceTokenStore
+	RateLimiter     RateLimiter
+	DPoPReplays     dpop.ReplayCache
+	// AccessRequests and Audit are shared by the realms of a permissions
+	// namespace, they are kept in memory of the replica if nil.
+	AccessRequests AccessRequestStore
+	Audit          AuditLog
+	// Usage and Snapshots are shared by the realms of a permissions
+	// namespace, they are kept in memory of the replica if nil.
+	Usage     GrantUsage
+	Snapshots SnapshotStore
+	// Webhooks is nil if no webhook is configured. Key rotations are only
+	// reported with a KeyHistory.
+	Webhooks   Webhooks
+	KeyHistory KeyHistory
 }
 
 type Controller struct {
 	k8sVerifier K8sVerifier
+	upstream    UpstreamVerifier
+	trusted     map[trustedKey]TrustedVerifier
 	repository  Repository
 	issuer      Issuer
+	dpop        *dpop.Verifier
+	revoked     RevocationList
+	references  ReferenceTokenStore
+	limiter     RateLimiter
+	events      *events.Broker
+	requests    AccessRequestStore
+	audit       AuditLog
+	usage       GrantUsage
+	snapshots   SnapshotStore
+	webhooks    Webhooks
+	denials     *deniedThrottle
 
-	cfg  *config.Config
-	keys *jwks.KeyPair
+	cfg   *config.Config
+	realm *config.Realm
+	keys  *jwks.KeyPair
 }
 
 func NewController(ctx context.Context, opts *ControllerOpts) (*Controller, error) {
 	cfg := opts.Cfg
+	realm := opts.Realm
 	keys := opts.Keys
 	repository := opts.Repository
 
-	issuer, err := NewIssuer(cfg, keys, repository)
+	issuer, err := NewIssuer(realm, keys, repository)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create issued: %w", err)
 	}
 
-	k8sVerifier, err := k8s.NewVerifier(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create k8s verifier: %w", err)
+	k8sVerifier := opts.K8sVerifier
+	if k8sVerifier == nil && realm.SupportsSubjectTokenType(config.TokenTypeK8s) {
+		if k8sVerifier, err = NewK8sVerifier(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var upstream UpstreamVerifier
+	if realm.Upstream != nil {
+		upstream = oidc.NewVerifier(realm.Upstream, nil)
 	}
 
-	return &Controller{
-		cfg:  cfg,
-		keys: keys,
+	trusted := make(map[trustedKey]TrustedVerifier, len(realm.TrustedIssuers))
+	for _, trustedCfg := range realm.TrustedIssuers {
+		verifier, err := oidc.NewTrustedVerifier(trustedCfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		trusted[trustedKey{tokenType: trustedCfg.SubjectTokenType, issuer: trustedCfg.Issuer}] = verifier
+	}
+
+	broker := opts.Events
+	if broker == nil {
+		broker = NewEventsBroker()
+	}
+
+	revoked := opts.Revocations
+	if revoked == nil {
+		revoked = newRevocationList()
+	}
+
+	references := opts.ReferenceTokens
+	if references == nil {
+		references = db.NewReferenceTokens()
+	}
+
+	requests := opts.AccessRequests
+	if requests == nil {
+		requests = db.NewAccessRequests()
+	}
+
+	audit := opts.Audit
+	if audit == nil {
+		audit = db.NewAuditLog()
+	}
+
+	usage := opts.Usage
+	if usage == nil {
+		usage = db.NewGrantUsage()
+	}
+
+	snapshots := opts.Snapshots
+	if snapshots == nil {
+		snapshots = db.NewSnapshots()
+	}
+
+	limiter := opts.RateLimiter
+	if limiter == nil && cfg != nil && cfg.Limits.TokenRequestsPerMinute > 0 {
+		limiter = newRateLimiter(cfg.Limits.TokenRequestsPerMinute, time.Minute)
+	}
+
+	dpopVerifier := dpop.NewVerifier(dpopProofWindow)
+	if opts.DPoPReplays != nil {
+		dpopVerifier = dpop.NewSharedVerifier(dpopProofWindow, opts.DPoPReplays)
+	}
+
+	ctl := &Controller{
+		cfg:   cfg,
+		realm: realm,
+		keys:  keys,
 
 		k8sVerifier: k8sVerifier,
+		upstream:    upstream,
+		trusted:     trusted,
 		repository:  repository,
 		issuer:      issuer,
-	}, nil
+		dpop:        dpopVerifier,
+		revoked:     revoked,
+		references:  references,
+		limiter:     limiter,
+		events:      broker,
+		requests:    requests,
+		audit:       audit,
+		usage:       usage,
+		snapshots:   snapshots,
+		webhooks:    opts.Webhooks,
+		denials:     newDeniedThrottle(deniedNotifyInterval),
+	}
+	ctl.initSnapshots(ctx)
+	if opts.KeyHistory != nil {
+		ctl.announceKey(ctx, opts.KeyHistory)
+	}
+
+	return ctl, nil
+}
+
+func NewK8sVerifier(ctx context.Context) (K8sVerifier, error) {
+	k8sVerifier, err := k8s.NewVerifier(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s verifier: %w", err)
+	}
+
+	return k8sVerifier, nil
+}
+
+func (ctl *Controller) Realm() *config.Realm {
+	return ctl.realm
 }
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+)
+
+// AuditPath lists the audit trail of the realm permissions namespace, relative
+// to the realm issuer.
+const AuditPath = "/audit"
+
+// Actions of the audit trail.
+const (
+	AuditPermissionsUpdated    = "permissions.updated"
+	AuditAccessRequestCreated  = "access_request.created"
+	AuditAccessRequestApproved = "access_request.approved"
+	AuditAccessRequestDenied   = "access_request.denied"
+	AuditAccessRequestExpired  = "access_request.expired"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// recordAudit appends the event to the audit trail. A failure is only logged,
+// the change it describes has already been made.
+func (ctl *Controller) recordAudit(ctx context.Context, event db.AuditEvent) {
+	if ctl.audit == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Realm = ctl.realm.Name
+	if err := ctl.audit.Record(ctx, event); err != nil {
+		log.Printf("failed to record audit event %+v: %v", event, err)
+	}
+}
+
+// NewAuditHandler returns the latest audit events, the newest one first. The
+// number of events is set by the limit query parameter.
+func (ctl *Controller) NewAuditHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ctl.authenticateCaller(r); err != nil {
+			respondCallerError(w, err)
+			return
+		}
+
+		limit := defaultAuditLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				respondError(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxAuditLimit)
+		}
+
+		events, err := ctl.audit.List(r.Context(), limit)
+		if err != nil {
+			log.Printf("failed to list audit events of realm %s: %v", ctl.realm.Name, err)
+			respondError(w, "audit trail is not available", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, events)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
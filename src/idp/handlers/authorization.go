@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+)
+
+var errForbidden = errors.New("caller may not change the permissions")
+
+// isAdmin reports whether the caller manages the permissions of the realm.
+func (ctl *Controller) isAdmin(c *caller) bool {
+	return slices.ContainsFunc(ctl.realm.Admins, c.is)
+}
+
+// isApprover reports whether the caller reviews access requests for the
+// scope.
+func (ctl *Controller) isApprover(c *caller, scope string) bool {
+	if ctl.realm.AccessRequests == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(ctl.realm.AccessRequests.Approvers[scope], c.is)
+}
+
+// mayGrant reports whether the caller may change the roles granted on the
+// scope, admins of the realm and approvers of the scope may.
+func (ctl *Controller) mayGrant(c *caller, scope string) bool {
+	return ctl.isAdmin(c) || ctl.isApprover(c, scope)
+}
+
+// mayReview reports whether the caller reads the permission history, admins
+// and approvers of any scope may.
+func (ctl *Controller) mayReview(c *caller) bool {
+	if ctl.isAdmin(c) {
+		return true
+	} else if ctl.realm.AccessRequests == nil {
+		return false
+	}
+
+	for _, approvers := range ctl.realm.AccessRequests.Approvers {
+		if slices.ContainsFunc(approvers, c.is) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeCaller authenticates the caller and checks it with allowed, the
+// response is written if the caller may not proceed.
+func (ctl *Controller) authorizeCaller(w http.ResponseWriter, r *http.Request, allowed func(c *caller) bool) (*caller, bool) {
+	caller, err := ctl.authenticateCaller(r)
+	if err != nil {
+		respondCallerError(w, err)
+		return nil, false
+	} else if !allowed(caller) {
+		log.Printf("%s %s refused for %s in realm %s", r.Method, r.URL.Path, caller.ID, ctl.realm.Name)
+		respondError(w, "caller is not allowed to access this resource", http.StatusForbidden)
+		return nil, false
+	}
+
+	return caller, true
+}
+
+type callerKey struct{}
+
+// withCaller keeps the authorized caller of a gRPC call for the handler, it
+// is recorded as the actor of the changes.
+func withCaller(ctx context.Context, c *caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+func callerFromContext(ctx context.Context) (*caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*caller)
+	return c, ok
+}
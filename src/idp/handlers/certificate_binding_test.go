@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/signer"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/testpki"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/verifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCertificateBoundTokens runs the IdP, a signer and a resource server
+// guarded like the postgres sidecar, each on its own TLS listener. The token
+// the signer asks to bind is accepted from its certificate only.
+func TestCertificateBoundTokens(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pki := testpki.New(t)
+	realm := testRealm()
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO"}}})
+
+	ctl, err := NewController(ctx, &ControllerOpts{
+		Realm:       realm,
+		Keys:        jwks.GenerateKeyPair(),
+		Repository:  repo,
+		K8sVerifier: workloadTokens{},
+	})
+	require.NoError(t, err)
+	tokenHandler, err := ctl.NewTokenHandler(ctx)
+	require.NoError(t, err)
+
+	prefix := "/realms/" + realm.Name
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+TokenPath, tokenHandler)
+	mux.HandleFunc("POST "+prefix+BatchTokenPath, ctl.NewBatchTokenHandler())
+	mux.HandleFunc(prefix+CertsPath, ctl.CertsHandler())
+	idp := httptest.NewUnstartedServer(mux)
+	idp.TLS = pki.ServerTLSConfig(false)
+	idp.TLS.ClientCAs = pki.CertPool()
+	idp.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	idp.StartTLS()
+	defer idp.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa:service-a"), 0o600))
+
+	tokenSigner, err := signer.NewTokenSigner(ctx, "service-a", []string{"postgres-a"}, true,
+		signer.WithIdPAddress(idp.URL),
+		signer.WithIssuer("http://idp.test"),
+		signer.WithRealm(realm.Name),
+		signer.WithCABundle(pki.CAFile),
+		signer.WithClientCertificate(pki.ClientCertFile, pki.ClientKeyFile),
+		signer.WithSubjectToken(tokenFile),
+		signer.WithCertificateBoundTokens(),
+	)
+	require.NoError(t, err)
+	defer tokenSigner.Close()
+
+	tokenVerifier, err := verifier.NewVerifier(ctx, "postgres-a", true,
+		verifier.WithIdPAddress(idp.URL),
+		verifier.WithIssuer("http://idp.test"),
+		verifier.WithRealm(realm.Name),
+		verifier.WithCABundle(pki.CAFile),
+	)
+	require.NoError(t, err)
+
+	var presented atomic.Value
+	query := verifier.VerifySQLMiddleware(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, tokenVerifier)
+	sidecar := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-S2I-Token"); token != "" {
+			presented.Store(token)
+		}
+		query(w, r)
+	}))
+	sidecar.TLS, err = verifier.ServerTLSConfig(pki.CAFile)
+	require.NoError(t, err)
+	sidecar.TLS.Certificates = []tls.Certificate{pki.ServerCert}
+	sidecar.StartTLS()
+	defer sidecar.Close()
+
+	sendQuery := func(t *testing.T, client *http.Client, token string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPost, sidecar.URL, strings.NewReader(`{"sql": "SELECT 1"}`))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("X-S2I-Token", token)
+		}
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// the signer issues its tokens in the background
+	signed := &http.Client{Transport: signer.NewAuthTransport(tokenSigner, "postgres-a")}
+	require.Eventually(t, func() bool {
+		return sendQuery(t, signed, "") == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	boundToken, _ := presented.Load().(string)
+	require.NotEmpty(t, boundToken)
+	claims, err := ctl.parseToken(boundToken)
+	require.NoError(t, err)
+	require.NotNil(t, claims.Cnf)
+	assert.NotEmpty(t, claims.Cnf.X5tS256)
+
+	otherCert, otherKey := pki.Issue(t, "service-b", x509.ExtKeyUsageClientAuth)
+	other, err := tls.X509KeyPair(otherCert, otherKey)
+	require.NoError(t, err)
+
+	for name, certs := range map[string][]tls.Certificate{
+		"other certificate": {other},
+		"no certificate":    nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      pki.CertPool(),
+				Certificates: certs,
+			}}}
+
+			assert.Equal(t, http.StatusUnauthorized, sendQuery(t, client, boundToken))
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DebugConfigPath serves the effective config, it spans the realms, so admins
+// of the default realm read it.
+const DebugConfigPath = "/debug/config"
+
+// NewDebugConfigHandler dumps the effective config in the same YAML format it
+// is loaded from, secrets are redacted.
+func (ctl *Controller) NewDebugConfigHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.isAdmin); !ok {
+			return
+		}
+
+		marshalled, err := yaml.Marshal(ctl.cfg.Redacted())
+		if err != nil {
+			respondError(w, fmt.Sprintf("failed to marshal config: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(marshalled)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
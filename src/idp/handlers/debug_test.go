@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugConfigHandler_RedactsSecrets(t *testing.T) {
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	cfg.Store.DSN = "postgres://user:secret@db/idp"
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	ctl := &Controller{cfg: cfg, realm: realm, k8sVerifier: workloadTokens{}}
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", DebugConfigPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ctl.NewDebugConfigHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	// the config lists clients, admins and endpoints of the deployment
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusForbidden, get("sa:service-a").Code)
+
+	w := get("sa:auth-ui")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "service2infra")
+	assert.Contains(t, w.Body.String(), "token_ttl: 10m0s")
+	assert.NotContains(t, w.Body.String(), "secret")
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// verifyAccessToken accepts an active access token of the realm as subject,
+// the token issued for it is downscoped: it never gets more roles or a later
+// expiry than the subject token.
+func (ctl *Controller) verifyAccessToken(ctx context.Context, rawToken string) (string, *IssueOpts, error) {
+	claims, err := ctl.tokenClaims(ctx, rawToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if ctl.revoked != nil {
+		revoked, err := ctl.revoked.IsRevoked(ctx, rawToken)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to check revocation: %w", err)
+		} else if revoked {
+			return "", nil, errors.New("access token is revoked")
+		}
+	}
+	if ctl.outdatedPermissions(claims) {
+		return "", nil, errors.New("access token has outdated permissions")
+	}
+
+	return claims.ClientID, &IssueOpts{Downscope: claims}, nil
+}
+
+// downscope narrows the roles and the lifetime of the token to the requested
+// ones. The token keeps the scope, the permissions version and the key binding
+// of the subject token, so revoking the subject permissions invalidates it too.
+func downscope(req *TokenRequest, subject *tokens.Claims, opts *IssueOpts) error {
+	if req.Scope != subject.Scope {
+		return newOAuthError(http.StatusBadRequest, errInvalidScope, "a downscoped token keeps the scope of the subject token",
+			fmt.Errorf("requested scope %q, subject token scope %q", req.Scope, subject.Scope))
+	}
+
+	roles := subject.Roles
+	if req.Roles != "" {
+		roles = uniqueFields(req.Roles)
+		for _, role := range roles {
+			if !slices.Contains(subject.Roles, role) {
+				return newOAuthError(http.StatusBadRequest, errInvalidScope, fmt.Sprintf("role %q is not granted by the subject token", role), nil)
+			}
+		}
+	}
+
+	ttl := time.Until(subject.Exp.Time())
+	if req.ExpiresIn != "" {
+		seconds, err := strconv.Atoi(req.ExpiresIn)
+		if err != nil || seconds <= 0 {
+			return newOAuthError(http.StatusBadRequest, errInvalidRequest, "expires_in must be a positive number of seconds", err)
+		}
+		ttl = min(ttl, time.Duration(seconds)*time.Second)
+	}
+	if ttl < time.Second {
+		return newOAuthError(http.StatusBadRequest, errInvalidGrant, "subject token is about to expire", nil)
+	}
+
+	if subject.Cnf != nil {
+		if !confirms(opts.Cnf, subject.Cnf) {
+			return newOAuthError(http.StatusBadRequest, errInvalidGrant, "subject token is bound to another key", nil)
+		}
+		opts.Cnf = subject.Cnf
+	}
+
+	downscoped := *subject
+	downscoped.Roles = roles
+	opts.Downscope = &downscoped
+	opts.TTL = ttl
+
+	return nil
+}
+
+// confirms reports whether the request proved possession of every key the
+// subject token is bound to.
+func confirms(request, subject *tokens.Confirmation) bool {
+	if request == nil {
+		return false
+	}
+
+	return (subject.Jkt == "" || request.Jkt == subject.Jkt) &&
+		(subject.X5tS256 == "" || request.X5tS256 == subject.X5tS256)
+}
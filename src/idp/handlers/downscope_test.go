@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDownscopeController(t *testing.T) (*Controller, *db.Repository, string) {
+	t.Helper()
+
+	realm := testRealm()
+	realm.SubjectTokenTypes = []string{k8sTokenType, accessTokenType}
+
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO", "RW"}}})
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(realm, keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+
+	ctl := &Controller{realm: realm, keys: keys, issuer: issuer, repository: repo, revoked: newRevocationList(), k8sVerifier: workloadTokens{}}
+	return ctl, repo, resp.AccessToken
+}
+
+func downscopeToken(t *testing.T, ctl *Controller, subjectToken string, params url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token_type": {accessTokenType},
+		"subject_token":      {subjectToken},
+		"scope":              {"postgres-a"},
+	}
+	for key, values := range params {
+		form[key] = values
+	}
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestTokenHandler_Downscope(t *testing.T) {
+	ctl, _, subjectToken := newDownscopeController(t)
+	subject, err := ctl.parseToken(subjectToken)
+	require.NoError(t, err)
+
+	w := downscopeToken(t, ctl, subjectToken, url.Values{"roles": {"RO"}, "expires_in": {"10"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp IssueResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, int64(10), resp.ExpiresIn)
+
+	claims, err := ctl.parseToken(resp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "service-a", claims.ClientID)
+	assert.Equal(t, "postgres-a", claims.Scope)
+	assert.Equal(t, []string{"RO"}, claims.Roles)
+	assert.Equal(t, subject.PermVer, claims.PermVer)
+	assert.NotEqual(t, subject.Jti, claims.Jti)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), claims.Exp.Time(), 2*time.Second)
+
+	// without parameters the token keeps the roles and the expiry
+	w = downscopeToken(t, ctl, resp.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var again IssueResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&again))
+	againClaims, err := ctl.parseToken(again.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"RO"}, againClaims.Roles)
+	assert.LessOrEqual(t, againClaims.Exp, claims.Exp)
+}
+
+func TestTokenHandler_DownscopeNeverExceedsSubject(t *testing.T) {
+	ctl, _, subjectToken := newDownscopeController(t)
+
+	w := downscopeToken(t, ctl, subjectToken, url.Values{"expires_in": {"3600"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp IssueResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	subject, err := ctl.parseToken(subjectToken)
+	require.NoError(t, err)
+	claims, err := ctl.parseToken(resp.AccessToken)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, claims.Exp, subject.Exp)
+	assert.Equal(t, []string{"RO", "RW"}, claims.Roles)
+
+	tests := []struct {
+		name   string
+		params url.Values
+		code   string
+	}{
+		{name: "role not in the subject token", params: url.Values{"roles": {"RO DDL"}}, code: errInvalidScope},
+		{name: "another scope", params: url.Values{"scope": {"postgres-b"}}, code: errInvalidScope},
+		{name: "invalid lifetime", params: url.Values{"expires_in": {"-5"}}, code: errInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := downscopeToken(t, ctl, subjectToken, tt.params)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var errResp OAuthErrorResp
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+			assert.Equal(t, tt.code, errResp.Error)
+		})
+	}
+}
+
+func TestTokenHandler_DownscopeInactiveSubject(t *testing.T) {
+	t.Run("revoked", func(t *testing.T) {
+		ctl, _, subjectToken := newDownscopeController(t)
+		require.Equal(t, http.StatusOK, postToken(t, ctl.RevocationHandler(), "service-a", subjectToken).Code)
+
+		assert.Equal(t, http.StatusBadRequest, downscopeToken(t, ctl, subjectToken, nil).Code)
+	})
+
+	t.Run("outdated permissions", func(t *testing.T) {
+		ctl, repo, subjectToken := newDownscopeController(t)
+		require.NoError(t, repo.UpdatePermissions("service-a", "postgres-a", []string{"RO"}))
+
+		assert.Equal(t, http.StatusBadRequest, downscopeToken(t, ctl, subjectToken, url.Values{"roles": {"RO"}}).Code)
+	})
+
+	t.Run("not accepted by the realm", func(t *testing.T) {
+		ctl, _, subjectToken := newDownscopeController(t)
+		ctl.realm.SubjectTokenTypes = []string{k8sTokenType}
+
+		assert.Equal(t, http.StatusBadRequest, downscopeToken(t, ctl, subjectToken, nil).Code)
+	})
+
+	t.Run("another realm", func(t *testing.T) {
+		ctl, repo, _ := newDownscopeController(t)
+		otherIssuer, err := NewIssuer(config.NewRealm("http://idp.test", "service2service", time.Minute), ctl.keys, repo)
+		require.NoError(t, err)
+		otherResp, err := otherIssuer.IssueToken("service-a", "postgres-a", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusBadRequest, downscopeToken(t, ctl, otherResp.AccessToken, nil).Code)
+	})
+}
+
+func TestDownscope_KeepsKeyBinding(t *testing.T) {
+	subject := &tokens.Claims{
+		Scope: "postgres-a",
+		Roles: []string{"RO", "RW"},
+		Exp:   tokens.NewNumericDate(time.Now().Add(time.Minute)),
+		Cnf:   &tokens.Confirmation{Jkt: "key-a"},
+	}
+	req := &TokenRequest{Scope: "postgres-a", Roles: "RO"}
+
+	assert.Error(t, downscope(req, subject, &IssueOpts{}))
+	assert.Error(t, downscope(req, subject, &IssueOpts{Cnf: &tokens.Confirmation{Jkt: "key-b"}}))
+
+	opts := &IssueOpts{Cnf: &tokens.Confirmation{Jkt: "key-a"}}
+	require.NoError(t, downscope(req, subject, opts))
+	assert.Equal(t, subject.Cnf, opts.Cnf)
+	assert.Equal(t, []string{"RO"}, opts.Downscope.Roles)
+	assert.Equal(t, []string{"RO", "RW"}, subject.Roles)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/events"
+)
+
+// PermissionEventsPath is the SSE stream of permission changes, relative to
+// the realm issuer.
+const PermissionEventsPath = "/permissions/events"
+
+// eventsBuffer is the number of events queued per subscriber before new ones
+// are dropped.
+const eventsBuffer = 16
+
+// eventsKeepAlive is the interval of comment lines keeping idle streams open
+// through proxies.
+var eventsKeepAlive = 15 * time.Second
+
+// NewEventsBroker creates a broker to be shared by the realms of a permissions
+// namespace.
+func NewEventsBroker() *events.Broker {
+	return events.NewBroker(eventsBuffer)
+}
+
+// NewPermissionEventsHandler streams the permission changes of the client
+// authenticated by its service account token as server-sent events. The stream
+// ends when ctx is done, so a graceful shutdown does not wait for subscribers.
+func (ctl *Controller) NewPermissionEventsHandler(ctx context.Context) http.HandlerFunc {
+	// not wrapped in baseMetricsMiddleware, streams would skew the request
+	// duration histograms
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ctl.k8sVerifier == nil || ctl.events == nil {
+			respondError(w, "permission events are not supported in this realm", http.StatusNotImplemented)
+			return
+		}
+
+		subjectToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subjectToken == "" {
+			respondError(w, "missing service account token", http.StatusUnauthorized)
+			return
+		}
+
+		clientID, _, err := ctl.k8sVerifier.VerifyWithClient(subjectToken)
+		if err != nil {
+			log.Printf("failed to verify k8s token of events subscriber: %v", err)
+			respondError(w, "service account token not verified", http.StatusUnauthorized)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		// the server write timeout would cut the stream otherwise
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+			log.Printf("failed to disable write deadline of events stream: %v", err)
+		}
+
+		subscription, cancel := ctl.events.Subscribe(clientID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": subscribed\n\n")
+		rc.Flush()
+
+		log.Printf("permission events subscribed, realm: %s, clientID: %s", ctl.realm.Name, clientID)
+		defer log.Printf("permission events unsubscribed, realm: %s, clientID: %s", ctl.realm.Name, clientID)
+
+		keepAlive := time.NewTicker(eventsKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case event, ok := <-subscription:
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("failed to marshal permission event: %v", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: permissions\ndata: %s\n\n", data)
+			}
+
+			if err := rc.Flush(); err != nil {
+				log.Printf("failed to flush events stream, clientID: %s: %v", clientID, err)
+				return
+			}
+		}
+	}
+}
+
+func (ctl *Controller) publishPermissionEvent(client, scope string, roles []string) events.PermissionEvent {
+	event := events.PermissionEvent{
+		Client: client,
+		Scope:  scope,
+		Roles:  roles,
+		Time:   time.Now(),
+	}
+	if versioned, ok := ctl.repository.(VersionedRepository); ok {
+		_, version := versioned.GetVersionedPermissions(client, scope)
+		event.Version, event.MinVersion = version.Version, version.MinVersion
+	}
+	if ctl.events == nil {
+		return event
+	}
+
+	delivered := ctl.events.Publish(event)
+	log.Printf("permission event published, clientID: %s, scope: %s, subscribers: %d", client, scope, delivered)
+
+	return event
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionEventsHandler_StreamsClientEvents(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "sa-token").Return("client1", jwt.MapClaims{}, nil)
+	k8sVerifier.On("VerifyWithClient", "admin-token").Return("auth-ui", jwt.MapClaims{}, nil)
+
+	repo := new(mockRepository)
+	repo.On("UpdatePermissions", "client1", "scope1", []string{"RW"}).Return(nil)
+	repo.On("UpdatePermissions", "client2", "scope1", []string{"RO"}).Return(nil)
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	ctl := &Controller{
+		realm:       realm,
+		k8sVerifier: k8sVerifier,
+		repository:  repo,
+		events:      NewEventsBroker(),
+	}
+
+	srv := httptest.NewServer(ctl.NewPermissionEventsHandler(context.Background()))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer sa-token")
+
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		return strings.TrimSuffix(line, "\n")
+	}
+	assert.Equal(t, ": subscribed", readLine())
+	assert.Equal(t, "", readLine())
+
+	update := ctl.NewUpdatePermissionsHandler(context.Background())
+	for _, body := range []string{
+		`{"client":"client2","scope":"scope1","roles":["RO"]}`,
+		`{"client":"client1","scope":"scope1","roles":["RW"]}`,
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/update_permissions", bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		update.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// the event of client2 is not delivered to client1
+	assert.Equal(t, "event: permissions", readLine())
+	data, ok := strings.CutPrefix(readLine(), "data: ")
+	require.True(t, ok)
+
+	var event events.PermissionEvent
+	require.NoError(t, json.Unmarshal([]byte(data), &event))
+	assert.Equal(t, "client1", event.Client)
+	assert.Equal(t, "scope1", event.Scope)
+	assert.Equal(t, []string{"RW"}, event.Roles)
+	assert.WithinDuration(t, time.Now(), event.Time, time.Minute)
+}
+
+func TestPermissionEventsHandler_EndsOnShutdown(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "sa-token").Return("client1", jwt.MapClaims{}, nil)
+
+	broker := NewEventsBroker()
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, events: broker}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/permissions/events", nil)
+	req.Header.Set("Authorization", "Bearer sa-token")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctl.NewPermissionEventsHandler(ctx).ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	require.Eventually(t, func() bool { return broker.Subscribers("client1") == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("events stream is not closed on shutdown")
+	}
+	assert.Zero(t, broker.Subscribers("client1"))
+}
+
+func TestPermissionEventsHandler_Unauthorized(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "bad-token").Return("", jwt.MapClaims{}, errors.New("invalid token"))
+
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, events: NewEventsBroker()}
+	handler := ctl.NewPermissionEventsHandler(context.Background())
+
+	for name, header := range map[string]string{
+		"missing token": "",
+		"invalid token": "Bearer bad-token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/permissions/events", nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tracing"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/idpv1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// GRPCServer serves the token and permissions APIs of the realms over gRPC.
+// Requests name their realm, the default realm is used when they don't.
+type GRPCServer struct {
+	idpv1.UnimplementedTokenServiceServer
+	idpv1.UnimplementedPermissionsServiceServer
+
+	defaultRealm string
+	realms       map[string]*Controller
+}
+
+func NewGRPCServer(defaultRealm string) *GRPCServer {
+	return &GRPCServer{
+		defaultRealm: defaultRealm,
+		realms:       make(map[string]*Controller),
+	}
+}
+
+// AddRealm serves the realm of the controller, it must be called before the
+// server starts.
+func (s *GRPCServer) AddRealm(ctl *Controller) {
+	s.realms[ctl.Realm().Name] = ctl
+}
+
+// ServerOptions returns the options the gRPC server needs, the calls are
+// traced and permission changes are authorized with them.
+func (s *GRPCServer) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(tracingInterceptor, s.authorizationInterceptor)}
+}
+
+// Register registers the services along with server reflection and health,
+// the returned health server reports the services as serving.
+func (s *GRPCServer) Register(server *grpc.Server) *health.Server {
+	idpv1.RegisterTokenServiceServer(server, s)
+	idpv1.RegisterPermissionsServiceServer(server, s)
+
+	healthServer := health.NewServer()
+	for _, service := range []string{"", idpv1.TokenService_ServiceDesc.ServiceName, idpv1.PermissionsService_ServiceDesc.ServiceName} {
+		healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	return healthServer
+}
+
+func (s *GRPCServer) ExchangeToken(ctx context.Context, req *idpv1.ExchangeTokenRequest) (*idpv1.ExchangeTokenResponse, error) {
+	ctl, err := s.controller(req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+
+	tokenReq := &TokenRequest{
+		GrantType:        req.GetGrantType(),
+		SubjectTokenType: req.GetSubjectTokenType(),
+		SubjectToken:     req.GetSubjectToken(),
+		Scope:            req.GetScope(),
+	}
+	issueResp, err := ctl.exchange(ctx, tokenReq, func() (*IssueOpts, error) {
+		return issueOptsFromPeer(ctx)
+	})
+	if err != nil {
+		return nil, exchangeStatus(err)
+	}
+
+	return &idpv1.ExchangeTokenResponse{
+		AccessToken:     issueResp.AccessToken,
+		TokenType:       issueResp.Type,
+		ExpiresAt:       issueResp.ExpiresAt.Unix(),
+		ExpiresIn:       issueResp.ExpiresIn,
+		IssuedTokenType: issueResp.IssuedTokenType,
+	}, nil
+}
+
+func (s *GRPCServer) IntrospectToken(ctx context.Context, req *idpv1.IntrospectTokenRequest) (*idpv1.IntrospectTokenResponse, error) {
+	ctl, err := s.controller(req.GetRealm())
+	if err != nil {
+		return nil, err
+	} else if req.GetToken() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token must not be empty")
+	}
+
+	caller, err := ctl.authenticateClient(ctx, authorizationFromMetadata(ctx))
+	if err != nil {
+		log.Printf("failed to authenticate introspection caller in realm %s: %v", ctl.realm.Name, err)
+		return nil, status.Error(codes.Unauthenticated, "client authentication failed")
+	}
+
+	resp, err := ctl.introspect(ctx, caller, req.GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, errTokenStateUnavailable.Error())
+	}
+
+	introspectResp := &idpv1.IntrospectTokenResponse{
+		Active:    resp.Active,
+		Scope:     resp.Scope,
+		ClientId:  resp.ClientID,
+		TokenType: resp.TokenType,
+		Exp:       resp.Exp,
+		Iat:       resp.Iat,
+		Sub:       resp.Sub,
+		Aud:       resp.Aud,
+		Iss:       resp.Iss,
+		Roles:     resp.Roles,
+	}
+	if resp.Cnf != nil {
+		introspectResp.Cnf = &idpv1.Confirmation{X5TS256: resp.Cnf.X5tS256, Jkt: resp.Cnf.Jkt}
+	}
+
+	return introspectResp, nil
+}
+
+func (s *GRPCServer) GetPermissions(ctx context.Context, req *idpv1.GetPermissionsRequest) (*idpv1.GetPermissionsResponse, error) {
+	ctl, err := s.controller(req.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+
+	return &idpv1.GetPermissionsResponse{Roles: ctl.repository.GetPermissions(req.GetClient(), req.GetScope())}, nil
+}
+
+func (s *GRPCServer) UpdatePermissions(ctx context.Context, req *idpv1.UpdatePermissionsRequest) (*idpv1.UpdatePermissionsResponse, error) {
+	ctl, err := s.controller(req.GetRealm())
+	if err != nil {
+		return nil, err
+	} else if err := validatePermissionsTarget(req.GetClient(), req.GetScope()); err != nil {
+		return nil, err
+	}
+
+	roles := req.GetRoles()
+	if roles == nil {
+		roles = []string{}
+	}
+	caller, _ := callerFromContext(ctx)
+	if err := ctl.updatePermissions(ctx, caller.ID, req.GetClient(), req.GetScope(), roles); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update permissions: %v", err)
+	}
+
+	return &idpv1.UpdatePermissionsResponse{}, nil
+}
+
+func (s *GRPCServer) DeletePermissions(ctx context.Context, req *idpv1.DeletePermissionsRequest) (*idpv1.DeletePermissionsResponse, error) {
+	ctl, err := s.controller(req.GetRealm())
+	if err != nil {
+		return nil, err
+	} else if err := validatePermissionsTarget(req.GetClient(), req.GetScope()); err != nil {
+		return nil, err
+	}
+
+	caller, _ := callerFromContext(ctx)
+	if err := ctl.updatePermissions(ctx, caller.ID, req.GetClient(), req.GetScope(), []string{}); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete permissions: %v", err)
+	}
+
+	return &idpv1.DeletePermissionsResponse{}, nil
+}
+
+func (s *GRPCServer) controller(realm string) (*Controller, error) {
+	if realm == "" {
+		realm = s.defaultRealm
+	}
+
+	ctl, ok := s.realms[realm]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown realm %q", realm)
+	}
+
+	return ctl, nil
+}
+
+func validatePermissionsTarget(client, scope string) error {
+	if client == "" || scope == "" {
+		return status.Error(codes.InvalidArgument, "client and scope must not be empty")
+	}
+
+	return nil
+}
+
+// authorizationFromMetadata returns the authorization metadata of the call,
+// it carries the bearer token like the Authorization header does over HTTP.
+func authorizationFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// bindCertificateMetadata opts a gRPC exchange in to a certificate-bound
+// token, like the bind_certificate parameter of the token endpoint.
+const bindCertificateMetadata = "bind-certificate"
+
+// issueOptsFromPeer binds the token to the client certificate when the client
+// asks for it over mTLS (RFC 8705). DPoP proofs cover an HTTP method and URL,
+// so they are not accepted over gRPC.
+func issueOptsFromPeer(ctx context.Context) (*IssueOpts, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(bindCertificateMetadata); len(values) == 0 || values[0] != "true" {
+		return &IssueOpts{}, nil
+	}
+
+	var peerCerts []*x509.Certificate
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			peerCerts = tlsInfo.State.PeerCertificates
+		}
+	}
+	cnf, err := certificateConfirmation(peerCerts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssueOpts{Cnf: cnf}, nil
+}
+
+// exchangeStatus reports the OAuth error of a failed exchange as the status
+// message, the cause is only logged like on the token endpoint.
+func exchangeStatus(err error) error {
+	var oauthErr *oauthError
+	if !errors.As(err, &oauthErr) {
+		return status.Error(codes.Internal, errServerError)
+	}
+
+	code := codes.InvalidArgument
+	switch oauthErr.code {
+	case errInvalidGrant:
+		code = codes.Unauthenticated
+	case errUnauthorizedClient:
+		code = codes.PermissionDenied
+	case errSlowDown:
+		code = codes.ResourceExhausted
+	case errServerError:
+		code = codes.Internal
+	}
+
+	st := status.New(code, oauthErr.code+": "+oauthErr.description)
+	if oauthErr.retryAfter > 0 {
+		withRetry, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(oauthErr.retryAfter)})
+		if err != nil {
+			log.Printf("failed to attach retry info: %v", err)
+		} else {
+			st = withRetry
+		}
+	}
+
+	return st.Err()
+}
+
+// permissionsWrites are the calls changing grants, they are authorized by
+// authorizationInterceptor.
+var permissionsWrites = map[string]bool{
+	idpv1.PermissionsService_UpdatePermissions_FullMethodName: true,
+	idpv1.PermissionsService_DeletePermissions_FullMethodName: true,
+}
+
+// permissionsTarget is the realm and scope of a permissions write.
+type permissionsTarget interface {
+	GetRealm() string
+	GetScope() string
+}
+
+// authorizationInterceptor lets admins of the realm and approvers of the scope
+// change grants, they authenticate by a bearer token in the authorization
+// metadata.
+func (s *GRPCServer) authorizationInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !permissionsWrites[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	target, ok := req.(permissionsTarget)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "no permissions target in %s", info.FullMethod)
+	}
+	ctl, err := s.controller(target.GetRealm())
+	if err != nil {
+		return nil, err
+	}
+
+	caller, err := ctl.authenticateBearer(ctx, authorizationFromMetadata(ctx))
+	if err != nil {
+		log.Printf("failed to authenticate %s caller in realm %s: %v", info.FullMethod, ctl.realm.Name, err)
+		return nil, status.Error(codes.Unauthenticated, "caller is not authenticated")
+	} else if !ctl.mayGrant(caller, target.GetScope()) {
+		log.Printf("%s on scope %s refused for %s in realm %s", info.FullMethod, target.GetScope(), caller.ID, ctl.realm.Name)
+		return nil, status.Error(codes.PermissionDenied, "only admins and approvers of the scope may change permissions")
+	}
+
+	return handler(withCaller(ctx, caller), req)
+}
+
+func tracingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, span := tracing.StartRPCSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	tracing.End(span, err)
+
+	return resp, err
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/idpv1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the controllers over an in-memory listener.
+func dialGRPC(t *testing.T, controllers ...*Controller) *grpc.ClientConn {
+	t.Helper()
+
+	api := NewGRPCServer(testRealm().Name)
+	for _, ctl := range controllers {
+		api.AddRealm(ctl)
+	}
+
+	server := grpc.NewServer(api.ServerOptions()...)
+	api.Register(server)
+
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPCServer_ExchangeToken(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+	k8sVerifier.On("VerifyWithClient", "invalid-token").Return("", testClaims{}, errors.New("invalid token"))
+
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(
+		&IssueResp{AccessToken: "token123", Type: "Bearer", ExpiresIn: 60, ExpiresAt: expiresAt}, nil,
+	)
+
+	client := idpv1.NewTokenServiceClient(dialGRPC(t, &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		issuer:      issuer,
+	}))
+
+	resp, err := client.ExchangeToken(context.Background(), &idpv1.ExchangeTokenRequest{
+		GrantType:        grantTypeTokenExchange,
+		SubjectTokenType: k8sTokenType,
+		SubjectToken:     "valid-token",
+		Scope:            "scope1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "token123", resp.GetAccessToken())
+	assert.Equal(t, "Bearer", resp.GetTokenType())
+	assert.Equal(t, expiresAt.Unix(), resp.GetExpiresAt())
+	assert.Equal(t, int64(60), resp.GetExpiresIn())
+
+	_, err = client.ExchangeToken(context.Background(), &idpv1.ExchangeTokenRequest{
+		GrantType:        grantTypeTokenExchange,
+		SubjectTokenType: k8sTokenType,
+		SubjectToken:     "invalid-token",
+		Scope:            "scope1",
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, "invalid_grant: subject token is invalid or expired", status.Convert(err).Message())
+
+	_, err = client.ExchangeToken(context.Background(), &idpv1.ExchangeTokenRequest{
+		GrantType: "client_credentials",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "unsupported_grant_type: grant type is not supported by the realm", status.Convert(err).Message())
+
+	// a bound token needs the client certificate of the call
+	_, err = client.ExchangeToken(metadata.AppendToOutgoingContext(context.Background(), bindCertificateMetadata, "true"), &idpv1.ExchangeTokenRequest{
+		GrantType:        grantTypeTokenExchange,
+		SubjectTokenType: k8sTokenType,
+		SubjectToken:     "valid-token",
+		Scope:            "scope1",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "invalid_request: bind_certificate requires a client certificate", status.Convert(err).Message())
+
+	_, err = client.ExchangeToken(context.Background(), &idpv1.ExchangeTokenRequest{Realm: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	issuer.AssertExpectations(t)
+}
+
+func TestGRPCServer_ExchangeToken_RateLimited(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(&IssueResp{AccessToken: "token123"}, nil)
+
+	client := idpv1.NewTokenServiceClient(dialGRPC(t, &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		issuer:      issuer,
+		limiter:     newRateLimiter(1, time.Minute),
+	}))
+
+	req := &idpv1.ExchangeTokenRequest{
+		GrantType:        grantTypeTokenExchange,
+		SubjectTokenType: k8sTokenType,
+		SubjectToken:     "valid-token",
+		Scope:            "scope1",
+	}
+	_, err := client.ExchangeToken(context.Background(), req)
+	require.NoError(t, err)
+
+	_, err = client.ExchangeToken(context.Background(), req)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, "slow_down: too many token requests, retry later", st.Message())
+
+	require.Len(t, st.Details(), 1)
+	retryInfo, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.Positive(t, retryInfo.GetRetryDelay().AsDuration())
+}
+
+func TestGRPCServer_IntrospectToken(t *testing.T) {
+	ctl, token := newIntrospectionController(t, testRealm())
+	client := idpv1.NewTokenServiceClient(dialGRPC(t, ctl))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer sa:postgres-a")
+
+	_, err := client.IntrospectToken(context.Background(), &idpv1.IntrospectTokenRequest{Token: token})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	resp, err := client.IntrospectToken(ctx, &idpv1.IntrospectTokenRequest{Token: token})
+	require.NoError(t, err)
+	assert.True(t, resp.GetActive())
+	assert.Equal(t, "service-a", resp.GetClientId())
+	assert.Equal(t, "postgres-a", resp.GetScope())
+	assert.Equal(t, []string{"RO"}, resp.GetRoles())
+
+	resp, err = client.IntrospectToken(ctx, &idpv1.IntrospectTokenRequest{Token: "garbage"})
+	require.NoError(t, err)
+	assert.False(t, resp.GetActive())
+
+	_, err = client.IntrospectToken(context.Background(), &idpv1.IntrospectTokenRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCServer_Permissions(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("UpdatePermissions", "client1", "scope1", []string{"RO", "RW"}).Return(nil).Once()
+	repo.On("UpdatePermissions", "client1", "scope1", []string{}).Return(nil).Once()
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO", "RW"})
+
+	broker := NewEventsBroker()
+	received, unsubscribe := broker.Subscribe("client1")
+	defer unsubscribe()
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	client := idpv1.NewPermissionsServiceClient(dialGRPC(t, &Controller{
+		realm:       realm,
+		repository:  repo,
+		events:      broker,
+		k8sVerifier: workloadTokens{},
+	}))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer sa:auth-ui")
+
+	_, err := client.UpdatePermissions(ctx, &idpv1.UpdatePermissionsRequest{
+		Client: "client1",
+		Scope:  "scope1",
+		Roles:  []string{"RO", "RW"},
+	})
+	require.NoError(t, err)
+
+	resp, err := client.GetPermissions(context.Background(), &idpv1.GetPermissionsRequest{Client: "client1", Scope: "scope1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"RO", "RW"}, resp.GetRoles())
+
+	_, err = client.DeletePermissions(ctx, &idpv1.DeletePermissionsRequest{Client: "client1", Scope: "scope1"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"RO", "RW"}, (<-received).Roles)
+	assert.Empty(t, (<-received).Roles)
+
+	_, err = client.UpdatePermissions(ctx, &idpv1.UpdatePermissionsRequest{Client: "client1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	repo.AssertExpectations(t)
+}
+
+func TestGRPCServer_PermissionsAuthorization(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("UpdatePermissions", "client1", "postgres-a", []string{"RO"}).Return(nil).Once()
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	realm.AccessRequests = &config.AccessRequestsConfig{Approvers: map[string][]string{"postgres-a": {"dba"}}}
+	client := idpv1.NewPermissionsServiceClient(dialGRPC(t, &Controller{
+		realm:       realm,
+		repository:  repo,
+		events:      NewEventsBroker(),
+		k8sVerifier: workloadTokens{},
+	}))
+	as := func(caller string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer sa:"+caller)
+	}
+
+	for name, tt := range map[string]struct {
+		ctx   context.Context
+		scope string
+		code  codes.Code
+	}{
+		"anonymous":           {ctx: context.Background(), scope: "postgres-a", code: codes.Unauthenticated},
+		"invalid token":       {ctx: metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer forged"), scope: "postgres-a", code: codes.Unauthenticated},
+		"workload":            {ctx: as("client1"), scope: "postgres-a", code: codes.PermissionDenied},
+		"approver elsewhere":  {ctx: as("dba"), scope: "postgres-b", code: codes.PermissionDenied},
+		"approver of a scope": {ctx: as("dba"), scope: "postgres-a", code: codes.OK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := client.UpdatePermissions(tt.ctx, &idpv1.UpdatePermissionsRequest{Client: "client1", Scope: tt.scope, Roles: []string{"RO"}})
+			assert.Equal(t, tt.code, status.Code(err))
+
+			_, err = client.DeletePermissions(tt.ctx, &idpv1.DeletePermissionsRequest{Client: "client1", Scope: "postgres-b"})
+			if tt.code != codes.Unauthenticated {
+				assert.Equal(t, codes.PermissionDenied, status.Code(err))
+			} else {
+				assert.Equal(t, codes.Unauthenticated, status.Code(err))
+			}
+		})
+	}
+
+	repo.AssertExpectations(t)
+}
+
+func TestGRPCServer_Health(t *testing.T) {
+	client := healthpb.NewHealthClient(dialGRPC(t, &Controller{realm: testRealm()}))
+
+	for _, service := range []string{"", "idp.v1.TokenService", "idp.v1.PermissionsService"} {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus(), service)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck reports whether a dependency can serve requests.
+type HealthCheck func(ctx context.Context) error
+
+// readinessChecker is implemented by dependencies that can become unavailable
+// at runtime, like the k8s JWKS or a remote permission store.
+type readinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+type Health struct {
+	mu     sync.RWMutex
+	checks map[string]HealthCheck
+
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+type HealthResp struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{
+		checks:  make(map[string]HealthCheck),
+		timeout: timeout,
+	}
+}
+
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[name] = check
+}
+
+func (h *Health) AddChecks(checks map[string]HealthCheck) {
+	for name, check := range checks {
+		h.AddCheck(name, check)
+	}
+}
+
+// SetShuttingDown makes readiness fail, so the pod is removed from the
+// Service endpoints while in-flight requests are drained.
+func (h *Health) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+// Check runs all checks concurrently and returns the error of every failed
+// one. Checks still running when ctx is done fail with its error.
+func (h *Health) Check(ctx context.Context) map[string]error {
+	h.mu.RLock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	done := make(chan result, len(checks))
+	for name, check := range checks {
+		go func() {
+			done <- result{name: name, err: check(ctx)}
+		}()
+	}
+
+	results := make(map[string]error, len(checks))
+	for range checks {
+		select {
+		case r := <-done:
+			results[r.name] = r.err
+		case <-ctx.Done():
+			for name := range checks {
+				if _, ok := results[name]; !ok {
+					results[name] = ctx.Err()
+				}
+			}
+			return results
+		}
+	}
+
+	return results
+}
+
+func (h *Health) NewLivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		respondHealth(w, http.StatusOK, HealthResp{Status: "ok"})
+	}
+}
+
+func (h *Health) NewReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.shuttingDown.Load() {
+			respondHealth(w, http.StatusServiceUnavailable, HealthResp{Status: "shutting_down"})
+			return
+		}
+
+		results := h.Check(r.Context())
+
+		resp := HealthResp{Status: "ok", Checks: make(map[string]string, len(results))}
+		code := http.StatusOK
+		names := make([]string, 0, len(results))
+		for name := range results {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			err := results[name]
+			if err == nil {
+				resp.Checks[name] = "ok"
+				continue
+			}
+
+			log.Printf("readiness check %s failed: %v", name, err)
+			resp.Checks[name] = err.Error()
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+
+		respondHealth(w, code, resp)
+	}
+}
+
+// ReadinessChecks returns the checks of the realm dependencies: key material,
+// the subject token verifier and the permission repository.
+func (ctl *Controller) ReadinessChecks() map[string]HealthCheck {
+	prefix := "realm/" + ctl.realm.Name + "/"
+
+	checks := map[string]HealthCheck{
+		prefix + "keys": func(_ context.Context) error {
+			return ctl.checkKeys()
+		},
+		prefix + "repository": func(ctx context.Context) error {
+			return checkReady(ctx, ctl.repository)
+		},
+	}
+	if ctl.k8sVerifier != nil {
+		checks[prefix+"subject_verifier"] = func(ctx context.Context) error {
+			return checkReady(ctx, ctl.k8sVerifier)
+		}
+	}
+	if ctl.upstream != nil {
+		checks[prefix+"upstream_verifier"] = func(ctx context.Context) error {
+			return checkReady(ctx, ctl.upstream)
+		}
+	}
+	for _, trustedCfg := range ctl.realm.TrustedIssuers {
+		trusted := ctl.trusted[trustedKey{tokenType: trustedCfg.SubjectTokenType, issuer: trustedCfg.Issuer}]
+		checks[prefix+"trusted_issuer/"+trustedCfg.Name] = func(ctx context.Context) error {
+			return checkReady(ctx, trusted)
+		}
+	}
+
+	return checks
+}
+
+func (ctl *Controller) checkKeys() error {
+	if ctl.keys == nil || ctl.keys.PrivateKey == nil {
+		return errors.New("no signing key")
+	} else if ctl.keys.Certificate == nil {
+		return errors.New("no signing certificate")
+	} else if now := time.Now(); now.After(ctl.keys.Certificate.NotAfter) {
+		return fmt.Errorf("signing certificate expired at %s", ctl.keys.Certificate.NotAfter)
+	}
+
+	return nil
+}
+
+func checkReady(ctx context.Context, dependency any) error {
+	if dependency == nil {
+		return errors.New("not configured")
+	}
+
+	checker, ok := dependency.(readinessChecker)
+	if !ok {
+		return nil
+	}
+
+	return checker.Ready(ctx)
+}
+
+func respondHealth(w http.ResponseWriter, code int, resp HealthResp) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
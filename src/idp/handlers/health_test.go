@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type readyRepository struct {
+	mockRepository
+	err error
+}
+
+func (r *readyRepository) Ready(_ context.Context) error {
+	return r.err
+}
+
+func serveHealth(t *testing.T, handler http.HandlerFunc) (int, HealthResp) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var resp HealthResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return w.Code, resp
+}
+
+func TestHealth_Liveness(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.AddCheck("broken", func(_ context.Context) error { return errors.New("down") })
+
+	code, resp := serveHealth(t, health.NewLivenessHandler())
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp.Status)
+}
+
+func TestHealth_ReadinessOK(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.AddCheck("a", func(_ context.Context) error { return nil })
+	health.AddCheck("b", func(_ context.Context) error { return nil })
+
+	code, resp := serveHealth(t, health.NewReadinessHandler())
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"a": "ok", "b": "ok"}, resp.Checks)
+}
+
+func TestHealth_ReadinessFailedCheck(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.AddCheck("a", func(_ context.Context) error { return nil })
+	health.AddCheck("b", func(_ context.Context) error { return errors.New("jwks unavailable") })
+
+	code, resp := serveHealth(t, health.NewReadinessHandler())
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", resp.Status)
+	assert.Equal(t, "jwks unavailable", resp.Checks["b"])
+}
+
+func TestHealth_ReadinessTimeout(t *testing.T) {
+	health := NewHealth(10 * time.Millisecond)
+	health.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, resp := serveHealth(t, health.NewReadinessHandler())
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, resp.Checks["slow"], "deadline exceeded")
+}
+
+func TestHealth_CheckIgnoringContext(t *testing.T) {
+	health := NewHealth(10 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	health.AddCheck("stuck", func(_ context.Context) error {
+		<-release
+		return nil
+	})
+	health.AddCheck("a", func(_ context.Context) error { return nil })
+
+	results := health.Check(context.Background())
+
+	assert.ErrorIs(t, results["stuck"], context.DeadlineExceeded)
+	assert.NoError(t, results["a"])
+}
+
+func TestHealth_ReadinessShuttingDown(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.SetShuttingDown()
+
+	code, resp := serveHealth(t, health.NewReadinessHandler())
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "shutting_down", resp.Status)
+}
+
+func TestController_ReadinessChecks(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	repo := &readyRepository{err: errors.New("store unavailable")}
+
+	ctl := &Controller{
+		realm:       testRealm(),
+		keys:        jwks.GenerateKeyPair(),
+		repository:  repo,
+		k8sVerifier: k8sVerifier,
+	}
+
+	checks := ctl.ReadinessChecks()
+	require.Len(t, checks, 3)
+
+	ctx := context.Background()
+	assert.NoError(t, checks["realm/service2infra/keys"](ctx))
+	assert.NoError(t, checks["realm/service2infra/subject_verifier"](ctx))
+	assert.EqualError(t, checks["realm/service2infra/repository"](ctx), "store unavailable")
+}
+
+func TestController_ReadinessChecks_ExpiredKeys(t *testing.T) {
+	keys := jwks.GenerateKeyPair()
+	keys.Certificate.NotAfter = time.Now().Add(-time.Hour)
+
+	ctl := &Controller{realm: testRealm(), keys: keys, repository: new(mockRepository)}
+
+	err := ctl.ReadinessChecks()["realm/service2infra/keys"](context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// IntrospectionResp is the RFC 7662 response, only Active is set for tokens
+// which are invalid, expired or revoked.
+type IntrospectionResp struct {
+	Active    bool                 `json:"active"`
+	Scope     string               `json:"scope,omitempty"`
+	ClientID  string               `json:"client_id,omitempty"`
+	TokenType string               `json:"token_type,omitempty"`
+	Exp       int64                `json:"exp,omitempty"`
+	Iat       int64                `json:"iat,omitempty"`
+	Nbf       int64                `json:"nbf,omitempty"`
+	Jti       string               `json:"jti,omitempty"`
+	Sub       string               `json:"sub,omitempty"`
+	Aud       string               `json:"aud,omitempty"`
+	Iss       string               `json:"iss,omitempty"`
+	Roles     []string             `json:"roles,omitempty"`
+	PermVer   int64                `json:"perm_ver,omitempty"`
+	Cnf       *tokens.Confirmation `json:"cnf,omitempty"`
+}
+
+// revocationList keeps revoked tokens until they expire on their own.
+type revocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{revoked: make(map[string]time.Time)}
+}
+
+func (l *revocationList) Revoke(_ context.Context, rawToken string, exp time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, keyExp := range l.revoked {
+		if now.After(keyExp) {
+			delete(l.revoked, key)
+		}
+	}
+	l.revoked[db.TokenKey(rawToken)] = exp
+
+	return nil
+}
+
+func (l *revocationList) IsRevoked(_ context.Context, rawToken string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.revoked[db.TokenKey(rawToken)]
+	return ok, nil
+}
+
+// authenticateClient authenticates the caller of the introspection and
+// revocation endpoints by its bearer token.
+func (ctl *Controller) authenticateClient(ctx context.Context, authorization string) (*caller, error) {
+	caller, err := ctl.authenticateBearer(ctx, authorization)
+	if err != nil {
+		return nil, newOAuthError(http.StatusUnauthorized, errInvalidClient, "client authentication failed", err)
+	}
+
+	return caller, nil
+}
+
+// IntrospectionHandler reports whether a token issued in the realm is active.
+// Only a resource server the token is issued for learns that it is active
+// (RFC 7662 section 2.1).
+func (ctl *Controller) IntrospectionHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, err := ctl.authenticateClient(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			log.Printf("failed to authenticate introspection caller in realm %s: %v", ctl.realm.Name, err)
+			writeOAuthError(w, err)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil || r.PostFormValue("token") == "" {
+			log.Printf("invalid introspection request: %v", err)
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, errInvalidRequest, "token is required", err))
+			return
+		}
+
+		resp, err := ctl.introspect(r.Context(), caller, r.PostFormValue("token"))
+		if err != nil {
+			writeOAuthError(w, newOAuthError(http.StatusInternalServerError, errServerError, errTokenStateUnavailable.Error(), err))
+			return
+		}
+
+		writeNoStoreJSON(w, http.StatusOK, resp)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// introspect is shared by the HTTP and gRPC introspection endpoints, errors
+// are only returned when the revocation list or the reference tokens are not
+// available. Tokens of other audiences than the caller are reported inactive.
+func (ctl *Controller) introspect(ctx context.Context, caller *caller, rawToken string) (IntrospectionResp, error) {
+	claims, err := ctl.tokenClaims(ctx, rawToken)
+	if errors.Is(err, errTokenStateUnavailable) {
+		log.Printf("failed to resolve reference token in realm %s: %v", ctl.realm.Name, err)
+		return IntrospectionResp{}, err
+	} else if err != nil {
+		log.Printf("introspected token is not active in realm %s: %v", ctl.realm.Name, err)
+		return IntrospectionResp{Active: false}, nil
+	}
+
+	if claims.Aud != caller.ID {
+		log.Printf("introspection of a token for %s by %s refused in realm %s", claims.Aud, caller.ID, ctl.realm.Name)
+		return IntrospectionResp{Active: false}, nil
+	}
+
+	revoked, err := ctl.revoked.IsRevoked(ctx, rawToken)
+	if err != nil {
+		log.Printf("failed to check revocation in realm %s: %v", ctl.realm.Name, err)
+		return IntrospectionResp{}, err
+	} else if revoked {
+		log.Printf("introspected token is revoked in realm %s, clientID: %s", ctl.realm.Name, claims.ClientID)
+		return IntrospectionResp{Active: false}, nil
+	}
+
+	if ctl.outdatedPermissions(claims) {
+		log.Printf("introspected token has outdated permissions in realm %s, clientID: %s, scope: %s", ctl.realm.Name, claims.ClientID, claims.Scope)
+		return IntrospectionResp{Active: false}, nil
+	}
+
+	return introspectionResp(claims), nil
+}
+
+// outdatedPermissions reports whether roles of the token were removed from its
+// client or from a group client it inherited them from after it had been
+// issued.
+func (ctl *Controller) outdatedPermissions(claims *tokens.Claims) bool {
+	versioned, ok := ctl.repository.(VersionedRepository)
+	if !ok {
+		return false
+	}
+
+	if _, version := versioned.GetVersionedPermissions(claims.ClientID, claims.Scope); claims.PermVer < version.MinVersion {
+		return true
+	}
+	for group, groupVersion := range claims.GroupPermVer {
+		if _, version := versioned.GetVersionedPermissions(group, claims.Scope); groupVersion < version.MinVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RevocationHandler revokes a token issued in the realm (RFC 7009). Unknown
+// and invalid tokens are answered with success as well, a token may only be
+// revoked by the client it was issued to. Encrypted tokens are not supported.
+func (ctl *Controller) RevocationHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, err := ctl.authenticateClient(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			log.Printf("failed to authenticate revocation caller in realm %s: %v", ctl.realm.Name, err)
+			writeOAuthError(w, err)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil || r.PostFormValue("token") == "" {
+			log.Printf("invalid revocation request: %v", err)
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, errInvalidRequest, "token is required", err))
+			return
+		}
+
+		rawToken := r.PostFormValue("token")
+		if isEncryptedToken(rawToken) {
+			log.Printf("revocation of an encrypted token refused in realm %s", ctl.realm.Name)
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, errUnsupportedTokenType, "encrypted tokens cannot be revoked", nil))
+			return
+		}
+
+		claims, err := ctl.tokenClaims(r.Context(), rawToken)
+		if errors.Is(err, errTokenStateUnavailable) {
+			log.Printf("failed to resolve revoked reference token in realm %s: %v", ctl.realm.Name, err)
+			writeOAuthError(w, newOAuthError(http.StatusInternalServerError, errServerError, "failed to revoke token", err))
+			return
+		} else if err != nil {
+			log.Printf("ignoring revocation of a token not active in realm %s: %v", ctl.realm.Name, err)
+			return
+		}
+
+		if !caller.is(claims.ClientID) {
+			log.Printf("revocation of a token of %s by %s refused in realm %s", claims.ClientID, caller.ID, ctl.realm.Name)
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, errUnauthorizedClient, "token was not issued to the client", nil))
+			return
+		}
+
+		if err := ctl.revoked.Revoke(r.Context(), rawToken, claims.Exp.Time()); err != nil {
+			log.Printf("failed to revoke token in realm %s: %v", ctl.realm.Name, err)
+			writeOAuthError(w, newOAuthError(http.StatusInternalServerError, errServerError, "failed to revoke token", err))
+			return
+		}
+		log.Printf("token revoked, realm: %s, clientID: %s, scope: %s", ctl.realm.Name, claims.ClientID, claims.Scope)
+		ctl.notify(config.WebhookEventTokenRevoked, TokenRevokedEvent{
+			ClientID:  claims.ClientID,
+			Scope:     claims.Scope,
+			JTI:       claims.Jti,
+			ExpiresAt: claims.Exp.Time(),
+		})
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// parseToken returns the claims of a token signed with the realm key, which
+// has not expired yet.
+func (ctl *Controller) parseToken(rawToken string) (*tokens.Claims, error) {
+	jws, err := jose.ParseSigned(rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	payload, err := jws.Verify(ctl.keys.PrivateKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token signature: %w", err)
+	}
+
+	var claims tokens.Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token claims: %w", err)
+	}
+
+	if claims.Iss != ctl.realm.Issuer {
+		return nil, fmt.Errorf("unexpected issuer: %s", claims.Iss)
+	} else if time.Now().After(claims.Exp.Time()) {
+		return nil, errors.New("token is expired")
+	} else if claims.Nbf != 0 && time.Now().Before(claims.Nbf.Time()) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	return &claims, nil
+}
+
+func introspectionResp(claims *tokens.Claims) IntrospectionResp {
+	tokenType := "Bearer"
+	if claims.Cnf != nil && claims.Cnf.Jkt != "" {
+		tokenType = dpop.TokenType
+	}
+
+	return IntrospectionResp{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: tokenType,
+		Exp:       int64(claims.Exp),
+		Iat:       int64(claims.Iat),
+		Nbf:       int64(claims.Nbf),
+		Jti:       claims.Jti,
+		Sub:       claims.Sub,
+		Aud:       claims.Aud,
+		Iss:       claims.Iss,
+		Roles:     claims.Roles,
+		PermVer:   claims.PermVer,
+		Cnf:       claims.Cnf,
+	}
+}
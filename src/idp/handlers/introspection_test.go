@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newIntrospectionController(t *testing.T, realm *config.Realm) (*Controller, string) {
+	t.Helper()
+
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "service-a", "postgres-a").Return([]string{"RO"})
+
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(realm, keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+
+	return &Controller{realm: realm, keys: keys, issuer: issuer, revoked: newRevocationList(), k8sVerifier: workloadTokens{}}, resp.AccessToken
+}
+
+// workloadTokens authenticates the service account token "sa:<client>" as the
+// workload of the client.
+type workloadTokens struct{}
+
+func (workloadTokens) VerifyWithClient(token string) (string, jwt.Claims, error) {
+	clientID, ok := strings.CutPrefix(token, "sa:")
+	if !ok {
+		return "", nil, errors.New("invalid service account token")
+	}
+	return clientID, jwt.MapClaims{}, nil
+}
+
+// postToken calls the introspection or revocation handler as the workload of
+// the client, no credentials are sent when the client is empty.
+func postToken(t *testing.T, handler http.HandlerFunc, client, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form := url.Values{}
+	form.Set("token", token)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if client != "" {
+		req.Header.Set("Authorization", "Bearer sa:"+client)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func introspect(t *testing.T, ctl *Controller, token string) IntrospectionResp {
+	t.Helper()
+
+	w := postToken(t, ctl.IntrospectionHandler(), "postgres-a", token)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var resp IntrospectionResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return resp
+}
+
+func TestIntrospectionHandler_ActiveToken(t *testing.T) {
+	ctl, token := newIntrospectionController(t, testRealm())
+
+	resp := introspect(t, ctl, token)
+
+	assert.True(t, resp.Active)
+	assert.Equal(t, "postgres-a", resp.Scope)
+	assert.Equal(t, "service-a", resp.ClientID)
+	assert.Equal(t, "Bearer", resp.TokenType)
+	assert.Equal(t, []string{"RO"}, resp.Roles)
+	assert.Equal(t, testRealm().Issuer, resp.Iss)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), time.Unix(resp.Exp, 0), 2*time.Second)
+}
+
+func TestIntrospectionHandler_InactiveToken(t *testing.T) {
+	ctl, _ := newIntrospectionController(t, testRealm())
+	_, foreignToken := newIntrospectionController(t, testRealm())
+
+	expiredRealm := testRealm()
+	expiredRealm.TokenTTL = -time.Minute
+	_, expiredToken := newIntrospectionController(t, expiredRealm)
+
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "service-a", "postgres-a").Return([]string{"RO"})
+	otherRealmIssuer, err := NewIssuer(config.NewRealm("http://idp.test", "service2service", time.Minute), ctl.keys, repo)
+	require.NoError(t, err)
+	otherRealmResp, err := otherRealmIssuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+
+	for name, token := range map[string]string{
+		"garbage":       "not-a-token",
+		"foreign key":   foreignToken,
+		"expired":       expiredToken,
+		"another realm": otherRealmResp.AccessToken,
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, IntrospectionResp{Active: false}, introspect(t, ctl, token))
+		})
+	}
+}
+
+func TestIntrospectionHandler_OutdatedPermissions(t *testing.T) {
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO", "RW"}}})
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(testRealm(), keys, repo)
+	require.NoError(t, err)
+	ctl := &Controller{realm: testRealm(), keys: keys, issuer: issuer, repository: repo, revoked: newRevocationList(), k8sVerifier: workloadTokens{}}
+
+	broad, err := issuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+
+	// granting more roles keeps the issued tokens valid
+	require.NoError(t, repo.UpdatePermissions("service-a", "postgres-a", []string{"RO", "RW", "DDL"}))
+	resp := introspect(t, ctl, broad.AccessToken)
+	require.True(t, resp.Active)
+	assert.Zero(t, resp.PermVer)
+
+	require.NoError(t, repo.UpdatePermissions("service-a", "postgres-a", []string{"RO"}))
+	assert.False(t, introspect(t, ctl, broad.AccessToken).Active)
+
+	reduced, err := issuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+	resp = introspect(t, ctl, reduced.AccessToken)
+	assert.True(t, resp.Active)
+	_, version := repo.GetVersionedPermissions("service-a", "postgres-a")
+	assert.Equal(t, version.Version, resp.PermVer)
+	assert.Equal(t, []string{"RO"}, resp.Roles)
+}
+
+func TestIntrospectionHandler_OutdatedGroupPermissions(t *testing.T) {
+	repo := db.NewRepository(map[string]map[string][]string{"group:dba": {"postgres-a": {"RO", "RW"}}})
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(testRealm(), keys, repo)
+	require.NoError(t, err)
+	ctl := &Controller{realm: testRealm(), keys: keys, issuer: issuer, repository: repo, revoked: newRevocationList(), k8sVerifier: workloadTokens{}}
+
+	inherited, err := issuer.IssueToken("user:alice@example.com", "postgres-a", &IssueOpts{GroupClients: []string{"group:dba"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"group:dba": 0}, inherited.Claims.GroupPermVer)
+	require.True(t, introspect(t, ctl, inherited.AccessToken).Active)
+
+	// the user keeps no roles of its own, but the downgrade of its group
+	// outdates the token
+	require.NoError(t, repo.UpdatePermissions("group:dba", "postgres-a", []string{"RO"}))
+	assert.False(t, introspect(t, ctl, inherited.AccessToken).Active)
+
+	reduced, err := issuer.IssueToken("user:alice@example.com", "postgres-a", &IssueOpts{GroupClients: []string{"group:dba"}})
+	require.NoError(t, err)
+	resp := introspect(t, ctl, reduced.AccessToken)
+	assert.True(t, resp.Active)
+	assert.Equal(t, []string{"RO"}, resp.Roles)
+}
+
+func TestIntrospectionHandler_MissingToken(t *testing.T) {
+	ctl, _ := newIntrospectionController(t, testRealm())
+
+	w := postToken(t, ctl.IntrospectionHandler(), "postgres-a", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIntrospectionHandler_Caller(t *testing.T) {
+	ctl, token := newIntrospectionController(t, testRealm())
+
+	w := postToken(t, ctl.IntrospectionHandler(), "", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	var errResp OAuthErrorResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, errInvalidClient, errResp.Error)
+
+	// only the audience of the token learns its state
+	for _, client := range []string{"service-a", "postgres-b"} {
+		w = postToken(t, ctl.IntrospectionHandler(), client, token)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp IntrospectionResp
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		assert.Equal(t, IntrospectionResp{Active: false}, resp, client)
+	}
+}
+
+func TestRevocationHandler(t *testing.T) {
+	ctl, token := newIntrospectionController(t, testRealm())
+	require.True(t, introspect(t, ctl, token).Active)
+
+	w := postToken(t, ctl.RevocationHandler(), "", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postToken(t, ctl.RevocationHandler(), "postgres-a", token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var errResp OAuthErrorResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, errUnauthorizedClient, errResp.Error)
+	require.True(t, introspect(t, ctl, token).Active)
+
+	w = postToken(t, ctl.RevocationHandler(), "service-a", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, introspect(t, ctl, token).Active)
+
+	w = postToken(t, ctl.RevocationHandler(), "service-a", "unknown-token")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the IdP cannot read the claims of tokens encrypted to a resource server
+	w = postToken(t, ctl.RevocationHandler(), "service-a", "header.key.iv.ciphertext.tag")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+	assert.Equal(t, errUnsupportedTokenType, errResp.Error)
+}
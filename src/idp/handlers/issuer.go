@@ -1,84 +1,235 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
-	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tokens"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
 )
 
+// errNoPermissions is returned when the client holds no roles on the scope,
+// neither itself nor through its groups.
+var errNoPermissions = errors.New("client has no permissions on the scope")
+
+// IssueResp is the token exchange response (RFC 8693 section 2.2.1).
 type IssueResp struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	Type            string `json:"token_type"`
+	// ExpiresIn is the lifetime of the token in seconds.
+	ExpiresIn int64 `json:"expires_in"`
+
+	// ExpiresAt is reported by the gRPC API instead of the lifetime.
+	ExpiresAt time.Time `json:"-"`
+	// Grants the roles of the token come from, roles inherited from a group
+	// are granted to the group client.
+	Grants []db.GrantKey `json:"-"`
+	// Claims of the token, AccessToken is empty in realms issuing opaque
+	// tokens: the controller keeps the claims behind a reference token.
+	Claims *tokens.Claims `json:"-"`
+}
+
+// legacyIssueResp is the v1 token response, expires_in is the expiry time.
+type legacyIssueResp struct {
 	AccessToken string    `json:"access_token"`
 	Type        string    `json:"token_type"`
 	ExpiresIn   time.Time `json:"expires_in"`
 }
 
+// tokenResponse returns the response body in the token format of the realm.
+func tokenResponse(realm *config.Realm, resp *IssueResp) any {
+	if realm.LegacyTokenFormat() {
+		return legacyIssueResp{AccessToken: resp.AccessToken, Type: resp.Type, ExpiresIn: resp.ExpiresAt}
+	}
+
+	return resp
+}
+
+// IssueOpts carries optional properties of the issued token.
+type IssueOpts struct {
+	// Cnf binds the token to the key the client proved possession of.
+	Cnf *tokens.Confirmation
+	// GroupClients pass their roles on to the token client, users get the
+	// roles of their upstream groups this way.
+	GroupClients []string
+	// TTL shortens the lifetime of the token if positive.
+	TTL time.Duration
+	// Downscope issues the token with the roles and permissions version of
+	// an access token of the realm instead of the permissions of the client.
+	Downscope *tokens.Claims
+}
+
 type TokenIssuer struct {
-	config  *config.Config
+	realm   *config.Realm
 	keyPair *jwks.KeyPair
 	signer  jwks.Signer
+	// encrypters of the scopes with a resource server encryption key
+	encrypters map[string]jose.Encrypter
 
 	repository Repository
 }
 
-func NewIssuer(cfg *config.Config, keys *jwks.KeyPair, repository Repository) (*TokenIssuer, error) {
-	signer, err := jose.NewSigner(
-		jose.SigningKey{
-			Algorithm: jose.RS256,
-			Key: jose.JSONWebKey{
-				Key:       keys.PrivateKey,
-				KeyID:     keys.KeyID,
-				Algorithm: "RS256",
-				Use:       "sig",
-			},
-		},
-		nil,
-	)
+func NewIssuer(realm *config.Realm, keys *jwks.KeyPair, repository Repository) (*TokenIssuer, error) {
+	signer, err := jwks.NewSigner(keys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create signer: %w", err)
+		return nil, err
+	}
+
+	encrypters := make(map[string]jose.Encrypter, len(realm.EncryptionKeys))
+	for scope, keyFile := range realm.EncryptionKeys {
+		if encrypters[scope], err = jwks.NewEncrypter(keyFile); err != nil {
+			return nil, fmt.Errorf("failed to load encryption key of scope %s: %w", scope, err)
+		}
 	}
 
 	return &TokenIssuer{
-		config:     cfg,
+		realm:      realm,
 		keyPair:    keys,
 		signer:     signer,
+		encrypters: encrypters,
 		repository: repository,
 	}, nil
 }
 
-func (i *TokenIssuer) IssueToken(clientID, scope string) (*IssueResp, error) {
-	allowedRoles := i.repository.GetPermissions(clientID, scope)
-	// if !ok {
-	// 	return nil, fmt.Errorf("access denied for client %s to scope %s", clientID, scope)
-	// }
+func (i *TokenIssuer) IssueToken(clientID, scope string, opts *IssueOpts) (*IssueResp, error) {
+	var allowedRoles []string
+	var version db.PermissionsVersion
+	var groupVersions map[string]int64
+	var grants []db.GrantKey
+	if opts != nil && opts.Downscope != nil {
+		// the grants were used when the original token was issued
+		allowedRoles = opts.Downscope.Roles
+		version = db.PermissionsVersion{Version: opts.Downscope.PermVer}
+		groupVersions = opts.Downscope.GroupPermVer
+	} else {
+		allowedRoles, version = i.permissions(clientID, scope)
+		grants = grantKeys(clientID, scope, allowedRoles)
+	}
+
+	ttl := i.realm.TokenTTL
+	if opts != nil {
+		for _, groupClient := range opts.GroupClients {
+			groupRoles, groupVersion := i.permissions(groupClient, scope)
+			if groupVersions == nil {
+				groupVersions = make(map[string]int64, len(opts.GroupClients))
+			}
+			groupVersions[groupClient] = groupVersion.Version
+			allowedRoles = mergeRoles(allowedRoles, groupRoles)
+			grants = append(grants, grantKeys(groupClient, scope, groupRoles)...)
+		}
+		if opts.TTL > 0 && opts.TTL < ttl {
+			ttl = opts.TTL
+		}
+	}
+	if len(allowedRoles) == 0 {
+		return nil, fmt.Errorf("%w, client: %s, scope: %s", errNoPermissions, clientID, scope)
+	}
 
 	timeNow := time.Now()
-	exp := timeNow.Add(i.config.TokenTTL)
+	exp := timeNow.Add(ttl)
 	tokenClaims := tokens.Claims{
-		Iss:      i.config.Issuer,
+		Iss:      i.realm.Issuer,
 		Sub:      clientID,
 		ClientID: clientID,
 		Aud:      scope,
 		Scope:    scope,
 		Roles:    allowedRoles,
-		Exp:      exp,
-		Iat:      timeNow,
+		Exp:      tokens.NewNumericDate(exp),
+		Iat:      tokens.NewNumericDate(timeNow),
+		Nbf:      tokens.NewNumericDate(timeNow),
+		Jti:      newTokenID(),
+		PermVer:  version.Version,
+
+		GroupPermVer: groupVersions,
+	}
+	tokenType := "Bearer"
+	if opts != nil {
+		tokenClaims.Cnf = opts.Cnf
+		if opts.Cnf != nil && opts.Cnf.Jkt != "" {
+			tokenType = dpop.TokenType
+		}
 	}
 
 	log.Printf("claims to issue: %v", tokenClaims)
 
-	accessToken, err := jwks.GenerateJWT(i.signer, tokenClaims)
+	resp := &IssueResp{
+		IssuedTokenType: config.TokenTypeAccessToken,
+		Type:            tokenType,
+		ExpiresIn:       int64(ttl / time.Second),
+		ExpiresAt:       tokenClaims.Exp.Time(),
+		Grants:          grants,
+		Claims:          &tokenClaims,
+	}
+	if i.realm.OpaqueTokens {
+		return resp, nil
+	}
+
+	var signed any = tokenClaims
+	if i.realm.LegacyTokenFormat() {
+		signed = tokenClaims.Legacy()
+	}
+
+	accessToken, err := jwks.GenerateJWT(i.signer, signed)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate jwt: %w", err)
 	}
+	if encrypter, ok := i.encrypters[scope]; ok {
+		if accessToken, err = jwks.EncryptJWT(encrypter, accessToken); err != nil {
+			return nil, err
+		}
+	}
+	resp.AccessToken = accessToken
 
-	return &IssueResp{
-		AccessToken: accessToken,
-		Type:        "Bearer",
-		ExpiresIn:   exp,
-	}, nil
+	return resp, nil
+}
+
+func grantKeys(client, scope string, roles []string) []db.GrantKey {
+	grants := make([]db.GrantKey, 0, len(roles))
+	for _, role := range roles {
+		grants = append(grants, db.GrantKey{Client: client, Scope: scope, Role: role})
+	}
+
+	return grants
+}
+
+// permissions returns the roles of the client along with their version. The
+// versions of group clients are kept in the tokens of their users, so taking
+// roles from a group invalidates the tokens which inherited them.
+func (i *TokenIssuer) permissions(clientID, scope string) ([]string, db.PermissionsVersion) {
+	if versioned, ok := i.repository.(VersionedRepository); ok {
+		return versioned.GetVersionedPermissions(clientID, scope)
+	}
+
+	return i.repository.GetPermissions(clientID, scope), db.PermissionsVersion{}
+}
+
+// newTokenID returns a random jti, which identifies the token in logs and
+// revocation lists of resource servers.
+func newTokenID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// mergeRoles returns the roles of both lists without duplicates, the lists
+// returned by the repository are never modified.
+func mergeRoles(roles, more []string) []string {
+	merged := make([]string, 0, len(roles)+len(more))
+	for _, role := range append(slices.Clone(roles), more...) {
+		if !slices.Contains(merged, role) {
+			merged = append(merged, role)
+		}
+	}
+
+	return merged
 }
@@ -1,12 +1,25 @@
 package handlers
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
+	josejwt "github.com/go-jose/go-jose/v3/jwt"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -58,13 +71,13 @@ func (m *mockSigner) Options() jose.SignerOptions {
 // 	issuer := &TokenIssuer{
 // 		repository: repo,
 // 		signer:     signer,
-// 		config: &config.Config{
+// 		realm: &config.Realm{
 // 			Issuer:   "test-issuer",
 // 			TokenTTL: 10 * time.Minute,
 // 		},
 // 	}
 
-// 	resp, err := issuer.IssueToken("client1", "scope1")
+// 	resp, err := issuer.IssueToken("client1", "scope1", nil)
 // 	require.NoError(t, err)
 // 	assert.Equal(t, "mock.jwt.token", resp.AccessToken)
 // 	repo.AssertExpectations(t)
@@ -81,13 +94,13 @@ func (m *mockSigner) Options() jose.SignerOptions {
 // 	issuer := &TokenIssuer{
 // 		repository: repo,
 // 		signer:     signer,
-// 		config: &config.Config{
+// 		realm: &config.Realm{
 // 			Issuer:   "test-issuer",
 // 			TokenTTL: 10 * time.Minute,
 // 		},
 // 	}
 
-// 	resp, err := issuer.IssueToken("client1", "scope1")
+// 	resp, err := issuer.IssueToken("client1", "scope1", nil)
 // 	require.NoError(t, err)
 // 	assert.Equal(t, "mock.jwt.token", resp.AccessToken)
 // 	repo.AssertExpectations(t)
@@ -104,19 +117,256 @@ func TestTokenIssuer_IssueToken_SignerError(t *testing.T) {
 	issuer := &TokenIssuer{
 		repository: repo,
 		signer:     signer,
-		config: &config.Config{
+		realm: &config.Realm{
 			Issuer:   "test-issuer",
 			TokenTTL: 10 * time.Minute,
 		},
 	}
 
-	_, err := issuer.IssueToken("client1", "scope1")
+	_, err := issuer.IssueToken("client1", "scope1", nil)
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to generate jwt")
 	repo.AssertExpectations(t)
 	signer.AssertExpectations(t)
 }
 
+func TestTokenIssuer_IssueToken_Confirmation(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO"})
+
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(testRealm(), keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("client1", "scope1", &IssueOpts{
+		Cnf: &tokens.Confirmation{X5tS256: "thumbprint"},
+	})
+	require.NoError(t, err)
+
+	jws, err := jose.ParseSigned(resp.AccessToken)
+	require.NoError(t, err)
+	payload, err := jws.Verify(keys.PrivateKey.Public())
+	require.NoError(t, err)
+
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, map[string]any{"x5t#S256": "thumbprint"}, claims["cnf"])
+	assert.Equal(t, []any{"RO"}, claims["roles"])
+	assert.Equal(t, "Bearer", resp.Type)
+}
+
+func TestTokenIssuer_IssueToken_DPoPTokenType(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO"})
+
+	issuer, err := NewIssuer(testRealm(), jwks.GenerateKeyPair(), repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("client1", "scope1", &IssueOpts{
+		Cnf: &tokens.Confirmation{Jkt: "thumbprint"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "DPoP", resp.Type)
+}
+
+func TestTokenIssuer_IssueToken_GroupClients(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "user:alice@example.com", "postgres-a").Return([]string{"RO"})
+	repo.On("GetPermissions", "group:dba", "postgres-a").Return([]string{"RO", "RW"})
+	repo.On("GetPermissions", "group:oncall", "postgres-a").Return([]string{})
+
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(testRealm(), keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("user:alice@example.com", "postgres-a", &IssueOpts{
+		GroupClients: []string{"group:dba", "group:oncall"},
+		TTL:          10 * time.Second,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), resp.ExpiresIn)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), resp.ExpiresAt, 2*time.Second)
+
+	jws, err := jose.ParseSigned(resp.AccessToken)
+	require.NoError(t, err)
+	payload, err := jws.Verify(keys.PrivateKey.Public())
+	require.NoError(t, err)
+
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, []any{"RO", "RW"}, claims["roles"])
+	assert.Equal(t, "user:alice@example.com", claims["client_id"])
+	assert.Equal(t, []db.GrantKey{
+		{Client: "user:alice@example.com", Scope: "postgres-a", Role: "RO"},
+		{Client: "group:dba", Scope: "postgres-a", Role: "RO"},
+		{Client: "group:dba", Scope: "postgres-a", Role: "RW"},
+	}, resp.Grants)
+	repo.AssertExpectations(t)
+}
+
+func TestTokenIssuer_IssueToken_TTLNeverExceedsRealm(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO"})
+
+	issuer, err := NewIssuer(testRealm(), jwks.GenerateKeyPair(), repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("client1", "scope1", &IssueOpts{TTL: time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, int64(testRealm().TokenTTL/time.Second), resp.ExpiresIn)
+}
+
+func TestTokenIssuer_IssueToken_StandardClaims(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO"})
+
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(testRealm(), keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("client1", "scope1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, config.TokenTypeAccessToken, resp.IssuedTokenType)
+
+	// a standard JWT library accepts the token
+	token, err := josejwt.ParseSigned(resp.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "at+jwt", token.Headers[0].ExtraHeaders[jose.HeaderType])
+
+	var claims josejwt.Claims
+	var custom struct {
+		ClientID string   `json:"client_id"`
+		Scope    string   `json:"scope"`
+		Roles    []string `json:"roles"`
+	}
+	require.NoError(t, token.Claims(keys.PrivateKey.Public(), &claims, &custom))
+	require.NoError(t, claims.Validate(josejwt.Expected{
+		Issuer:   testRealm().Issuer,
+		Audience: josejwt.Audience{"scope1"},
+		Time:     time.Now(),
+	}))
+	assert.NotEmpty(t, claims.ID)
+	assert.NotNil(t, claims.NotBefore)
+	assert.Equal(t, resp.ExpiresAt, claims.Expiry.Time())
+	assert.Equal(t, "client1", custom.ClientID)
+	assert.Equal(t, []string{"RO"}, custom.Roles)
+
+	second, err := issuer.IssueToken("client1", "scope1", nil)
+	require.NoError(t, err)
+	secondToken, err := josejwt.ParseSigned(second.AccessToken)
+	require.NoError(t, err)
+	var secondClaims josejwt.Claims
+	require.NoError(t, secondToken.UnsafeClaimsWithoutVerification(&secondClaims))
+	assert.NotEqual(t, claims.ID, secondClaims.ID)
+}
+
+func writePublicKey(t *testing.T, publicKey any) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "public.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	return path
+}
+
+func TestTokenIssuer_IssueToken_EncryptedScopes(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", mock.Anything).Return([]string{"RO"})
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	realm := testRealm()
+	realm.EncryptionKeys = map[string]string{
+		"postgres-a": writePublicKey(t, rsaKey.Public()),
+		"postgres-b": writePublicKey(t, ecKey.Public()),
+	}
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(realm, keys, repo)
+	require.NoError(t, err)
+
+	for scope, tt := range map[string]struct {
+		alg        jose.KeyAlgorithm
+		privateKey any
+	}{
+		"postgres-a": {alg: jose.RSA_OAEP_256, privateKey: rsaKey},
+		"postgres-b": {alg: jose.ECDH_ES_A256KW, privateKey: ecKey},
+	} {
+		t.Run(scope, func(t *testing.T) {
+			resp, err := issuer.IssueToken("client1", scope, nil)
+			require.NoError(t, err)
+
+			_, err = josejwt.ParseSigned(resp.AccessToken)
+			require.Error(t, err, "claims are not readable without the key of the resource server")
+
+			token, err := josejwt.ParseSignedAndEncrypted(resp.AccessToken)
+			require.NoError(t, err)
+			assert.Equal(t, string(tt.alg), token.Headers[0].Algorithm)
+			assert.Equal(t, "JWT", token.Headers[0].ExtraHeaders[jose.HeaderContentType])
+
+			nested, err := token.Decrypt(tt.privateKey)
+			require.NoError(t, err)
+			var claims tokens.Claims
+			require.NoError(t, nested.Claims(keys.PrivateKey.Public(), &claims))
+			assert.Equal(t, scope, claims.Aud)
+			assert.Equal(t, []string{"RO"}, claims.Roles)
+		})
+	}
+
+	// scopes without a key get signed tokens
+	resp, err := issuer.IssueToken("client1", "postgres-c", nil)
+	require.NoError(t, err)
+	_, err = josejwt.ParseSigned(resp.AccessToken)
+	assert.NoError(t, err)
+
+	realm.EncryptionKeys = map[string]string{"postgres-a": filepath.Join(t.TempDir(), "missing.pem")}
+	_, err = NewIssuer(realm, keys, repo)
+	assert.ErrorContains(t, err, "failed to load encryption key of scope postgres-a")
+}
+
+func TestTokenIssuer_IssueToken_LegacyFormat(t *testing.T) {
+	repo := new(mockRepository)
+	repo.On("GetPermissions", "client1", "scope1").Return([]string{"RO"})
+
+	realm := testRealm()
+	realm.TokenFormat = config.TokenFormatV1
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(realm, keys, repo)
+	require.NoError(t, err)
+
+	resp, err := issuer.IssueToken("client1", "scope1", nil)
+	require.NoError(t, err)
+
+	jws, err := jose.ParseSigned(resp.AccessToken)
+	require.NoError(t, err)
+	payload, err := jws.Verify(keys.PrivateKey.Public())
+	require.NoError(t, err)
+
+	// old auth-client builds decode these claims
+	var legacy tokens.LegacyClaims
+	require.NoError(t, json.Unmarshal(payload, &legacy))
+	assert.Equal(t, "client1", legacy.ClientID)
+	assert.WithinDuration(t, resp.ExpiresAt, legacy.Exp, time.Second)
+
+	var claims tokens.Claims
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "client1", claims.ClientID)
+	assert.Equal(t, resp.ExpiresAt, claims.Exp.Time())
+
+	body, err := json.Marshal(tokenResponse(realm, resp))
+	require.NoError(t, err)
+	var legacyResp struct {
+		ExpiresIn time.Time `json:"expires_in"`
+	}
+	require.NoError(t, json.Unmarshal(body, &legacyResp))
+	assert.True(t, resp.ExpiresAt.Equal(legacyResp.ExpiresIn))
+}
+
 // mockJSONWebSignature реализует jose.JSONWebSignature с поддержкой CompactSerialize
 type mockJSONWebSignature struct {
 	compact string
@@ -3,20 +3,90 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+)
+
+// Realm endpoint paths, relative to the realm issuer.
+const (
+	OpenIDConfigPath  = "/.well-known/openid-configuration"
+	OAuthMetadataPath = "/.well-known/oauth-authorization-server"
+	TokenPath         = "/protocol/openid-connect/token"
+	BatchTokenPath    = "/protocol/openid-connect/token/batch"
+	CertsPath         = "/protocol/openid-connect/certs"
+	IntrospectionPath = "/protocol/openid-connect/token/introspect"
+	RevocationPath    = "/protocol/openid-connect/revoke"
+)
+
+// clientAuthNone is the authentication method of the token endpoint: clients
+// are identified by the subject token they exchange. Introspection and
+// revocation callers present their service account or ID token as bearer
+// token instead.
+const (
+	clientAuthNone   = "none"
+	clientAuthBearer = "bearer"
 )
 
+// DiscoveryMetadata is the authorization server metadata (RFC 8414), it is
+// also served as OpenID Connect discovery document.
+type DiscoveryMetadata struct {
+	Issuer                string `json:"issuer"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+
+	ScopesSupported        []string `json:"scopes_supported"`
+	ResponseTypesSupported []string `json:"response_types_supported"`
+	GrantTypesSupported    []string `json:"grant_types_supported"`
+
+	TokenEndpointAuthMethodsSupported         []string `json:"token_endpoint_auth_methods_supported"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	RevocationEndpointAuthMethodsSupported    []string `json:"revocation_endpoint_auth_methods_supported"`
+
+	TLSClientCertificateBoundAccessTokens bool     `json:"tls_client_certificate_bound_access_tokens"`
+	DPoPSigningAlgValuesSupported         []string `json:"dpop_signing_alg_values_supported"`
+}
+
+// DiscoveryMetadata builds the metadata document from the realm configuration.
+func (ctl *Controller) DiscoveryMetadata() DiscoveryMetadata {
+	realm := ctl.realm
+
+	scopes := []string{}
+	certBound := false
+	if ctl.cfg != nil {
+		scopes = ctl.cfg.RealmScopes(realm)
+		certBound = ctl.cfg.TLS.Enabled() && ctl.cfg.TLS.ClientAuth != "" && ctl.cfg.TLS.ClientAuth != config.ClientAuthNone
+	}
+
+	return DiscoveryMetadata{
+		Issuer:                realm.Issuer,
+		TokenEndpoint:         realm.Issuer + TokenPath,
+		JWKSURI:               realm.Issuer + CertsPath,
+		IntrospectionEndpoint: realm.Issuer + IntrospectionPath,
+		RevocationEndpoint:    realm.Issuer + RevocationPath,
+
+		ScopesSupported: scopes,
+		// there is no authorization endpoint, tokens are only exchanged
+		ResponseTypesSupported: []string{},
+		GrantTypesSupported:    realm.GrantTypes,
+
+		TokenEndpointAuthMethodsSupported:         []string{clientAuthNone},
+		IntrospectionEndpointAuthMethodsSupported: []string{clientAuthBearer},
+		RevocationEndpointAuthMethodsSupported:    []string{clientAuthBearer},
+
+		TLSClientCertificateBoundAccessTokens: certBound,
+		DPoPSigningAlgValuesSupported:         dpop.SigningAlgorithms,
+	}
+}
+
+// OpenIDConfigHandler serves the metadata on both the OpenID Connect and the
+// RFC 8414 well-known paths.
 func (ctl *Controller) OpenIDConfigHandler() http.HandlerFunc {
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		response := map[string]interface{}{
-			"issuer":                                ctl.cfg.Issuer,
-			"token_endpoint":                        ctl.cfg.Issuer + "/realms/service2infra/protocol/openid-connect/token",
-			"jwks_uri":                              ctl.cfg.Issuer + "/realms/service2infra/protocol/openid-connect/certs",
-			"grant_types_supported":                 []string{grantTypeTokenExchange},
-			"id_token_signing_alg_values_supported": []string{"RS256"},
-		}
-
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(ctl.DiscoveryMetadata())
 	}
 
 	return handler
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenIDConfigHandler(t *testing.T) {
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+	cfg.Store.Permissions = map[string]map[string]map[string][]string{
+		"service2infra": {
+			"service-a": {"postgres-a": {"RO", "RW"}},
+			"service-b": {"postgres-b": {"RO"}},
+		},
+	}
+	cfg.TLS = config.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientAuth: config.ClientAuthRequest}
+
+	realm, ok := cfg.Realm("service2infra")
+	require.True(t, ok)
+	ctl := &Controller{cfg: cfg, realm: realm}
+
+	req := httptest.NewRequest("GET", "/realms/service2infra/.well-known/oauth-authorization-server", nil)
+	w := httptest.NewRecorder()
+	ctl.OpenIDConfigHandler().ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var metadata map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metadata))
+
+	issuer := "http://idp.idp.svc.cluster.local/realms/service2infra"
+	assert.Equal(t, map[string]any{
+		"issuer":                 issuer,
+		"token_endpoint":         issuer + "/protocol/openid-connect/token",
+		"jwks_uri":               issuer + "/protocol/openid-connect/certs",
+		"introspection_endpoint": issuer + "/protocol/openid-connect/token/introspect",
+		"revocation_endpoint":    issuer + "/protocol/openid-connect/revoke",
+
+		"scopes_supported":         []any{"postgres-a", "postgres-b"},
+		"response_types_supported": []any{},
+		"grant_types_supported":    []any{config.GrantTypeTokenExchange},
+
+		"token_endpoint_auth_methods_supported":         []any{"none"},
+		"introspection_endpoint_auth_methods_supported": []any{"bearer"},
+		"revocation_endpoint_auth_methods_supported":    []any{"bearer"},
+
+		"tls_client_certificate_bound_access_tokens": true,
+		"dpop_signing_alg_values_supported":          []any{"ES256", "ES384", "RS256", "PS256", "EdDSA"},
+	}, metadata)
+	assert.NotContains(t, metadata, "id_token_signing_alg_values_supported")
+}
+
+func TestOpenIDConfigHandler_WithoutMTLS(t *testing.T) {
+	ctl := &Controller{cfg: &config.Config{}, realm: testRealm()}
+
+	metadata := ctl.DiscoveryMetadata()
+
+	assert.False(t, metadata.TLSClientCertificateBoundAccessTokens)
+	assert.Equal(t, []string{}, metadata.ScopesSupported)
+	assert.Equal(t, "http://idp.test/realms/service2infra", metadata.Issuer)
+}
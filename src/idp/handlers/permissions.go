@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
 )
 
 type PermissionsRequest struct {
@@ -18,16 +21,29 @@ type PermissionsResponse struct {
 	Roles []string `json:"roles"`
 }
 
+// NewUpdatePermissionsHandler sets the roles of a client on a scope, admins of
+// the realm and approvers of the scope may call it.
 func (ctl *Controller) NewUpdatePermissionsHandler(ctx context.Context) http.HandlerFunc {
 	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, err := ctl.authenticateCaller(r)
+		if err != nil {
+			respondCallerError(w, err)
+			return
+		}
+
 		var req PermissionsRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			respondError(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		if err := ctl.repository.UpdatePermissions(req.Client, req.Scope, req.Roles); err != nil {
-			log.Printf("failed to update permissions (%s -> %s: %v): %v", req.Client, req.Scope, req.Roles, err)
+		if !ctl.mayGrant(caller, req.Scope) {
+			log.Printf("permissions update of %s on %s refused for %s in realm %s", req.Client, req.Scope, caller.ID, ctl.realm.Name)
+			respondError(w, fmt.Sprintf("%s may not change the permissions of scope %s", caller.ID, req.Scope), http.StatusForbidden)
+			return
+		}
+
+		if err := ctl.updatePermissions(r.Context(), caller.ID, req.Client, req.Scope, req.Roles); err != nil {
 			respondError(w, fmt.Sprintf("failed to update permissions: %v", err), http.StatusInternalServerError)
 			return
 		}
@@ -36,6 +52,44 @@ func (ctl *Controller) NewUpdatePermissionsHandler(ctx context.Context) http.Han
 	return baseMetricsMiddleware(handler)
 }
 
+// updatePermissions stores the roles, records the change in the audit trail and
+// notifies the holders of the client tokens. It is shared by the HTTP and gRPC
+// endpoints and the access request workflow.
+func (ctl *Controller) updatePermissions(ctx context.Context, actor, client, scope string, roles []string) error {
+	if err := ctl.repository.UpdatePermissions(client, scope, roles); err != nil {
+		log.Printf("failed to update permissions (%s -> %s: %v): %v", client, scope, roles, err)
+		return err
+	}
+
+	ctl.permissionsChanged(ctx, actor, "", db.PermissionUpdate{Client: client, Scope: scope, Roles: roles})
+	ctl.takeSnapshot(ctx, actor, fmt.Sprintf("roles of %s on %s set to %v", client, scope, roles))
+
+	return nil
+}
+
+// permissionsChanged reports a stored change to the audit trail, the holders
+// of the client tokens and the webhooks.
+func (ctl *Controller) permissionsChanged(ctx context.Context, actor, comment string, update db.PermissionUpdate) {
+	ctl.recordAudit(ctx, db.AuditEvent{
+		Actor:   actor,
+		Action:  AuditPermissionsUpdated,
+		Client:  update.Client,
+		Scope:   update.Scope,
+		Roles:   update.Roles,
+		Comment: comment,
+	})
+	event := ctl.publishPermissionEvent(update.Client, update.Scope, update.Roles)
+	ctl.notify(config.WebhookEventPermissionsUpdated, PermissionsUpdatedEvent{
+		Actor:      actor,
+		Client:     update.Client,
+		Scope:      update.Scope,
+		Roles:      update.Roles,
+		Version:    event.Version,
+		MinVersion: event.MinVersion,
+		Comment:    comment,
+	})
+}
+
 func (ctl *Controller) NewGetPermissionsHandler(ctx context.Context) http.HandlerFunc {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		var req PermissionsRequest
@@ -63,6 +117,60 @@ func (ctl *Controller) NewGetPermissionsHandler(ctx context.Context) http.Handle
 	return baseMetricsMiddleware(handler)
 }
 
+// PermissionsVersionsPath serves the permissions versions of the clients of a
+// scope, relative to the realm issuer.
+const PermissionsVersionsPath = "/permissions/versions"
+
+type PermissionsVersionsResponse struct {
+	Scope string `json:"scope"`
+	// Versions are keyed by client, clients whose permissions never changed
+	// are omitted.
+	Versions map[string]db.PermissionsVersion `json:"versions"`
+}
+
+// NewPermissionsVersionsHandler lets resource servers poll the minimum
+// permissions versions of their scope, tokens of older versions carry roles
+// which were taken away. The versions tell who holds roles on the scope, so
+// only the resource server of the scope and admins may read them.
+func (ctl *Controller) NewPermissionsVersionsHandler(ctx context.Context) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		scope := r.URL.Query().Get("scope")
+		if scope == "" {
+			respondError(w, "scope is required", http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := ctl.authorizeCaller(w, r, func(c *caller) bool {
+			return c.ID == scope || ctl.isAdmin(c)
+		}); !ok {
+			return
+		}
+
+		versioned, ok := ctl.repository.(VersionedRepository)
+		if !ok {
+			respondError(w, "permissions versions are not supported in this realm", http.StatusNotImplemented)
+			return
+		}
+
+		versions, err := versioned.ScopeVersions(r.Context(), scope)
+		if err != nil {
+			respondError(w, fmt.Sprintf("failed to get permissions versions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if versions == nil {
+			versions = map[string]db.PermissionsVersion{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(PermissionsVersionsResponse{Scope: scope, Versions: versions}); err != nil {
+			log.Printf("failed to write permissions versions response: %v", err)
+		}
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
 func respondError(w http.ResponseWriter, message string, code int) {
 	if code != http.StatusOK {
 		log.Printf("request failed: status: %d, message %s", code, message)
@@ -73,6 +181,14 @@ func respondError(w http.ResponseWriter, message string, code int) {
 	json.NewEncoder(w).Encode(RespErr{Error: message})
 }
 
+func respondJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
 type RespErr struct {
 	Error string `json:"error"`
 }
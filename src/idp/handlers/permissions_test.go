@@ -9,19 +9,31 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
+// permissionsAdmin returns a controller whose realm is managed by the
+// auth-ui workload.
+func permissionsAdmin(repo Repository) *Controller {
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+
+	return &Controller{realm: realm, repository: repo, k8sVerifier: workloadTokens{}}
+}
+
 func TestUpdatePermissionsHandler_Success(t *testing.T) {
 	repo := new(mockRepository)
 	repo.On("UpdatePermissions", "client1", "scope1", []string{"admin"}).Return(nil)
 
-	ctl := &Controller{repository: repo}
+	ctl := permissionsAdmin(repo)
 
 	body := `{"client":"client1","scope":"scope1","roles":["admin"]}`
 	req := httptest.NewRequest("POST", "/permissions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer sa:auth-ui")
 	w := httptest.NewRecorder()
 
 	handler := ctl.NewUpdatePermissionsHandler(context.Background())
@@ -31,11 +43,52 @@ func TestUpdatePermissionsHandler_Success(t *testing.T) {
 	repo.AssertExpectations(t)
 }
 
+func TestUpdatePermissionsHandler_Authorization(t *testing.T) {
+	ctl := permissionsAdmin(new(mockRepository))
+	ctl.realm.AccessRequests = &config.AccessRequestsConfig{Approvers: map[string][]string{"scope2": {"approver"}}}
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "not authenticated", status: http.StatusUnauthorized},
+		{name: "invalid token", token: "invalid", status: http.StatusUnauthorized},
+		{name: "not an admin", token: "sa:client1", status: http.StatusForbidden},
+		{name: "approver of another scope", token: "sa:approver", status: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"client":"client1","scope":"scope1","roles":["admin"]}`
+			req := httptest.NewRequest("POST", "/permissions", bytes.NewReader([]byte(body)))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			ctl.NewUpdatePermissionsHandler(context.Background()).ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+
+	// approvers manage the grants of their scope
+	repo := new(mockRepository)
+	repo.On("UpdatePermissions", "client1", "scope2", []string{"RO"}).Return(nil)
+	ctl.repository = repo
+
+	req := httptest.NewRequest("POST", "/permissions", bytes.NewReader([]byte(`{"client":"client1","scope":"scope2","roles":["RO"]}`)))
+	req.Header.Set("Authorization", "Bearer sa:approver")
+	w := httptest.NewRecorder()
+	ctl.NewUpdatePermissionsHandler(context.Background()).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	repo.AssertExpectations(t)
+}
+
 func TestUpdatePermissionsHandler_InvalidJSON(t *testing.T) {
-	ctl := &Controller{}
+	ctl := permissionsAdmin(nil)
 
 	body := `invalid_json`
 	req := httptest.NewRequest("POST", "/permissions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer sa:auth-ui")
 	w := httptest.NewRecorder()
 
 	handler := ctl.NewUpdatePermissionsHandler(context.Background())
@@ -49,10 +102,11 @@ func TestUpdatePermissionsHandler_RepoError(t *testing.T) {
 	repo := new(mockRepository)
 	repo.On("UpdatePermissions", "client1", "scope1", mock.Anything).Return(errors.New("db error"))
 
-	ctl := &Controller{repository: repo}
+	ctl := permissionsAdmin(repo)
 
 	body := `{"client":"client1","scope":"scope1","roles":["admin"]}`
 	req := httptest.NewRequest("POST", "/permissions", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer sa:auth-ui")
 	w := httptest.NewRecorder()
 
 	handler := ctl.NewUpdatePermissionsHandler(context.Background())
@@ -135,3 +189,54 @@ func TestGetPermissionsHandler_MarshalError(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, w.Code) // Только проверка статуса
 }
+
+func TestPermissionsVersionsHandler(t *testing.T) {
+	repo := db.NewRepository(map[string]map[string][]string{"client1": {"scope1": {"RO", "RW"}}})
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RO"}))
+	require.NoError(t, repo.UpdatePermissions("client2", "scope1", []string{"RO"}))
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	ctl := &Controller{realm: realm, repository: repo, k8sVerifier: workloadTokens{}}
+	handler := ctl.NewPermissionsVersionsHandler(context.Background())
+
+	get := func(handler http.Handler, query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", PermissionsVersionsPath+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(handler, "?scope=scope1", "sa:scope1")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, version1 := repo.GetVersionedPermissions("client1", "scope1")
+	_, version2 := repo.GetVersionedPermissions("client2", "scope1")
+	assert.Equal(t, version1.Version, version1.MinVersion)
+	assert.Zero(t, version2.MinVersion)
+	var resp PermissionsVersionsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, PermissionsVersionsResponse{
+		Scope:    "scope1",
+		Versions: map[string]db.PermissionsVersion{"client1": version1, "client2": version2},
+	}, resp)
+
+	// admins read the versions of any scope
+	w = get(handler, "?scope=unknown", "sa:auth-ui")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"scope":"unknown","versions":{}}`, w.Body.String())
+
+	// other callers do not learn who holds roles on the scope
+	assert.Equal(t, http.StatusUnauthorized, get(handler, "?scope=scope1", "").Code)
+	assert.Equal(t, http.StatusForbidden, get(handler, "?scope=scope1", "sa:client1").Code)
+
+	assert.Equal(t, http.StatusBadRequest, get(handler, "", "sa:scope1").Code)
+
+	// the mock repository is not versioned
+	unversioned := &Controller{realm: realm, repository: new(mockRepository), k8sVerifier: workloadTokens{}}
+	w = get(unversioned.NewPermissionsVersionsHandler(context.Background()), "?scope=scope1", "sa:scope1")
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a fixed window limiter kept in memory of the replica, with
+// several replicas every one of them allows the limit.
+type rateLimiter struct {
+	limit  int64
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	// nextSweep is when windows of idle clients are dropped next, at most
+	// once per window.
+	nextSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int64
+}
+
+func newRateLimiter(limit int64, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+func (l *rateLimiter) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	start := now.Truncate(l.window)
+	if !now.Before(l.nextSweep) {
+		for k, w := range l.windows {
+			if w.start.Before(start) {
+				delete(l.windows, k)
+			}
+		}
+		l.nextSweep = start.Add(l.window)
+	}
+
+	w, ok := l.windows[key]
+	if !ok {
+		w = &rateWindow{start: start}
+		l.windows[key] = w
+	}
+
+	if w.count >= l.limit {
+		return false, start.Add(l.window).Sub(now), nil
+	}
+	w.count++
+
+	return true, 0, nil
+}
+
+// rateLimitKey scopes the limit of a client to the realm.
+func (ctl *Controller) rateLimitKey(clientID string) string {
+	return ctl.realm.Name + ":" + clientID
+}
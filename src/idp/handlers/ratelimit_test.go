@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 45, 0, time.UTC)
+	limiter := newRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	allow := func(key string) (bool, time.Duration) {
+		allowed, retryAfter, err := limiter.Allow(context.Background(), key)
+		assert.NoError(t, err)
+		return allowed, retryAfter
+	}
+
+	for range 2 {
+		allowed, _ := allow("realm:client1")
+		assert.True(t, allowed)
+	}
+
+	allowed, retryAfter := allow("realm:client1")
+	assert.False(t, allowed)
+	assert.Equal(t, 15*time.Second, retryAfter)
+
+	allowed, _ = allow("realm:client2")
+	assert.True(t, allowed)
+
+	now = now.Add(15 * time.Second)
+	allowed, _ = allow("realm:client1")
+	assert.True(t, allowed)
+	assert.Len(t, limiter.windows, 1, "windows of the previous minute are purged")
+	// the next purge is due with the next window, not on every request
+	assert.Equal(t, time.Date(2025, 1, 1, 12, 2, 0, 0, time.UTC), limiter.nextSweep)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// errTokenStateUnavailable is returned when the revocation list or the
+// reference tokens can not be read, the token is neither active nor inactive
+// then.
+var errTokenStateUnavailable = errors.New("token state is not available")
+
+// newReferenceToken returns a random opaque token, it carries nothing but 256
+// bits of entropy.
+func newReferenceToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// isReferenceToken tells opaque tokens from JWTs, the base64url alphabet of
+// reference tokens has no dots.
+func isReferenceToken(rawToken string) bool {
+	return !strings.Contains(rawToken, ".")
+}
+
+// isEncryptedToken tells JWE tokens from JWS ones by their five compact parts,
+// they are encrypted to a resource server key the IdP does not hold.
+func isEncryptedToken(rawToken string) bool {
+	return strings.Count(rawToken, ".") == 4
+}
+
+// saveReferenceToken keeps the claims of the issued token in the store and
+// sets a reference token as the access token.
+func (ctl *Controller) saveReferenceToken(ctx context.Context, resp *IssueResp) error {
+	claims, err := json.Marshal(resp.Claims)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token claims: %w", err)
+	}
+
+	rawToken := newReferenceToken()
+	if err := ctl.references.Save(ctx, rawToken, claims, resp.ExpiresAt); err != nil {
+		return fmt.Errorf("failed to save reference token: %w", err)
+	}
+	resp.AccessToken = rawToken
+
+	return nil
+}
+
+// tokenClaims returns the claims of a JWT or a reference token of the realm,
+// which has not expired yet. JWTs issued before the realm switched to opaque
+// tokens stay valid until they expire.
+func (ctl *Controller) tokenClaims(ctx context.Context, rawToken string) (*tokens.Claims, error) {
+	if !isReferenceToken(rawToken) {
+		return ctl.parseToken(rawToken)
+	} else if ctl.references == nil {
+		return nil, errors.New("reference tokens are not kept by the realm")
+	}
+
+	data, err := ctl.references.Claims(ctx, rawToken)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, errors.New("reference token is unknown or expired")
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %w", errTokenStateUnavailable, err)
+	}
+
+	var claims tokens.Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reference token claims: %w", err)
+	}
+
+	if claims.Iss != ctl.realm.Issuer {
+		return nil, fmt.Errorf("unexpected issuer: %s", claims.Iss)
+	} else if time.Now().After(claims.Exp.Time()) {
+		return nil, errors.New("token is expired")
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingReferences struct{}
+
+func (failingReferences) Save(context.Context, string, []byte, time.Time) error {
+	return errors.New("connection refused")
+}
+
+func (failingReferences) Claims(context.Context, string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newOpaqueController(t *testing.T, references ReferenceTokenStore) (*Controller, *jwks.KeyPair) {
+	t.Helper()
+
+	realm := testRealm()
+	realm.OpaqueTokens = true
+	realm.SubjectTokenTypes = []string{k8sTokenType, accessTokenType}
+
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO", "RW"}}})
+	keys := jwks.GenerateKeyPair()
+	issuer, err := NewIssuer(realm, keys, repo)
+	require.NoError(t, err)
+
+	return &Controller{
+		realm:       realm,
+		keys:        keys,
+		issuer:      issuer,
+		repository:  repo,
+		revoked:     newRevocationList(),
+		references:  references,
+		k8sVerifier: workloadTokens{},
+	}, keys
+}
+
+func TestReferenceTokens_Introspection(t *testing.T) {
+	ctl, keys := newOpaqueController(t, db.NewReferenceTokens())
+
+	resp, err := ctl.issueExchanged(context.Background(), "service-a", "postgres-a", nil)
+	require.NoError(t, err)
+	assert.True(t, isReferenceToken(resp.AccessToken))
+	assert.Len(t, resp.AccessToken, 43)
+	assert.Equal(t, int64(60), resp.ExpiresIn)
+
+	active := introspect(t, ctl, resp.AccessToken)
+	assert.True(t, active.Active)
+	assert.Equal(t, "service-a", active.ClientID)
+	assert.Equal(t, "postgres-a", active.Scope)
+	assert.Equal(t, []string{"RO", "RW"}, active.Roles)
+	assert.Equal(t, resp.ExpiresAt.Unix(), active.Exp)
+
+	// JWTs issued before the realm switched to opaque tokens stay valid
+	jwtIssuer, err := NewIssuer(testRealm(), keys, ctl.repository)
+	require.NoError(t, err)
+	jwtResp, err := jwtIssuer.IssueToken("service-a", "postgres-a", nil)
+	require.NoError(t, err)
+	assert.True(t, introspect(t, ctl, jwtResp.AccessToken).Active)
+
+	other, err := ctl.issueExchanged(context.Background(), "service-a", "postgres-a", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, resp.AccessToken, other.AccessToken)
+
+	w := postToken(t, ctl.RevocationHandler(), "service-a", resp.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, IntrospectionResp{Active: false}, introspect(t, ctl, resp.AccessToken))
+	assert.True(t, introspect(t, ctl, other.AccessToken).Active)
+
+	assert.Equal(t, IntrospectionResp{Active: false}, introspect(t, ctl, newReferenceToken()))
+}
+
+func TestReferenceTokens_Downscope(t *testing.T) {
+	ctl, _ := newOpaqueController(t, db.NewReferenceTokens())
+
+	subject, err := ctl.issueExchanged(context.Background(), "service-a", "postgres-a", nil)
+	require.NoError(t, err)
+
+	w := downscopeToken(t, ctl, subject.AccessToken, url.Values{"roles": {"RO"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp IssueResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.True(t, isReferenceToken(resp.AccessToken))
+
+	downscoped := introspect(t, ctl, resp.AccessToken)
+	assert.True(t, downscoped.Active)
+	assert.Equal(t, []string{"RO"}, downscoped.Roles)
+}
+
+func TestReferenceTokens_StoreUnavailable(t *testing.T) {
+	ctl, _ := newOpaqueController(t, failingReferences{})
+
+	_, err := ctl.issueExchanged(context.Background(), "service-a", "postgres-a", nil)
+	var oauthErr *oauthError
+	require.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, http.StatusInternalServerError, oauthErr.status)
+
+	token := newReferenceToken()
+	w := postToken(t, ctl.IntrospectionHandler(), "postgres-a", token)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w = postToken(t, ctl.RevocationHandler(), "service-a", token)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
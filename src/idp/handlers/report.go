@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+)
+
+// AccessMatrixPath reports every grant of the realm permissions namespace,
+// relative to the realm issuer.
+const AccessMatrixPath = "/access_matrix"
+
+const defaultStaleDays = 30
+
+// AccessMatrixEntry is a role of a client on a scope.
+type AccessMatrixEntry struct {
+	Client string `json:"client"`
+	Scope  string `json:"scope"`
+	Role   string `json:"role"`
+	// GrantedAt is the last time the role was added according to the audit
+	// trail, nil if the trail does not reach back that far.
+	GrantedAt *time.Time `json:"granted_at,omitempty"`
+	// LastIssuedAt is the last time a token carrying the role was issued, nil
+	// if no such token was issued since usage is recorded.
+	LastIssuedAt *time.Time `json:"last_issued_at,omitempty"`
+	// Stale grants were neither granted nor used for stale_days, they are
+	// candidates for removal. No grant is stale before usage has been tracked
+	// for stale_days.
+	Stale bool `json:"stale"`
+}
+
+type AccessMatrix struct {
+	Realm       string    `json:"realm"`
+	GeneratedAt time.Time `json:"generated_at"`
+	StaleDays   int       `json:"stale_days"`
+	// UsageTrackedSince is when issuances started to be recorded.
+	UsageTrackedSince time.Time           `json:"usage_tracked_since"`
+	Entries           []AccessMatrixEntry `json:"entries"`
+}
+
+// recordUsage stores the issuance time of the token grants. A failure is only
+// logged, the token has already been issued.
+func (ctl *Controller) recordUsage(ctx context.Context, grants []db.GrantKey) {
+	if ctl.usage == nil || len(grants) == 0 {
+		return
+	}
+
+	if err := ctl.usage.RecordIssued(ctx, grants, time.Now()); err != nil {
+		log.Printf("failed to record grants usage of realm %s: %v", ctl.realm.Name, err)
+	}
+}
+
+// NewAccessMatrixHandler lists every client × scope × role of the namespace
+// with the last issuance of a token carrying it, for admins and approvers.
+// Grants unused for stale_days (30 by default) are flagged stale. The report is JSON unless format=csv is
+// passed or text/csv is accepted.
+func (ctl *Controller) NewAccessMatrixHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.mayReview); !ok {
+			return
+		}
+
+		staleDays := defaultStaleDays
+		if raw := r.URL.Query().Get("stale_days"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				respondError(w, "stale_days must be a positive number", http.StatusBadRequest)
+				return
+			}
+			staleDays = n
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+			if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+				format = "csv"
+			}
+		}
+		if format != "json" && format != "csv" {
+			respondError(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+
+		lister, ok := ctl.repository.(PermissionsLister)
+		if !ok {
+			respondError(w, "permissions repository can not be listed", http.StatusNotImplemented)
+			return
+		}
+
+		report, err := ctl.accessMatrix(r.Context(), lister, staleDays, time.Now())
+		if err != nil {
+			log.Printf("failed to build access matrix of realm %s: %v", ctl.realm.Name, err)
+			respondError(w, "access matrix is not available", http.StatusInternalServerError)
+			return
+		}
+
+		if format == "csv" {
+			writeAccessMatrixCSV(w, report)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, report)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+func (ctl *Controller) accessMatrix(ctx context.Context, lister PermissionsLister, staleDays int, now time.Time) (*AccessMatrix, error) {
+	permissions, err := lister.AllPermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lastIssued, err := ctl.usage.LastIssued(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	trackedSince, err := ctl.usage.TrackedSince(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	grantedAt, err := ctl.grantTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// a grant unused since tracking started may still be in use if tracking
+	// does not reach back stale_days
+	staleBefore := now.AddDate(0, 0, -staleDays)
+	tracked := trackedSince.Before(staleBefore)
+	report := &AccessMatrix{
+		Realm:             ctl.realm.Name,
+		GeneratedAt:       now,
+		StaleDays:         staleDays,
+		UsageTrackedSince: trackedSince,
+		Entries:           []AccessMatrixEntry{},
+	}
+	for client, scopes := range permissions {
+		for scope, roles := range scopes {
+			for _, role := range roles {
+				key := db.GrantKey{Client: client, Scope: scope, Role: role}
+				entry := AccessMatrixEntry{Client: client, Scope: scope, Role: role}
+
+				var lastSeen time.Time
+				if at, ok := grantedAt[key]; ok {
+					entry.GrantedAt = &at
+					lastSeen = at
+				}
+				if at, ok := lastIssued[key]; ok {
+					entry.LastIssuedAt = &at
+					lastSeen = latest(lastSeen, at)
+				}
+				entry.Stale = tracked && lastSeen.Before(staleBefore)
+
+				report.Entries = append(report.Entries, entry)
+			}
+		}
+	}
+
+	slices.SortFunc(report.Entries, func(a, b AccessMatrixEntry) int {
+		return strings.Compare(a.Client+"\x00"+a.Scope+"\x00"+a.Role, b.Client+"\x00"+b.Scope+"\x00"+b.Role)
+	})
+
+	return report, nil
+}
+
+// grantTimes replays the permission updates of the audit trail, the oldest
+// one first, to find when each role currently held was added.
+func (ctl *Controller) grantTimes(ctx context.Context) (map[db.GrantKey]time.Time, error) {
+	grantedAt := make(map[db.GrantKey]time.Time)
+	if ctl.audit == nil {
+		return grantedAt, nil
+	}
+
+	events, err := ctl.audit.List(ctx, db.AuditMaxEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[[2]string][]string)
+	for _, event := range slices.Backward(events) {
+		if event.Action != AuditPermissionsUpdated {
+			continue
+		}
+
+		binding := [2]string{event.Client, event.Scope}
+		for _, role := range held[binding] {
+			if !slices.Contains(event.Roles, role) {
+				delete(grantedAt, db.GrantKey{Client: event.Client, Scope: event.Scope, Role: role})
+			}
+		}
+		for _, role := range event.Roles {
+			if !slices.Contains(held[binding], role) {
+				grantedAt[db.GrantKey{Client: event.Client, Scope: event.Scope, Role: role}] = event.Time
+			}
+		}
+		held[binding] = event.Roles
+	}
+
+	return grantedAt, nil
+}
+
+func writeAccessMatrixCSV(w http.ResponseWriter, report *AccessMatrix) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"client", "scope", "role", "granted_at", "last_issued_at", "stale"})
+	for _, entry := range report.Entries {
+		out.Write([]string{
+			entry.Client,
+			entry.Scope,
+			entry.Role,
+			formatTime(entry.GrantedAt),
+			formatTime(entry.LastIssuedAt),
+			strconv.FormatBool(entry.Stale),
+		})
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("failed to write access matrix: %v", err)
+	}
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
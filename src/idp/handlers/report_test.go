@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAccessMatrixTest(t *testing.T) *Controller {
+	t.Helper()
+
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "service-a-token").Return("service-a", testClaims{}, nil)
+	k8sVerifier.On("VerifyWithClient", "admin-token").Return("auth-ui", testClaims{}, nil)
+
+	ctx := context.Background()
+	now := time.Now()
+	audit := db.NewAuditLog()
+	for _, event := range []db.AuditEvent{
+		{Time: now.AddDate(0, 0, -90), Action: AuditPermissionsUpdated, Client: "service-a", Scope: "postgres-a", Roles: []string{"RO", "RW"}},
+		{Time: now.AddDate(0, 0, -60), Action: AuditPermissionsUpdated, Client: "service-b", Scope: "postgres-a", Roles: []string{"RO"}},
+		{Time: now.AddDate(0, 0, -50), Action: AuditPermissionsUpdated, Client: "service-a", Scope: "postgres-a", Roles: []string{"RO"}},
+		{Time: now.AddDate(0, 0, -5), Action: AuditPermissionsUpdated, Client: "service-a", Scope: "postgres-a", Roles: []string{"RO", "RW"}},
+	} {
+		require.NoError(t, audit.Record(ctx, event))
+	}
+
+	usage := db.NewGrantUsage()
+	require.NoError(t, usage.RecordIssued(ctx, []db.GrantKey{{Client: "service-a", Scope: "postgres-a", Role: "RO"}}, now.Add(-time.Hour)))
+	require.NoError(t, usage.RecordIssued(ctx, []db.GrantKey{{Client: "service-b", Scope: "postgres-a", Role: "RO"}}, now.AddDate(0, 0, -40)))
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+
+	return &Controller{
+		realm:       realm,
+		k8sVerifier: k8sVerifier,
+		repository: db.NewRepository(map[string]map[string][]string{
+			"service-a": {"postgres-a": {"RO", "RW"}},
+			"service-b": {"postgres-a": {"RO"}},
+			"service-c": {"postgres-b": {"RO"}},
+		}),
+		audit: audit,
+		usage: trackedUsage{GrantUsage: usage, since: now.AddDate(0, 0, -100)},
+	}
+}
+
+// trackedUsage records usage since a time before the test started.
+type trackedUsage struct {
+	*db.GrantUsage
+	since time.Time
+}
+
+func (u trackedUsage) TrackedSince(context.Context) (time.Time, error) {
+	return u.since, nil
+}
+
+func getAccessMatrix(t *testing.T, ctl *Controller, target, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ctl.NewAccessMatrixHandler().ServeHTTP(w, req)
+
+	return w
+}
+
+func TestAccessMatrixHandler_JSON(t *testing.T) {
+	ctl := newAccessMatrixTest(t)
+
+	w := getAccessMatrix(t, ctl, AccessMatrixPath, "admin-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var report AccessMatrix
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, defaultStaleDays, report.StaleDays)
+	require.Len(t, report.Entries, 4)
+
+	stale := make(map[db.GrantKey]bool)
+	for _, entry := range report.Entries {
+		stale[db.GrantKey{Client: entry.Client, Scope: entry.Scope, Role: entry.Role}] = entry.Stale
+	}
+	assert.Equal(t, map[db.GrantKey]bool{
+		// used an hour ago
+		{Client: "service-a", Scope: "postgres-a", Role: "RO"}: false,
+		// granted again 5 days ago, never used
+		{Client: "service-a", Scope: "postgres-a", Role: "RW"}: false,
+		// last used 40 days ago
+		{Client: "service-b", Scope: "postgres-a", Role: "RO"}: true,
+		// neither granted nor used as far as known
+		{Client: "service-c", Scope: "postgres-b", Role: "RO"}: true,
+	}, stale)
+
+	rw := report.Entries[1]
+	assert.Equal(t, "RW", rw.Role)
+	require.NotNil(t, rw.GrantedAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, -5), *rw.GrantedAt, time.Second)
+	assert.Nil(t, rw.LastIssuedAt)
+
+	w = getAccessMatrix(t, ctl, AccessMatrixPath+"?stale_days=60", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.False(t, report.Entries[2].Stale)
+	assert.True(t, report.Entries[3].Stale)
+}
+
+func TestAccessMatrixHandler_RecentTracking(t *testing.T) {
+	ctl := newAccessMatrixTest(t)
+	usage := ctl.usage.(trackedUsage)
+	usage.since = time.Now().AddDate(0, 0, -10)
+	ctl.usage = usage
+
+	w := getAccessMatrix(t, ctl, AccessMatrixPath, "admin-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var report AccessMatrix
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.WithinDuration(t, usage.since, report.UsageTrackedSince, time.Second)
+	require.Len(t, report.Entries, 4)
+	for _, entry := range report.Entries {
+		assert.False(t, entry.Stale, "%s of %s on %s is not stale before usage was tracked for 30 days", entry.Role, entry.Client, entry.Scope)
+	}
+}
+
+func TestAccessMatrixHandler_CSV(t *testing.T) {
+	ctl := newAccessMatrixTest(t)
+
+	w := getAccessMatrix(t, ctl, AccessMatrixPath+"?format=csv", "admin-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	assert.Equal(t, []string{"client", "scope", "role", "granted_at", "last_issued_at", "stale"}, records[0])
+	assert.Equal(t, []string{"service-c", "postgres-b", "RO", "", "", "true"}, records[4])
+}
+
+func TestAccessMatrixHandler_Errors(t *testing.T) {
+	ctl := newAccessMatrixTest(t)
+
+	assert.Equal(t, http.StatusUnauthorized, getAccessMatrix(t, ctl, AccessMatrixPath, "").Code)
+	assert.Equal(t, http.StatusForbidden, getAccessMatrix(t, ctl, AccessMatrixPath, "service-a-token").Code)
+	assert.Equal(t, http.StatusBadRequest, getAccessMatrix(t, ctl, AccessMatrixPath+"?stale_days=0", "admin-token").Code)
+	assert.Equal(t, http.StatusBadRequest, getAccessMatrix(t, ctl, AccessMatrixPath+"?format=xml", "admin-token").Code)
+
+	ctl.repository = new(mockRepository)
+	assert.Equal(t, http.StatusNotImplemented, getAccessMatrix(t, ctl, AccessMatrixPath, "admin-token").Code)
+}
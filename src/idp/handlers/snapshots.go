@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+)
+
+// PermissionsSnapshotsPath lists the snapshots of the realm permissions
+// namespace, relative to the realm issuer. A snapshot is taken after every
+// change of the permission set.
+const PermissionsSnapshotsPath = "/permissions/snapshots"
+
+const (
+	defaultSnapshotsLimit = 100
+	maxSnapshotsLimit     = db.SnapshotMaxCount
+)
+
+var errRollbackNotSupported = errors.New("permissions repository can not be rolled back")
+
+type SnapshotsDiffResponse struct {
+	From int64 `json:"from"`
+	// To is zero for the current permission set.
+	To      int64               `json:"to"`
+	Changes []db.PermissionDiff `json:"changes"`
+}
+
+type RollbackReq struct {
+	Comment string `json:"comment"`
+}
+
+type RollbackResponse struct {
+	RolledBackTo int64 `json:"rolled_back_to"`
+	// Snapshot is the number of the snapshot taken after the rollback, zero
+	// if nothing had to change.
+	Snapshot int64               `json:"snapshot"`
+	Changes  []db.PermissionDiff `json:"changes"`
+}
+
+// initSnapshots takes the first snapshot of the namespace, so the first change
+// can be rolled back.
+func (ctl *Controller) initSnapshots(ctx context.Context) {
+	if ctl.snapshots == nil {
+		return
+	}
+
+	latest, err := ctl.snapshots.List(ctx, 1)
+	if err != nil {
+		log.Printf("failed to list permission snapshots of realm %s: %v", ctl.realm.Name, err)
+		return
+	} else if len(latest) > 0 {
+		return
+	}
+
+	ctl.takeSnapshot(ctx, systemActor, "initial permissions")
+}
+
+// takeSnapshot stores the current permission set. A failure is only logged,
+// the change it follows has already been made.
+func (ctl *Controller) takeSnapshot(ctx context.Context, actor, comment string) int64 {
+	lister, ok := ctl.repository.(PermissionsLister)
+	if !ok || ctl.snapshots == nil {
+		return 0
+	}
+
+	var revision int64
+	if batch, ok := ctl.repository.(BatchRepository); ok {
+		var err error
+		if revision, err = batch.PermissionsRevision(ctx); err != nil {
+			log.Printf("failed to read permissions revision for snapshot of realm %s: %v", ctl.realm.Name, err)
+			return 0
+		}
+	}
+
+	permissions, err := lister.AllPermissions(ctx)
+	if err != nil {
+		log.Printf("failed to read permissions for snapshot of realm %s: %v", ctl.realm.Name, err)
+		return 0
+	}
+
+	snapshot := &db.Snapshot{
+		Time:        time.Now(),
+		Actor:       actor,
+		Comment:     comment,
+		Revision:    revision,
+		Permissions: permissions,
+	}
+	if err := ctl.snapshots.Save(ctx, snapshot); err != nil {
+		log.Printf("failed to save permission snapshot of realm %s: %v", ctl.realm.Name, err)
+		return 0
+	}
+
+	return snapshot.Number
+}
+
+// NewListSnapshotsHandler returns the latest snapshots without their
+// permissions, the newest one first. Snapshots are read by admins and
+// approvers.
+func (ctl *Controller) NewListSnapshotsHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.mayReview); !ok {
+			return
+		}
+
+		limit := defaultSnapshotsLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				respondError(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxSnapshotsLimit)
+		}
+
+		snapshots, err := ctl.snapshots.List(r.Context(), limit)
+		if err != nil {
+			log.Printf("failed to list permission snapshots of realm %s: %v", ctl.realm.Name, err)
+			respondError(w, "permission snapshots are not available", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, snapshots)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+func (ctl *Controller) NewGetSnapshotHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.mayReview); !ok {
+			return
+		}
+
+		snapshot, ok := ctl.snapshot(w, r, r.PathValue("number"))
+		if !ok {
+			return
+		}
+
+		respondJSON(w, http.StatusOK, snapshot)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// NewDiffSnapshotsHandler compares the snapshot of the from query parameter
+// with the one of to, or with the current permission set if to is omitted.
+func (ctl *Controller) NewDiffSnapshotsHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.mayReview); !ok {
+			return
+		}
+
+		from, ok := ctl.snapshot(w, r, r.URL.Query().Get("from"))
+		if !ok {
+			return
+		}
+
+		resp := SnapshotsDiffResponse{From: from.Number}
+		var toPermissions map[string]map[string][]string
+		if rawTo := r.URL.Query().Get("to"); rawTo != "" {
+			to, ok := ctl.snapshot(w, r, rawTo)
+			if !ok {
+				return
+			}
+			resp.To, toPermissions = to.Number, to.Permissions
+		} else {
+			lister, ok := ctl.repository.(PermissionsLister)
+			if !ok {
+				respondError(w, "permissions repository can not be listed", http.StatusNotImplemented)
+				return
+			}
+
+			var err error
+			if toPermissions, err = lister.AllPermissions(r.Context()); err != nil {
+				log.Printf("failed to list permissions of realm %s: %v", ctl.realm.Name, err)
+				respondError(w, "permissions are not available", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp.Changes = db.DiffPermissions(from.Permissions, toPermissions)
+		respondJSON(w, http.StatusOK, resp)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// NewRollbackHandler restores the permission set of the snapshot in a single
+// transaction. Every client whose roles change is notified as on a normal
+// update, and a new snapshot is taken, so the rollback can be undone too. The
+// caller must be allowed to grant roles on every scope which changes.
+func (ctl *Controller) NewRollbackHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := ctl.authorizeCaller(w, r, ctl.mayReview)
+		if !ok {
+			return
+		}
+
+		var req RollbackReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			respondError(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		target, ok := ctl.snapshot(w, r, r.PathValue("number"))
+		if !ok {
+			return
+		}
+
+		resp, err := ctl.rollback(r.Context(), caller, target, req.Comment)
+		if errors.Is(err, errRollbackNotSupported) {
+			respondError(w, err.Error(), http.StatusNotImplemented)
+			return
+		} else if errors.Is(err, errForbidden) {
+			respondError(w, err.Error(), http.StatusForbidden)
+			return
+		} else if errors.Is(err, db.ErrConflict) {
+			respondError(w, "permissions changed during the rollback, retry it", http.StatusConflict)
+			return
+		} else if err != nil {
+			respondError(w, fmt.Sprintf("failed to roll back permissions: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, resp)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// rollback computes the changes against the current permission set and swaps
+// them in only if no other change was made meanwhile.
+func (ctl *Controller) rollback(ctx context.Context, caller *caller, target *db.Snapshot, comment string) (*RollbackResponse, error) {
+	lister, listerOK := ctl.repository.(PermissionsLister)
+	batch, batchOK := ctl.repository.(BatchRepository)
+	if !listerOK || !batchOK {
+		return nil, errRollbackNotSupported
+	}
+
+	revision, err := batch.PermissionsRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := lister.AllPermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RollbackResponse{
+		RolledBackTo: target.Number,
+		Changes:      db.DiffPermissions(current, target.Permissions),
+	}
+	if len(resp.Changes) == 0 {
+		return resp, nil
+	}
+
+	updates := make([]db.PermissionUpdate, 0, len(resp.Changes))
+	for _, change := range resp.Changes {
+		if !ctl.mayGrant(caller, change.Scope) {
+			return nil, fmt.Errorf("%w: scope %s", errForbidden, change.Scope)
+		}
+		updates = append(updates, db.PermissionUpdate{Client: change.Client, Scope: change.Scope, Roles: change.To})
+	}
+	if err := batch.CompareAndSwapPermissions(ctx, revision, updates); err != nil {
+		log.Printf("failed to roll back permissions of realm %s to snapshot %d: %v", ctl.realm.Name, target.Number, err)
+		return nil, err
+	}
+
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to snapshot %d", target.Number)
+	}
+	for _, update := range updates {
+		ctl.permissionsChanged(ctx, caller.ID, comment, update)
+	}
+	resp.Snapshot = ctl.takeSnapshot(ctx, caller.ID, comment)
+
+	log.Printf("permissions of realm %s rolled back to snapshot %d, changes: %d", ctl.realm.Name, target.Number, len(updates))
+
+	return resp, nil
+}
+
+// snapshot returns the snapshot of the raw number.
+func (ctl *Controller) snapshot(w http.ResponseWriter, r *http.Request, rawNumber string) (*db.Snapshot, bool) {
+	number, err := strconv.ParseInt(rawNumber, 10, 64)
+	if err != nil || number <= 0 {
+		respondError(w, fmt.Sprintf("invalid snapshot number %q", rawNumber), http.StatusBadRequest)
+		return nil, false
+	}
+
+	snapshot, err := ctl.snapshots.Get(r.Context(), number)
+	if errors.Is(err, db.ErrNotFound) {
+		respondError(w, fmt.Sprintf("snapshot %d not found", number), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("failed to get permission snapshot of realm %s: %v", ctl.realm.Name, err)
+		respondError(w, "failed to get permission snapshot", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return snapshot, true
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotsTest(t *testing.T) (*Controller, *db.Repository) {
+	t.Helper()
+
+	repo := db.NewRepository(map[string]map[string][]string{
+		"service-a": {"postgres-a": {"RO", "RW"}},
+		"service-b": {"postgres-a": {"RO"}},
+	})
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	realm.AccessRequests = &config.AccessRequestsConfig{Approvers: map[string][]string{
+		"postgres-a": {"dba"},
+		"postgres-b": {"lead"},
+	}}
+	ctl := &Controller{
+		realm:       realm,
+		repository:  repo,
+		events:      NewEventsBroker(),
+		audit:       db.NewAuditLog(),
+		snapshots:   db.NewSnapshots(),
+		k8sVerifier: workloadTokens{},
+	}
+	ctl.initSnapshots(context.Background())
+
+	return ctl, repo
+}
+
+func serveSnapshots(t *testing.T, handler http.HandlerFunc, method, target, number string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return serveSnapshotsAs(t, "auth-ui", handler, method, target, number, body)
+}
+
+// serveSnapshotsAs calls the handler as the workload of the client, without
+// credentials when the client is empty.
+func serveSnapshotsAs(t *testing.T, client string, handler http.HandlerFunc, method, target, number string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var raw []byte
+	if body != nil {
+		var err error
+		raw, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(method, target, bytes.NewReader(raw))
+	req.SetPathValue("number", number)
+	if client != "" {
+		req.Header.Set("Authorization", "Bearer sa:"+client)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestSnapshots_EveryChangeIsNumbered(t *testing.T) {
+	ctl, _ := newSnapshotsTest(t)
+	ctx := context.Background()
+
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-a", "postgres-a", []string{"RO"}))
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-c", "postgres-a", []string{"RO"}))
+
+	w := serveSnapshots(t, ctl.NewListSnapshotsHandler(), "GET", PermissionsSnapshotsPath, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var snapshots []db.Snapshot
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&snapshots))
+	require.Len(t, snapshots, 3)
+	assert.Equal(t, int64(3), snapshots[0].Number)
+	assert.Equal(t, "auth-ui", snapshots[0].Actor)
+	assert.Equal(t, int64(2), snapshots[0].Revision)
+	assert.Equal(t, int64(1), snapshots[2].Number)
+	assert.Equal(t, systemActor, snapshots[2].Actor)
+
+	w = serveSnapshots(t, ctl.NewGetSnapshotHandler(), "GET", PermissionsSnapshotsPath+"/2", "2", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var snapshot db.Snapshot
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&snapshot))
+	assert.Equal(t, map[string]map[string][]string{
+		"service-a": {"postgres-a": {"RO"}},
+		"service-b": {"postgres-a": {"RO"}},
+	}, snapshot.Permissions)
+
+	assert.Equal(t, http.StatusNotFound, serveSnapshots(t, ctl.NewGetSnapshotHandler(), "GET", PermissionsSnapshotsPath+"/9", "9", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serveSnapshots(t, ctl.NewGetSnapshotHandler(), "GET", PermissionsSnapshotsPath+"/x", "x", nil).Code)
+}
+
+func TestSnapshots_Diff(t *testing.T) {
+	ctl, _ := newSnapshotsTest(t)
+	ctx := context.Background()
+
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-a", "postgres-a", []string{"RO"}))
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-b", "postgres-a", []string{}))
+
+	w := serveSnapshots(t, ctl.NewDiffSnapshotsHandler(), "GET", PermissionsSnapshotsPath+"/diff?from=1&to=2", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var diff SnapshotsDiffResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&diff))
+	assert.Equal(t, int64(2), diff.To)
+	assert.Equal(t, []db.PermissionDiff{
+		{Client: "service-a", Scope: "postgres-a", From: []string{"RO", "RW"}, To: []string{"RO"}, Removed: []string{"RW"}},
+	}, diff.Changes)
+
+	// to is the current permission set when omitted
+	w = serveSnapshots(t, ctl.NewDiffSnapshotsHandler(), "GET", PermissionsSnapshotsPath+"/diff?from=1", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&diff))
+	assert.Zero(t, diff.To)
+	assert.Len(t, diff.Changes, 2)
+
+	assert.Equal(t, http.StatusBadRequest, serveSnapshots(t, ctl.NewDiffSnapshotsHandler(), "GET", PermissionsSnapshotsPath+"/diff", "", nil).Code)
+}
+
+func TestSnapshots_Rollback(t *testing.T) {
+	ctl, repo := newSnapshotsTest(t)
+	ctx := context.Background()
+
+	// a bad bulk update locks both services out
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-a", "postgres-a", []string{}))
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-b", "postgres-a", []string{}))
+	require.NoError(t, ctl.updatePermissions(ctx, "auth-ui", "service-c", "postgres-a", []string{"RO"}))
+
+	subscription, cancel := ctl.events.Subscribe("service-a")
+	defer cancel()
+
+	w := serveSnapshots(t, ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", RollbackReq{Comment: "undo bulk update"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp RollbackResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, int64(1), resp.RolledBackTo)
+	assert.Equal(t, int64(5), resp.Snapshot)
+	assert.Len(t, resp.Changes, 3)
+
+	assert.Equal(t, []string{"RO", "RW"}, repo.GetPermissions("service-a", "postgres-a"))
+	assert.Equal(t, []string{"RO"}, repo.GetPermissions("service-b", "postgres-a"))
+	assert.Equal(t, []string{}, repo.GetPermissions("service-c", "postgres-a"))
+
+	// holders of the tokens are notified as on a normal update
+	select {
+	case event := <-subscription:
+		assert.Equal(t, []string{"RO", "RW"}, event.Roles)
+		_, version := repo.GetVersionedPermissions("service-a", "postgres-a")
+		assert.Equal(t, version.Version, event.Version)
+	default:
+		t.Fatal("rollback is not published")
+	}
+
+	events, err := ctl.audit.List(ctx, 3)
+	require.NoError(t, err)
+	for _, event := range events {
+		assert.Equal(t, AuditPermissionsUpdated, event.Action)
+		assert.Equal(t, "undo bulk update", event.Comment)
+	}
+
+	latest, err := ctl.snapshots.Get(ctx, resp.Snapshot)
+	require.NoError(t, err)
+	first, err := ctl.snapshots.Get(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, db.DiffPermissions(first.Permissions, latest.Permissions))
+
+	// nothing changes on a repeated rollback
+	w = serveSnapshots(t, ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Empty(t, resp.Changes)
+	assert.Zero(t, resp.Snapshot)
+}
+
+func TestSnapshots_RollbackNotSupported(t *testing.T) {
+	ctl, _ := newSnapshotsTest(t)
+	require.NoError(t, ctl.snapshots.Save(context.Background(), &db.Snapshot{Permissions: map[string]map[string][]string{}}))
+	ctl.repository = new(mockRepository)
+
+	w := serveSnapshots(t, ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestSnapshots_Authorization(t *testing.T) {
+	ctl, repo := newSnapshotsTest(t)
+	require.NoError(t, ctl.updatePermissions(context.Background(), "auth-ui", "service-a", "postgres-a", []string{}))
+
+	handlers := map[string]struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		"list":     {ctl.NewListSnapshotsHandler(), "GET", PermissionsSnapshotsPath},
+		"get":      {ctl.NewGetSnapshotHandler(), "GET", PermissionsSnapshotsPath + "/1"},
+		"diff":     {ctl.NewDiffSnapshotsHandler(), "GET", PermissionsSnapshotsPath + "/diff?from=1"},
+		"rollback": {ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath + "/1/rollback"},
+	}
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, http.StatusUnauthorized, serveSnapshotsAs(t, "", h.handler, h.method, h.target, "1", nil).Code)
+			assert.Equal(t, http.StatusForbidden, serveSnapshotsAs(t, "service-a", h.handler, h.method, h.target, "1", nil).Code)
+		})
+	}
+
+	// approvers of other scopes read the history, but do not roll back postgres-a
+	w := serveSnapshotsAs(t, "lead", ctl.NewListSnapshotsHandler(), "GET", PermissionsSnapshotsPath, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveSnapshotsAs(t, "lead", ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, repo.GetPermissions("service-a", "postgres-a"))
+
+	w = serveSnapshotsAs(t, "dba", ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"RO", "RW"}, repo.GetPermissions("service-a", "postgres-a"))
+
+	latest, err := ctl.snapshots.List(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "dba", latest[0].Actor)
+}
+
+// racingRepository changes the permissions right after they are listed, like
+// a concurrent update between the read and the write of a rollback.
+type racingRepository struct {
+	*db.Repository
+	race func()
+}
+
+func (r *racingRepository) AllPermissions(ctx context.Context) (map[string]map[string][]string, error) {
+	permissions, err := r.Repository.AllPermissions(ctx)
+	if r.race != nil {
+		r.race()
+		r.race = nil
+	}
+	return permissions, err
+}
+
+func TestSnapshots_RollbackConflict(t *testing.T) {
+	ctl, repo := newSnapshotsTest(t)
+	require.NoError(t, ctl.updatePermissions(context.Background(), "auth-ui", "service-a", "postgres-a", []string{}))
+
+	racing := &racingRepository{Repository: repo}
+	racing.race = func() {
+		require.NoError(t, repo.UpdatePermissions("service-b", "postgres-a", []string{"RO", "RW"}))
+	}
+	ctl.repository = racing
+
+	w := serveSnapshots(t, ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Empty(t, repo.GetPermissions("service-a", "postgres-a"), "nothing is rolled back")
+	assert.Equal(t, []string{"RO", "RW"}, repo.GetPermissions("service-b", "postgres-a"), "the concurrent update is kept")
+
+	// a retry rolls back both changes
+	w = serveSnapshots(t, ctl.NewRollbackHandler(), "POST", PermissionsSnapshotsPath+"/1/rollback", "1", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"RO", "RW"}, repo.GetPermissions("service-a", "postgres-a"))
+	assert.Equal(t, []string{"RO"}, repo.GetPermissions("service-b", "postgres-a"))
+}
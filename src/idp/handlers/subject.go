@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/oidc"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tracing"
+)
+
+// TrustedVerifier checks subject tokens of a federated issuer and returns the
+// client they map to.
+type TrustedVerifier interface {
+	Verify(ctx context.Context, rawToken string) (string, error)
+}
+
+// trustedKey selects the verifier of a subject token.
+type trustedKey struct {
+	tokenType string
+	issuer    string
+}
+
+// verifySubject picks the verifier by the subject token type and issuer:
+// trusted issuers first, then the in-cluster k8s verifier, access tokens of
+// the realm, JWTs or reference ones, and the upstream provider of users. The
+// returned options carry what the subject adds to the issued token.
+func (ctl *Controller) verifySubject(ctx context.Context, tokenType, rawToken string) (string, *IssueOpts, error) {
+	// a malformed token is rejected by whichever verifier gets it
+	issuer, _ := oidc.UnverifiedIssuer(rawToken)
+	if trusted, ok := ctl.trusted[trustedKey{tokenType: tokenType, issuer: issuer}]; ok {
+		verifyCtx, span := tracing.Tracer().Start(ctx, "TrustedVerifier.Verify")
+		clientID, err := trusted.Verify(verifyCtx, rawToken)
+		tracing.End(span, err)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return clientID, &IssueOpts{}, nil
+	}
+
+	switch {
+	case tokenType == k8sTokenType && ctl.k8sVerifier != nil:
+		_, span := tracing.Tracer().Start(ctx, "K8sVerifier.VerifyWithClient")
+		clientID, _, err := ctl.k8sVerifier.VerifyWithClient(rawToken)
+		tracing.End(span, err)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to verify k8s token: %w", err)
+		}
+
+		return clientID, &IssueOpts{}, nil
+	case tokenType == accessTokenType && isReferenceToken(rawToken),
+		tokenType == accessTokenType && issuer == ctl.realm.Issuer && ctl.keys != nil:
+		return ctl.verifyAccessToken(ctx, rawToken)
+	case tokenType == idTokenType && ctl.upstream != nil:
+		verifyCtx, span := tracing.Tracer().Start(ctx, "UpstreamVerifier.Verify")
+		identity, err := ctl.upstream.Verify(verifyCtx, rawToken)
+		tracing.End(span, err)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to verify upstream id token: %w", err)
+		}
+
+		return identity.ClientID(), &IssueOpts{
+			GroupClients: identity.GroupClientIDs(),
+			TTL:          ctl.realm.Upstream.TokenTTL,
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("no trusted issuer %q of %s tokens", issuer, tokenType)
+	}
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	josejwt "github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockTrustedVerifier struct{ mock.Mock }
+
+func (m *mockTrustedVerifier) Verify(_ context.Context, rawToken string) (string, error) {
+	args := m.Called(rawToken)
+	return args.String(0), args.Error(1)
+}
+
+// unsignedSubjectToken only carries an iss for picking the verifier, the
+// verifiers are mocked.
+func unsignedSubjectToken(t *testing.T, issuer string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("test-secret-test-secret-test-sec")}, nil)
+	require.NoError(t, err)
+
+	raw, err := josejwt.Signed(signer).Claims(josejwt.Claims{
+		Issuer: issuer,
+		Expiry: josejwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}).CompactSerialize()
+	require.NoError(t, err)
+
+	return raw
+}
+
+func TestVerifySubject_PicksVerifierByTypeAndIssuer(t *testing.T) {
+	clusterB := unsignedSubjectToken(t, "https://oidc.cluster-b.example")
+	local := unsignedSubjectToken(t, "https://kubernetes.default.svc.cluster.local")
+	ci := unsignedSubjectToken(t, "https://ci.example")
+
+	trustedClusterB := new(mockTrustedVerifier)
+	trustedClusterB.On("Verify", clusterB).Return("cluster-b:service-a", nil)
+
+	trustedCI := new(mockTrustedVerifier)
+	trustedCI.On("Verify", ci).Return("ci:deploy", nil)
+
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", local).Return("service-a", testClaims{}, nil)
+
+	ctl := &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		trusted: map[trustedKey]TrustedVerifier{
+			{tokenType: k8sTokenType, issuer: "https://oidc.cluster-b.example"}: trustedClusterB,
+			{tokenType: jwtTokenType, issuer: "https://ci.example"}:             trustedCI,
+		},
+	}
+
+	for _, tc := range []struct {
+		tokenType, token, wantClient string
+	}{
+		{k8sTokenType, clusterB, "cluster-b:service-a"},
+		{k8sTokenType, local, "service-a"},
+		{jwtTokenType, ci, "ci:deploy"},
+	} {
+		clientID, opts, err := ctl.verifySubject(context.Background(), tc.tokenType, tc.token)
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantClient, clientID)
+		assert.Equal(t, &IssueOpts{}, opts)
+	}
+
+	// a token of a trusted issuer is not accepted as another token type
+	_, _, err := ctl.verifySubject(context.Background(), jwtTokenType, clusterB)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `no trusted issuer "https://oidc.cluster-b.example"`)
+
+	trustedClusterB.AssertExpectations(t)
+	trustedCI.AssertExpectations(t)
+	k8sVerifier.AssertExpectations(t)
+}
@@ -2,96 +2,410 @@ package handlers
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tracing"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange" // RFC 8693
-	k8sTokenType           = "urn:ietf:params:oauth:token-type:jwt:kubernetes"
+	grantTypeTokenExchange = config.GrantTypeTokenExchange
+	k8sTokenType           = config.TokenTypeK8s
+	idTokenType            = config.TokenTypeIDToken
+	accessTokenType        = config.TokenTypeAccessToken
+	jwtTokenType           = config.TokenTypeJWT
+
+	// dpopProofWindow is how far a proof iat may be from now, and how long
+	// its jti is kept to detect replays.
+	dpopProofWindow = time.Minute
 )
 
+var errRateLimited = errors.New("token requests rate limit exceeded")
+
 type TokenRequest struct {
 	GrantType        string `form:"grant_type"`
 	SubjectTokenType string `form:"subject_token_type"`
 	SubjectToken     string `form:"subject_token"`
 	Scope            string `form:"scope"`
+
+	// Roles and ExpiresIn narrow a downscoped token, they are ignored for
+	// other subject tokens.
+	Roles     string `form:"roles"`
+	ExpiresIn string `form:"expires_in"`
+
+	// BindCertificate opts in to a token bound to the client certificate
+	// of the exchange (RFC 8705). Only clients presenting the same
+	// certificate to the resource servers ask for it.
+	BindCertificate bool `form:"bind_certificate"`
+}
+
+func tokenRequestFromForm(r *http.Request) *TokenRequest {
+	return &TokenRequest{
+		GrantType:        r.FormValue("grant_type"),
+		SubjectTokenType: r.FormValue("subject_token_type"),
+		SubjectToken:     r.FormValue("subject_token"),
+		Scope:            r.FormValue("scope"),
+		Roles:            r.FormValue("roles"),
+		ExpiresIn:        r.FormValue("expires_in"),
+		BindCertificate:  r.FormValue("bind_certificate") == "true",
+	}
+}
+
+// OAuth error codes of the token endpoint (RFC 6749 section 5.2, RFC 9449
+// section 5), slow_down is borrowed from RFC 8628 for rate limited clients.
+// unsupported_token_type is returned by the revocation endpoint (RFC 7009
+// section 2.2.1).
+const (
+	errInvalidRequest       = "invalid_request"
+	errInvalidClient        = "invalid_client"
+	errInvalidGrant         = "invalid_grant"
+	errInvalidScope         = "invalid_scope"
+	errUnauthorizedClient   = "unauthorized_client"
+	errUnsupportedGrantType = "unsupported_grant_type"
+	errUnsupportedTokenType = "unsupported_token_type"
+	errInvalidDPoPProof     = "invalid_dpop_proof"
+	errSlowDown             = "slow_down"
+	errServerError          = "server_error"
+)
+
+// oauthError is an error response of the OAuth endpoints. The description is
+// shown to the client, err is the cause, which is only logged.
+type oauthError struct {
+	status      int
+	code        string
+	description string
+	retryAfter  time.Duration
+	err         error
+}
+
+func newOAuthError(status int, code, description string, err error) *oauthError {
+	return &oauthError{status: status, code: code, description: description, err: err}
+}
+
+func (e *oauthError) Error() string {
+	if e.err == nil {
+		return e.code + ": " + e.description
+	}
+	return fmt.Sprintf("%s: %s: %v", e.code, e.description, e.err)
+}
+
+func (e *oauthError) Unwrap() error {
+	return e.err
+}
+
+// OAuthErrorResp is the JSON error body of RFC 6749 section 5.2.
+type OAuthErrorResp struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// writeOAuthError responds with the error, errors of other types are
+// reported as server_error.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	var oauthErr *oauthError
+	if !errors.As(err, &oauthErr) {
+		oauthErr = newOAuthError(http.StatusInternalServerError, errServerError, "internal server error", err)
+	}
+
+	if oauthErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if oauthErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(oauthErr.retryAfter.Seconds()))))
+	}
+	writeNoStoreJSON(w, oauthErr.status, OAuthErrorResp{
+		Error:            oauthErr.code,
+		ErrorDescription: oauthErr.description,
+	})
+}
+
+// writeNoStoreJSON writes a response carrying tokens or token state, which
+// must not be cached (RFC 6749 section 5.1).
+func writeNoStoreJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
 }
 
 func (ctl *Controller) NewTokenHandler(ctx context.Context) (http.HandlerFunc, error) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		var err error
-		var scope, clientID string
-		issueStart := time.Now()
+
+		reqCtx, span := tracing.StartServerSpan(r, "TokenHandler")
 		defer func() {
-			issueDuration := float64(time.Since(issueStart).Milliseconds())
-			tokenResult := "ok"
-			if err != nil {
-				tokenResult = "error"
-			}
-			if clientID == "" {
-				clientID = "unknown"
-			}
-			if scope == "" {
-				scope = "unknown"
-			}
-
-			tokenIssuedTotal.WithLabelValues(tokenResult, clientID, scope).Inc()
-			tokenIssueDuration.WithLabelValues(tokenResult, clientID, scope).Observe(issueDuration)
+			tracing.End(span, err)
 		}()
 
 		if err = r.ParseForm(); err != nil {
 			log.Printf("failed to parse form request params: %v", err)
-			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			err = newOAuthError(http.StatusBadRequest, errInvalidRequest, "request body must be a valid form", err)
+			writeOAuthError(w, err)
 			return
 		}
 
-		// log.Printf("Incoming request: Method=%s, URL=%s, Body=%s", r.Method, r.URL, r.Form)
+		req := tokenRequestFromForm(r)
 
-		req := TokenRequest{
-			GrantType:        r.FormValue("grant_type"),
-			SubjectTokenType: r.FormValue("subject_token_type"),
-			SubjectToken:     r.FormValue("subject_token"),
-			Scope:            r.FormValue("scope"),
-		}
-		scope = req.Scope
-
-		if req.GrantType != grantTypeTokenExchange {
-			log.Printf("unexpected grant_type: %s", req.GrantType)
-			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
-			return
-		} else if req.SubjectTokenType != k8sTokenType {
-			log.Printf("unexpected subject_token_type: %s", req.GrantType)
-			http.Error(w, `{"error":"unsupported_subject_token_type"}`, http.StatusBadRequest)
+		var issueResp *IssueResp
+		issueResp, err = ctl.exchange(reqCtx, req, func() (*IssueOpts, error) {
+			return ctl.issueOptsFromRequest(r, req.BindCertificate)
+		})
+		if err != nil {
+			writeOAuthError(w, err)
 			return
 		}
 
-		clientID, _, err = ctl.k8sVerifier.VerifyWithClient(req.SubjectToken)
+		writeNoStoreJSON(w, http.StatusOK, tokenResponse(ctl.realm, issueResp))
+	}
+
+	return baseMetricsMiddleware(handler), nil
+}
+
+// exchange verifies the subject token and issues a token of the realm, it is
+// shared by the HTTP and gRPC token endpoints. bind is called once the client
+// is known and may bind the token to a key of the client. Errors are of type
+// *oauthError.
+func (ctl *Controller) exchange(ctx context.Context, req *TokenRequest, bind func() (*IssueOpts, error)) (resp *IssueResp, err error) {
+	var clientID string
+	issueStart := time.Now()
+
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("idp.realm", ctl.realm.Name),
+			attribute.String("idp.client_id", clientID),
+			attribute.String("idp.scope", req.Scope),
+		)
+
+		observeExchange(clientID, req.Scope, issueStart, err)
+		ctl.notifyDenied(req, clientID, req.Scope, err)
+	}()
+
+	if err := ctl.validateTokenRequest(req); err != nil {
+		log.Printf("invalid token request in realm %s: %v", ctl.realm.Name, err)
+		return nil, err
+	}
+
+	clientID, issueOpts, err := ctl.authorizeExchange(ctx, req, bind)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctl.issueExchanged(ctx, clientID, req.Scope, issueOpts)
+}
+
+// authorizeExchange verifies the subject token, checks the rate limit of the
+// client and binds the tokens to be issued.
+func (ctl *Controller) authorizeExchange(ctx context.Context, req *TokenRequest, bind func() (*IssueOpts, error)) (string, *IssueOpts, error) {
+	clientID, subjectOpts, err := ctl.verifySubject(ctx, req.SubjectTokenType, req.SubjectToken)
+	if err != nil {
+		log.Printf("failed to verify subject token in realm %s: %v", ctl.realm.Name, err)
+		return "", nil, newOAuthError(http.StatusBadRequest, errInvalidGrant, "subject token is invalid or expired", err)
+	}
+
+	if ctl.limiter != nil {
+		allowed, retryAfter, err := ctl.limiter.Allow(ctx, ctl.rateLimitKey(clientID))
 		if err != nil {
-			log.Printf("failed to verify k8s token: %v", err)
-			http.Error(w, `{"error":"token_not_verified"}`, http.StatusBadRequest)
-			return
+			log.Printf("failed to check rate limit, clientID: %s: %v", clientID, err)
+			return clientID, nil, newOAuthError(http.StatusInternalServerError, errServerError, "rate limit is not available", err)
+		} else if !allowed {
+			log.Printf("token requests rate limited, realm: %s, clientID: %s", ctl.realm.Name, clientID)
+			rateLimitErr := newOAuthError(http.StatusTooManyRequests, errSlowDown, "too many token requests, retry later", errRateLimited)
+			rateLimitErr.retryAfter = retryAfter
+			return clientID, nil, rateLimitErr
 		}
+	}
 
-		issueResp, err := ctl.issuer.IssueToken(clientID, scope)
-		if err != nil {
-			log.Printf("failed to issue idp token: %v", err)
-			http.Error(w, `{"error":"access_denied"}`, http.StatusForbidden)
-			return
+	issueOpts, err := bind()
+	var bindErr *oauthError
+	if errors.As(err, &bindErr) {
+		log.Printf("failed to bind token, clientID: %s: %v", clientID, err)
+		return clientID, nil, bindErr
+	} else if err != nil {
+		log.Printf("failed to verify dpop proof, clientID: %s: %v", clientID, err)
+		return clientID, nil, newOAuthError(http.StatusBadRequest, errInvalidDPoPProof, "dpop proof is invalid", err)
+	}
+	issueOpts.GroupClients = subjectOpts.GroupClients
+	issueOpts.TTL = subjectOpts.TTL
+	if subjectOpts.Downscope != nil {
+		if err := downscope(req, subjectOpts.Downscope, issueOpts); err != nil {
+			log.Printf("invalid downscoping request, clientID: %s: %v", clientID, err)
+			return clientID, nil, err
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		// json.NewEncoder(w).Encode(issueResp)
-		if err := json.NewEncoder(w).Encode(issueResp); err != nil {
-			log.Printf("failed to write token response: %v", err)
-			http.Error(w, `{"error":"internal_error"}`, http.StatusInternalServerError)
-			return
+	return clientID, issueOpts, nil
+}
+
+// issueExchanged issues the token of the scope to the authorized client.
+func (ctl *Controller) issueExchanged(ctx context.Context, clientID, scope string, opts *IssueOpts) (*IssueResp, error) {
+	_, issueSpan := tracing.Tracer().Start(ctx, "Issuer.IssueToken")
+	resp, err := ctl.issuer.IssueToken(clientID, scope, opts)
+	tracing.End(issueSpan, err)
+	if errors.Is(err, errNoPermissions) {
+		log.Printf("client is not authorized for the scope, realm: %s: %v", ctl.realm.Name, err)
+		return nil, newOAuthError(http.StatusBadRequest, errUnauthorizedClient, "client is not authorized for the scope", err)
+	} else if err != nil {
+		log.Printf("failed to issue idp token: %v", err)
+		return nil, newOAuthError(http.StatusInternalServerError, errServerError, "failed to issue token", err)
+	}
+	if ctl.realm.OpaqueTokens {
+		if err := ctl.saveReferenceToken(ctx, resp); err != nil {
+			log.Printf("failed to issue reference token: %v", err)
+			return nil, newOAuthError(http.StatusInternalServerError, errServerError, "failed to issue token", err)
 		}
+	}
+
+	log.Printf("token issued, realm: %s, clientID: %s, scope: %s", ctl.realm.Name, clientID, scope)
+	ctl.recordUsage(ctx, resp.Grants)
 
-		log.Printf("token issued, clientID: %s, scope: %s", clientID, scope)
+	return resp, nil
+}
+
+// observeExchange counts the exchange in the token metrics.
+func observeExchange(clientID, scope string, issueStart time.Time, err error) {
+	issueDuration := float64(time.Since(issueStart).Milliseconds())
+	tokenResult := "ok"
+	if err != nil {
+		tokenResult = "error"
+	}
+	if clientID == "" {
+		clientID = "unknown"
+	}
+	if scope == "" {
+		scope = "unknown"
 	}
 
-	return baseMetricsMiddleware(handler), nil
+	tokenIssuedTotal.WithLabelValues(tokenResult, clientID, scope).Inc()
+	tokenIssueDuration.WithLabelValues(tokenResult, clientID, scope).Observe(issueDuration)
+}
+
+// notifyDenied reports an exchange rejected because of the client to the
+// webhooks. Only clients whose subject token was verified are reported, and
+// repeated denials are aggregated, so unauthenticated or misbehaving callers
+// cannot flood the webhooks. Rate limited requests are not reported.
+func (ctl *Controller) notifyDenied(req *TokenRequest, clientID, scope string, err error) {
+	var denied *oauthError
+	if clientID == "" || !errors.As(err, &denied) || denied.status >= http.StatusInternalServerError || denied.code == errSlowDown {
+		return
+	}
+
+	if scope == "" {
+		scope = "unknown"
+	}
+	notify, suppressed := ctl.denials.allow(deniedKey{client: clientID, scope: scope, code: denied.code}, time.Now())
+	if !notify {
+		return
+	}
+	ctl.notify(config.WebhookEventTokenDenied, TokenDeniedEvent{
+		ClientID:         clientID,
+		Scope:            scope,
+		SubjectTokenType: req.SubjectTokenType,
+		Error:            denied.code,
+		ErrorDescription: denied.description,
+		Suppressed:       suppressed,
+	})
+}
+
+// validateTokenRequest checks the parameters before the subject token is
+// verified.
+func (ctl *Controller) validateTokenRequest(req *TokenRequest) error {
+	if err := ctl.validateSubjectParams(req); err != nil {
+		return err
+	}
+
+	switch {
+	case req.Scope == "":
+		return newOAuthError(http.StatusBadRequest, errInvalidScope, "scope is required", nil)
+	case strings.ContainsAny(req.Scope, " \t"):
+		return newOAuthError(http.StatusBadRequest, errInvalidScope, "a token is issued for a single scope", nil)
+	}
+
+	return nil
+}
+
+// validateSubjectParams checks the grant and subject token parameters. A
+// subject token type the realm does not accept is an unsupported parameter
+// value of the request (RFC 8693 section 2.2.2).
+func (ctl *Controller) validateSubjectParams(req *TokenRequest) error {
+	switch {
+	case req.GrantType == "":
+		return newOAuthError(http.StatusBadRequest, errInvalidRequest, "grant_type is required", nil)
+	case req.GrantType != grantTypeTokenExchange || !ctl.realm.SupportsGrantType(req.GrantType):
+		return newOAuthError(http.StatusBadRequest, errUnsupportedGrantType, "grant type is not supported by the realm",
+			fmt.Errorf("unexpected grant_type %q", req.GrantType))
+	case req.SubjectToken == "":
+		return newOAuthError(http.StatusBadRequest, errInvalidRequest, "subject_token is required", nil)
+	case req.SubjectTokenType == "":
+		return newOAuthError(http.StatusBadRequest, errInvalidRequest, "subject_token_type is required", nil)
+	case !ctl.realm.SupportsSubjectTokenType(req.SubjectTokenType):
+		return newOAuthError(http.StatusBadRequest, errInvalidRequest, "subject token type is not accepted by the realm",
+			fmt.Errorf("unexpected subject_token_type %q", req.SubjectTokenType))
+	}
+
+	return nil
+}
+
+// issueOptsFromRequest binds the token to the client certificate when the
+// client asks for it over mTLS (RFC 8705), and to the DPoP key when the
+// request carries a proof (RFC 9449). A certificate presented to the IdP
+// alone does not bind the token, the client may call resource servers
+// without it.
+func (ctl *Controller) issueOptsFromRequest(r *http.Request, bindCertificate bool) (*IssueOpts, error) {
+	opts := &IssueOpts{}
+	if bindCertificate {
+		var peerCerts []*x509.Certificate
+		if r.TLS != nil {
+			peerCerts = r.TLS.PeerCertificates
+		}
+		cnf, err := certificateConfirmation(peerCerts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Cnf = cnf
+	}
+
+	rawProof := r.Header.Get(dpop.HeaderName)
+	if rawProof == "" {
+		return opts, nil
+	}
+
+	proof, err := ctl.dpop.Verify(r.Context(), rawProof, r.Method, dpop.RequestURI(r), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Cnf == nil {
+		opts.Cnf = &tokens.Confirmation{}
+	}
+	opts.Cnf.Jkt = proof.JKT
+
+	return opts, nil
+}
+
+// certificateConfirmation returns the confirmation of the client certificate,
+// the exchange asking for a bound token must come over mTLS.
+func certificateConfirmation(peerCerts []*x509.Certificate) (*tokens.Confirmation, error) {
+	if len(peerCerts) == 0 {
+		return nil, newOAuthError(http.StatusBadRequest, errInvalidRequest, "bind_certificate requires a client certificate", nil)
+	}
+
+	return &tokens.Confirmation{X5tS256: jwks.GetX5tS256(peerCerts[0])}, nil
 }
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxBatchScopes bounds the tokens issued by a single batch request.
+const maxBatchScopes = 64
+
+// BatchTokenResp carries either a token or an error for every requested
+// scope. Tokens are in the token endpoint format of the realm.
+type BatchTokenResp struct {
+	Tokens map[string]any            `json:"tokens"`
+	Errors map[string]OAuthErrorResp `json:"errors,omitempty"`
+}
+
+// NewBatchTokenHandler exchanges a subject token for tokens of several scopes,
+// the scope parameter lists them separated by spaces. The subject token is
+// verified once, and the batch counts as a single request in the rate limit.
+func (ctl *Controller) NewBatchTokenHandler() http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		reqCtx, span := tracing.StartServerSpan(r, "BatchTokenHandler")
+		defer func() {
+			tracing.End(span, err)
+		}()
+
+		if err = r.ParseForm(); err != nil {
+			log.Printf("failed to parse form request params: %v", err)
+			err = newOAuthError(http.StatusBadRequest, errInvalidRequest, "request body must be a valid form", err)
+			writeOAuthError(w, err)
+			return
+		}
+
+		req := tokenRequestFromForm(r)
+
+		var resp *BatchTokenResp
+		resp, err = ctl.exchangeBatch(reqCtx, req, func() (*IssueOpts, error) {
+			return ctl.issueOptsFromRequest(r, req.BindCertificate)
+		})
+		if err != nil {
+			writeOAuthError(w, err)
+			return
+		}
+
+		writeNoStoreJSON(w, http.StatusOK, resp)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// exchangeBatch verifies the subject token once and issues a token for every
+// scope of the request. A scope which fails does not fail the others, errors
+// of the request itself are of type *oauthError.
+func (ctl *Controller) exchangeBatch(ctx context.Context, req *TokenRequest, bind func() (*IssueOpts, error)) (resp *BatchTokenResp, err error) {
+	var clientID string
+	scopes := uniqueFields(req.Scope)
+	issueStart := time.Now()
+
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("idp.realm", ctl.realm.Name),
+			attribute.String("idp.client_id", clientID),
+			attribute.StringSlice("idp.scopes", scopes),
+		)
+
+		if err == nil {
+			return
+		} else if clientID == "" {
+			// the scopes of a request which failed before authorization are
+			// not trusted as metric labels
+			observeExchange(clientID, "", issueStart, err)
+		} else {
+			for _, scope := range scopes[:min(len(scopes), maxBatchScopes)] {
+				observeExchange(clientID, scope, issueStart, err)
+			}
+		}
+		ctl.notifyDenied(req, clientID, strings.Join(scopes, " "), err)
+	}()
+
+	if err := ctl.validateBatchTokenRequest(req, scopes); err != nil {
+		log.Printf("invalid batch token request in realm %s: %v", ctl.realm.Name, err)
+		return nil, err
+	}
+
+	clientID, issueOpts, err := ctl.authorizeExchange(ctx, req, bind)
+	if err != nil {
+		return nil, err
+	}
+
+	resp = &BatchTokenResp{Tokens: make(map[string]any, len(scopes))}
+	for _, scope := range scopes {
+		scopeStart := time.Now()
+		issueResp, err := ctl.issueExchanged(ctx, clientID, scope, issueOpts)
+		observeExchange(clientID, scope, scopeStart, err)
+		if err != nil {
+			var oauthErr *oauthError
+			errors.As(err, &oauthErr)
+			if resp.Errors == nil {
+				resp.Errors = make(map[string]OAuthErrorResp)
+			}
+			resp.Errors[scope] = OAuthErrorResp{Error: oauthErr.code, ErrorDescription: oauthErr.description}
+			continue
+		}
+
+		resp.Tokens[scope] = tokenResponse(ctl.realm, issueResp)
+	}
+
+	log.Printf("batch token request served, realm: %s, clientID: %s, tokens: %d, errors: %d", ctl.realm.Name, clientID, len(resp.Tokens), len(resp.Errors))
+
+	return resp, nil
+}
+
+func (ctl *Controller) validateBatchTokenRequest(req *TokenRequest, scopes []string) error {
+	if err := ctl.validateSubjectParams(req); err != nil {
+		return err
+	}
+
+	switch {
+	case len(scopes) == 0:
+		return newOAuthError(http.StatusBadRequest, errInvalidScope, "scope is required", nil)
+	case len(scopes) > maxBatchScopes:
+		return newOAuthError(http.StatusBadRequest, errInvalidScope, fmt.Sprintf("at most %d scopes are issued by a batch", maxBatchScopes), nil)
+	}
+
+	return nil
+}
+
+// uniqueFields splits space separated values like scopes (RFC 6749 section
+// 3.3), keeping the order of the first occurrences.
+func uniqueFields(raw string) []string {
+	values := []string{}
+	for _, value := range strings.Fields(raw) {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postBatchToken(t *testing.T, ctl *Controller, scope, subjectToken string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token_type": {k8sTokenType},
+		"subject_token":      {subjectToken},
+		"scope":              {scope},
+	}
+	req := httptest.NewRequest(http.MethodPost, BatchTokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ctl.NewBatchTokenHandler().ServeHTTP(w, req)
+
+	return w
+}
+
+func manyScopes(n int) string {
+	scopes := make([]string, 0, n)
+	for i := range n {
+		scopes = append(scopes, "scope"+strconv.Itoa(i))
+	}
+
+	return strings.Join(scopes, " ")
+}
+
+func TestBatchTokenHandler(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(&IssueResp{AccessToken: "token1", Type: "Bearer", ExpiresIn: 300}, nil)
+	issuer.On("IssueToken", "client1", "scope2", &IssueOpts{}).Return(&IssueResp{AccessToken: "token2", Type: "Bearer", ExpiresIn: 300}, nil)
+	issuer.On("IssueToken", "client1", "broken", &IssueOpts{}).Return(nil, errors.New("signer unavailable"))
+
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: issuer}
+
+	w := postBatchToken(t, ctl, "scope1 scope2 scope1 broken", "valid-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var resp struct {
+		Tokens map[string]IssueResp      `json:"tokens"`
+		Errors map[string]OAuthErrorResp `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Tokens, 2)
+	assert.Equal(t, "token1", resp.Tokens["scope1"].AccessToken)
+	assert.Equal(t, "token2", resp.Tokens["scope2"].AccessToken)
+	assert.Equal(t, int64(300), resp.Tokens["scope2"].ExpiresIn)
+	assert.Equal(t, map[string]OAuthErrorResp{
+		"broken": {Error: errServerError, ErrorDescription: "failed to issue token"},
+	}, resp.Errors)
+
+	// the subject token is verified once for the whole batch, duplicates are
+	// issued once
+	k8sVerifier.AssertNumberOfCalls(t, "VerifyWithClient", 1)
+	issuer.AssertNumberOfCalls(t, "IssueToken", 3)
+}
+
+func TestBatchTokenHandler_RequestErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		scope        string
+		subjectToken string
+		limiter      *rateLimiter
+		status       int
+		code         string
+	}{
+		{
+			name:         "missing scope",
+			scope:        " ",
+			subjectToken: "valid-token",
+			status:       http.StatusBadRequest,
+			code:         errInvalidScope,
+		},
+		{
+			name:         "too many scopes",
+			scope:        manyScopes(maxBatchScopes + 1),
+			subjectToken: "valid-token",
+			status:       http.StatusBadRequest,
+			code:         errInvalidScope,
+		},
+		{
+			name:         "invalid subject_token",
+			scope:        "scope1 scope2",
+			subjectToken: "invalid-token",
+			status:       http.StatusBadRequest,
+			code:         errInvalidGrant,
+		},
+		{
+			name:         "rate limited",
+			scope:        "scope1 scope2",
+			subjectToken: "valid-token",
+			limiter:      newRateLimiter(0, time.Minute),
+			status:       http.StatusTooManyRequests,
+			code:         errSlowDown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sVerifier := new(mockK8sVerifier)
+			k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil).Maybe()
+			k8sVerifier.On("VerifyWithClient", "invalid-token").Return("", testClaims{}, errors.New("token signature mismatch")).Maybe()
+
+			issuer := new(mockIssuer)
+			ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: issuer}
+			if tt.limiter != nil {
+				ctl.limiter = tt.limiter
+			}
+
+			w := postBatchToken(t, ctl, tt.scope, tt.subjectToken)
+			assert.Equal(t, tt.status, w.Code)
+
+			var resp OAuthErrorResp
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, tt.code, resp.Error)
+			issuer.AssertNotCalled(t, "IssueToken")
+		})
+	}
+}
+
+func TestBatchTokenHandler_UnauthorizedMetrics(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "invalid-token").Return("", testClaims{}, errors.New("token signature mismatch"))
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: new(mockIssuer)}
+
+	unknown := tokenIssuedTotal.WithLabelValues("error", "unknown", "unknown")
+	before := testutil.ToFloat64(unknown)
+
+	w := postBatchToken(t, ctl, "forged-scope1 forged-scope2", "invalid-token")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the request is counted once, without the scopes of the caller
+	assert.Equal(t, before+1, testutil.ToFloat64(unknown))
+	assert.Zero(t, testutil.ToFloat64(tokenIssuedTotal.WithLabelValues("error", "unknown", "forged-scope1")))
+}
+
+func TestBatchTokenHandler_CountsOnceInRateLimit(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(&IssueResp{AccessToken: "token1"}, nil)
+	issuer.On("IssueToken", "client1", "scope2", &IssueOpts{}).Return(&IssueResp{AccessToken: "token2"}, nil)
+
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: issuer, limiter: newRateLimiter(1, time.Minute)}
+
+	assert.Equal(t, http.StatusOK, postBatchToken(t, ctl, "scope1 scope2", "valid-token").Code)
+	assert.Equal(t, http.StatusTooManyRequests, postBatchToken(t, ctl, "scope1 scope2", "valid-token").Code)
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTokenHandler_ErrorConformance checks the error responses against RFC
+// 6749 section 5.2 and RFC 8693 section 2.2.2.
+func TestTokenHandler_ErrorConformance(t *testing.T) {
+	validForm := func() url.Values {
+		return url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token_type": {k8sTokenType},
+			"subject_token":      {"valid-token"},
+			"scope":              {"scope1"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		form    func() url.Values
+		limiter *rateLimiter
+		status  int
+		code    string
+	}{
+		{
+			name:   "form body with invalid encoding",
+			body:   "grant_type=%zz",
+			status: http.StatusBadRequest,
+			code:   errInvalidRequest,
+		},
+		{
+			name:   "missing grant_type",
+			form:   func() url.Values { f := validForm(); f.Del("grant_type"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidRequest,
+		},
+		{
+			name:   "unsupported grant_type",
+			form:   func() url.Values { f := validForm(); f.Set("grant_type", "client_credentials"); return f },
+			status: http.StatusBadRequest,
+			code:   errUnsupportedGrantType,
+		},
+		{
+			name:   "missing subject_token",
+			form:   func() url.Values { f := validForm(); f.Del("subject_token"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidRequest,
+		},
+		{
+			name:   "missing subject_token_type",
+			form:   func() url.Values { f := validForm(); f.Del("subject_token_type"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidRequest,
+		},
+		{
+			name:   "subject_token_type not accepted by the realm",
+			form:   func() url.Values { f := validForm(); f.Set("subject_token_type", "urn:example:unknown"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidRequest,
+		},
+		{
+			name:   "missing scope",
+			form:   func() url.Values { f := validForm(); f.Del("scope"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidScope,
+		},
+		{
+			name:   "several scopes",
+			form:   func() url.Values { f := validForm(); f.Set("scope", "scope1 scope2"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidScope,
+		},
+		{
+			name:   "invalid subject_token",
+			form:   func() url.Values { f := validForm(); f.Set("subject_token", "invalid-token"); return f },
+			status: http.StatusBadRequest,
+			code:   errInvalidGrant,
+		},
+		{
+			name:    "rate limited",
+			form:    validForm,
+			limiter: newRateLimiter(0, time.Minute),
+			status:  http.StatusTooManyRequests,
+			code:    errSlowDown,
+		},
+		{
+			name:   "client without permissions on the scope",
+			form:   func() url.Values { f := validForm(); f.Set("scope", "forbidden"); return f },
+			status: http.StatusBadRequest,
+			code:   errUnauthorizedClient,
+		},
+		{
+			name:   "issuer failure",
+			form:   func() url.Values { f := validForm(); f.Set("scope", "broken"); return f },
+			status: http.StatusInternalServerError,
+			code:   errServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sVerifier := new(mockK8sVerifier)
+			k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil).Maybe()
+			k8sVerifier.On("VerifyWithClient", "invalid-token").Return("", testClaims{}, errors.New("token signature mismatch")).Maybe()
+
+			issuer := new(mockIssuer)
+			issuer.On("IssueToken", "client1", "broken", &IssueOpts{}).Return(nil, errors.New("signer unavailable")).Maybe()
+			issuer.On("IssueToken", "client1", "forbidden", &IssueOpts{}).Return(nil, fmt.Errorf("%w, client: client1, scope: forbidden", errNoPermissions)).Maybe()
+
+			ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: issuer}
+			if tt.limiter != nil {
+				ctl.limiter = tt.limiter
+			}
+
+			handler, err := ctl.NewTokenHandler(context.Background())
+			require.NoError(t, err)
+
+			body := tt.body
+			if tt.form != nil {
+				body = tt.form().Encode()
+			}
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			assert.Equal(t, "no-cache", w.Header().Get("Pragma"))
+
+			var resp OAuthErrorResp
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.code, resp.Error)
+			assert.NotEmpty(t, resp.ErrorDescription)
+			// the description is shown to clients, causes must not leak into it
+			assert.NotContains(t, resp.ErrorDescription, "signature mismatch")
+			assert.NotContains(t, resp.ErrorDescription, "signer unavailable")
+
+			if tt.status == http.StatusTooManyRequests {
+				assert.NotEmpty(t, w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// TestTokenHandler_UnauthorizedClient issues with the repository of the realm,
+// a client without roles on the scope gets no token.
+func TestTokenHandler_UnauthorizedClient(t *testing.T) {
+	realm := testRealm()
+	repo := db.NewRepository(map[string]map[string][]string{"service-a": {"postgres-a": {"RO"}}})
+	issuer, err := NewIssuer(realm, jwks.GenerateKeyPair(), repo)
+	require.NoError(t, err)
+
+	ctl := &Controller{realm: realm, k8sVerifier: workloadTokens{}, issuer: issuer}
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		client string
+		scope  string
+		status int
+	}{
+		{client: "service-a", scope: "postgres-a", status: http.StatusOK},
+		{client: "service-a", scope: "postgres-b", status: http.StatusBadRequest},
+		{client: "service-b", scope: "postgres-a", status: http.StatusBadRequest},
+	} {
+		form := url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token_type": {k8sTokenType},
+			"subject_token":      {"sa:" + tt.client},
+			"scope":              {tt.scope},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		require.Equal(t, tt.status, w.Code, "%s on %s: %s", tt.client, tt.scope, w.Body.String())
+		if tt.status != http.StatusOK {
+			var resp OAuthErrorResp
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, errUnauthorizedClient, resp.Error)
+		}
+	}
+}
+
+func TestTokenHandler_SuccessIsNotCached(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(&IssueResp{AccessToken: "token123"}, nil)
+
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier, issuer: issuer}
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	form := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token_type": {k8sTokenType},
+		"subject_token":      {"valid-token"},
+		"scope":              {"scope1"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "no-cache", w.Header().Get("Pragma"))
+}
@@ -2,6 +2,13 @@ package handlers
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -9,11 +16,25 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-jose/go-jose/v3"
+	josejwt "github.com/go-jose/go-jose/v3/jwt"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/oidc"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // Реализация jwt.Claims для тестов
@@ -36,10 +57,20 @@ func (m *mockK8sVerifier) VerifyWithClient(token string) (string, jwt.Claims, er
 	return args.String(0), args.Get(1).(jwt.Claims), args.Error(2)
 }
 
+type mockUpstreamVerifier struct{ mock.Mock }
+
+func (m *mockUpstreamVerifier) Verify(_ context.Context, rawIDToken string) (*oidc.Identity, error) {
+	args := m.Called(rawIDToken)
+	if identity := args.Get(0); identity != nil {
+		return identity.(*oidc.Identity), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
 type mockIssuer struct{ mock.Mock }
 
-func (m *mockIssuer) IssueToken(clientID, scope string) (*IssueResp, error) {
-	args := m.Called(clientID, scope)
+func (m *mockIssuer) IssueToken(clientID, scope string, opts *IssueOpts) (*IssueResp, error) {
+	args := m.Called(clientID, scope, opts)
 	if resp := args.Get(0); resp != nil {
 		return resp.(*IssueResp), args.Error(1)
 	}
@@ -58,6 +89,10 @@ func (m *mockRepository) GetPermissions(client, scope string) []string {
 	return args.Get(0).([]string)
 }
 
+func testRealm() *config.Realm {
+	return config.NewRealm("http://idp.test", "service2infra", time.Minute)
+}
+
 func TestTokenHandler_Success(t *testing.T) {
 	k8sVerifier := new(mockK8sVerifier)
 	k8sVerifier.On("VerifyWithClient", "valid-token").Return(
@@ -65,11 +100,12 @@ func TestTokenHandler_Success(t *testing.T) {
 	)
 
 	issuer := new(mockIssuer)
-	issuer.On("IssueToken", "client1", "scope1").Return(
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(
 		&IssueResp{AccessToken: "token123"}, nil,
 	)
 
 	ctl := &Controller{
+		realm:       testRealm(),
 		k8sVerifier: k8sVerifier,
 		issuer:      issuer,
 	}
@@ -101,8 +137,274 @@ func TestTokenHandler_Success(t *testing.T) {
 	issuer.AssertExpectations(t)
 }
 
+func TestTokenHandler_BindsClientCertificate(t *testing.T) {
+	clientCert := jwks.GenerateKeyPair().Certificate
+
+	tests := []struct {
+		name     string
+		bind     bool
+		peerCert *x509.Certificate
+		status   int
+		wantOpts *IssueOpts
+	}{
+		{
+			name:     "bound on request",
+			bind:     true,
+			peerCert: clientCert,
+			status:   http.StatusOK,
+			wantOpts: &IssueOpts{Cnf: &tokens.Confirmation{X5tS256: jwks.GetX5tS256(clientCert)}},
+		},
+		{
+			// the client may call resource servers without the certificate
+			name:     "certificate without request",
+			peerCert: clientCert,
+			status:   http.StatusOK,
+			wantOpts: &IssueOpts{},
+		},
+		{
+			name:   "request without certificate",
+			bind:   true,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sVerifier := new(mockK8sVerifier)
+			k8sVerifier.On("VerifyWithClient", "valid-token").Return(
+				"client1", testClaims{Namespace: "ns1"}, nil,
+			)
+
+			issuer := new(mockIssuer)
+			if tt.wantOpts != nil {
+				issuer.On("IssueToken", "client1", "scope1", tt.wantOpts).Return(
+					&IssueResp{AccessToken: "token123"}, nil,
+				)
+			}
+
+			ctl := &Controller{
+				realm:       testRealm(),
+				k8sVerifier: k8sVerifier,
+				issuer:      issuer,
+			}
+
+			form := url.Values{}
+			form.Add("grant_type", grantTypeTokenExchange)
+			form.Add("subject_token_type", k8sTokenType)
+			form.Add("subject_token", "valid-token")
+			form.Add("scope", "scope1")
+			if tt.bind {
+				form.Add("bind_certificate", "true")
+			}
+
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.peerCert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.peerCert}}
+			}
+			w := httptest.NewRecorder()
+
+			handler, err := ctl.NewTokenHandler(context.Background())
+			require.NoError(t, err)
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			if tt.wantOpts == nil {
+				assert.Contains(t, w.Body.String(), `"error":"invalid_request"`)
+				issuer.AssertNotCalled(t, "IssueToken")
+			}
+			issuer.AssertExpectations(t)
+		})
+	}
+}
+
+func newDPoPProof(t *testing.T, key *ecdsa.PrivateKey, method, uri string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt"),
+	)
+	require.NoError(t, err)
+
+	proof, err := josejwt.Signed(signer).Claims(map[string]any{
+		"jti": "proof-1",
+		"htm": method,
+		"htu": uri,
+		"iat": time.Now().Unix(),
+	}).CompactSerialize()
+	require.NoError(t, err)
+
+	return proof
+}
+
+func TestTokenHandler_BindsDPoPKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	thumbprint, err := (&jose.JSONWebKey{Key: key.Public()}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		proofURI string
+		wantCode int
+	}{
+		{name: "valid proof", proofURI: "http://example.com/token", wantCode: http.StatusOK},
+		{name: "proof for another endpoint", proofURI: "http://example.com/other", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8sVerifier := new(mockK8sVerifier)
+			k8sVerifier.On("VerifyWithClient", "valid-token").Return(
+				"client1", testClaims{Namespace: "ns1"}, nil,
+			)
+
+			wantOpts := &IssueOpts{Cnf: &tokens.Confirmation{Jkt: base64.RawURLEncoding.EncodeToString(thumbprint)}}
+			issuer := new(mockIssuer)
+			issuer.On("IssueToken", "client1", "scope1", wantOpts).Return(
+				&IssueResp{AccessToken: "token123", Type: "DPoP"}, nil,
+			)
+
+			ctl := &Controller{
+				realm:       testRealm(),
+				k8sVerifier: k8sVerifier,
+				issuer:      issuer,
+				dpop:        dpop.NewVerifier(time.Minute),
+			}
+
+			form := url.Values{}
+			form.Add("grant_type", grantTypeTokenExchange)
+			form.Add("subject_token_type", k8sTokenType)
+			form.Add("subject_token", "valid-token")
+			form.Add("scope", "scope1")
+
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("DPoP", newDPoPProof(t, key, "POST", tt.proofURI))
+			w := httptest.NewRecorder()
+
+			handler, err := ctl.NewTokenHandler(context.Background())
+			require.NoError(t, err)
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusOK {
+				issuer.AssertExpectations(t)
+			} else {
+				assert.JSONEq(t, `{"error":"invalid_dpop_proof","error_description":"dpop proof is invalid"}`, w.Body.String())
+				issuer.AssertNotCalled(t, "IssueToken", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	return recorder
+}
+
+func TestTokenHandler_Tracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return(
+		"client1", testClaims{Namespace: "ns1"}, nil,
+	)
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(
+		nil, errors.New("no permissions"),
+	)
+
+	ctl := &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		issuer:      issuer,
+	}
+
+	form := url.Values{}
+	form.Add("grant_type", grantTypeTokenExchange)
+	form.Add("subject_token_type", k8sTokenType)
+	form.Add("subject_token", "valid-token")
+	form.Add("scope", "scope1")
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+	handler.ServeHTTP(w, req)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+		names[span.Name()] = span
+	}
+
+	root := names["TokenHandler"]
+	require.NotNil(t, root)
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent().SpanID().String())
+	assert.Equal(t, codes.Error, root.Status().Code)
+	assert.Contains(t, root.Attributes(), attribute.String("idp.client_id", "client1"))
+
+	for _, name := range []string{"K8sVerifier.VerifyWithClient", "Issuer.IssueToken"} {
+		require.Contains(t, names, name)
+		assert.Equal(t, root.SpanContext().SpanID(), names[name].Parent().SpanID())
+	}
+	assert.Equal(t, codes.Error, names["Issuer.IssueToken"].Status().Code)
+}
+
+func TestTokenHandler_TracingEarlyReturns(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "expired-token").Return(
+		"", testClaims{}, errors.New("token is expired"),
+	)
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier}
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	for name, body := range map[string]string{
+		"invalid form":    "%zz",
+		"invalid request": url.Values{"grant_type": {"password"}}.Encode(),
+		"invalid subject": url.Values{"grant_type": {grantTypeTokenExchange}, "subject_token_type": {k8sTokenType}, "subject_token": {"expired-token"}, "scope": {"scope1"}}.Encode(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := recordSpans(t)
+
+			req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			var root sdktrace.ReadOnlySpan
+			for _, span := range recorder.Ended() {
+				if span.Name() == "TokenHandler" {
+					root = span
+				}
+			}
+			require.NotNil(t, root)
+			assert.Equal(t, codes.Error, root.Status().Code)
+		})
+	}
+}
+
 func TestTokenHandler_InvalidForm(t *testing.T) {
-	ctl := &Controller{}
+	ctl := &Controller{realm: testRealm()}
 
 	req := httptest.NewRequest("POST", "/token", nil)
 	w := httptest.NewRecorder()
@@ -112,11 +414,11 @@ func TestTokenHandler_InvalidForm(t *testing.T) {
 	handler.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Contains(t, w.Body.String(), `{"error":"unsupported_grant_type"}`)
+	assert.Contains(t, w.Body.String(), `"error":"invalid_request"`)
 }
 
 func TestTokenHandler_UnsupportedGrantType(t *testing.T) {
-	ctl := &Controller{}
+	ctl := &Controller{realm: testRealm()}
 
 	form := url.Values{}
 	form.Add("grant_type", "invalid_grant")
@@ -130,15 +432,17 @@ func TestTokenHandler_UnsupportedGrantType(t *testing.T) {
 	handler.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Contains(t, w.Body.String(), `{"error":"unsupported_grant_type"}`)
+	assert.Contains(t, w.Body.String(), `"error":"unsupported_grant_type"`)
 }
 
 func TestTokenHandler_UnsupportedTokenType(t *testing.T) {
-	ctl := &Controller{}
+	ctl := &Controller{realm: testRealm()}
 
 	form := url.Values{}
 	form.Add("grant_type", grantTypeTokenExchange)
 	form.Add("subject_token_type", "invalid_type")
+	form.Add("subject_token", "valid-token")
+	form.Add("scope", "scope1")
 
 	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -149,7 +453,7 @@ func TestTokenHandler_UnsupportedTokenType(t *testing.T) {
 	handler.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Contains(t, w.Body.String(), `{"error":"unsupported_subject_token_type"}`)
+	assert.Contains(t, w.Body.String(), `"error":"invalid_request"`)
 }
 
 func TestTokenHandler_TokenVerificationFailed(t *testing.T) {
@@ -158,12 +462,13 @@ func TestTokenHandler_TokenVerificationFailed(t *testing.T) {
 		"", testClaims{}, errors.New("verification failed"), // Исправлено здесь
 	)
 
-	ctl := &Controller{k8sVerifier: k8sVerifier}
+	ctl := &Controller{realm: testRealm(), k8sVerifier: k8sVerifier}
 
 	form := url.Values{}
 	form.Add("grant_type", grantTypeTokenExchange)
 	form.Add("subject_token_type", k8sTokenType)
 	form.Add("subject_token", "invalid-token")
+	form.Add("scope", "scope1")
 
 	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -174,7 +479,7 @@ func TestTokenHandler_TokenVerificationFailed(t *testing.T) {
 	handler.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
-	assert.Contains(t, w.Body.String(), `{"error":"token_not_verified"}`)
+	assert.Contains(t, w.Body.String(), `"error":"invalid_grant"`)
 	k8sVerifier.AssertExpectations(t)
 }
 
@@ -185,11 +490,12 @@ func TestTokenHandler_IssuerError(t *testing.T) {
 	)
 
 	issuer := new(mockIssuer)
-	issuer.On("IssueToken", "client1", "scope1").Return(
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(
 		nil, errors.New("issuer error"),
 	)
 
 	ctl := &Controller{
+		realm:       testRealm(),
 		k8sVerifier: k8sVerifier,
 		issuer:      issuer,
 	}
@@ -208,11 +514,55 @@ func TestTokenHandler_IssuerError(t *testing.T) {
 	require.NoError(t, err)
 	handler.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusForbidden, w.Code)
-	assert.Contains(t, w.Body.String(), `{"error":"access_denied"}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"server_error"`)
 	issuer.AssertExpectations(t)
 }
 
+func TestTokenHandler_GrantTypeNotAllowedInRealm(t *testing.T) {
+	realm := testRealm()
+	realm.GrantTypes = []string{}
+	ctl := &Controller{realm: realm}
+
+	form := url.Values{}
+	form.Add("grant_type", grantTypeTokenExchange)
+	form.Add("subject_token_type", k8sTokenType)
+	form.Add("subject_token", "valid-token")
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"unsupported_grant_type"`)
+}
+
+func TestTokenHandler_SubjectTokenTypeNotAllowedInRealm(t *testing.T) {
+	realm := testRealm()
+	realm.SubjectTokenTypes = []string{}
+	ctl := &Controller{realm: realm}
+
+	form := url.Values{}
+	form.Add("grant_type", grantTypeTokenExchange)
+	form.Add("subject_token_type", k8sTokenType)
+	form.Add("subject_token", "valid-token")
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"invalid_request"`)
+}
+
 // Кастомный ResponseWriter, который возвращает ошибку
 type errorResponseWriter struct {
 	http.ResponseWriter
@@ -227,3 +577,117 @@ func (w *errorResponseWriter) Write(p []byte) (int, error) {
 	w.count++
 	return w.ResponseWriter.Write(p)
 }
+
+func TestTokenHandler_RateLimited(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return(
+		"client1", testClaims{Namespace: "ns1"}, nil,
+	)
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "client1", "scope1", &IssueOpts{}).Return(
+		&IssueResp{AccessToken: "token123"}, nil,
+	).Once()
+
+	ctl := &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		issuer:      issuer,
+		limiter:     newRateLimiter(1, time.Minute),
+	}
+
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	form := url.Values{}
+	form.Add("grant_type", grantTypeTokenExchange)
+	form.Add("subject_token_type", k8sTokenType)
+	form.Add("subject_token", "valid-token")
+	form.Add("scope", "scope1")
+
+	var codes []int
+	for range 2 {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+
+		if w.Code == http.StatusTooManyRequests {
+			assert.NotEmpty(t, w.Header().Get("Retry-After"))
+			assert.Contains(t, w.Body.String(), "slow_down")
+		}
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests}, codes)
+	issuer.AssertExpectations(t)
+}
+
+func TestTokenHandler_ExchangesUpstreamIDToken(t *testing.T) {
+	realm := testRealm()
+	realm.SubjectTokenTypes = append(realm.SubjectTokenTypes, config.TokenTypeIDToken)
+	realm.Upstream = &config.UpstreamConfig{TokenTTL: 30 * time.Second}
+
+	upstream := new(mockUpstreamVerifier)
+	upstream.On("Verify", "id-token").Return(&oidc.Identity{User: "alice@example.com", Groups: []string{"dba"}}, nil)
+	upstream.On("Verify", "bad-id-token").Return(nil, errors.New("invalid audience"))
+
+	issuer := new(mockIssuer)
+	issuer.On("IssueToken", "user:alice@example.com", "postgres-a", &IssueOpts{
+		GroupClients: []string{"group:dba"},
+		TTL:          30 * time.Second,
+	}).Return(&IssueResp{AccessToken: "token123"}, nil)
+
+	ctl := &Controller{realm: realm, upstream: upstream, issuer: issuer}
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	exchange := func(subjectToken string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		form.Add("grant_type", grantTypeTokenExchange)
+		form.Add("subject_token_type", idTokenType)
+		form.Add("subject_token", subjectToken)
+		form.Add("scope", "postgres-a")
+
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := exchange("id-token")
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokenResp IssueResp
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tokenResp))
+	assert.Equal(t, "token123", tokenResp.AccessToken)
+
+	w = exchange("bad-id-token")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_grant")
+
+	upstream.AssertExpectations(t)
+	issuer.AssertExpectations(t)
+}
+
+func TestTokenHandler_IDTokenNotAllowedInRealm(t *testing.T) {
+	ctl := &Controller{realm: testRealm()}
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	form := url.Values{}
+	form.Add("grant_type", grantTypeTokenExchange)
+	form.Add("subject_token_type", idTokenType)
+	form.Add("subject_token", "id-token")
+	form.Add("scope", "postgres-a")
+
+	req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_request")
+}
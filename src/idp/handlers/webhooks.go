@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/webhooks"
+)
+
+// WebhookDeadLettersPath lists the webhook deliveries which ran out of
+// attempts, webhooks are shared by all realms.
+const WebhookDeadLettersPath = "/webhooks/dead_letters"
+
+const defaultDeadLettersLimit = 100
+
+// PermissionsUpdatedEvent is the data of permissions.updated events.
+type PermissionsUpdatedEvent struct {
+	Actor      string   `json:"actor"`
+	Client     string   `json:"client"`
+	Scope      string   `json:"scope"`
+	Roles      []string `json:"roles"`
+	Version    int64    `json:"version,omitempty"`
+	MinVersion int64    `json:"min_version,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+}
+
+// TokenDeniedEvent is the data of token.denied events, only clients whose
+// subject token was verified are reported.
+type TokenDeniedEvent struct {
+	ClientID         string `json:"client_id"`
+	Scope            string `json:"scope"`
+	SubjectTokenType string `json:"subject_token_type,omitempty"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	// Suppressed counts the same denials held back since the previous event.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// TokenRevokedEvent is the data of token.revoked events, the token itself is
+// never sent.
+type TokenRevokedEvent struct {
+	ClientID  string    `json:"client_id"`
+	Scope     string    `json:"scope"`
+	JTI       string    `json:"jti,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// KeyRotatedEvent is the data of key.rotated events.
+type KeyRotatedEvent struct {
+	KeyID         string `json:"key_id"`
+	PreviousKeyID string `json:"previous_key_id"`
+}
+
+// deniedNotifyInterval is how often token.denied is sent for the same client,
+// scope and error.
+var deniedNotifyInterval = time.Minute
+
+type deniedKey struct {
+	client, scope, code string
+}
+
+type deniedState struct {
+	notifiedAt time.Time
+	suppressed int
+}
+
+// deniedThrottle aggregates the denials of a client retrying the same failing
+// exchange, so it does not flood the webhooks. States idle for an interval are
+// swept, along with the counts they held back.
+type deniedThrottle struct {
+	interval time.Duration
+
+	mu        sync.Mutex
+	states    map[deniedKey]*deniedState
+	nextSweep time.Time
+}
+
+func newDeniedThrottle(interval time.Duration) *deniedThrottle {
+	return &deniedThrottle{interval: interval, states: make(map[deniedKey]*deniedState)}
+}
+
+// allow reports whether the denial is sent now and how many were held back
+// before it, a nil throttle sends every denial.
+func (t *deniedThrottle) allow(key deniedKey, now time.Time) (bool, int) {
+	if t == nil {
+		return true, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.After(t.nextSweep) {
+		for stateKey, state := range t.states {
+			if now.Sub(state.notifiedAt) >= t.interval {
+				delete(t.states, stateKey)
+			}
+		}
+		t.nextSweep = now.Add(t.interval)
+	}
+
+	state, ok := t.states[key]
+	if !ok {
+		t.states[key] = &deniedState{notifiedAt: now}
+		return true, 0
+	} else if now.Sub(state.notifiedAt) < t.interval {
+		state.suppressed++
+		return false, 0
+	}
+
+	suppressed := state.suppressed
+	state.notifiedAt, state.suppressed = now, 0
+	return true, suppressed
+}
+
+// notify publishes the event of the realm to the webhooks.
+func (ctl *Controller) notify(eventType string, data any) {
+	if ctl.webhooks == nil {
+		return
+	}
+
+	ctl.webhooks.Publish(webhooks.Event{Type: eventType, Realm: ctl.realm.Name, Data: data})
+}
+
+// announceKey reports a rotation if the realm signed with another key before
+// the start. Generated keys are new on every start, which is not a rotation.
+func (ctl *Controller) announceKey(ctx context.Context, history KeyHistory) {
+	if ctl.keys == nil || ctl.realm.Keys.Source == config.KeySourceGenerate {
+		return
+	}
+
+	previous, err := history.SwapKeyID(ctx, ctl.realm.Name, ctl.keys.KeyID)
+	if err != nil {
+		log.Printf("failed to check key rotation of realm %s: %v", ctl.realm.Name, err)
+		return
+	} else if previous == "" || previous == ctl.keys.KeyID {
+		return
+	}
+
+	log.Printf("signing key of realm %s rotated, kid: %s, previous kid: %s", ctl.realm.Name, ctl.keys.KeyID, previous)
+	ctl.notify(config.WebhookEventKeyRotated, KeyRotatedEvent{KeyID: ctl.keys.KeyID, PreviousKeyID: previous})
+}
+
+// NewWebhookDeadLettersHandler returns the latest dead-lettered deliveries, the
+// newest one first, to admins of the realm.
+func (ctl *Controller) NewWebhookDeadLettersHandler(dispatcher *webhooks.Dispatcher) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ctl.authorizeCaller(w, r, ctl.isAdmin); !ok {
+			return
+		}
+
+		limit := defaultDeadLettersLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				respondError(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, db.DeadLettersMaxCount)
+		}
+
+		deliveries, err := dispatcher.DeadLetters(r.Context(), limit)
+		if err != nil {
+			log.Printf("failed to list webhook dead letters: %v", err)
+			respondError(w, "dead letters are not available", http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, deliveries)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
+
+// NewWebhookRedeliverHandler queues the dead-lettered delivery of the {id}
+// path parameter again, for admins of the realm.
+func (ctl *Controller) NewWebhookRedeliverHandler(dispatcher *webhooks.Dispatcher) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := ctl.authorizeCaller(w, r, ctl.isAdmin)
+		if !ok {
+			return
+		}
+
+		delivery, err := dispatcher.Redeliver(r.Context(), r.PathValue("id"))
+		if errors.Is(err, db.ErrNotFound) {
+			respondError(w, "dead letter not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("failed to redeliver webhook dead letter: %v", err)
+			respondError(w, "failed to redeliver dead letter", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("webhook dead letter %s of %s redelivered by %s", delivery.ID, delivery.Webhook, caller.ID)
+		respondJSON(w, http.StatusAccepted, delivery)
+	}
+
+	return baseMetricsMiddleware(handler)
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/webhooks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedWebhooks struct {
+	mu     sync.Mutex
+	events []webhooks.Event
+}
+
+func (w *recordedWebhooks) Publish(event webhooks.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.events = append(w.events, event)
+}
+
+func (w *recordedWebhooks) published() []webhooks.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]webhooks.Event(nil), w.events...)
+}
+
+type keyHistory map[string]string
+
+func (h keyHistory) SwapKeyID(_ context.Context, realm, keyID string) (string, error) {
+	previous := h[realm]
+	h[realm] = keyID
+
+	return previous, nil
+}
+
+func TestWebhooks_PermissionsUpdated(t *testing.T) {
+	ctl, repo := newSnapshotsTest(t)
+	hooks := &recordedWebhooks{}
+	ctl.webhooks = hooks
+
+	require.NoError(t, ctl.updatePermissions(context.Background(), "auth-ui", "service-a", "postgres-a", []string{"RO"}))
+	_, version := repo.GetVersionedPermissions("service-a", "postgres-a")
+
+	events := hooks.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, config.WebhookEventPermissionsUpdated, events[0].Type)
+	assert.Equal(t, ctl.realm.Name, events[0].Realm)
+	assert.Equal(t, PermissionsUpdatedEvent{
+		Actor:   "auth-ui",
+		Client:  "service-a",
+		Scope:   "postgres-a",
+		Roles:   []string{"RO"},
+		Version: version.Version,
+		// RW was removed, tokens of older versions are outdated
+		MinVersion: version.Version,
+	}, events[0].Data)
+}
+
+func TestWebhooks_TokenDenied(t *testing.T) {
+	k8sVerifier := new(mockK8sVerifier)
+	k8sVerifier.On("VerifyWithClient", "valid-token").Return("client1", testClaims{}, nil)
+	k8sVerifier.On("VerifyWithClient", "invalid-token").Return("", testClaims{}, errors.New("invalid token"))
+
+	hooks := &recordedWebhooks{}
+	ctl := &Controller{
+		realm:       testRealm(),
+		k8sVerifier: k8sVerifier,
+		issuer:      new(mockIssuer),
+		dpop:        dpop.NewVerifier(time.Minute),
+		webhooks:    hooks,
+		denials:     newDeniedThrottle(time.Minute),
+	}
+	handler, err := ctl.NewTokenHandler(context.Background())
+	require.NoError(t, err)
+
+	exchange := func(subjectToken, scope string) {
+		form := url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token_type": {k8sTokenType},
+			"subject_token":      {subjectToken},
+			"scope":              {scope},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(dpop.HeaderName, "invalid-proof")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the subject of invalid requests and tokens is not verified, they are not reported
+	exchange("valid-token", "scope1 scope2")
+	exchange("invalid-token", "scope1")
+	assert.Empty(t, hooks.published())
+
+	// repeated denials of the client are aggregated
+	for range 3 {
+		exchange("valid-token", "scope1")
+	}
+
+	ctl.limiter = newRateLimiter(0, time.Minute)
+	// rate limited requests are not reported
+	exchange("valid-token", "scope2")
+
+	events := hooks.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, config.WebhookEventTokenDenied, events[0].Type)
+	denied := events[0].Data.(TokenDeniedEvent)
+	assert.Equal(t, "client1", denied.ClientID)
+	assert.Equal(t, errInvalidDPoPProof, denied.Error)
+	assert.Equal(t, k8sTokenType, denied.SubjectTokenType)
+	assert.NotEmpty(t, denied.ErrorDescription)
+	assert.Zero(t, denied.Suppressed)
+}
+
+func TestDeniedThrottle(t *testing.T) {
+	throttle := newDeniedThrottle(time.Minute)
+	key := deniedKey{client: "client1", scope: "scope1", code: errInvalidDPoPProof}
+	now := time.Now()
+
+	notify, suppressed := throttle.allow(key, now)
+	assert.True(t, notify)
+	assert.Zero(t, suppressed)
+
+	for i := range 3 {
+		notify, _ = throttle.allow(key, now.Add(time.Duration(i+1)*time.Second))
+		assert.False(t, notify)
+	}
+
+	// other clients are throttled on their own
+	notify, _ = throttle.allow(deniedKey{client: "client2", scope: "scope1", code: errInvalidDPoPProof}, now)
+	assert.True(t, notify)
+
+	notify, suppressed = throttle.allow(key, now.Add(time.Minute))
+	assert.True(t, notify)
+	assert.Equal(t, 3, suppressed)
+
+	var disabled *deniedThrottle
+	notify, _ = disabled.allow(key, now)
+	assert.True(t, notify)
+}
+
+func TestWebhooks_TokenRevoked(t *testing.T) {
+	ctl, token := newIntrospectionController(t, testRealm())
+	hooks := &recordedWebhooks{}
+	ctl.webhooks = hooks
+
+	w := postToken(t, ctl.RevocationHandler(), "service-a", token)
+	require.Equal(t, http.StatusOK, w.Code)
+	postToken(t, ctl.RevocationHandler(), "service-a", "unknown-token")
+
+	events := hooks.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, config.WebhookEventTokenRevoked, events[0].Type)
+	revoked := events[0].Data.(TokenRevokedEvent)
+	assert.Equal(t, "service-a", revoked.ClientID)
+	assert.Equal(t, "postgres-a", revoked.Scope)
+	assert.False(t, revoked.ExpiresAt.IsZero())
+}
+
+func TestWebhooks_KeyRotated(t *testing.T) {
+	history := keyHistory{}
+	hooks := &recordedWebhooks{}
+	ctx := context.Background()
+
+	realm := testRealm()
+	realm.Keys.Source = config.KeySourceFile
+
+	// generated keys change on every restart, they are not announced
+	generated := &Controller{realm: testRealm(), keys: jwks.GenerateKeyPair(), webhooks: hooks}
+	generated.announceKey(ctx, history)
+	assert.Empty(t, history)
+
+	first := &Controller{realm: realm, keys: jwks.GenerateKeyPair(), webhooks: hooks}
+	first.announceKey(ctx, history)
+	// a restart with the same key is not a rotation
+	first.announceKey(ctx, history)
+	assert.Empty(t, hooks.published())
+
+	rotated := &Controller{realm: realm, keys: jwks.GenerateKeyPair(), webhooks: hooks}
+	rotated.announceKey(ctx, history)
+
+	events := hooks.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, config.WebhookEventKeyRotated, events[0].Type)
+	assert.Equal(t, KeyRotatedEvent{KeyID: rotated.keys.KeyID, PreviousKeyID: first.keys.KeyID}, events[0].Data)
+}
+
+func TestWebhookDeadLettersHandlers(t *testing.T) {
+	deadLetters := db.NewDeadLetters()
+	dispatcher, err := webhooks.NewDispatcher(config.WebhooksConfig{QueueSize: 1}, deadLetters, nil)
+	require.NoError(t, err)
+
+	failedAt := time.Now()
+	require.NoError(t, deadLetters.Add(context.Background(), &db.WebhookDelivery{
+		ID:        "d1",
+		Webhook:   "chat",
+		Event:     config.WebhookEventKeyRotated,
+		Payload:   json.RawMessage(`{}`),
+		Attempts:  8,
+		FailedAt:  &failedAt,
+		CreatedAt: failedAt,
+	}))
+
+	realm := testRealm()
+	realm.Admins = []string{"auth-ui"}
+	ctl := &Controller{realm: realm, k8sVerifier: workloadTokens{}}
+
+	list := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", WebhookDeadLettersPath+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ctl.NewWebhookDeadLettersHandler(dispatcher).ServeHTTP(w, req)
+		return w
+	}
+	redeliver := func(id, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", WebhookDeadLettersPath+"/"+id+"/redeliver", nil)
+		req.SetPathValue("id", id)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		ctl.NewWebhookRedeliverHandler(dispatcher).ServeHTTP(w, req)
+		return w
+	}
+
+	// dead letters hold the payloads of the events, they are for admins only
+	assert.Equal(t, http.StatusUnauthorized, list("", "").Code)
+	assert.Equal(t, http.StatusForbidden, list("", "sa:service-a").Code)
+	assert.Equal(t, http.StatusUnauthorized, redeliver("d1", "").Code)
+	assert.Equal(t, http.StatusForbidden, redeliver("d1", "sa:service-a").Code)
+
+	w := list("?limit=10", "sa:auth-ui")
+	require.Equal(t, http.StatusOK, w.Code)
+	var deliveries []db.WebhookDelivery
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&deliveries))
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "d1", deliveries[0].ID)
+
+	assert.Equal(t, http.StatusBadRequest, list("?limit=-1", "sa:auth-ui").Code)
+
+	w = redeliver("d1", "sa:auth-ui")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var delivery db.WebhookDelivery
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&delivery))
+	assert.Zero(t, delivery.Attempts)
+	assert.Nil(t, delivery.FailedAt)
+
+	assert.Equal(t, http.StatusNotFound, redeliver("d1", "sa:auth-ui").Code)
+}
@@ -2,53 +2,300 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/idp/handlers"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
-	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
 	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/jwks"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tlsconfig"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tracing"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/webhooks"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	cfg := config.Load()
-	keyPair := jwks.GenerateKeyPair()
-
-	permissions := map[string]map[string][]string{
-		"service-a": {"postgres-a": {"RO", "RW"}},
-		"service-b": {"postgres-b": {"RO"}},
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
-	repository := db.NewRepository(permissions)
 
-	controllerOpts := &handlers.ControllerOpts{
-		Cfg:        cfg,
-		Keys:       keyPair,
-		Repository: repository,
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing, "idp")
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
 	}
-	controller, err := handlers.NewController(ctx, controllerOpts)
+
+	stores, err := newStores(ctx, cfg)
 	if err != nil {
-		log.Fatalf("Failed to create token controller: %v", err)
+		log.Fatalf("Failed to create %s store: %v", cfg.Store.Backend, err)
 	}
+	defer stores.Close()
 
-	tokenHandler, err := controller.NewTokenHandler(ctx)
+	keyLoader := newKeyLoader()
+	defer keyLoader.Close()
+
+	k8sVerifier, err := handlers.NewK8sVerifier(ctx)
 	if err != nil {
-		log.Fatalf("Failed to create token handler: %v", err)
+		log.Fatalf("Failed to create k8s verifier: %v", err)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 
-	mux.HandleFunc("/realms/service2infra/.well-known/openid-configuration", controller.OpenIDConfigHandler())
-	mux.HandleFunc("/realms/service2infra/protocol/openid-connect/token", tokenHandler)
-	mux.HandleFunc("/realms/service2infra/protocol/openid-connect/certs", controller.CertsHandler())
+	health := handlers.NewHealth(cfg.Server.ReadinessTimeout)
+	mux.HandleFunc("/healthz", health.NewLivenessHandler())
+	mux.HandleFunc("/readyz", health.NewReadinessHandler())
+
+	grpcAPI := handlers.NewGRPCServer(cfg.DefaultRealm)
+
+	// realms get a nil interface rather than a nil dispatcher without webhooks
+	var notifier handlers.Webhooks
+	var dispatcher *webhooks.Dispatcher
+	webhooksDone := make(chan struct{})
+	if len(cfg.Webhooks.Endpoints) > 0 {
+		var err error
+		dispatcher, err = webhooks.NewDispatcher(cfg.Webhooks, stores.DeadLetters(), nil)
+		if err != nil {
+			log.Fatalf("Failed to create webhooks: %v", err)
+		}
+		go func() {
+			defer close(webhooksDone)
+			dispatcher.Run(ctx)
+		}()
+
+		notifier = dispatcher
+		log.Printf("webhooks enabled, endpoints: %d", len(cfg.Webhooks.Endpoints))
+	} else {
+		close(webhooksDone)
+	}
+
+	for _, realm := range cfg.Realms {
+		repository, broker, err := stores.Namespace(ctx, realm.PermissionsNamespace)
+		if err != nil {
+			log.Fatalf("Failed to create permissions store for realm %s: %v", realm.Name, err)
+		}
+
+		requests, audit := stores.AccessRequests(realm.PermissionsNamespace)
+
+		keys, err := keyLoader.Load(ctx, realm.Keys)
+		if err != nil {
+			log.Fatalf("Failed to load keys for realm %s: %v", realm.Name, err)
+		}
+
+		controllerOpts := &handlers.ControllerOpts{
+			Cfg:         cfg,
+			Realm:       realm,
+			Keys:        keys,
+			Repository:  repository,
+			K8sVerifier: k8sVerifier,
+			Events:      broker,
+			Revocations: stores.Revocations(realm),
+			RateLimiter: stores.RateLimiter(),
+			DPoPReplays: stores.DPoPReplays(realm),
+
+			ReferenceTokens: stores.ReferenceTokens(realm),
+
+			AccessRequests: requests,
+			Audit:          audit,
+			Usage:          stores.Usage(realm.PermissionsNamespace),
+			Snapshots:      stores.Snapshots(realm.PermissionsNamespace),
+			Webhooks:       notifier,
+			KeyHistory:     stores.KeyHistory(),
+		}
+		controller, err := handlers.NewController(ctx, controllerOpts)
+		if err != nil {
+			log.Fatalf("Failed to create token controller for realm %s: %v", realm.Name, err)
+		}
+
+		if err := registerRealm(ctx, mux, controller); err != nil {
+			log.Fatalf("Failed to register realm %s: %v", realm.Name, err)
+		}
+		health.AddChecks(controller.ReadinessChecks())
+		go controller.RunGrantExpiry(ctx)
+		grpcAPI.AddRealm(controller)
+
+		if realm.Name == cfg.DefaultRealm {
+			mux.HandleFunc("/update_permissions", controller.NewUpdatePermissionsHandler(ctx))
+			mux.HandleFunc("/get_permissions", controller.NewGetPermissionsHandler(ctx))
+			mux.HandleFunc("GET "+handlers.DebugConfigPath, controller.NewDebugConfigHandler())
+
+			// dead letters span the realms, admins of the default one manage them
+			if dispatcher != nil {
+				mux.HandleFunc("GET "+handlers.WebhookDeadLettersPath, controller.NewWebhookDeadLettersHandler(dispatcher))
+				mux.HandleFunc("POST "+handlers.WebhookDeadLettersPath+"/{id}/redeliver", controller.NewWebhookRedeliverHandler(dispatcher))
+			}
+		}
+
+		log.Printf("realm %s registered, issuer: %s, token ttl: %s", realm.Name, realm.Issuer, realm.TokenTTL)
+	}
+
+	var handler http.Handler = mux
+	if cfg.Limits.MaxRequestBodyBytes > 0 {
+		handler = http.MaxBytesHandler(mux, cfg.Limits.MaxRequestBodyBytes)
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Address,
+		Handler:           handler,
+		MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 2)
+	if cfg.TLS.Enabled() {
+		reloader, err := tlsconfig.NewReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalf("Failed to load tls config: %v", err)
+		}
+		go reloader.Run(ctx)
+
+		health.AddCheck("tls", reloader.Ready)
+		server.TLSConfig = reloader.TLSConfig()
+
+		go func() {
+			log.Printf("idp OIDC server started on %s (tls, client auth: %s)", cfg.Address, cfg.TLS.ClientAuth)
+			serveErr <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			log.Printf("idp OIDC server started on %s", cfg.Address)
+			serveErr <- server.ListenAndServe()
+		}()
+	}
+
+	var grpcSrv *grpcServer
+	if cfg.GRPCAddress != "" {
+		grpcSrv, err = startGRPC(cfg.GRPCAddress, grpcAPI, server.TLSConfig, serveErr)
+		if err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("idp server failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutdown signal received, failing readiness for %s", cfg.Server.DrainPeriod)
+	health.SetShuttingDown()
+	time.Sleep(cfg.Server.DrainPeriod)
+
+	log.Printf("draining requests for up to %s", cfg.Server.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to gracefully shutdown idp server: %v", err)
+	}
+	if grpcSrv != nil {
+		grpcSrv.Shutdown(shutdownCtx)
+	}
+	// pending deliveries are dead-lettered before the store is closed
+	<-webhooksDone
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Printf("failed to flush traces: %v", err)
+	}
+
+	log.Printf("idp server stopped")
+}
+
+// keyLoader loads the signing keys of the realms, realms using the same HSM
+// key share its session, as the PKCS#11 library is initialized once.
+type keyLoader struct {
+	hsmKeys map[config.PKCS11KeyConfig]*jwks.KeyPair
+	closers []io.Closer
+}
+
+func newKeyLoader() *keyLoader {
+	return &keyLoader{hsmKeys: make(map[config.PKCS11KeyConfig]*jwks.KeyPair)}
+}
+
+func (l *keyLoader) Load(ctx context.Context, keysCfg config.KeysConfig) (*jwks.KeyPair, error) {
+	switch keysCfg.Source {
+	case config.KeySourceFile:
+		return jwks.LoadKeyPair(keysCfg.PrivateKeyFile)
+	case config.KeySourceVault:
+		signer, err := jwks.NewVaultSigner(ctx, keysCfg.Vault, nil)
+		if err != nil {
+			return nil, err
+		}
+		return jwks.NewKeyPair(signer)
+	case config.KeySourcePKCS11:
+		if keys, ok := l.hsmKeys[keysCfg.PKCS11]; ok {
+			return keys, nil
+		}
+
+		signer, err := jwks.NewPKCS11Signer(keysCfg.PKCS11)
+		if err != nil {
+			return nil, err
+		}
+		l.closers = append(l.closers, signer)
+
+		keys, err := jwks.NewKeyPair(signer)
+		if err != nil {
+			return nil, err
+		}
+		l.hsmKeys[keysCfg.PKCS11] = keys
+		return keys, nil
+	default:
+		return jwks.GenerateKeyPair(), nil
+	}
+}
+
+func (l *keyLoader) Close() {
+	for _, closer := range l.closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("failed to close signing key session: %v", err)
+		}
+	}
+}
+
+func registerRealm(ctx context.Context, mux *http.ServeMux, controller *handlers.Controller) error {
+	tokenHandler, err := controller.NewTokenHandler(ctx)
+	if err != nil {
+		return err
+	}
+
+	prefix := "/realms/" + controller.Realm().Name
+
+	mux.HandleFunc(prefix+handlers.OpenIDConfigPath, controller.OpenIDConfigHandler())
+	mux.HandleFunc(prefix+handlers.OAuthMetadataPath, controller.OpenIDConfigHandler())
+	// RFC 8414 inserts the well-known path between the host and the issuer path
+	mux.HandleFunc(handlers.OAuthMetadataPath+prefix, controller.OpenIDConfigHandler())
+	mux.HandleFunc(prefix+handlers.TokenPath, tokenHandler)
+	mux.HandleFunc("POST "+prefix+handlers.BatchTokenPath, controller.NewBatchTokenHandler())
+	mux.HandleFunc(prefix+handlers.CertsPath, controller.CertsHandler())
+	mux.HandleFunc("POST "+prefix+handlers.IntrospectionPath, controller.IntrospectionHandler())
+	mux.HandleFunc("POST "+prefix+handlers.RevocationPath, controller.RevocationHandler())
 
-	mux.HandleFunc("/update_permissions", controller.NewUpdatePermissionsHandler(ctx))
-	mux.HandleFunc("/get_permissions", controller.NewGetPermissionsHandler(ctx))
+	mux.HandleFunc("GET "+prefix+handlers.PermissionEventsPath, controller.NewPermissionEventsHandler(ctx))
+	mux.HandleFunc("GET "+prefix+handlers.PermissionsVersionsPath, controller.NewPermissionsVersionsHandler(ctx))
+	mux.HandleFunc("GET "+prefix+handlers.PermissionsSnapshotsPath, controller.NewListSnapshotsHandler())
+	mux.HandleFunc("GET "+prefix+handlers.PermissionsSnapshotsPath+"/diff", controller.NewDiffSnapshotsHandler())
+	mux.HandleFunc("GET "+prefix+handlers.PermissionsSnapshotsPath+"/{number}", controller.NewGetSnapshotHandler())
+	mux.HandleFunc("POST "+prefix+handlers.PermissionsSnapshotsPath+"/{number}/rollback", controller.NewRollbackHandler())
+	mux.HandleFunc("POST "+prefix+handlers.AccessRequestsPath, controller.NewCreateAccessRequestHandler())
+	mux.HandleFunc("GET "+prefix+handlers.AccessRequestsPath, controller.NewListAccessRequestsHandler())
+	mux.HandleFunc("GET "+prefix+handlers.AccessRequestsPath+"/{id}", controller.NewGetAccessRequestHandler())
+	mux.HandleFunc("POST "+prefix+handlers.AccessRequestsPath+"/{id}/approve", controller.NewReviewAccessRequestHandler(true))
+	mux.HandleFunc("POST "+prefix+handlers.AccessRequestsPath+"/{id}/deny", controller.NewReviewAccessRequestHandler(false))
+	mux.HandleFunc("GET "+prefix+handlers.AuditPath, controller.NewAuditHandler())
+	mux.HandleFunc("GET "+prefix+handlers.AccessMatrixPath, controller.NewAccessMatrixHandler())
+	mux.HandleFunc(prefix+"/update_permissions", controller.NewUpdatePermissionsHandler(ctx))
+	mux.HandleFunc(prefix+"/get_permissions", controller.NewGetPermissionsHandler(ctx))
 
-	log.Printf("idp OIDC server started on %s", cfg.Address)
-	log.Fatal(http.ListenAndServe(cfg.Address, mux))
+	return nil
 }
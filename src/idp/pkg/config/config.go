@@ -1,17 +1,1094 @@
 package config
 
-import "time"
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange" // RFC 8693
+	TokenTypeK8s           = "urn:ietf:params:oauth:token-type:jwt:kubernetes"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeJWTSPIFFE     = "urn:ietf:params:oauth:token-type:jwt-spiffe"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+const (
+	StoreBackendMemory = "memory"
+	StoreBackendRedis  = "redis"
+
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+
+	KeySourceGenerate = "generate"
+	KeySourceFile     = "file"
+	KeySourceVault    = "vault"
+	KeySourcePKCS11   = "pkcs11"
+
+	defaultVaultTransitMount = "transit"
+
+	// TokenFormatV1 issues the claims and token responses of auth-client
+	// builds before RFC 9068 support: RFC 3339 exp and iat, clientID and an
+	// expires_in timestamp. TokenFormatV2 is RFC 9068 and RFC 6749 compliant.
+	TokenFormatV1 = "v1"
+	TokenFormatV2 = "v2"
+
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+
+	redacted = "[REDACTED]"
+)
+
+// Events sent to webhooks.
+const (
+	WebhookEventPermissionsUpdated = "permissions.updated"
+	WebhookEventTokenDenied        = "token.denied"
+	WebhookEventTokenRevoked       = "token.revoked"
+	WebhookEventKeyRotated         = "key.rotated"
+)
+
+var webhookEvents = []string{
+	WebhookEventPermissionsUpdated,
+	WebhookEventTokenDenied,
+	WebhookEventTokenRevoked,
+	WebhookEventKeyRotated,
+}
+
+const (
+	defaultWebhookTimeout     = 5 * time.Second
+	defaultWebhookMaxAttempts = 8
+)
+
+var realmNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Realm is an isolated token issuing domain served under /realms/{name}.
+type Realm struct {
+	Name     string        `yaml:"name"`
+	Issuer   string        `yaml:"issuer"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	// TokenFormat of issued tokens, "v1" keeps old auth-client builds working
+	// during a rollout.
+	TokenFormat string `yaml:"token_format"`
+	// OpaqueTokens issues random reference tokens instead of JWTs, their
+	// claims stay in the IdP store and resource servers resolve them by
+	// introspection.
+	OpaqueTokens bool `yaml:"opaque_tokens"`
+	// EncryptionKeys are PEM public key files of the resource servers by
+	// scope, tokens of these scopes are JWTs nested in a JWE only the resource
+	// server decrypts. The IdP can not read them either, so they are not
+	// introspected, revoked or downscoped.
+	EncryptionKeys map[string]string `yaml:"encryption_keys"`
+
+	GrantTypes        []string `yaml:"grant_types"`
+	SubjectTokenTypes []string `yaml:"subject_token_types"`
+
+	// PermissionsNamespace selects the permission store used by the realm,
+	// realms with the same namespace share grants.
+	PermissionsNamespace string `yaml:"permissions_namespace"`
+
+	Keys KeysConfig `yaml:"keys"`
+
+	// Upstream enables the id_token subject token type for human users.
+	Upstream *UpstreamConfig `yaml:"upstream"`
+	// TrustedIssuers accept subject tokens of other clusters, CI systems or
+	// SPIFFE issuers, a token is verified by the issuer of its type and iss.
+	TrustedIssuers []*TrustedIssuer `yaml:"trusted_issuers"`
+
+	// AccessRequests enables the access request workflow, clients ask for
+	// roles and the approvers of the scope grant them.
+	AccessRequests *AccessRequestsConfig `yaml:"access_requests"`
+	// Admins are the clients which manage the permissions of the realm, e.g.
+	// the "auth-ui" workload or "group:idp-admins". The global admins are
+	// used when empty.
+	Admins []string `yaml:"admins"`
+}
+
+// AccessRequestsConfig designates who reviews requests for roles on a scope.
+type AccessRequestsConfig struct {
+	// Approvers per scope are clients of the permission model, e.g.
+	// "user:alice@example.com" or "group:dba". Requests for scopes without
+	// approvers are rejected.
+	Approvers map[string][]string `yaml:"approvers"`
+	// MaxGrantTTL bounds the lifetime of approved grants, zero allows
+	// permanent ones.
+	MaxGrantTTL time.Duration `yaml:"max_grant_ttl"`
+}
+
+// TrustedIssuer is an external issuer of workload subject tokens.
+type TrustedIssuer struct {
+	Name   string `yaml:"name"`
+	Issuer string `yaml:"issuer"`
+	// SubjectTokenType the tokens are exchanged as, it has to be enabled in
+	// the realm subject_token_types.
+	SubjectTokenType string `yaml:"subject_token_type"`
+	// JWKSURI is discovered from the issuer metadata when empty.
+	JWKSURI string `yaml:"jwks_uri"`
+	// Audiences the tokens must be issued to, at least one is required.
+	Audiences []string `yaml:"audiences"`
+	// ClientTemplate maps the token claims to the client of the permission
+	// model, e.g. `{{index . "kubernetes.io" "serviceaccount" "name"}}`. It
+	// defaults to "<name>:{{.sub}}", so clients of different issuers with the
+	// same sub do not share grants.
+	ClientTemplate string `yaml:"client_template"`
+}
+
+// UpstreamConfig trusts ID tokens of an external OIDC provider. The user and
+// the groups of a token are the "user:<name>" and "group:<name>" clients of
+// the permission model, the issued token carries the roles of all of them.
+type UpstreamConfig struct {
+	Issuer string `yaml:"issuer"`
+	// Audience is the client id ID tokens are issued to, the CLI login flow
+	// authenticates as this client.
+	Audience string `yaml:"audience"`
+	// JWKSURI is discovered from the issuer metadata when empty.
+	JWKSURI string `yaml:"jwks_uri"`
+
+	UserClaim   string `yaml:"user_claim"`
+	GroupsClaim string `yaml:"groups_claim"`
+
+	// TokenTTL of tokens issued to users, it never exceeds the realm one.
+	TokenTTL time.Duration `yaml:"token_ttl"`
+}
+
+const (
+	UserClientPrefix  = "user:"
+	GroupClientPrefix = "group:"
+
+	defaultUpstreamTokenTTL = 5 * time.Minute
+)
+
+type KeysConfig struct {
+	// Source is "generate" (new key on every start), "file", "vault" or
+	// "pkcs11". With the latter two the private key never enters the IdP
+	// process, tokens are signed by Vault Transit or the HSM, pkcs11 takes a
+	// build with cgo. generate stays the default since it needs no mounted
+	// key and keeps the in-memory key of earlier releases, deployments which
+	// outlive a restart or run several replicas set file or one of the
+	// remote sources.
+	Source         string          `yaml:"source"`
+	PrivateKeyFile string          `yaml:"private_key_file"`
+	Vault          VaultKeyConfig  `yaml:"vault"`
+	PKCS11         PKCS11KeyConfig `yaml:"pkcs11"`
+}
+
+// VaultKeyConfig points to an RSA key of the Vault Transit secrets engine.
+type VaultKeyConfig struct {
+	Address string `yaml:"address"`
+	// Mount is the path the transit engine is mounted on.
+	Mount   string `yaml:"mount"`
+	KeyName string `yaml:"key_name"`
+	// Token authenticates to Vault, TokenFile is read on every request
+	// instead, so a token renewed by the Vault agent is picked up.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// PKCS11KeyConfig points to an RSA key pair of a PKCS#11 token.
+type PKCS11KeyConfig struct {
+	// Module is the path of the PKCS#11 library of the HSM.
+	Module     string `yaml:"module"`
+	TokenLabel string `yaml:"token_label"`
+	KeyLabel   string `yaml:"key_label"`
+	// PIN of the user, PINFile is read at start instead if set.
+	PIN     string `yaml:"pin"`
+	PINFile string `yaml:"pin_file"`
+}
+
+type StoreConfig struct {
+	// Backend is either "memory" (state of a single replica) or "redis"
+	// (state shared by all replicas), DSN is a redis:// URL for the latter.
+	Backend string `yaml:"backend"`
+	DSN     string `yaml:"dsn"`
+
+	// Permissions seeds the store: namespace -> client -> scope -> roles.
+	Permissions map[string]map[string]map[string][]string `yaml:"permissions"`
+}
+
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+
+	// DrainPeriod is how long readiness fails on SIGTERM before the listeners
+	// close, so the pod is removed from the Service endpoints first.
+	DrainPeriod time.Duration `yaml:"drain_period"`
+	// ShutdownTimeout bounds draining of in-flight requests on SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ReadinessTimeout bounds a single /readyz run of all checks.
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile enable HTTPS, they are reloaded when changed on disk.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ClientCAFile is the bundle client certificates are verified against.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is one of "none", "request" or "require".
+	ClientAuth string `yaml:"client_auth"`
+
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != ""
+}
+
+type TracingConfig struct {
+	// Exporter is one of "none", "otlp", "stdout" or "file".
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP collector URL, the standard OTEL_EXPORTER_OTLP_*
+	// variables are used when empty.
+	Endpoint string `yaml:"endpoint"`
+	// File receives the spans as JSON lines with the "file" exporter.
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// WebhooksConfig lists the endpoints IdP events are posted to. Deliveries are
+// retried with exponential backoff and dead-lettered after the last attempt.
+type WebhooksConfig struct {
+	Endpoints []*WebhookConfig `yaml:"endpoints"`
+	// QueueSize bounds the deliveries waiting to be sent, new ones are
+	// dead-lettered while it is full.
+	QueueSize int `yaml:"queue_size"`
+	// MinBackoff is the delay of the first retry, it doubles with every
+	// attempt up to MaxBackoff.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type WebhookConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Secret is the HMAC key of the payload signatures, SecretFile is read at
+	// start instead if set.
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret_file"`
+	// Events and Realms filter the sent events, all are sent when empty.
+	Events []string `yaml:"events"`
+	Realms []string `yaml:"realms"`
+
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+type LimitsConfig struct {
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	MaxHeaderBytes      int   `yaml:"max_header_bytes"`
+
+	// TokenRequestsPerMinute limits token requests of a client in a realm,
+	// zero disables the limit.
+	TokenRequestsPerMinute int64 `yaml:"token_requests_per_minute"`
+}
 
 type Config struct {
-	Address  string
-	Issuer   string
-	TokenTTL time.Duration
+	Address string `yaml:"address"`
+	// GRPCAddress is the listen address of the gRPC API, it is disabled when
+	// empty.
+	GRPCAddress string `yaml:"grpc_address"`
+
+	Issuer   string        `yaml:"issuer"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	// TokenFormat is the default token format of realms.
+	TokenFormat string `yaml:"token_format"`
+
+	// DefaultRealm is also served on the legacy unprefixed admin routes.
+	DefaultRealm string `yaml:"default_realm"`
+	// Admins are the default admins of realms.
+	Admins []string `yaml:"admins"`
+
+	Realms []*Realm     `yaml:"realms"`
+	Server ServerConfig `yaml:"server"`
+	TLS    TLSConfig    `yaml:"tls"`
+	Store  StoreConfig  `yaml:"store"`
+	Keys   KeysConfig   `yaml:"keys"`
+	Limits LimitsConfig `yaml:"limits"`
+
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+
+	Tracing TracingConfig `yaml:"tracing"`
 }
 
-func Load() *Config {
+func defaultConfig() *Config {
 	return &Config{
-		Address:  ":8080",
-		Issuer:   "http://idp.idp.svc.cluster.local",
-		TokenTTL: 10 * time.Minute,
+		Address:     ":8080",
+		Issuer:      "http://idp.idp.svc.cluster.local",
+		TokenTTL:    10 * time.Minute,
+		TokenFormat: TokenFormatV2,
+
+		DefaultRealm: "service2infra",
+		Server: ServerConfig{
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			DrainPeriod:       10 * time.Second,
+			ShutdownTimeout:   15 * time.Second,
+			ReadinessTimeout:  3 * time.Second,
+		},
+		TLS: TLSConfig{
+			ClientAuth:     ClientAuthNone,
+			ReloadInterval: 30 * time.Second,
+		},
+		Store: StoreConfig{
+			Backend: StoreBackendMemory,
+		},
+		Keys: KeysConfig{
+			Source: KeySourceGenerate,
+		},
+		Limits: LimitsConfig{
+			MaxRequestBodyBytes: 1 << 20,
+			MaxHeaderBytes:      1 << 20,
+		},
+		Webhooks: WebhooksConfig{
+			QueueSize:  1000,
+			MinBackoff: time.Second,
+			MaxBackoff: 5 * time.Minute,
+		},
+		Tracing: TracingConfig{
+			Exporter:    TracingExporterNone,
+			SampleRatio: 1,
+		},
+	}
+}
+
+func defaultRealms(baseIssuer string) []*Realm {
+	return []*Realm{
+		NewRealm(baseIssuer, "service2infra", 10*time.Minute),
+		NewRealm(baseIssuer, "service2service", 5*time.Minute),
+	}
+}
+
+// Load builds the config from defaults, the YAML file, IDP_* environment
+// variables and command line flags, later sources override earlier ones.
+func Load(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("idp", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("IDP_CONFIG"), "path to the YAML config file")
+	address := fs.String("address", "", "listen address")
+	grpcAddress := fs.String("grpc-address", "", "listen address of the gRPC API")
+	issuer := fs.String("issuer", "", "base issuer URL")
+	tokenTTL := fs.Duration("token-ttl", 0, "default token TTL of realms")
+	tokenFormat := fs.String("token-format", "", "default token format of realms, v1 or v2")
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("failed to parse flags: %w", err)
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "address":
+			cfg.Address = *address
+		case "grpc-address":
+			cfg.GRPCAddress = *grpcAddress
+		case "issuer":
+			cfg.Issuer = *issuer
+		case "token-ttl":
+			cfg.TokenTTL = *tokenTTL
+		case "token-format":
+			cfg.TokenFormat = *tokenFormat
+		}
+	})
+
+	cfg.applyDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+
+	setString := func(key string, dst *string) {
+		if v, ok := lookup(key); ok {
+			*dst = v
+		}
+	}
+	setDuration := func(key string, dst *time.Duration) {
+		if v, ok := lookup(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	setFloat := func(key string, dst *float64) {
+		if v, ok := lookup(key); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			*dst = f
+		}
+	}
+	setInt := func(key string, dst *int64) {
+		if v, ok := lookup(key); ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	setSize := func(key string, dst *int) {
+		if v, ok := lookup(key); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	setString("IDP_ADDRESS", &c.Address)
+	setString("IDP_GRPC_ADDRESS", &c.GRPCAddress)
+	setString("IDP_ISSUER", &c.Issuer)
+	setString("IDP_DEFAULT_REALM", &c.DefaultRealm)
+	setDuration("IDP_TOKEN_TTL", &c.TokenTTL)
+	setString("IDP_TOKEN_FORMAT", &c.TokenFormat)
+	setDuration("IDP_SERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	setDuration("IDP_SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	setDuration("IDP_SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	setDuration("IDP_SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	setDuration("IDP_SERVER_DRAIN_PERIOD", &c.Server.DrainPeriod)
+	setDuration("IDP_SERVER_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	setDuration("IDP_SERVER_READINESS_TIMEOUT", &c.Server.ReadinessTimeout)
+	setString("IDP_TRACING_EXPORTER", &c.Tracing.Exporter)
+	setString("IDP_TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	setString("IDP_TRACING_FILE", &c.Tracing.File)
+	setFloat("IDP_TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+	setString("IDP_TLS_CERT_FILE", &c.TLS.CertFile)
+	setString("IDP_TLS_KEY_FILE", &c.TLS.KeyFile)
+	setString("IDP_TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile)
+	setString("IDP_TLS_CLIENT_AUTH", &c.TLS.ClientAuth)
+	setString("IDP_STORE_BACKEND", &c.Store.Backend)
+	setString("IDP_STORE_DSN", &c.Store.DSN)
+	setString("IDP_KEYS_SOURCE", &c.Keys.Source)
+	setString("IDP_KEYS_PRIVATE_KEY_FILE", &c.Keys.PrivateKeyFile)
+	setString("IDP_KEYS_VAULT_ADDRESS", &c.Keys.Vault.Address)
+	setString("IDP_KEYS_VAULT_MOUNT", &c.Keys.Vault.Mount)
+	setString("IDP_KEYS_VAULT_KEY_NAME", &c.Keys.Vault.KeyName)
+	setString("IDP_KEYS_VAULT_TOKEN", &c.Keys.Vault.Token)
+	setString("IDP_KEYS_VAULT_TOKEN_FILE", &c.Keys.Vault.TokenFile)
+	setString("IDP_KEYS_PKCS11_MODULE", &c.Keys.PKCS11.Module)
+	setString("IDP_KEYS_PKCS11_TOKEN_LABEL", &c.Keys.PKCS11.TokenLabel)
+	setString("IDP_KEYS_PKCS11_KEY_LABEL", &c.Keys.PKCS11.KeyLabel)
+	setString("IDP_KEYS_PKCS11_PIN", &c.Keys.PKCS11.PIN)
+	setString("IDP_KEYS_PKCS11_PIN_FILE", &c.Keys.PKCS11.PINFile)
+	setInt("IDP_LIMITS_MAX_REQUEST_BODY_BYTES", &c.Limits.MaxRequestBodyBytes)
+	setSize("IDP_LIMITS_MAX_HEADER_BYTES", &c.Limits.MaxHeaderBytes)
+	setInt("IDP_LIMITS_TOKEN_REQUESTS_PER_MINUTE", &c.Limits.TokenRequestsPerMinute)
+
+	return errors.Join(errs...)
+}
+
+// applyDefaults fills realm fields left empty with values derived from the
+// global config.
+func (c *Config) applyDefaults() {
+	for _, webhook := range c.Webhooks.Endpoints {
+		if webhook.Timeout == 0 {
+			webhook.Timeout = defaultWebhookTimeout
+		}
+		if webhook.MaxAttempts == 0 {
+			webhook.MaxAttempts = defaultWebhookMaxAttempts
+		}
+	}
+
+	if len(c.Realms) == 0 {
+		c.Realms = defaultRealms(c.Issuer)
+		for _, realm := range c.Realms {
+			realm.Keys = c.Keys
+		}
+	}
+
+	for _, realm := range c.Realms {
+		if realm.Issuer == "" {
+			realm.Issuer = RealmIssuer(c.Issuer, realm.Name)
+		}
+		if realm.TokenTTL == 0 {
+			realm.TokenTTL = c.TokenTTL
+		}
+		if realm.TokenFormat == "" {
+			realm.TokenFormat = c.TokenFormat
+		}
+		if len(realm.Admins) == 0 {
+			realm.Admins = c.Admins
+		}
+		if len(realm.GrantTypes) == 0 {
+			realm.GrantTypes = []string{GrantTypeTokenExchange}
+		}
+		if len(realm.SubjectTokenTypes) == 0 {
+			realm.SubjectTokenTypes = []string{TokenTypeK8s}
+		}
+		if realm.PermissionsNamespace == "" {
+			realm.PermissionsNamespace = realm.Name
+		}
+		if realm.Keys.Source == "" {
+			realm.Keys = c.Keys
+		}
+		if realm.Keys.Source == KeySourceVault && realm.Keys.Vault.Mount == "" {
+			realm.Keys.Vault.Mount = defaultVaultTransitMount
+		}
+		for _, trusted := range realm.TrustedIssuers {
+			if trusted.SubjectTokenType == "" {
+				trusted.SubjectTokenType = TokenTypeJWT
+			}
+			if trusted.ClientTemplate == "" {
+				trusted.ClientTemplate = trusted.Name + ":{{.sub}}"
+			}
+		}
+		if upstream := realm.Upstream; upstream != nil {
+			if upstream.UserClaim == "" {
+				upstream.UserClaim = "email"
+			}
+			if upstream.GroupsClaim == "" {
+				upstream.GroupsClaim = "groups"
+			}
+			if upstream.TokenTTL == 0 {
+				upstream.TokenTTL = min(defaultUpstreamTokenTTL, realm.TokenTTL)
+			}
+		}
+	}
+}
+
+// Validate reports every invalid field at once, so a broken deployment can be
+// fixed in one go.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Address == "" {
+		fail("address", "must not be empty")
+	}
+	if c.GRPCAddress != "" && c.GRPCAddress == c.Address {
+		fail("grpc_address", "must differ from address %q", c.Address)
+	}
+	if err := validateURL(c.Issuer); err != nil {
+		fail("issuer", "%v", err)
+	}
+	if c.TokenTTL <= 0 {
+		fail("token_ttl", "must be positive, got %s", c.TokenTTL)
+	}
+	if !validTokenFormat(c.TokenFormat) {
+		fail("token_format", "must be %q or %q, got %q", TokenFormatV1, TokenFormatV2, c.TokenFormat)
+	}
+	if slices.Contains(c.Admins, "") {
+		fail("admins", "must not contain empty clients")
 	}
+
+	for _, timeout := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.drain_period", c.Server.DrainPeriod},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		if timeout.value < 0 {
+			fail(timeout.field, "must not be negative, got %s", timeout.value)
+		}
+	}
+	if c.Server.ReadinessTimeout <= 0 {
+		fail("server.readiness_timeout", "must be positive, got %s", c.Server.ReadinessTimeout)
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		fail("tls", "%v", err)
+	}
+
+	switch c.Store.Backend {
+	case StoreBackendMemory:
+	case StoreBackendRedis:
+		if c.Store.DSN == "" {
+			fail("store.dsn", "is required for the %q backend", StoreBackendRedis)
+		}
+	default:
+		fail("store.backend", "unknown backend %q", c.Store.Backend)
+	}
+
+	if err := c.Keys.validate(); err != nil {
+		fail("keys", "%v", err)
+	}
+
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterOTLP, TracingExporterStdout:
+	case TracingExporterFile:
+		if c.Tracing.File == "" {
+			fail("tracing.file", "is required for the %q exporter", TracingExporterFile)
+		}
+	default:
+		fail("tracing.exporter", "unknown exporter %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio", "must be within [0, 1], got %v", c.Tracing.SampleRatio)
+	}
+
+	if c.Limits.MaxRequestBodyBytes < 0 {
+		fail("limits.max_request_body_bytes", "must not be negative")
+	}
+	if c.Limits.MaxHeaderBytes < 0 {
+		fail("limits.max_header_bytes", "must not be negative")
+	}
+	if c.Limits.TokenRequestsPerMinute < 0 {
+		fail("limits.token_requests_per_minute", "must not be negative")
+	}
+
+	if len(c.Realms) == 0 {
+		fail("realms", "at least one realm is required")
+	} else if _, ok := c.Realm(c.DefaultRealm); !ok {
+		fail("default_realm", "realm %q is not defined", c.DefaultRealm)
+	}
+
+	seen := make(map[string]bool)
+	for i, realm := range c.Realms {
+		field := fmt.Sprintf("realms[%d]", i)
+		if !realmNameRe.MatchString(realm.Name) {
+			fail(field+".name", "must match %s, got %q", realmNameRe, realm.Name)
+		} else if seen[realm.Name] {
+			fail(field+".name", "duplicate realm %q", realm.Name)
+		}
+		seen[realm.Name] = true
+
+		if err := validateURL(realm.Issuer); err != nil {
+			fail(field+".issuer", "%v", err)
+		}
+		if realm.TokenTTL <= 0 {
+			fail(field+".token_ttl", "must be positive, got %s", realm.TokenTTL)
+		}
+		if !validTokenFormat(realm.TokenFormat) {
+			fail(field+".token_format", "must be %q or %q, got %q", TokenFormatV1, TokenFormatV2, realm.TokenFormat)
+		} else if realm.OpaqueTokens && realm.LegacyTokenFormat() {
+			fail(field+".opaque_tokens", "v1 tokens are always JWTs")
+		}
+		if len(realm.EncryptionKeys) > 0 && realm.OpaqueTokens {
+			fail(field+".encryption_keys", "opaque tokens are not encrypted")
+		} else if len(realm.EncryptionKeys) > 0 && realm.LegacyTokenFormat() {
+			fail(field+".encryption_keys", "v1 tokens are never encrypted")
+		}
+		for scope, keyFile := range realm.EncryptionKeys {
+			if scope == "" || keyFile == "" {
+				fail(field+".encryption_keys", "public key file of scope %q must not be empty", scope)
+			}
+		}
+		for _, grantType := range realm.GrantTypes {
+			if grantType != GrantTypeTokenExchange {
+				fail(field+".grant_types", "unsupported grant type %q", grantType)
+			}
+		}
+		for _, tokenType := range realm.SubjectTokenTypes {
+			switch tokenType {
+			case TokenTypeK8s:
+			case TokenTypeAccessToken:
+				// access tokens of the realm itself are downscoped
+			case TokenTypeIDToken:
+				if realm.Upstream == nil && !realm.trusts(tokenType) {
+					fail(field+".subject_token_types", "%q requires upstream or a trusted issuer", tokenType)
+				}
+			case TokenTypeJWT, TokenTypeJWTSPIFFE:
+				if !realm.trusts(tokenType) {
+					fail(field+".subject_token_types", "%q requires a trusted issuer", tokenType)
+				}
+			default:
+				fail(field+".subject_token_types", "unsupported subject token type %q", tokenType)
+			}
+		}
+		trustedSeen := make(map[string]bool)
+		for j, trusted := range realm.TrustedIssuers {
+			trustedField := fmt.Sprintf("%s.trusted_issuers[%d]", field, j)
+			if err := trusted.validate(); err != nil {
+				fail(trustedField, "%v", err)
+			}
+			if !realm.SupportsSubjectTokenType(trusted.SubjectTokenType) {
+				fail(trustedField+".subject_token_type", "%q is not enabled in the realm", trusted.SubjectTokenType)
+			}
+
+			key := trusted.SubjectTokenType + " " + trusted.Issuer
+			if trustedSeen[key] {
+				fail(trustedField+".issuer", "duplicate issuer %q of %q tokens", trusted.Issuer, trusted.SubjectTokenType)
+			}
+			trustedSeen[key] = true
+		}
+		if realm.Upstream != nil {
+			if err := realm.Upstream.validate(realm.TokenTTL); err != nil {
+				fail(field+".upstream", "%v", err)
+			}
+		}
+		if err := realm.Keys.validate(); err != nil {
+			fail(field+".keys", "%v", err)
+		}
+		if c.Store.Backend == StoreBackendRedis && realm.Keys.Source == KeySourceGenerate {
+			// replicas sharing the store would each sign with a key of their own
+			fail(field+".keys.source", "%q keys are not shared between replicas of the %q backend", KeySourceGenerate, StoreBackendRedis)
+		}
+		if realm.AccessRequests != nil {
+			if err := realm.AccessRequests.validate(); err != nil {
+				fail(field+".access_requests", "%v", err)
+			}
+		}
+		if slices.Contains(realm.Admins, "") {
+			fail(field+".admins", "must not contain empty clients")
+		}
+	}
+
+	if c.Webhooks.QueueSize <= 0 {
+		fail("webhooks.queue_size", "must be positive, got %d", c.Webhooks.QueueSize)
+	}
+	if c.Webhooks.MinBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.MinBackoff {
+		fail("webhooks", "min_backoff must be positive and not exceed max_backoff, got %s and %s", c.Webhooks.MinBackoff, c.Webhooks.MaxBackoff)
+	}
+	webhookNames := make(map[string]bool)
+	for i, webhook := range c.Webhooks.Endpoints {
+		field := fmt.Sprintf("webhooks.endpoints[%d]", i)
+		if err := webhook.validate(c); err != nil {
+			fail(field, "%v", err)
+		}
+		if webhookNames[webhook.Name] {
+			fail(field+".name", "duplicate webhook %q", webhook.Name)
+		}
+		webhookNames[webhook.Name] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+func (k KeysConfig) validate() error {
+	switch k.Source {
+	case KeySourceGenerate:
+	case KeySourceFile:
+		if k.PrivateKeyFile == "" {
+			return fmt.Errorf("private_key_file is required for %q source", KeySourceFile)
+		}
+	case KeySourceVault:
+		var errs []error
+		if err := validateURL(k.Vault.Address); err != nil {
+			errs = append(errs, fmt.Errorf("vault.address: %w", err))
+		}
+		if k.Vault.KeyName == "" {
+			errs = append(errs, errors.New("vault.key_name must not be empty"))
+		}
+		if (k.Vault.Token == "") == (k.Vault.TokenFile == "") {
+			errs = append(errs, errors.New("exactly one of vault.token and vault.token_file must be set"))
+		}
+		return errors.Join(errs...)
+	case KeySourcePKCS11:
+		if !pkcs11Supported {
+			return errors.New("pkcs11 keys require a build with cgo")
+		}
+
+		var errs []error
+		if k.PKCS11.Module == "" {
+			errs = append(errs, errors.New("pkcs11.module must not be empty"))
+		}
+		if k.PKCS11.TokenLabel == "" || k.PKCS11.KeyLabel == "" {
+			errs = append(errs, errors.New("pkcs11.token_label and pkcs11.key_label must not be empty"))
+		}
+		if k.PKCS11.PIN != "" && k.PKCS11.PINFile != "" {
+			errs = append(errs, errors.New("pkcs11.pin and pkcs11.pin_file are mutually exclusive"))
+		}
+		return errors.Join(errs...)
+	default:
+		return fmt.Errorf("unknown key source %q", k.Source)
+	}
+
+	return nil
+}
+
+func (t *TrustedIssuer) validate() error {
+	var errs []error
+	if t.Name == "" {
+		errs = append(errs, errors.New("name must not be empty"))
+	}
+	if err := validateURL(t.Issuer); err != nil && !strings.HasPrefix(t.Issuer, "spiffe://") {
+		errs = append(errs, fmt.Errorf("issuer: %w", err))
+	}
+	if t.JWKSURI != "" {
+		if err := validateURL(t.JWKSURI); err != nil {
+			errs = append(errs, fmt.Errorf("jwks_uri: %w", err))
+		}
+	} else if strings.HasPrefix(t.Issuer, "spiffe://") {
+		errs = append(errs, errors.New("jwks_uri is required for spiffe issuers"))
+	}
+	if len(t.Audiences) == 0 {
+		errs = append(errs, errors.New("audiences must not be empty"))
+	}
+	if _, err := template.New(t.Name).Option("missingkey=error").Parse(t.ClientTemplate); err != nil {
+		errs = append(errs, fmt.Errorf("client_template: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (u *UpstreamConfig) validate(realmTTL time.Duration) error {
+	var errs []error
+	if err := validateURL(u.Issuer); err != nil {
+		errs = append(errs, fmt.Errorf("issuer: %w", err))
+	}
+	if u.Audience == "" {
+		errs = append(errs, errors.New("audience must not be empty"))
+	}
+	if u.JWKSURI != "" {
+		if err := validateURL(u.JWKSURI); err != nil {
+			errs = append(errs, fmt.Errorf("jwks_uri: %w", err))
+		}
+	}
+	if u.TokenTTL <= 0 || u.TokenTTL > realmTTL {
+		errs = append(errs, fmt.Errorf("token_ttl must be positive and not exceed the realm one, got %s", u.TokenTTL))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (a *AccessRequestsConfig) validate() error {
+	var errs []error
+	if len(a.Approvers) == 0 {
+		errs = append(errs, errors.New("approvers must not be empty"))
+	}
+	for scope, approvers := range a.Approvers {
+		if len(approvers) == 0 || slices.Contains(approvers, "") {
+			errs = append(errs, fmt.Errorf("approvers of scope %q must not be empty", scope))
+		}
+	}
+	if a.MaxGrantTTL < 0 {
+		errs = append(errs, fmt.Errorf("max_grant_ttl must not be negative, got %s", a.MaxGrantTTL))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *WebhookConfig) validate(c *Config) error {
+	var errs []error
+	if w.Name == "" {
+		errs = append(errs, errors.New("name must not be empty"))
+	}
+	if err := validateURL(w.URL); err != nil {
+		errs = append(errs, fmt.Errorf("url: %w", err))
+	}
+	if (w.Secret == "") == (w.SecretFile == "") {
+		errs = append(errs, errors.New("exactly one of secret and secret_file must be set"))
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			errs = append(errs, fmt.Errorf("unknown event %q", event))
+		}
+	}
+	for _, realm := range w.Realms {
+		if _, ok := c.Realm(realm); !ok {
+			errs = append(errs, fmt.Errorf("realm %q is not defined", realm))
+		}
+	}
+	if w.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("timeout must be positive, got %s", w.Timeout))
+	}
+	if w.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("max_attempts must be positive, got %d", w.MaxAttempts))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Sends reports whether the event of the realm is sent to the webhook.
+func (w *WebhookConfig) Sends(event, realm string) bool {
+	return (len(w.Events) == 0 || slices.Contains(w.Events, event)) &&
+		(len(w.Realms) == 0 || slices.Contains(w.Realms, realm))
+}
+
+func (t TLSConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+
+	switch t.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if !t.Enabled() {
+			return fmt.Errorf("client_auth %q requires cert_file", t.ClientAuth)
+		} else if t.ClientCAFile == "" {
+			return fmt.Errorf("client_auth %q requires client_ca_file", t.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown client_auth %q", t.ClientAuth)
+	}
+
+	if t.Enabled() && t.ReloadInterval <= 0 {
+		return fmt.Errorf("reload_interval must be positive, got %s", t.ReloadInterval)
+	}
+
+	return nil
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must be absolute http(s), got %q", raw)
+	} else if u.Host == "" {
+		return fmt.Errorf("url host is empty in %q", raw)
+	}
+
+	return nil
+}
+
+// Redacted returns a deep enough copy of the config with secrets masked,
+// it is safe to expose it on debug endpoints.
+func (c *Config) Redacted() *Config {
+	cp := *c
+	if cp.Store.DSN != "" {
+		cp.Store.DSN = redacted
+	}
+	cp.Keys = c.Keys.redacted()
+
+	cp.Realms = make([]*Realm, 0, len(c.Realms))
+	for _, realm := range c.Realms {
+		realmCp := *realm
+		realmCp.Keys = realm.Keys.redacted()
+		cp.Realms = append(cp.Realms, &realmCp)
+	}
+
+	cp.Webhooks.Endpoints = nil
+	for _, webhook := range c.Webhooks.Endpoints {
+		webhookCp := *webhook
+		if webhookCp.Secret != "" {
+			webhookCp.Secret = redacted
+		}
+		cp.Webhooks.Endpoints = append(cp.Webhooks.Endpoints, &webhookCp)
+	}
+
+	return &cp
+}
+
+func (k KeysConfig) redacted() KeysConfig {
+	if k.Vault.Token != "" {
+		k.Vault.Token = redacted
+	}
+	if k.PKCS11.PIN != "" {
+		k.PKCS11.PIN = redacted
+	}
+
+	return k
+}
+
+// NewRealm returns a realm with the default grant and subject token types,
+// its issuer and permissions namespace are derived from the realm name.
+func NewRealm(baseIssuer, name string, ttl time.Duration) *Realm {
+	return &Realm{
+		Name:                 name,
+		Issuer:               RealmIssuer(baseIssuer, name),
+		TokenTTL:             ttl,
+		TokenFormat:          TokenFormatV2,
+		GrantTypes:           []string{GrantTypeTokenExchange},
+		SubjectTokenTypes:    []string{TokenTypeK8s},
+		PermissionsNamespace: name,
+		Keys:                 KeysConfig{Source: KeySourceGenerate},
+	}
+}
+
+// LegacyTokenFormat reports whether the realm issues v1 tokens.
+func (r *Realm) LegacyTokenFormat() bool {
+	return r.TokenFormat == TokenFormatV1
+}
+
+func validTokenFormat(format string) bool {
+	return format == TokenFormatV1 || format == TokenFormatV2
+}
+
+func RealmIssuer(baseIssuer, name string) string {
+	return baseIssuer + "/realms/" + name
+}
+
+func (c *Config) Realm(name string) (*Realm, bool) {
+	for _, realm := range c.Realms {
+		if realm.Name == name {
+			return realm, true
+		}
+	}
+
+	return nil, false
+}
+
+// RealmScopes returns the sorted scopes permissions are configured for in the
+// namespace of the realm.
+func (c *Config) RealmScopes(realm *Realm) []string {
+	scopes := []string{}
+	for _, clientScopes := range c.Store.Permissions[realm.PermissionsNamespace] {
+		for scope := range clientScopes {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	slices.Sort(scopes)
+
+	return scopes
+}
+
+func (r *Realm) SupportsGrantType(grantType string) bool {
+	return slices.Contains(r.GrantTypes, grantType)
+}
+
+func (r *Realm) SupportsSubjectTokenType(tokenType string) bool {
+	return slices.Contains(r.SubjectTokenTypes, tokenType)
+}
+
+func (r *Realm) trusts(tokenType string) bool {
+	return slices.ContainsFunc(r.TrustedIssuers, func(t *TrustedIssuer) bool {
+		return t.SubjectTokenType == tokenType
+	})
 }
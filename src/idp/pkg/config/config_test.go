@@ -0,0 +1,572 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "idp.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":8080", cfg.Address)
+	assert.Equal(t, "http://idp.idp.svc.cluster.local", cfg.Issuer)
+	require.Len(t, cfg.Realms, 2)
+
+	realm, ok := cfg.Realm("service2infra")
+	require.True(t, ok)
+	assert.Equal(t, "http://idp.idp.svc.cluster.local/realms/service2infra", realm.Issuer)
+	assert.Equal(t, 10*time.Minute, realm.TokenTTL)
+	assert.Equal(t, TokenFormatV2, realm.TokenFormat)
+	assert.Equal(t, KeySourceGenerate, realm.Keys.Source)
+	assert.Equal(t, 10*time.Second, cfg.Server.DrainPeriod)
+	assert.Empty(t, cfg.Store.Permissions, "no grants unless configured")
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfig(t, `
+address: ":9000"
+grpc_address: ":9001"
+issuer: "https://file.example"
+token_ttl: 3m
+default_realm: a
+realms:
+  - name: a
+  - name: b
+    token_ttl: 1m
+    token_format: v2
+    permissions_namespace: a
+store:
+  dsn: "postgres://user:secret@db/idp"
+  permissions:
+    a:
+      client: {scope: [RO]}
+`)
+
+	t.Setenv("IDP_ISSUER", "https://env.example")
+	t.Setenv("IDP_TOKEN_TTL", "4m")
+	t.Setenv("IDP_GRPC_ADDRESS", ":9002")
+	t.Setenv("IDP_TOKEN_FORMAT", "v1")
+
+	cfg, err := Load([]string{"-config", path, "-token-ttl", "5m", "-grpc-address", ":9003"})
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.Address)
+	assert.Equal(t, ":9003", cfg.GRPCAddress)
+	assert.Equal(t, "https://env.example", cfg.Issuer)
+	assert.Equal(t, 5*time.Minute, cfg.TokenTTL)
+
+	a, ok := cfg.Realm("a")
+	require.True(t, ok)
+	assert.Equal(t, "https://env.example/realms/a", a.Issuer)
+	assert.Equal(t, 5*time.Minute, a.TokenTTL)
+	assert.True(t, a.LegacyTokenFormat())
+	assert.Equal(t, "a", a.PermissionsNamespace)
+
+	b, ok := cfg.Realm("b")
+	require.True(t, ok)
+	assert.Equal(t, time.Minute, b.TokenTTL)
+	assert.False(t, b.LegacyTokenFormat())
+	assert.Equal(t, "a", b.PermissionsNamespace)
+
+	assert.Equal(t, []string{"RO"}, cfg.Store.Permissions["a"]["client"]["scope"])
+}
+
+func TestLoad_UnknownField(t *testing.T) {
+	path := writeConfig(t, "adress: \":9000\"\n")
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "adress")
+}
+
+func TestLoad_LimitsEnv(t *testing.T) {
+	t.Setenv("IDP_LIMITS_MAX_HEADER_BYTES", "4096")
+	t.Setenv("IDP_SERVER_READINESS_TIMEOUT", "500ms")
+
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, cfg.Limits.MaxHeaderBytes)
+	assert.Equal(t, 500*time.Millisecond, cfg.Server.ReadinessTimeout)
+
+	t.Setenv("IDP_LIMITS_MAX_HEADER_BYTES", "1MiB")
+	_, err = Load(nil)
+	assert.ErrorContains(t, err, "IDP_LIMITS_MAX_HEADER_BYTES")
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	t.Setenv("IDP_TOKEN_TTL", "ten minutes")
+
+	_, err := Load(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "IDP_TOKEN_TTL")
+}
+
+func TestValidate_ReportsAllErrors(t *testing.T) {
+	path := writeConfig(t, `
+issuer: "idp.local"
+default_realm: missing
+store:
+  backend: etcd
+tracing:
+  exporter: file
+realms:
+  - name: "Bad Name"
+    token_ttl: -1s
+  - name: dup
+    keys: {source: file}
+  - name: dup
+    grant_types: [password]
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+
+	for _, want := range []string{
+		"issuer: url must be absolute",
+		"default_realm: realm \"missing\" is not defined",
+		"store.backend: unknown backend \"etcd\"",
+		"tracing.file: is required for the \"file\" exporter",
+		"realms[0].name",
+		"realms[0].token_ttl: must be positive",
+		"realms[1].keys: private_key_file is required",
+		"realms[2].name: duplicate realm \"dup\"",
+		"realms[2].grant_types: unsupported grant type \"password\"",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidate_RedisStore(t *testing.T) {
+	path := writeConfig(t, `
+store:
+  backend: redis
+limits:
+  token_requests_per_minute: -1
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "store.dsn: is required for the \"redis\" backend")
+	assert.Contains(t, err.Error(), "limits.token_requests_per_minute: must not be negative")
+	assert.Contains(t, err.Error(), "realms[0].keys.source: \"generate\" keys are not shared between replicas of the \"redis\" backend")
+
+	t.Setenv("IDP_STORE_DSN", "redis://redis.redis.svc.cluster.local:6379/0")
+	t.Setenv("IDP_LIMITS_TOKEN_REQUESTS_PER_MINUTE", "60")
+	path = writeConfig(t, `
+store:
+  backend: redis
+keys:
+  source: file
+  private_key_file: /etc/idp/keys/private.pem
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), cfg.Limits.TokenRequestsPerMinute)
+}
+
+func TestLoad_UpstreamDefaults(t *testing.T) {
+	path := writeConfig(t, `
+default_realm: humans
+realms:
+  - name: humans
+    token_ttl: 2m
+    subject_token_types:
+      - urn:ietf:params:oauth:token-type:id_token
+    upstream:
+      issuer: https://login.example.com
+      audience: idp-cli
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+
+	upstream := cfg.Realms[0].Upstream
+	require.NotNil(t, upstream)
+	assert.Equal(t, "email", upstream.UserClaim)
+	assert.Equal(t, "groups", upstream.GroupsClaim)
+	assert.Equal(t, 2*time.Minute, upstream.TokenTTL, "capped by the realm ttl")
+}
+
+func TestValidate_Upstream(t *testing.T) {
+	path := writeConfig(t, `
+realms:
+  - name: no-upstream
+    subject_token_types:
+      - urn:ietf:params:oauth:token-type:id_token
+  - name: bad-upstream
+    token_ttl: 1m
+    upstream:
+      issuer: login.example.com
+      token_ttl: 1h
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+
+	for _, want := range []string{
+		"realms[0].subject_token_types: \"urn:ietf:params:oauth:token-type:id_token\" requires upstream",
+		"realms[1].upstream: issuer: url must be absolute",
+		"audience must not be empty",
+		"token_ttl must be positive and not exceed the realm one, got 1h0m0s",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidate_AccessRequests(t *testing.T) {
+	path := writeConfig(t, `
+realms:
+  - name: a
+    access_requests:
+      max_grant_ttl: -1h
+  - name: b
+    access_requests:
+      approvers:
+        postgres-a: []
+  - name: c
+    access_requests:
+      approvers:
+        postgres-a: ["group:dba"]
+      max_grant_ttl: 72h
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "realms[0].access_requests: approvers must not be empty")
+	assert.Contains(t, err.Error(), "max_grant_ttl must not be negative, got -1h0m0s")
+	assert.Contains(t, err.Error(), `realms[1].access_requests: approvers of scope "postgres-a" must not be empty`)
+	assert.NotContains(t, err.Error(), "realms[2]")
+}
+
+func TestLoad_Admins(t *testing.T) {
+	path := writeConfig(t, `
+admins: [auth-ui]
+default_realm: a
+realms:
+  - name: a
+  - name: b
+    admins: ["group:idp-admins"]
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+
+	a, _ := cfg.Realm("a")
+	assert.Equal(t, []string{"auth-ui"}, a.Admins)
+	b, _ := cfg.Realm("b")
+	assert.Equal(t, []string{"group:idp-admins"}, b.Admins)
+
+	path = writeConfig(t, `
+admins: [""]
+default_realm: a
+realms:
+  - name: a
+    admins: [auth-ui, ""]
+`)
+	_, err = Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "admins: must not contain empty clients")
+	assert.Contains(t, err.Error(), "realms[0].admins: must not contain empty clients")
+}
+
+func TestValidate_TokenFormat(t *testing.T) {
+	path := writeConfig(t, `
+token_format: v3
+realms:
+  - name: a
+    token_format: rfc9068
+  - name: b
+    token_format: v1
+    opaque_tokens: true
+  - name: c
+    opaque_tokens: true
+    encryption_keys:
+      postgres-a: /etc/idp/encryption/postgres-a.pem
+      postgres-b: ""
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `token_format: must be "v1" or "v2", got "v3"`)
+	assert.Contains(t, err.Error(), `realms[0].token_format: must be "v1" or "v2", got "rfc9068"`)
+	assert.Contains(t, err.Error(), "realms[1].opaque_tokens: v1 tokens are always JWTs")
+	assert.Contains(t, err.Error(), "realms[2].encryption_keys: opaque tokens are not encrypted")
+	assert.Contains(t, err.Error(), `realms[2].encryption_keys: public key file of scope "postgres-b" must not be empty`)
+}
+
+func TestValidate_Webhooks(t *testing.T) {
+	path := writeConfig(t, `
+realms:
+  - name: a
+webhooks:
+  min_backoff: 10m
+  max_backoff: 1m
+  endpoints:
+    - name: chat
+      url: https://chat.example.com/hooks/idp
+      secret: s3cr3t
+      events: ["permissions.updated"]
+      realms: ["a"]
+    - name: chat
+      url: ftp://tickets
+      events: ["token.issued"]
+      realms: ["b"]
+      max_attempts: -1
+`)
+
+	_, err := Load([]string{"-config", path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webhooks: min_backoff must be positive and not exceed max_backoff, got 10m0s and 1m0s")
+	assert.NotContains(t, err.Error(), "webhooks.endpoints[0]:")
+	assert.Contains(t, err.Error(), "exactly one of secret and secret_file must be set")
+	assert.Contains(t, err.Error(), `unknown event "token.issued"`)
+	assert.Contains(t, err.Error(), `realm "b" is not defined`)
+	assert.Contains(t, err.Error(), "max_attempts must be positive, got -1")
+	assert.Contains(t, err.Error(), `webhooks.endpoints[1].name: duplicate webhook "chat"`)
+}
+
+func TestWebhookConfig_Sends(t *testing.T) {
+	all := &WebhookConfig{}
+	assert.True(t, all.Sends(WebhookEventKeyRotated, "a"))
+
+	filtered := &WebhookConfig{Events: []string{WebhookEventTokenDenied}, Realms: []string{"a"}}
+	assert.True(t, filtered.Sends(WebhookEventTokenDenied, "a"))
+	assert.False(t, filtered.Sends(WebhookEventTokenDenied, "b"))
+	assert.False(t, filtered.Sends(WebhookEventKeyRotated, "a"))
+}
+
+func TestValidate_TrustedIssuers(t *testing.T) {
+	path := writeConfig(t, `
+default_realm: federated
+realms:
+  - name: federated
+    subject_token_types:
+      - urn:ietf:params:oauth:token-type:jwt:kubernetes
+      - urn:ietf:params:oauth:token-type:jwt-spiffe
+    trusted_issuers:
+      - name: cluster-b
+        issuer: https://oidc.cluster-b.example
+        subject_token_type: urn:ietf:params:oauth:token-type:jwt:kubernetes
+        audiences: [idp]
+        client_template: 'cluster-b:{{index . "kubernetes.io" "serviceaccount" "name"}}'
+      - name: spire
+        issuer: spiffe://cluster-b.example
+        subject_token_type: urn:ietf:params:oauth:token-type:jwt-spiffe
+        jwks_uri: https://spire.cluster-b.example/keys
+        audiences: [idp]
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+	assert.Equal(t, "spire:{{.sub}}", cfg.Realms[0].TrustedIssuers[1].ClientTemplate)
+
+	path = writeConfig(t, `
+default_realm: federated
+realms:
+  - name: federated
+    subject_token_types:
+      - urn:ietf:params:oauth:token-type:jwt-spiffe
+    trusted_issuers:
+      - name: ci
+        issuer: https://ci.example
+        client_template: '{{.project'
+      - name: spire
+        issuer: spiffe://cluster-b.example
+        subject_token_type: urn:ietf:params:oauth:token-type:jwt-spiffe
+        audiences: [idp]
+      - name: spire-copy
+        issuer: spiffe://cluster-b.example
+        subject_token_type: urn:ietf:params:oauth:token-type:jwt-spiffe
+        jwks_uri: https://spire.cluster-b.example/keys
+        audiences: [idp]
+`)
+
+	_, err = Load([]string{"-config", path})
+	require.Error(t, err)
+
+	for _, want := range []string{
+		"realms[0].trusted_issuers[0]: audiences must not be empty",
+		"client_template: template: ci:1: unclosed action",
+		"realms[0].trusted_issuers[0].subject_token_type: \"urn:ietf:params:oauth:token-type:jwt\" is not enabled in the realm",
+		"realms[0].trusted_issuers[1]: jwks_uri is required for spiffe issuers",
+		"realms[0].trusted_issuers[2].issuer: duplicate issuer \"spiffe://cluster-b.example\"",
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidate_SigningKeys(t *testing.T) {
+	path := writeConfig(t, `
+default_realm: vault
+realms:
+  - name: vault
+    keys:
+      source: vault
+      vault: {address: "https://vault:8200", key_name: idp, token_file: /var/run/secrets/vault/token}
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+	assert.Equal(t, "transit", cfg.Realms[0].Keys.Vault.Mount)
+
+	path = writeConfig(t, `
+default_realm: vault
+realms:
+  - name: vault
+    keys:
+      source: vault
+      vault: {address: vault:8200, token: root, token_file: token}
+  - name: hsm
+    keys:
+      source: pkcs11
+      pkcs11: {token_label: idp, pin: "1234", pin_file: pin}
+`)
+
+	_, err = Load([]string{"-config", path})
+	require.Error(t, err)
+
+	wantErrs := []string{
+		"realms[0].keys: vault.address: url must be absolute",
+		"vault.key_name must not be empty",
+		"exactly one of vault.token and vault.token_file must be set",
+	}
+	if pkcs11Supported {
+		wantErrs = append(wantErrs,
+			"realms[1].keys: pkcs11.module must not be empty",
+			"pkcs11.token_label and pkcs11.key_label must not be empty",
+			"pkcs11.pin and pkcs11.pin_file are mutually exclusive",
+		)
+	} else {
+		wantErrs = append(wantErrs, "realms[1].keys: pkcs11 keys require a build with cgo")
+	}
+	for _, want := range wantErrs {
+		assert.Contains(t, err.Error(), want)
+	}
+}
+
+func TestValidate_PKCS11Keys(t *testing.T) {
+	path := writeConfig(t, `
+default_realm: hsm
+realms:
+  - name: hsm
+    keys:
+      source: pkcs11
+      pkcs11: {module: /usr/lib/softhsm/libsofthsm2.so, token_label: idp, key_label: idp-signing}
+`)
+
+	_, err := Load([]string{"-config", path})
+	if pkcs11Supported {
+		require.NoError(t, err)
+	} else {
+		// the key would only fail to load once the IdP starts
+		require.ErrorContains(t, err, "realms[0].keys: pkcs11 keys require a build with cgo")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, err := Load(nil)
+	require.NoError(t, err)
+	cfg.Store.DSN = "postgres://user:secret@db/idp"
+	cfg.Keys.Vault.Token = "root"
+	cfg.Realms[0].Keys.PKCS11.PIN = "1234"
+
+	redactedCfg := cfg.Redacted()
+	assert.Equal(t, redacted, redactedCfg.Store.DSN)
+	assert.Equal(t, "postgres://user:secret@db/idp", cfg.Store.DSN)
+	assert.Equal(t, redacted, redactedCfg.Keys.Vault.Token)
+	assert.Equal(t, redacted, redactedCfg.Realms[0].Keys.PKCS11.PIN)
+	assert.Equal(t, "1234", cfg.Realms[0].Keys.PKCS11.PIN)
+
+	cfg.Webhooks.Endpoints = []*WebhookConfig{{Name: "chat", Secret: "hook-secret"}}
+	redactedCfg = cfg.Redacted()
+	assert.Equal(t, redacted, redactedCfg.Webhooks.Endpoints[0].Secret)
+	assert.Equal(t, "hook-secret", cfg.Webhooks.Endpoints[0].Secret)
+
+	redactedCfg.Realms[0].Name = "changed"
+	assert.NotEqual(t, "changed", cfg.Realms[0].Name)
+}
+
+func TestValidate_TLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     string
+		wantErr string
+	}{
+		{
+			name: "server tls",
+			tls:  "{cert_file: tls.crt, key_file: tls.key}",
+		},
+		{
+			name: "mtls",
+			tls:  "{cert_file: tls.crt, key_file: tls.key, client_ca_file: ca.crt, client_auth: require}",
+		},
+		{
+			name:    "missing key",
+			tls:     "{cert_file: tls.crt}",
+			wantErr: "tls: cert_file and key_file must be set together",
+		},
+		{
+			name:    "mtls without tls",
+			tls:     "{client_ca_file: ca.crt, client_auth: request}",
+			wantErr: "tls: client_auth \"request\" requires cert_file",
+		},
+		{
+			name:    "mtls without client ca",
+			tls:     "{cert_file: tls.crt, key_file: tls.key, client_auth: require}",
+			wantErr: "tls: client_auth \"require\" requires client_ca_file",
+		},
+		{
+			name:    "unknown client auth",
+			tls:     "{client_auth: always}",
+			wantErr: "tls: unknown client_auth \"always\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, "tls: "+tt.tls+"\n")
+
+			_, err := Load([]string{"-config", path})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRealmScopes(t *testing.T) {
+	path := writeConfig(t, `
+store:
+  permissions:
+    service2service:
+      service-a: {service-b: [RO]}
+      service-b: {service-a: [RO]}
+`)
+
+	cfg, err := Load([]string{"-config", path})
+	require.NoError(t, err)
+
+	realm, ok := cfg.Realm("service2service")
+	require.True(t, ok)
+	assert.Equal(t, []string{"service-a", "service-b"}, cfg.RealmScopes(realm))
+
+	realm.PermissionsNamespace = "unknown"
+	assert.Equal(t, []string{}, cfg.RealmScopes(realm))
+}
@@ -0,0 +1,7 @@
+//go:build cgo
+
+package config
+
+// pkcs11Supported reports whether the build can load the PKCS#11 library of
+// an HSM, which takes cgo.
+const pkcs11Supported = true
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for access requests and snapshots which do not
+// exist.
+var ErrNotFound = errors.New("not found")
+
+type AccessRequestStatus string
+
+const (
+	AccessRequestPending  AccessRequestStatus = "pending"
+	AccessRequestApproved AccessRequestStatus = "approved"
+	AccessRequestDenied   AccessRequestStatus = "denied"
+	// AccessRequestExpired is an approved request whose grant has run out.
+	AccessRequestExpired AccessRequestStatus = "expired"
+)
+
+// AccessRequest asks the approvers of a scope to grant roles to a client.
+type AccessRequest struct {
+	ID    string `json:"id"`
+	Realm string `json:"realm"`
+
+	Client        string   `json:"client"`
+	Scope         string   `json:"scope"`
+	Roles         []string `json:"roles"`
+	Justification string   `json:"justification"`
+	// TTLSeconds is the requested lifetime of the grant, zero asks for a
+	// permanent one.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+
+	Requester string              `json:"requester"`
+	CreatedAt time.Time           `json:"created_at"`
+	Status    AccessRequestStatus `json:"status"`
+
+	Reviewer      string     `json:"reviewer,omitempty"`
+	ReviewComment string     `json:"review_comment,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewed_at,omitempty"`
+
+	// GrantExpiresAt is set for time-bound grants.
+	GrantExpiresAt *time.Time `json:"grant_expires_at,omitempty"`
+	// AddedRoles are the roles the client did not have before the approval,
+	// only they are taken away when the grant expires.
+	AddedRoles []string `json:"added_roles,omitempty"`
+}
+
+// AccessRequestFilter selects access requests, empty fields match any.
+type AccessRequestFilter struct {
+	Realm  string
+	Status AccessRequestStatus
+	Client string
+	Scope  string
+}
+
+func (f AccessRequestFilter) match(req *AccessRequest) bool {
+	return (f.Realm == "" || f.Realm == req.Realm) &&
+		(f.Status == "" || f.Status == req.Status) &&
+		(f.Client == "" || f.Client == req.Client) &&
+		(f.Scope == "" || f.Scope == req.Scope)
+}
+
+// sortAccessRequests orders the requests from the oldest one.
+func sortAccessRequests(reqs []*AccessRequest) {
+	slices.SortFunc(reqs, func(a, b *AccessRequest) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+func (req *AccessRequest) clone() *AccessRequest {
+	cp := *req
+	cp.Roles = slices.Clone(req.Roles)
+	cp.AddedRoles = slices.Clone(req.AddedRoles)
+	return &cp
+}
+
+// AccessRequests keeps the access requests of a namespace in memory of the
+// replica.
+type AccessRequests struct {
+	mu   sync.Mutex
+	reqs map[string]*AccessRequest
+}
+
+func NewAccessRequests() *AccessRequests {
+	return &AccessRequests{reqs: make(map[string]*AccessRequest)}
+}
+
+func (s *AccessRequests) Create(_ context.Context, req *AccessRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reqs[req.ID]; ok {
+		return errors.New("access request already exists")
+	}
+	s.reqs[req.ID] = req.clone()
+
+	return nil
+}
+
+func (s *AccessRequests) Get(_ context.Context, id string) (*AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.reqs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return req.clone(), nil
+}
+
+func (s *AccessRequests) List(_ context.Context, filter AccessRequestFilter) ([]*AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reqs := []*AccessRequest{}
+	for _, req := range s.reqs {
+		if filter.match(req) {
+			reqs = append(reqs, req.clone())
+		}
+	}
+	sortAccessRequests(reqs)
+
+	return reqs, nil
+}
+
+// Update applies the change to the stored request atomically, nothing is
+// stored if the change fails.
+func (s *AccessRequests) Update(_ context.Context, id string, change func(req *AccessRequest) error) (*AccessRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.reqs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	req := stored.clone()
+	if err := change(req); err != nil {
+		return nil, err
+	}
+	s.reqs[id] = req
+
+	return req.clone(), nil
+}
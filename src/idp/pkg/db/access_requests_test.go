@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type accessRequestStore interface {
+	Create(ctx context.Context, req *AccessRequest) error
+	Get(ctx context.Context, id string) (*AccessRequest, error)
+	List(ctx context.Context, filter AccessRequestFilter) ([]*AccessRequest, error)
+	Update(ctx context.Context, id string, change func(req *AccessRequest) error) (*AccessRequest, error)
+}
+
+func TestAccessRequests(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, store := range map[string]accessRequestStore{
+		"memory": NewAccessRequests(),
+		"redis":  NewRedisAccessRequests(client, "ns"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			first := &AccessRequest{ID: "a", Realm: "r1", Client: "service-a", Scope: "postgres-a", Roles: []string{"RW"}, Status: AccessRequestPending, CreatedAt: created}
+			second := &AccessRequest{ID: "b", Realm: "r1", Client: "service-b", Scope: "postgres-a", Roles: []string{"RO"}, Status: AccessRequestPending, CreatedAt: created.Add(time.Minute)}
+			other := &AccessRequest{ID: "c", Realm: "r2", Client: "service-a", Scope: "postgres-a", Roles: []string{"RO"}, Status: AccessRequestPending, CreatedAt: created}
+			for _, req := range []*AccessRequest{second, first, other} {
+				require.NoError(t, store.Create(ctx, req))
+			}
+			assert.Error(t, store.Create(ctx, first))
+
+			got, err := store.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.Equal(t, first, got)
+			_, err = store.Get(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			reqs, err := store.List(ctx, AccessRequestFilter{Realm: "r1"})
+			require.NoError(t, err)
+			require.Len(t, reqs, 2)
+			assert.Equal(t, "a", reqs[0].ID)
+			assert.Equal(t, "b", reqs[1].ID)
+
+			updated, err := store.Update(ctx, "a", func(req *AccessRequest) error {
+				req.Status = AccessRequestApproved
+				req.AddedRoles = []string{"RW"}
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, AccessRequestApproved, updated.Status)
+
+			// a failed change is not stored
+			_, err = store.Update(ctx, "b", func(req *AccessRequest) error {
+				req.Status = AccessRequestDenied
+				return errors.New("rejected")
+			})
+			assert.EqualError(t, err, "rejected")
+
+			reqs, err = store.List(ctx, AccessRequestFilter{Realm: "r1", Status: AccessRequestPending})
+			require.NoError(t, err)
+			require.Len(t, reqs, 1)
+			assert.Equal(t, "b", reqs[0].ID)
+
+			reqs, err = store.List(ctx, AccessRequestFilter{Client: "service-a", Status: AccessRequestApproved})
+			require.NoError(t, err)
+			require.Len(t, reqs, 1)
+			assert.Equal(t, []string{"RW"}, reqs[0].AddedRoles)
+
+			_, err = store.Update(ctx, "unknown", func(*AccessRequest) error { return nil })
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+type auditLog interface {
+	Record(ctx context.Context, event AuditEvent) error
+	List(ctx context.Context, limit int) ([]AuditEvent, error)
+}
+
+func TestAuditLog(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, log := range map[string]auditLog{
+		"memory": NewAuditLog(),
+		"redis":  NewRedisAuditLog(client, "ns"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, action := range []string{"first", "second", "third"} {
+				require.NoError(t, log.Record(ctx, AuditEvent{Time: time.Now().UTC(), Actor: "admin", Action: action}))
+			}
+
+			events, err := log.List(ctx, 2)
+			require.NoError(t, err)
+			require.Len(t, events, 2)
+			assert.Equal(t, "third", events[0].Action)
+			assert.Equal(t, "second", events[1].Action)
+
+			events, err = log.List(ctx, 0)
+			require.NoError(t, err)
+			assert.Empty(t, events)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuditMaxEvents bounds the audit trail, older events are dropped.
+const AuditMaxEvents = 10000
+
+// AuditEvent records who changed the permissions of a namespace and why.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Realm  string    `json:"realm"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+
+	Client    string   `json:"client,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+	Comment   string   `json:"comment,omitempty"`
+}
+
+// AuditLog keeps the audit trail of a namespace in memory of the replica.
+type AuditLog struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+func (l *AuditLog) Record(_ context.Context, event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, event)
+	if len(l.events) > AuditMaxEvents {
+		l.events = slices.Delete(l.events, 0, len(l.events)-AuditMaxEvents)
+	}
+
+	return nil
+}
+
+// List returns up to limit latest events, the newest one first.
+func (l *AuditLog) List(_ context.Context, limit int) ([]AuditEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := make([]AuditEvent, 0, max(min(limit, len(l.events)), 0))
+	for i := len(l.events) - 1; i >= 0 && len(events) < limit; i-- {
+		events = append(events, l.events[i])
+	}
+
+	return events, nil
+}
@@ -1,10 +1,22 @@
 package db
 
-import "sync"
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
 
 type storage struct {
 	sync.Mutex
 	permissions map[string]map[string][]string
+	// versions are kept by scope and client
+	versions map[string]map[string]PermissionsVersion
+	// revision grows with every change of the permission set
+	revision int64
+	// baseVersion is the start time in milliseconds, versions of a restarted
+	// IdP stay above the ones of the tokens it issued before.
+	baseVersion int64
 }
 
 type Repository struct {
@@ -15,6 +27,8 @@ func NewRepository(permissions map[string]map[string][]string) *Repository {
 	return &Repository{
 		storage: &storage{
 			permissions: permissions,
+			versions:    make(map[string]map[string]PermissionsVersion),
+			baseVersion: time.Now().UnixMilli(),
 		},
 	}
 }
@@ -23,15 +37,85 @@ func (r *Repository) UpdatePermissions(client, scope string, roles []string) err
 	r.storage.Lock()
 	defer r.storage.Unlock()
 
-	r.storage.permissions[client][scope] = roles
+	r.storage.update(client, scope, roles)
 	return nil
 }
 
+// UpdatePermissionsBatch stores the roles of all the clients at once, no
+// reader sees a part of the changes.
+func (r *Repository) UpdatePermissionsBatch(_ context.Context, updates []PermissionUpdate) error {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	for _, u := range updates {
+		r.storage.update(u.Client, u.Scope, u.Roles)
+	}
+	return nil
+}
+
+// PermissionsRevision returns the revision of the permission set, it grows
+// with every change of any roles.
+func (r *Repository) PermissionsRevision(_ context.Context) (int64, error) {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	return r.storage.revision, nil
+}
+
+// CompareAndSwapPermissions stores the roles like UpdatePermissionsBatch
+// unless the permission set has changed since the revision.
+func (r *Repository) CompareAndSwapPermissions(_ context.Context, revision int64, updates []PermissionUpdate) error {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	if r.storage.revision != revision {
+		return ErrConflict
+	}
+	for _, u := range updates {
+		r.storage.update(u.Client, u.Scope, u.Roles)
+	}
+	return nil
+}
+
+func (s *storage) update(client, scope string, roles []string) {
+	clientPerms, ok := s.permissions[client]
+	if !ok {
+		clientPerms = make(map[string][]string)
+		s.permissions[client] = clientPerms
+	}
+
+	scopeVersions, ok := s.versions[scope]
+	if !ok {
+		scopeVersions = make(map[string]PermissionsVersion)
+		s.versions[scope] = scopeVersions
+	}
+	version, ok := scopeVersions[client]
+	if !ok {
+		version = PermissionsVersion{Version: s.baseVersion}
+	}
+	scopeVersions[client] = version.next(clientPerms[scope], roles)
+
+	clientPerms[scope] = roles
+	s.revision++
+}
+
 func (r *Repository) GetPermissions(client, scope string) []string {
 	r.storage.Lock()
 	defer r.storage.Unlock()
 
-	clientPerms, ok := r.storage.permissions[client]
+	return r.storage.roles(client, scope)
+}
+
+// GetVersionedPermissions returns the roles along with their version.
+func (r *Repository) GetVersionedPermissions(client, scope string) ([]string, PermissionsVersion) {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	return r.storage.roles(client, scope), r.storage.versions[scope][client]
+}
+
+func (s *storage) roles(client, scope string) []string {
+	clientPerms, ok := s.permissions[client]
 	if !ok {
 		return []string{}
 	}
@@ -43,3 +127,31 @@ func (r *Repository) GetPermissions(client, scope string) []string {
 
 	return roles
 }
+
+// ScopeVersions returns the versions of the clients whose permissions on the
+// scope have changed since the start.
+func (r *Repository) ScopeVersions(_ context.Context, scope string) (map[string]PermissionsVersion, error) {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	return maps.Clone(r.storage.versions[scope]), nil
+}
+
+// AllPermissions returns a copy of the roles of every client: client -> scope
+// -> roles.
+func (r *Repository) AllPermissions(_ context.Context) (map[string]map[string][]string, error) {
+	r.storage.Lock()
+	defer r.storage.Unlock()
+
+	permissions := make(map[string]map[string][]string, len(r.storage.permissions))
+	for client, scopes := range r.storage.permissions {
+		permissions[client] = maps.Clone(scopes)
+	}
+
+	return permissions, nil
+}
+
+// Ready always succeeds for the in-memory storage.
+func (r *Repository) Ready(_ context.Context) error {
+	return nil
+}
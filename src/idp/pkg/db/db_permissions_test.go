@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository_UpdatePermissionsOfNewClient(t *testing.T) {
+	repo := NewRepository(map[string]map[string][]string{})
+
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RO"}))
+
+	assert.Equal(t, []string{"RO"}, repo.GetPermissions("client1", "scope1"))
+}
+
+func TestRepository_PermissionsVersions(t *testing.T) {
+	repo := NewRepository(map[string]map[string][]string{"client1": {"scope1": {"RO"}}})
+
+	base := repo.storage.baseVersion
+
+	roles, version := repo.GetVersionedPermissions("client1", "scope1")
+	assert.Equal(t, []string{"RO"}, roles)
+	assert.Equal(t, PermissionsVersion{}, version)
+
+	// an upgrade keeps the tokens issued before valid
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RO", "RW"}))
+	_, version = repo.GetVersionedPermissions("client1", "scope1")
+	assert.Equal(t, PermissionsVersion{Version: base + 1, MinVersion: 0}, version)
+
+	// a downgrade invalidates them
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RO"}))
+	_, version = repo.GetVersionedPermissions("client1", "scope1")
+	assert.Equal(t, PermissionsVersion{Version: base + 2, MinVersion: base + 2}, version)
+
+	versions, err := repo.ScopeVersions(context.Background(), "scope1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]PermissionsVersion{"client1": {Version: base + 2, MinVersion: base + 2}}, versions)
+}
+
+func TestRepository_PermissionsVersionsAfterRestart(t *testing.T) {
+	permissions := map[string]map[string][]string{"client1": {"scope1": {"RO", "RW"}}}
+	repo := NewRepository(permissions)
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RO", "RW", "DDL"}))
+	_, issued := repo.GetVersionedPermissions("client1", "scope1")
+
+	// versions are kept in memory only, a downgrade after a restart must
+	// still invalidate the tokens issued before it
+	time.Sleep(time.Millisecond)
+	restarted := NewRepository(permissions)
+	require.NoError(t, restarted.UpdatePermissions("client1", "scope1", []string{"RO"}))
+	_, version := restarted.GetVersionedPermissions("client1", "scope1")
+	assert.Greater(t, version.MinVersion, issued.Version)
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds a single store operation of a request, the repository
+// interface carries no request context.
+const redisTimeout = 2 * time.Second
+
+// NewRedisClient connects to the store shared by the IdP replicas, dsn is a
+// redis:// or rediss:// URL.
+func NewRedisClient(dsn string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis dsn: %w", err)
+	}
+
+	return redis.NewClient(opts), nil
+}
+
+// TokenKey identifies a token in the stores without keeping the token itself.
+func TokenKey(rawToken string) string {
+	h := sha256.Sum256([]byte(rawToken))
+	return hex.EncodeToString(h[:])
+}
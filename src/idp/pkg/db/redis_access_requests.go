@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisAccessRequests shares the access requests of a namespace between
+// replicas, they are kept in a single hash by id.
+type RedisAccessRequests struct {
+	client    *redis.Client
+	namespace string
+}
+
+func NewRedisAccessRequests(client *redis.Client, namespace string) *RedisAccessRequests {
+	return &RedisAccessRequests{client: client, namespace: namespace}
+}
+
+func (s *RedisAccessRequests) key() string {
+	return "idp:" + s.namespace + ":access_requests"
+}
+
+func (s *RedisAccessRequests) Create(ctx context.Context, req *AccessRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access request: %w", err)
+	}
+
+	created, err := s.client.HSetNX(ctx, s.key(), req.ID, data).Result()
+	if err != nil {
+		return fmt.Errorf("failed to store access request: %w", err)
+	} else if !created {
+		return errors.New("access request already exists")
+	}
+
+	return nil
+}
+
+func (s *RedisAccessRequests) Get(ctx context.Context, id string) (*AccessRequest, error) {
+	return s.get(ctx, s.client, id)
+}
+
+func (s *RedisAccessRequests) get(ctx context.Context, cmd redis.Cmdable, id string) (*AccessRequest, error) {
+	data, err := cmd.HGet(ctx, s.key(), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get access request: %w", err)
+	}
+
+	var req AccessRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal access request: %w", err)
+	}
+
+	return &req, nil
+}
+
+func (s *RedisAccessRequests) List(ctx context.Context, filter AccessRequestFilter) ([]*AccessRequest, error) {
+	raw, err := s.client.HGetAll(ctx, s.key()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access requests: %w", err)
+	}
+
+	reqs := []*AccessRequest{}
+	for id, data := range raw {
+		var req AccessRequest
+		if err := json.Unmarshal([]byte(data), &req); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal access request %s: %w", id, err)
+		}
+		if filter.match(&req) {
+			reqs = append(reqs, &req)
+		}
+	}
+	sortAccessRequests(reqs)
+
+	return reqs, nil
+}
+
+// Update applies the change in an optimistic transaction, so concurrent
+// reviews of a request on different replicas do not both succeed.
+func (s *RedisAccessRequests) Update(ctx context.Context, id string, change func(req *AccessRequest) error) (*AccessRequest, error) {
+	var updated *AccessRequest
+	update := func(tx *redis.Tx) error {
+		req, err := s.get(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := change(req); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("failed to marshal access request: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, s.key(), id, data)
+			return nil
+		})
+		updated = req
+		return err
+	}
+
+	var err error
+	for range updateRetries {
+		err = s.client.Watch(ctx, update, s.key())
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
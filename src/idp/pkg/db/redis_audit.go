@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisAuditLog shares the audit trail of a namespace between replicas, it is
+// a capped list with the newest event at the head.
+type RedisAuditLog struct {
+	client    *redis.Client
+	namespace string
+}
+
+func NewRedisAuditLog(client *redis.Client, namespace string) *RedisAuditLog {
+	return &RedisAuditLog{client: client, namespace: namespace}
+}
+
+func (l *RedisAuditLog) key() string {
+	return "idp:" + l.namespace + ":audit"
+}
+
+func (l *RedisAuditLog) Record(ctx context.Context, event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	_, err = l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, l.key(), data)
+		pipe.LTrim(ctx, l.key(), 0, AuditMaxEvents-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store audit event: %w", err)
+	}
+
+	return nil
+}
+
+func (l *RedisAuditLog) List(ctx context.Context, limit int) ([]AuditEvent, error) {
+	if limit <= 0 {
+		return []AuditEvent{}, nil
+	}
+
+	raw, err := l.client.LRange(ctx, l.key(), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %w", err)
+	}
+
+	events := make([]AuditEvent, 0, len(raw))
+	for _, data := range raw {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisDPoPReplays shares the jti of accepted DPoP proofs of a realm between
+// replicas, a proof replayed to another replica is rejected too. The keys
+// expire together with the proof window.
+type RedisDPoPReplays struct {
+	client *redis.Client
+	realm  string
+}
+
+func NewRedisDPoPReplays(client *redis.Client, realm string) *RedisDPoPReplays {
+	return &RedisDPoPReplays{client: client, realm: realm}
+}
+
+func (r *RedisDPoPReplays) Remember(ctx context.Context, key string, expiresAt time.Time) (bool, error) {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		ttl = time.Millisecond
+	}
+
+	fresh, err := r.client.SetNX(ctx, "idp:"+r.realm+":dpop:"+TokenKey(key), 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to remember dpop proof: %w", err)
+	}
+
+	return fresh, nil
+}
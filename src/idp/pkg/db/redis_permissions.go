@@ -0,0 +1,443 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PermissionChange is published on every update, so other replicas drop the
+// cached roles and notify their own subscribers.
+type PermissionChange struct {
+	Client string   `json:"client"`
+	Scope  string   `json:"scope"`
+	Roles  []string `json:"roles"`
+	PermissionsVersion
+	// Origin is the replica which made the change.
+	Origin string `json:"origin"`
+}
+
+// updateRetries bounds the optimistic transactions of concurrent updates of
+// the same client and scope.
+const updateRetries = 5
+
+// RedisRepository keeps the permissions of a namespace in redis hashes, one
+// per client, and their versions in hashes per scope. Both are cached in
+// memory of the replica until a change is published.
+type RedisRepository struct {
+	client    *redis.Client
+	namespace string
+	origin    string
+
+	mu    sync.Mutex
+	cache map[string]map[string]cachedPermissions
+	// generation grows with every invalidation, roles read from redis before
+	// it are not cached.
+	generation uint64
+}
+
+type cachedPermissions struct {
+	roles   []string
+	version PermissionsVersion
+}
+
+func NewRedisRepository(client *redis.Client, namespace string) *RedisRepository {
+	origin := make([]byte, 8)
+	rand.Read(origin)
+
+	return &RedisRepository{
+		client:    client,
+		namespace: namespace,
+		origin:    hex.EncodeToString(origin),
+		cache:     make(map[string]map[string]cachedPermissions),
+	}
+}
+
+func (r *RedisRepository) permissionsKey(client string) string {
+	return "idp:" + r.namespace + ":permissions:" + client
+}
+
+func (r *RedisRepository) versionsKey(scope string) string {
+	return "idp:" + r.namespace + ":versions:" + scope
+}
+
+func (r *RedisRepository) revisionKey() string {
+	return "idp:" + r.namespace + ":permissions_revision"
+}
+
+func (r *RedisRepository) changesChannel() string {
+	return "idp:" + r.namespace + ":permissions"
+}
+
+// Seed stores the configured permissions which are not in redis yet, so grants
+// changed at runtime survive restarts of the replicas.
+func (r *RedisRepository) Seed(ctx context.Context, permissions map[string]map[string][]string) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for client, scopes := range permissions {
+			for scope, roles := range scopes {
+				data, err := json.Marshal(roles)
+				if err != nil {
+					return fmt.Errorf("failed to marshal roles: %w", err)
+				}
+				pipe.HSetNX(ctx, r.permissionsKey(client), scope, data)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to seed permissions: %w", err)
+	}
+
+	return nil
+}
+
+func (r *RedisRepository) UpdatePermissions(client, scope string, roles []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return r.UpdatePermissionsBatch(ctx, []PermissionUpdate{{Client: client, Scope: scope, Roles: roles}})
+}
+
+// UpdatePermissionsBatch stores the roles of all the clients in a single
+// transaction, either every change is made and published or none is. The
+// clients and scopes of the updates must not repeat.
+func (r *RedisRepository) UpdatePermissionsBatch(ctx context.Context, updates []PermissionUpdate) error {
+	return r.updateBatch(ctx, updates, nil)
+}
+
+// PermissionsRevision returns the revision of the permission set shared by the
+// replicas, it grows with every change of any roles.
+func (r *RedisRepository) PermissionsRevision(ctx context.Context) (int64, error) {
+	revision, err := r.client.Get(ctx, r.revisionKey()).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, fmt.Errorf("failed to get permissions revision: %w", err)
+	}
+
+	return revision, nil
+}
+
+// CompareAndSwapPermissions stores the roles like UpdatePermissionsBatch
+// unless the permission set has changed since the revision.
+func (r *RedisRepository) CompareAndSwapPermissions(ctx context.Context, revision int64, updates []PermissionUpdate) error {
+	return r.updateBatch(ctx, updates, &revision)
+}
+
+// updateBatch stores the updates, the revision is watched and compared when
+// it is set.
+func (r *RedisRepository) updateBatch(ctx context.Context, updates []PermissionUpdate, revision *int64) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	generation := r.cacheGeneration()
+
+	keys := make([]string, 0, 2*len(updates)+1)
+	for _, u := range updates {
+		keys = append(keys, r.permissionsKey(u.Client), r.versionsKey(u.Scope))
+	}
+	if revision != nil {
+		keys = append(keys, r.revisionKey())
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	versions := make([]PermissionsVersion, len(updates))
+	update := func(tx *redis.Tx) error {
+		if revision != nil {
+			current, err := tx.Get(ctx, r.revisionKey()).Int64()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			} else if current != *revision {
+				return ErrConflict
+			}
+		}
+		for i, u := range updates {
+			oldRoles, oldVersion, err := r.load(ctx, tx, u.Client, u.Scope)
+			if err != nil {
+				return err
+			}
+			versions[i] = oldVersion.next(oldRoles, u.Roles)
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, u := range updates {
+				data, err := json.Marshal(u.Roles)
+				if err != nil {
+					return fmt.Errorf("failed to marshal roles: %w", err)
+				}
+				versionData, err := json.Marshal(versions[i])
+				if err != nil {
+					return fmt.Errorf("failed to marshal version: %w", err)
+				}
+				change, err := json.Marshal(PermissionChange{
+					Client:             u.Client,
+					Scope:              u.Scope,
+					Roles:              u.Roles,
+					PermissionsVersion: versions[i],
+					Origin:             r.origin,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to marshal permission change: %w", err)
+				}
+
+				pipe.HSet(ctx, r.permissionsKey(u.Client), u.Scope, data)
+				pipe.HSet(ctx, r.versionsKey(u.Scope), u.Client, versionData)
+				pipe.Publish(ctx, r.changesChannel(), change)
+			}
+			pipe.IncrBy(ctx, r.revisionKey(), int64(len(updates)))
+
+			return nil
+		})
+		return err
+	}
+
+	// a concurrent update of the same roles restarts the transaction, so no
+	// version is issued twice
+	var err error
+	for range updateRetries {
+		err = r.client.Watch(ctx, update, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if errors.Is(err, ErrConflict) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to store permissions: %w", err)
+	}
+
+	for i, u := range updates {
+		r.setCached(generation, u.Client, u.Scope, u.Roles, versions[i])
+	}
+
+	return nil
+}
+
+// GetPermissions returns no roles when the store is unavailable, a client is
+// never granted more than it was.
+func (r *RedisRepository) GetPermissions(client, scope string) []string {
+	roles, _ := r.GetVersionedPermissions(client, scope)
+	return roles
+}
+
+// GetVersionedPermissions returns the roles along with their version, both
+// are read in a single transaction.
+func (r *RedisRepository) GetVersionedPermissions(client, scope string) ([]string, PermissionsVersion) {
+	if cached, ok := r.cached(client, scope); ok {
+		return cached.roles, cached.version
+	}
+	generation := r.cacheGeneration()
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	roles, version, err := r.load(ctx, r.client.TxPipeline(), client, scope)
+	if err != nil {
+		log.Printf("failed to get permissions of client %s on %s scope: %v", client, scope, err)
+		return []string{}, PermissionsVersion{}
+	}
+
+	r.setCached(generation, client, scope, roles, version)
+
+	return roles, version
+}
+
+// load reads the roles and the version of the client on the scope, a pipeline
+// is executed before the results are read.
+func (r *RedisRepository) load(ctx context.Context, cmd redis.Cmdable, client, scope string) ([]string, PermissionsVersion, error) {
+	rolesCmd := cmd.HGet(ctx, r.permissionsKey(client), scope)
+	versionCmd := cmd.HGet(ctx, r.versionsKey(scope), client)
+	if pipe, ok := cmd.(redis.Pipeliner); ok {
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, PermissionsVersion{}, err
+		}
+	}
+
+	roles := []string{}
+	if data, err := rolesCmd.Bytes(); err == nil {
+		if err := json.Unmarshal(data, &roles); err != nil {
+			return nil, PermissionsVersion{}, fmt.Errorf("failed to unmarshal roles: %w", err)
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, PermissionsVersion{}, err
+	}
+
+	var version PermissionsVersion
+	if data, err := versionCmd.Bytes(); err == nil {
+		if err := json.Unmarshal(data, &version); err != nil {
+			return nil, PermissionsVersion{}, fmt.Errorf("failed to unmarshal version: %w", err)
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, PermissionsVersion{}, err
+	}
+
+	return roles, version, nil
+}
+
+// ScopeVersions returns the versions of the clients whose permissions on the
+// scope have ever changed.
+func (r *RedisRepository) ScopeVersions(ctx context.Context, scope string) (map[string]PermissionsVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	raw, err := r.client.HGetAll(ctx, r.versionsKey(scope)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get versions of %s scope: %w", scope, err)
+	}
+
+	versions := make(map[string]PermissionsVersion, len(raw))
+	for client, data := range raw {
+		var version PermissionsVersion
+		if err := json.Unmarshal([]byte(data), &version); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal version of client %s: %w", client, err)
+		}
+		versions[client] = version
+	}
+
+	return versions, nil
+}
+
+// AllPermissions returns the roles of every client: client -> scope -> roles.
+// The permission hashes are scanned, so it is meant for reports only.
+func (r *RedisRepository) AllPermissions(ctx context.Context) (map[string]map[string][]string, error) {
+	prefix := r.permissionsKey("")
+	permissions := make(map[string]map[string][]string)
+
+	iter := r.client.Scan(ctx, 0, prefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		raw, err := r.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get permissions of %s: %w", key, err)
+		}
+
+		scopes := make(map[string][]string, len(raw))
+		for scope, data := range raw {
+			var roles []string
+			if err := json.Unmarshal([]byte(data), &roles); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal roles of %s on %s scope: %w", key, scope, err)
+			}
+			scopes[scope] = roles
+		}
+		permissions[strings.TrimPrefix(key, prefix)] = scopes
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan permissions: %w", err)
+	}
+
+	return permissions, nil
+}
+
+// Ready checks the connection to redis.
+func (r *RedisRepository) Ready(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// Run listens to the changes published by all replicas until ctx is done, it
+// drops the cached roles and calls onChange for changes of other replicas. The
+// whole cache is dropped on every (re)subscription, as changes could be missed
+// while the connection was down.
+func (r *RedisRepository) Run(ctx context.Context, onChange func(change PermissionChange)) {
+	pubsub := r.client.Subscribe(ctx, r.changesChannel())
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("failed to receive permission changes of %s namespace: %v", r.namespace, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			r.resetCache()
+		case *redis.Message:
+			var change PermissionChange
+			if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+				log.Printf("failed to unmarshal permission change: %v; payload: %s", err, msg.Payload)
+				continue
+			}
+
+			if change.Origin == r.origin {
+				continue
+			}
+
+			r.dropCached(change.Client, change.Scope)
+			if onChange != nil {
+				onChange(change)
+			}
+		}
+	}
+}
+
+func (r *RedisRepository) cached(client, scope string) (cachedPermissions, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached, ok := r.cache[client][scope]
+	return cached, ok
+}
+
+func (r *RedisRepository) cacheGeneration() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.generation
+}
+
+// setCached caches roles read or written at the generation. They are dropped
+// if the cache was invalidated since, as they may predate the change, or if a
+// newer version of them is cached already.
+func (r *RedisRepository) setCached(generation uint64, client, scope string, roles []string, version PermissionsVersion) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if generation != r.generation {
+		return
+	}
+
+	clientPerms, ok := r.cache[client]
+	if !ok {
+		clientPerms = make(map[string]cachedPermissions)
+		r.cache[client] = clientPerms
+	}
+	if cached, ok := clientPerms[scope]; ok && cached.version.Version > version.Version {
+		return
+	}
+	clientPerms[scope] = cachedPermissions{roles: roles, version: version}
+}
+
+func (r *RedisRepository) dropCached(client, scope string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.cache[client], scope)
+	r.generation++
+}
+
+func (r *RedisRepository) resetCache() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = make(map[string]map[string]cachedPermissions)
+	r.generation++
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRateLimiter is a fixed window limiter with counters shared by all
+// replicas, so the limit holds for the whole deployment.
+type RedisRateLimiter struct {
+	client *redis.Client
+	limit  int64
+	window time.Duration
+	now    func() time.Time
+}
+
+func NewRedisRateLimiter(client *redis.Client, limit int64, window time.Duration) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		client: client,
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}
+}
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	now := l.now()
+	start := now.Truncate(l.window)
+	windowKey := "idp:ratelimit:" + key + ":" + strconv.FormatInt(start.Unix(), 10)
+
+	var count *redis.IntCmd
+	_, err := l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, windowKey)
+		pipe.PExpire(ctx, windowKey, l.window)
+		return nil
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to count request: %w", err)
+	}
+
+	if count.Val() > l.limit {
+		return false, start.Add(l.window).Sub(now), nil
+	}
+
+	return true, 0, nil
+}
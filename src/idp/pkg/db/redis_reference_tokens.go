@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisReferenceTokens shares the claims of the opaque tokens of a realm
+// between replicas, the keys expire together with the tokens.
+type RedisReferenceTokens struct {
+	client *redis.Client
+	realm  string
+}
+
+func NewRedisReferenceTokens(client *redis.Client, realm string) *RedisReferenceTokens {
+	return &RedisReferenceTokens{client: client, realm: realm}
+}
+
+func (s *RedisReferenceTokens) key(rawToken string) string {
+	return "idp:" + s.realm + ":reference:" + TokenKey(rawToken)
+}
+
+func (s *RedisReferenceTokens) Save(ctx context.Context, rawToken string, claims []byte, exp time.Time) error {
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := s.client.Set(ctx, s.key(rawToken), claims, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store reference token: %w", err)
+	}
+
+	return nil
+}
+
+func (s *RedisReferenceTokens) Claims(ctx context.Context, rawToken string) ([]byte, error) {
+	claims, err := s.client.Get(ctx, s.key(rawToken)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get reference token: %w", err)
+	}
+
+	return claims, nil
+}
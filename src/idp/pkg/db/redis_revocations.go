@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisRevocationList shares revoked tokens of a realm between replicas, the
+// keys expire together with the tokens.
+type RedisRevocationList struct {
+	client *redis.Client
+	realm  string
+}
+
+func NewRedisRevocationList(client *redis.Client, realm string) *RedisRevocationList {
+	return &RedisRevocationList{client: client, realm: realm}
+}
+
+func (l *RedisRevocationList) key(rawToken string) string {
+	return "idp:" + l.realm + ":revoked:" + TokenKey(rawToken)
+}
+
+func (l *RedisRevocationList) Revoke(ctx context.Context, rawToken string, exp time.Time) error {
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := l.client.Set(ctx, l.key(rawToken), 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store revoked token: %w", err)
+	}
+
+	return nil
+}
+
+func (l *RedisRevocationList) IsRevoked(ctx context.Context, rawToken string) (bool, error) {
+	n, err := l.client.Exists(ctx, l.key(rawToken)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check revoked token: %w", err)
+	}
+
+	return n > 0, nil
+}
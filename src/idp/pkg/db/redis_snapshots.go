@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSnapshots shares the permission snapshots of a namespace between
+// replicas. Snapshots are kept in a hash by number, their metadata in a
+// sorted set listed without reading the permissions.
+type RedisSnapshots struct {
+	client    *redis.Client
+	namespace string
+}
+
+func NewRedisSnapshots(client *redis.Client, namespace string) *RedisSnapshots {
+	return &RedisSnapshots{client: client, namespace: namespace}
+}
+
+func (s *RedisSnapshots) key() string {
+	return "idp:" + s.namespace + ":snapshots"
+}
+
+func (s *RedisSnapshots) indexKey() string {
+	return "idp:" + s.namespace + ":snapshots:index"
+}
+
+func (s *RedisSnapshots) counterKey() string {
+	return "idp:" + s.namespace + ":snapshots:last"
+}
+
+// Save numbers the snapshot by a counter shared by the replicas and stores it.
+func (s *RedisSnapshots) Save(ctx context.Context, snapshot *Snapshot) error {
+	number, err := s.client.Incr(ctx, s.counterKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to number snapshot: %w", err)
+	}
+	snapshot.Number = number
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	metadata := *snapshot
+	metadata.Permissions = nil
+	metadataData, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		field := strconv.FormatInt(number, 10)
+		pipe.HSet(ctx, s.key(), field, data)
+		pipe.ZAdd(ctx, s.indexKey(), redis.Z{Score: float64(number), Member: metadataData})
+		if dropped := number - SnapshotMaxCount; dropped > 0 {
+			pipe.HDel(ctx, s.key(), strconv.FormatInt(dropped, 10))
+			pipe.ZRemRangeByScore(ctx, s.indexKey(), "-inf", strconv.FormatInt(dropped, 10))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (s *RedisSnapshots) Get(ctx context.Context, number int64) (*Snapshot, error) {
+	data, err := s.client.HGet(ctx, s.key(), strconv.FormatInt(number, 10)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+
+	return &snapshot, nil
+}
+
+func (s *RedisSnapshots) List(ctx context.Context, limit int) ([]Snapshot, error) {
+	if limit <= 0 {
+		return []Snapshot{}, nil
+	}
+
+	raw, err := s.client.ZRevRange(ctx, s.indexKey(), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	snapshots := make([]Snapshot, 0, len(raw))
+	for _, data := range raw {
+		var snapshot Snapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+	client, err := NewRedisClient("redis://" + srv.Addr())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return srv, client
+}
+
+func TestRedisRepository_SeedKeepsStoredPermissions(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	repo := NewRedisRepository(client, "ns")
+	require.NoError(t, repo.UpdatePermissions("client1", "scope1", []string{"RW"}))
+
+	restarted := NewRedisRepository(client, "ns")
+	require.NoError(t, restarted.Seed(ctx, map[string]map[string][]string{
+		"client1": {"scope1": {"RO"}, "scope2": {"RO"}},
+	}))
+
+	assert.Equal(t, []string{"RW"}, restarted.GetPermissions("client1", "scope1"))
+	assert.Equal(t, []string{"RO"}, restarted.GetPermissions("client1", "scope2"))
+	assert.Equal(t, []string{}, restarted.GetPermissions("client2", "scope1"))
+	assert.Empty(t, NewRedisRepository(client, "other").GetPermissions("client1", "scope1"))
+}
+
+func TestRedisRepository_ChangesInvalidateOtherReplicas(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replicaA := NewRedisRepository(client, "ns")
+	replicaB := NewRedisRepository(client, "ns")
+	require.NoError(t, replicaA.Seed(ctx, map[string]map[string][]string{"client1": {"scope1": {"RO"}}}))
+
+	changesA := make(chan PermissionChange, 1)
+	changesB := make(chan PermissionChange, 1)
+	go replicaA.Run(ctx, func(change PermissionChange) { changesA <- change })
+	go replicaB.Run(ctx, func(change PermissionChange) { changesB <- change })
+
+	// both replicas have the roles cached now
+	require.Equal(t, []string{"RO"}, replicaA.GetPermissions("client1", "scope1"))
+	require.Equal(t, []string{"RO"}, replicaB.GetPermissions("client1", "scope1"))
+
+	require.Eventually(t, func() bool {
+		return client.PubSubNumSub(ctx, replicaA.changesChannel()).Val()[replicaA.changesChannel()] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, replicaB.UpdatePermissions("client1", "scope1", []string{"RO", "RW"}))
+
+	select {
+	case change := <-changesA:
+		assert.Equal(t, "client1", change.Client)
+		assert.Equal(t, "scope1", change.Scope)
+		assert.Equal(t, []string{"RO", "RW"}, change.Roles)
+	case <-time.After(time.Second):
+		t.Fatal("permission change is not delivered to another replica")
+	}
+	assert.Equal(t, []string{"RO", "RW"}, replicaA.GetPermissions("client1", "scope1"))
+
+	select {
+	case change := <-changesB:
+		t.Fatalf("own change is delivered to the replica: %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisRepository_PermissionsVersions(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replicaA := NewRedisRepository(client, "ns")
+	replicaB := NewRedisRepository(client, "ns")
+	require.NoError(t, replicaA.Seed(ctx, map[string]map[string][]string{"client1": {"scope1": {"RO", "RW"}}}))
+
+	changesA := make(chan PermissionChange, 1)
+	go replicaA.Run(ctx, func(change PermissionChange) { changesA <- change })
+
+	_, version := replicaA.GetVersionedPermissions("client1", "scope1")
+	require.Equal(t, PermissionsVersion{}, version)
+
+	require.Eventually(t, func() bool {
+		return client.PubSubNumSub(ctx, replicaA.changesChannel()).Val()[replicaA.changesChannel()] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, replicaB.UpdatePermissions("client1", "scope1", []string{"RO"}))
+
+	select {
+	case change := <-changesA:
+		assert.Equal(t, PermissionsVersion{Version: 1, MinVersion: 1}, change.PermissionsVersion)
+	case <-time.After(time.Second):
+		t.Fatal("permission change is not delivered to another replica")
+	}
+
+	roles, version := replicaA.GetVersionedPermissions("client1", "scope1")
+	assert.Equal(t, []string{"RO"}, roles)
+	assert.Equal(t, PermissionsVersion{Version: 1, MinVersion: 1}, version)
+
+	require.NoError(t, replicaA.UpdatePermissions("client1", "scope1", []string{"RO", "RW"}))
+	versions, err := NewRedisRepository(client, "ns").ScopeVersions(ctx, "scope1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]PermissionsVersion{"client1": {Version: 2, MinVersion: 1}}, versions)
+}
+
+func TestRedisRepository_CacheKeepsInvalidations(t *testing.T) {
+	_, client := newTestRedis(t)
+	repo := NewRedisRepository(client, "ns")
+
+	// roles read before a change of another replica was received are stale
+	generation := repo.cacheGeneration()
+	repo.dropCached("client1", "scope1")
+	repo.setCached(generation, "client1", "scope1", []string{"RO", "RW"}, PermissionsVersion{Version: 1})
+	_, ok := repo.cached("client1", "scope1")
+	assert.False(t, ok)
+
+	// roles read before a local update do not replace the updated ones
+	generation = repo.cacheGeneration()
+	repo.setCached(generation, "client1", "scope1", []string{"RO"}, PermissionsVersion{Version: 2, MinVersion: 2})
+	repo.setCached(generation, "client1", "scope1", []string{"RO", "RW"}, PermissionsVersion{Version: 1})
+	cached, ok := repo.cached("client1", "scope1")
+	require.True(t, ok)
+	assert.Equal(t, []string{"RO"}, cached.roles)
+	assert.Equal(t, int64(2), cached.version.Version)
+}
+
+func TestRedisRepository_Ready(t *testing.T) {
+	srv, client := newTestRedis(t)
+	repo := NewRedisRepository(client, "ns")
+
+	assert.NoError(t, repo.Ready(context.Background()))
+
+	srv.Close()
+	assert.Error(t, repo.Ready(context.Background()))
+	assert.Equal(t, []string{}, repo.GetPermissions("client1", "scope1"))
+}
+
+func TestRedisRevocationList(t *testing.T) {
+	srv, client := newTestRedis(t)
+	ctx := context.Background()
+
+	replicaA := NewRedisRevocationList(client, "realm")
+	replicaB := NewRedisRevocationList(client, "realm")
+
+	require.NoError(t, replicaA.Revoke(ctx, "token", time.Now().Add(time.Minute)))
+	require.NoError(t, replicaA.Revoke(ctx, "expired", time.Now().Add(-time.Minute)))
+
+	revoked, err := replicaB.IsRevoked(ctx, "token")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = replicaB.IsRevoked(ctx, "expired")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	revoked, err = NewRedisRevocationList(client, "other").IsRevoked(ctx, "token")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	srv.FastForward(2 * time.Minute)
+	revoked, err = replicaB.IsRevoked(ctx, "token")
+	require.NoError(t, err)
+	assert.False(t, revoked, "revocation is kept after the token expiry")
+}
+
+func TestRedisDPoPReplays(t *testing.T) {
+	srv, client := newTestRedis(t)
+	ctx := context.Background()
+
+	replicaA := NewRedisDPoPReplays(client, "realm")
+	replicaB := NewRedisDPoPReplays(client, "realm")
+
+	fresh, err := replicaA.Remember(ctx, "jkt:jti-1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	fresh, err = replicaB.Remember(ctx, "jkt:jti-1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, fresh, "replays are shared by replicas")
+
+	fresh, err = NewRedisDPoPReplays(client, "other").Remember(ctx, "jkt:jti-1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	srv.FastForward(2 * time.Minute)
+	fresh, err = replicaB.Remember(ctx, "jkt:jti-1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh, "proofs are forgotten after the window")
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	now := time.Date(2025, 1, 1, 12, 0, 10, 0, time.UTC)
+	replicaA := NewRedisRateLimiter(client, 2, time.Minute)
+	replicaB := NewRedisRateLimiter(client, 2, time.Minute)
+	replicaA.now = func() time.Time { return now }
+	replicaB.now = func() time.Time { return now }
+
+	allowed, _, err := replicaA.Allow(ctx, "realm:client1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, _, err = replicaB.Allow(ctx, "realm:client1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, retryAfter, err := replicaA.Allow(ctx, "realm:client1")
+	require.NoError(t, err)
+	assert.False(t, allowed, "limit is shared by replicas")
+	assert.Equal(t, 50*time.Second, retryAfter)
+
+	allowed, _, err = replicaA.Allow(ctx, "realm:client2")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	now = now.Add(time.Minute)
+	allowed, _, err = replicaB.Allow(ctx, "realm:client1")
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
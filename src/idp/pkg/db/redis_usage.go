@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisGrantUsage shares the last issuance times of grants between replicas,
+// they are kept in a single sorted set scored by the time. The time tracking
+// started is kept next to it.
+type RedisGrantUsage struct {
+	client    *redis.Client
+	namespace string
+}
+
+func NewRedisGrantUsage(client *redis.Client, namespace string) *RedisGrantUsage {
+	return &RedisGrantUsage{client: client, namespace: namespace}
+}
+
+func (u *RedisGrantUsage) key() string {
+	return "idp:" + u.namespace + ":last_issued"
+}
+
+func (u *RedisGrantUsage) sinceKey() string {
+	return "idp:" + u.namespace + ":usage_tracked_since"
+}
+
+// RecordIssued stores the time in unix seconds, a member is a JSON encoded
+// grant since clients and scopes may contain any separator. The score only
+// grows, so replicas racing with older times do not move it back.
+func (u *RedisGrantUsage) RecordIssued(ctx context.Context, grants []GrantKey, at time.Time) error {
+	if len(grants) == 0 {
+		return nil
+	}
+
+	members := make([]redis.Z, 0, len(grants))
+	for _, grant := range grants {
+		member, err := json.Marshal(grant)
+		if err != nil {
+			return fmt.Errorf("failed to marshal grant: %w", err)
+		}
+		members = append(members, redis.Z{Score: float64(at.Unix()), Member: string(member)})
+	}
+
+	pipe := u.client.TxPipeline()
+	pipe.SetNX(ctx, u.sinceKey(), at.Unix(), 0)
+	pipe.ZAddGT(ctx, u.key(), members...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store grant usage: %w", err)
+	}
+
+	return nil
+}
+
+// TrackedSince returns when the first issuance was recorded, or starts the
+// tracking now if none was.
+func (u *RedisGrantUsage) TrackedSince(ctx context.Context) (time.Time, error) {
+	if err := u.client.SetNX(ctx, u.sinceKey(), time.Now().Unix(), 0).Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to start grant usage tracking: %w", err)
+	}
+
+	since, err := u.client.Get(ctx, u.sinceKey()).Int64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get grant usage tracking start: %w", err)
+	}
+
+	return time.Unix(since, 0), nil
+}
+
+func (u *RedisGrantUsage) LastIssued(ctx context.Context) (map[GrantKey]time.Time, error) {
+	raw, err := u.client.ZRangeWithScores(ctx, u.key(), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grant usage: %w", err)
+	}
+
+	lastIssued := make(map[GrantKey]time.Time, len(raw))
+	for _, z := range raw {
+		member, _ := z.Member.(string)
+		var grant GrantKey
+		if err := json.Unmarshal([]byte(member), &grant); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal grant %q: %w", member, err)
+		}
+		lastIssued[grant] = time.Unix(int64(z.Score), 0)
+	}
+
+	return lastIssued, nil
+}
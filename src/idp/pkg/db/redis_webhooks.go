@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisDeadLetters shares the dead-lettered deliveries between replicas. They
+// are kept in a hash by id and ordered by a sorted set of the ids.
+type RedisDeadLetters struct {
+	client *redis.Client
+}
+
+func NewRedisDeadLetters(client *redis.Client) *RedisDeadLetters {
+	return &RedisDeadLetters{client: client}
+}
+
+func (l *RedisDeadLetters) key() string {
+	return "idp:webhooks:dead_letters"
+}
+
+func (l *RedisDeadLetters) indexKey() string {
+	return "idp:webhooks:dead_letters:index"
+}
+
+func (l *RedisDeadLetters) Add(ctx context.Context, delivery *WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+
+	var score float64
+	if delivery.FailedAt != nil {
+		score = float64(delivery.FailedAt.UnixNano())
+	}
+
+	_, err = l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, l.key(), delivery.ID, data)
+		pipe.ZAdd(ctx, l.indexKey(), redis.Z{Score: score, Member: delivery.ID})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store dead letter: %w", err)
+	}
+
+	dropped, err := l.client.ZRange(ctx, l.indexKey(), 0, -DeadLettersMaxCount-1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to trim dead letters: %w", err)
+	}
+	if len(dropped) > 0 {
+		_, err = l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, l.key(), dropped...)
+			pipe.ZRem(ctx, l.indexKey(), toAny(dropped)...)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to trim dead letters: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (l *RedisDeadLetters) List(ctx context.Context, limit int) ([]WebhookDelivery, error) {
+	if limit <= 0 {
+		return []WebhookDelivery{}, nil
+	}
+
+	ids, err := l.client.ZRevRange(ctx, l.indexKey(), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	if len(ids) == 0 {
+		return []WebhookDelivery{}, nil
+	}
+
+	raw, err := l.client.HMGet(ctx, l.key(), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(raw))
+	for _, data := range raw {
+		data, ok := data.(string)
+		if !ok {
+			// taken concurrently
+			continue
+		}
+
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// Take removes the delivery, of replicas taking the same one concurrently
+// only one gets it.
+func (l *RedisDeadLetters) Take(ctx context.Context, id string) (*WebhookDelivery, error) {
+	data, err := l.client.HGet(ctx, l.key(), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter: %w", err)
+	}
+
+	var deleted *redis.IntCmd
+	_, err = l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.HDel(ctx, l.key(), id)
+		pipe.ZRem(ctx, l.indexKey(), id)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove dead letter: %w", err)
+	} else if deleted.Val() == 0 {
+		return nil, ErrNotFound
+	}
+
+	var delivery WebhookDelivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dead letter: %w", err)
+	}
+
+	return &delivery, nil
+}
+
+// RedisKeyHistory remembers the signing key each realm was last started with,
+// so a start with another key is reported as a rotation.
+type RedisKeyHistory struct {
+	client *redis.Client
+}
+
+func NewRedisKeyHistory(client *redis.Client) *RedisKeyHistory {
+	return &RedisKeyHistory{client: client}
+}
+
+// SwapKeyID stores the key id of the realm and returns the previous one, empty
+// on the first start.
+func (h *RedisKeyHistory) SwapKeyID(ctx context.Context, realm, keyID string) (string, error) {
+	previous, err := h.client.SetArgs(ctx, "idp:"+realm+":key_id", keyID, redis.SetArgs{Get: true}).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to swap key id: %w", err)
+	}
+
+	return previous, nil
+}
+
+func toAny(values []string) []any {
+	result := make([]any, 0, len(values))
+	for _, value := range values {
+		result = append(result, value)
+	}
+
+	return result
+}
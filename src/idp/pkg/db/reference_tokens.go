@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// referenceTokensSweepInterval is how often expired reference tokens are
+// dropped, they are not resolved anyway once expired.
+const referenceTokensSweepInterval = time.Minute
+
+// ReferenceTokens keeps the claims of opaque tokens in memory of the replica,
+// tokens are only resolved by the replica which issued them.
+type ReferenceTokens struct {
+	mu        sync.Mutex
+	tokens    map[string]referenceToken
+	nextSweep time.Time
+}
+
+type referenceToken struct {
+	claims []byte
+	exp    time.Time
+}
+
+func NewReferenceTokens() *ReferenceTokens {
+	return &ReferenceTokens{tokens: make(map[string]referenceToken)}
+}
+
+// Save keeps the claims of the token until exp, expired tokens are swept at
+// most once per sweep interval, not on every issuance.
+func (s *ReferenceTokens) Save(_ context.Context, rawToken string, claims []byte, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now := time.Now(); now.After(s.nextSweep) {
+		for key, token := range s.tokens {
+			if now.After(token.exp) {
+				delete(s.tokens, key)
+			}
+		}
+		s.nextSweep = now.Add(referenceTokensSweepInterval)
+	}
+	s.tokens[TokenKey(rawToken)] = referenceToken{claims: claims, exp: exp}
+
+	return nil
+}
+
+// Claims returns ErrNotFound for unknown and expired tokens.
+func (s *ReferenceTokens) Claims(_ context.Context, rawToken string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[TokenKey(rawToken)]
+	if !ok || time.Now().After(token.exp) {
+		return nil, ErrNotFound
+	}
+
+	return token.claims, nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type referenceTokenStore interface {
+	Save(ctx context.Context, rawToken string, claims []byte, exp time.Time) error
+	Claims(ctx context.Context, rawToken string) ([]byte, error)
+}
+
+func TestReferenceTokens(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, store := range map[string]referenceTokenStore{
+		"memory": NewReferenceTokens(),
+		"redis":  NewRedisReferenceTokens(client, "realm"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			require.NoError(t, store.Save(ctx, "token", []byte(`{"sub":"client1"}`), time.Now().Add(time.Minute)))
+			require.NoError(t, store.Save(ctx, "expired", []byte(`{"sub":"client2"}`), time.Now().Add(-time.Minute)))
+
+			claims, err := store.Claims(ctx, "token")
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"sub":"client1"}`, string(claims))
+
+			_, err = store.Claims(ctx, "expired")
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = store.Claims(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestReferenceTokens_Sweep(t *testing.T) {
+	ctx := context.Background()
+	store := NewReferenceTokens()
+
+	require.NoError(t, store.Save(ctx, "expired", []byte(`{}`), time.Now().Add(-time.Minute)))
+	require.NoError(t, store.Save(ctx, "token", []byte(`{}`), time.Now().Add(time.Minute)))
+	assert.Len(t, store.tokens, 2, "tokens are not swept within the interval")
+
+	store.nextSweep = time.Now().Add(-time.Second)
+	require.NoError(t, store.Save(ctx, "other", []byte(`{}`), time.Now().Add(time.Minute)))
+	assert.Len(t, store.tokens, 2)
+	assert.NotContains(t, store.tokens, TokenKey("expired"))
+}
+
+func TestRedisReferenceTokens_Expire(t *testing.T) {
+	srv, client := newTestRedis(t)
+	ctx := context.Background()
+
+	require.NoError(t, NewRedisReferenceTokens(client, "realm").Save(ctx, "token", []byte(`{}`), time.Now().Add(time.Minute)))
+	for _, key := range srv.Keys() {
+		assert.NotContains(t, key, "token", "only the hash of the token is stored")
+	}
+
+	_, err := NewRedisReferenceTokens(client, "other").Claims(ctx, "token")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	srv.FastForward(2 * time.Minute)
+	_, err = NewRedisReferenceTokens(client, "realm").Claims(ctx, "token")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
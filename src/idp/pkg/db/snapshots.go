@@ -0,0 +1,164 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SnapshotMaxCount bounds the kept snapshots of a namespace, older ones are
+// dropped.
+const SnapshotMaxCount = 1000
+
+// ErrConflict is returned by a compare-and-swap of a permission set, which has
+// changed since its revision was read.
+var ErrConflict = errors.New("permissions have changed concurrently")
+
+// PermissionUpdate sets the roles of a client on a scope.
+type PermissionUpdate struct {
+	Client string   `json:"client"`
+	Scope  string   `json:"scope"`
+	Roles  []string `json:"roles"`
+}
+
+// Snapshot is the permission set of a namespace after a change, snapshots are
+// numbered from one in the order they are taken.
+type Snapshot struct {
+	Number  int64     `json:"number"`
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Comment string    `json:"comment,omitempty"`
+	// Revision of the permission set the snapshot was taken at.
+	Revision int64 `json:"revision"`
+	// Permissions are client -> scope -> roles, they are omitted in listings.
+	Permissions map[string]map[string][]string `json:"permissions,omitempty"`
+}
+
+// Snapshots keeps the permission snapshots of a namespace in memory of the
+// replica.
+type Snapshots struct {
+	mu        sync.Mutex
+	last      int64
+	snapshots []Snapshot
+}
+
+func NewSnapshots() *Snapshots {
+	return &Snapshots{}
+}
+
+// Save numbers the snapshot and stores it.
+func (s *Snapshots) Save(_ context.Context, snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	snapshot.Number = s.last
+	s.snapshots = append(s.snapshots, *snapshot)
+	if len(s.snapshots) > SnapshotMaxCount {
+		s.snapshots = slices.Delete(s.snapshots, 0, len(s.snapshots)-SnapshotMaxCount)
+	}
+
+	return nil
+}
+
+func (s *Snapshots) Get(_ context.Context, number int64) (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := slices.BinarySearchFunc(s.snapshots, number, func(snapshot Snapshot, number int64) int {
+		return cmp.Compare(snapshot.Number, number)
+	})
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	snapshot := s.snapshots[i]
+	return &snapshot, nil
+}
+
+// List returns up to limit latest snapshots without their permissions, the
+// newest one first.
+func (s *Snapshots) List(_ context.Context, limit int) ([]Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := make([]Snapshot, 0, max(min(limit, len(s.snapshots)), 0))
+	for i := len(s.snapshots) - 1; i >= 0 && len(snapshots) < limit; i-- {
+		snapshot := s.snapshots[i]
+		snapshot.Permissions = nil
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// PermissionDiff is the change of the roles of a client on a scope between two
+// permission sets.
+type PermissionDiff struct {
+	Client  string   `json:"client"`
+	Scope   string   `json:"scope"`
+	From    []string `json:"from"`
+	To      []string `json:"to"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// DiffPermissions returns the roles which differ between the permission sets,
+// sorted by client and scope. A missing client or scope has no roles.
+func DiffPermissions(from, to map[string]map[string][]string) []PermissionDiff {
+	diffs := []PermissionDiff{}
+	seen := make(map[[2]string]bool)
+
+	compare := func(client, scope string) {
+		binding := [2]string{client, scope}
+		if seen[binding] {
+			return
+		}
+		seen[binding] = true
+
+		diff := PermissionDiff{
+			Client: client,
+			Scope:  scope,
+			From:   rolesOf(from, client, scope),
+			To:     rolesOf(to, client, scope),
+		}
+		for _, role := range diff.To {
+			if !slices.Contains(diff.From, role) {
+				diff.Added = append(diff.Added, role)
+			}
+		}
+		for _, role := range diff.From {
+			if !slices.Contains(diff.To, role) {
+				diff.Removed = append(diff.Removed, role)
+			}
+		}
+		if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	for _, permissions := range []map[string]map[string][]string{from, to} {
+		for client, scopes := range permissions {
+			for scope := range scopes {
+				compare(client, scope)
+			}
+		}
+	}
+
+	slices.SortFunc(diffs, func(a, b PermissionDiff) int {
+		return cmp.Or(cmp.Compare(a.Client, b.Client), cmp.Compare(a.Scope, b.Scope))
+	})
+
+	return diffs
+}
+
+func rolesOf(permissions map[string]map[string][]string, client, scope string) []string {
+	if roles := permissions[client][scope]; roles != nil {
+		return roles
+	}
+
+	return []string{}
+}
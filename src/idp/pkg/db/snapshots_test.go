@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type snapshotStore interface {
+	Save(ctx context.Context, snapshot *Snapshot) error
+	Get(ctx context.Context, number int64) (*Snapshot, error)
+	List(ctx context.Context, limit int) ([]Snapshot, error)
+}
+
+func TestSnapshots(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, store := range map[string]snapshotStore{
+		"memory": NewSnapshots(),
+		"redis":  NewRedisSnapshots(client, "ns"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			taken := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			first := &Snapshot{Time: taken, Actor: "system", Permissions: map[string]map[string][]string{"service-a": {"postgres-a": {"RO"}}}}
+			second := &Snapshot{Time: taken.Add(time.Minute), Actor: "admin", Comment: "grant RW", Permissions: map[string]map[string][]string{"service-a": {"postgres-a": {"RO", "RW"}}}}
+			require.NoError(t, store.Save(ctx, first))
+			require.NoError(t, store.Save(ctx, second))
+			assert.Equal(t, int64(1), first.Number)
+			assert.Equal(t, int64(2), second.Number)
+
+			got, err := store.Get(ctx, 1)
+			require.NoError(t, err)
+			assert.Equal(t, first, got)
+			_, err = store.Get(ctx, 3)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			snapshots, err := store.List(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, snapshots, 2)
+			assert.Equal(t, int64(2), snapshots[0].Number)
+			assert.Equal(t, "grant RW", snapshots[0].Comment)
+			assert.Nil(t, snapshots[0].Permissions)
+
+			snapshots, err = store.List(ctx, 1)
+			require.NoError(t, err)
+			assert.Len(t, snapshots, 1)
+		})
+	}
+}
+
+func TestDiffPermissions(t *testing.T) {
+	from := map[string]map[string][]string{
+		"service-a": {"postgres-a": {"RO", "RW"}, "postgres-b": {"RO"}},
+		"service-b": {"postgres-a": {"RO"}},
+	}
+	to := map[string]map[string][]string{
+		"service-a": {"postgres-a": {"RO"}, "postgres-b": {"RO"}},
+		"service-c": {"postgres-a": {"RO"}},
+	}
+
+	assert.Equal(t, []PermissionDiff{
+		{Client: "service-a", Scope: "postgres-a", From: []string{"RO", "RW"}, To: []string{"RO"}, Removed: []string{"RW"}},
+		{Client: "service-b", Scope: "postgres-a", From: []string{"RO"}, To: []string{}, Removed: []string{"RO"}},
+		{Client: "service-c", Scope: "postgres-a", From: []string{}, To: []string{"RO"}, Added: []string{"RO"}},
+	}, DiffPermissions(from, to))
+	assert.Empty(t, DiffPermissions(from, from))
+}
+
+func TestUpdatePermissionsBatch(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	permissions := func() map[string]map[string][]string {
+		return map[string]map[string][]string{"service-a": {"postgres-a": {"RO", "RW"}}}
+	}
+	redisRepo := NewRedisRepository(client, "ns")
+	require.NoError(t, redisRepo.Seed(ctx, permissions()))
+
+	memoryRepo := NewRepository(permissions())
+
+	for name, test := range map[string]struct {
+		repo interface {
+			UpdatePermissionsBatch(ctx context.Context, updates []PermissionUpdate) error
+			GetVersionedPermissions(client, scope string) ([]string, PermissionsVersion)
+		}
+		base int64
+	}{
+		"memory": {repo: memoryRepo, base: memoryRepo.storage.baseVersion},
+		"redis":  {repo: redisRepo},
+	} {
+		repo := test.repo
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, repo.UpdatePermissionsBatch(ctx, []PermissionUpdate{
+				{Client: "service-a", Scope: "postgres-a", Roles: []string{"RO"}},
+				{Client: "service-b", Scope: "postgres-a", Roles: []string{"RO"}},
+			}))
+
+			roles, version := repo.GetVersionedPermissions("service-a", "postgres-a")
+			assert.Equal(t, []string{"RO"}, roles)
+			assert.Equal(t, PermissionsVersion{Version: test.base + 1, MinVersion: test.base + 1}, version)
+
+			roles, version = repo.GetVersionedPermissions("service-b", "postgres-a")
+			assert.Equal(t, []string{"RO"}, roles)
+			assert.Equal(t, PermissionsVersion{Version: test.base + 1}, version)
+		})
+	}
+
+	// the changes reach other replicas
+	roles, _ := NewRedisRepository(client, "ns").GetVersionedPermissions("service-b", "postgres-a")
+	assert.Equal(t, []string{"RO"}, roles)
+}
+
+func TestCompareAndSwapPermissions(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	for name, repo := range map[string]interface {
+		UpdatePermissions(client, scope string, roles []string) error
+		PermissionsRevision(ctx context.Context) (int64, error)
+		CompareAndSwapPermissions(ctx context.Context, revision int64, updates []PermissionUpdate) error
+		GetPermissions(client, scope string) []string
+	}{
+		"memory": NewRepository(map[string]map[string][]string{}),
+		"redis":  NewRedisRepository(client, "ns"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			revision, err := repo.PermissionsRevision(ctx)
+			require.NoError(t, err)
+
+			require.NoError(t, repo.UpdatePermissions("service-a", "postgres-a", []string{"RO"}))
+			err = repo.CompareAndSwapPermissions(ctx, revision, []PermissionUpdate{{Client: "service-b", Scope: "postgres-b", Roles: []string{"RO"}}})
+			require.ErrorIs(t, err, ErrConflict)
+			assert.Empty(t, repo.GetPermissions("service-b", "postgres-b"))
+
+			revision, err = repo.PermissionsRevision(ctx)
+			require.NoError(t, err)
+			require.NoError(t, repo.CompareAndSwapPermissions(ctx, revision, []PermissionUpdate{
+				{Client: "service-a", Scope: "postgres-a", Roles: []string{}},
+				{Client: "service-b", Scope: "postgres-b", Roles: []string{"RO"}},
+			}))
+			assert.Empty(t, repo.GetPermissions("service-a", "postgres-a"))
+			assert.Equal(t, []string{"RO"}, repo.GetPermissions("service-b", "postgres-b"))
+
+			next, err := repo.PermissionsRevision(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, revision+2, next)
+		})
+	}
+}
@@ -5,3 +5,11 @@ CREATE TABLE service2infra."Permissions" (
     ServerName TEXT NOT NULL,
     roles TEXT[] NOT NULL
 );
+
+CREATE SCHEMA IF NOT EXISTS service2service;
+
+CREATE TABLE service2service."Permissions" (
+    ClientName TEXT NOT NULL,
+    ServerName TEXT NOT NULL,
+    roles TEXT[] NOT NULL
+);
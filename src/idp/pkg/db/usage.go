@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+// GrantKey is a role of a client on a scope.
+type GrantKey struct {
+	Client string `json:"client"`
+	Scope  string `json:"scope"`
+	Role   string `json:"role"`
+}
+
+// GrantUsage keeps when a token carrying a grant was last issued, in memory of
+// the replica. Usage is tracked since the replica started.
+type GrantUsage struct {
+	mu         sync.Mutex
+	lastIssued map[GrantKey]time.Time
+	since      time.Time
+}
+
+func NewGrantUsage() *GrantUsage {
+	return &GrantUsage{lastIssued: make(map[GrantKey]time.Time), since: time.Now()}
+}
+
+func (u *GrantUsage) RecordIssued(_ context.Context, grants []GrantKey, at time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, grant := range grants {
+		if at.After(u.lastIssued[grant]) {
+			u.lastIssued[grant] = at
+		}
+	}
+
+	return nil
+}
+
+func (u *GrantUsage) TrackedSince(_ context.Context) (time.Time, error) {
+	return u.since, nil
+}
+
+func (u *GrantUsage) LastIssued(_ context.Context) (map[GrantKey]time.Time, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return maps.Clone(u.lastIssued), nil
+}
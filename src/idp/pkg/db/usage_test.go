@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type grantUsage interface {
+	RecordIssued(ctx context.Context, grants []GrantKey, at time.Time) error
+	LastIssued(ctx context.Context) (map[GrantKey]time.Time, error)
+	TrackedSince(ctx context.Context) (time.Time, error)
+}
+
+func TestGrantUsage(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, usage := range map[string]grantUsage{
+		"memory": NewGrantUsage(),
+		"redis":  NewRedisGrantUsage(client, "ns"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			issued := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			ro := GrantKey{Client: "service-a", Scope: "postgres-a", Role: "RO"}
+			rw := GrantKey{Client: "service-a", Scope: "postgres-a", Role: "RW"}
+			require.NoError(t, usage.RecordIssued(ctx, []GrantKey{ro, rw}, issued))
+			require.NoError(t, usage.RecordIssued(ctx, []GrantKey{ro}, issued.Add(time.Hour)))
+			// an older issuance does not move the time back
+			require.NoError(t, usage.RecordIssued(ctx, []GrantKey{rw}, issued.Add(-time.Hour)))
+
+			lastIssued, err := usage.LastIssued(ctx)
+			require.NoError(t, err)
+			require.Len(t, lastIssued, 2)
+			assert.True(t, issued.Add(time.Hour).Equal(lastIssued[ro]))
+			assert.True(t, issued.Equal(lastIssued[rw]))
+
+			since, err := usage.TrackedSince(ctx)
+			require.NoError(t, err)
+			assert.False(t, since.After(time.Now()))
+		})
+	}
+}
+
+func TestRedisGrantUsage_TrackedSince(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	issued := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	usage := NewRedisGrantUsage(client, "ns")
+	require.NoError(t, usage.RecordIssued(ctx, []GrantKey{{Client: "service-a", Scope: "postgres-a", Role: "RO"}}, issued))
+	require.NoError(t, usage.RecordIssued(ctx, []GrantKey{{Client: "service-a", Scope: "postgres-a", Role: "RO"}}, issued.Add(time.Hour)))
+
+	since, err := usage.TrackedSince(ctx)
+	require.NoError(t, err)
+	assert.True(t, issued.Equal(since), "tracking started with the first issuance")
+
+	// a namespace without issuances starts tracking on the first read
+	before := time.Now().Truncate(time.Second)
+	since, err = NewRedisGrantUsage(client, "other").TrackedSince(ctx)
+	require.NoError(t, err)
+	assert.False(t, since.Before(before))
+}
+
+func TestAllPermissions(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+
+	permissions := map[string]map[string][]string{
+		"service-a": {"postgres-a": {"RO", "RW"}},
+		"service-b": {"postgres-a": {"RO"}, "postgres-b": {"RO"}},
+	}
+
+	redisRepo := NewRedisRepository(client, "ns")
+	require.NoError(t, redisRepo.Seed(ctx, permissions))
+	require.NoError(t, NewRedisRepository(client, "other").Seed(ctx, map[string]map[string][]string{
+		"service-c": {"postgres-a": {"RO"}},
+	}))
+
+	for name, repo := range map[string]interface {
+		AllPermissions(ctx context.Context) (map[string]map[string][]string, error)
+	}{
+		"memory": NewRepository(permissions),
+		"redis":  redisRepo,
+	} {
+		t.Run(name, func(t *testing.T) {
+			all, err := repo.AllPermissions(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, permissions, all)
+		})
+	}
+}
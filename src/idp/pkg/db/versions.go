@@ -0,0 +1,24 @@
+package db
+
+import "slices"
+
+// PermissionsVersion of the roles of a client on a scope. Version grows with
+// every change, MinVersion is the version of the latest change which removed
+// roles: tokens issued before it may carry roles the client no longer has.
+type PermissionsVersion struct {
+	Version    int64 `json:"version"`
+	MinVersion int64 `json:"min_version"`
+}
+
+// next returns the version of the change from the old roles to the new ones.
+func (v PermissionsVersion) next(oldRoles, roles []string) PermissionsVersion {
+	next := PermissionsVersion{Version: v.Version + 1, MinVersion: v.MinVersion}
+	for _, role := range oldRoles {
+		if !slices.Contains(roles, role) {
+			next.MinVersion = next.Version
+			break
+		}
+	}
+
+	return next
+}
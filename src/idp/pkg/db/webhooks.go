@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DeadLettersMaxCount bounds the dead-lettered deliveries, older ones are
+// dropped.
+const DeadLettersMaxCount = 10000
+
+// WebhookDelivery is an event sent to a webhook endpoint.
+type WebhookDelivery struct {
+	ID      string          `json:"id"`
+	Webhook string          `json:"webhook"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// FailedAt is set once the delivery is dead-lettered.
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// DeadLetters keeps the deliveries which ran out of attempts in memory of the
+// replica.
+type DeadLetters struct {
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+func NewDeadLetters() *DeadLetters {
+	return &DeadLetters{}
+}
+
+func (l *DeadLetters) Add(_ context.Context, delivery *WebhookDelivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.deliveries = append(l.deliveries, *delivery)
+	if len(l.deliveries) > DeadLettersMaxCount {
+		l.deliveries = slices.Delete(l.deliveries, 0, len(l.deliveries)-DeadLettersMaxCount)
+	}
+
+	return nil
+}
+
+// List returns up to limit latest deliveries, the newest one first.
+func (l *DeadLetters) List(_ context.Context, limit int) ([]WebhookDelivery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	deliveries := make([]WebhookDelivery, 0, max(min(limit, len(l.deliveries)), 0))
+	for i := len(l.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		deliveries = append(deliveries, l.deliveries[i])
+	}
+
+	return deliveries, nil
+}
+
+// Take removes the delivery, so it is redelivered only once.
+func (l *DeadLetters) Take(_ context.Context, id string) (*WebhookDelivery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := slices.IndexFunc(l.deliveries, func(delivery WebhookDelivery) bool { return delivery.ID == id })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	delivery := l.deliveries[i]
+	l.deliveries = slices.Delete(l.deliveries, i, i+1)
+
+	return &delivery, nil
+}
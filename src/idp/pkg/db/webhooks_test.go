@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deadLetterStore interface {
+	Add(ctx context.Context, delivery *WebhookDelivery) error
+	List(ctx context.Context, limit int) ([]WebhookDelivery, error)
+	Take(ctx context.Context, id string) (*WebhookDelivery, error)
+}
+
+func TestDeadLetters(t *testing.T) {
+	_, client := newTestRedis(t)
+
+	for name, store := range map[string]deadLetterStore{
+		"memory": NewDeadLetters(),
+		"redis":  NewRedisDeadLetters(client),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			firstFailed, secondFailed := created.Add(time.Minute), created.Add(time.Hour)
+
+			first := &WebhookDelivery{
+				ID:        "d1",
+				Webhook:   "chat",
+				Event:     "permissions.updated",
+				Payload:   json.RawMessage(`{"id":"e1"}`),
+				Attempts:  8,
+				LastError: "endpoint responded with status 503",
+				CreatedAt: created,
+				FailedAt:  &firstFailed,
+			}
+			second := &WebhookDelivery{
+				ID:        "d2",
+				Webhook:   "tickets",
+				Event:     "key.rotated",
+				Payload:   json.RawMessage(`{"id":"e2"}`),
+				Attempts:  1,
+				LastError: "endpoint rejected the delivery with status 400",
+				CreatedAt: created,
+				FailedAt:  &secondFailed,
+			}
+			require.NoError(t, store.Add(ctx, first))
+			require.NoError(t, store.Add(ctx, second))
+
+			deliveries, err := store.List(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, deliveries, 2)
+			assert.Equal(t, "d2", deliveries[0].ID)
+			assert.Equal(t, *first, deliveries[1])
+
+			deliveries, err = store.List(ctx, 1)
+			require.NoError(t, err)
+			require.Len(t, deliveries, 1)
+			assert.Equal(t, "d2", deliveries[0].ID)
+
+			taken, err := store.Take(ctx, "d1")
+			require.NoError(t, err)
+			assert.Equal(t, first, taken)
+			_, err = store.Take(ctx, "d1")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			deliveries, err = store.List(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, deliveries, 1)
+			assert.Equal(t, "d2", deliveries[0].ID)
+		})
+	}
+}
+
+func TestRedisKeyHistory(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	history := NewRedisKeyHistory(client)
+
+	previous, err := history.SwapKeyID(ctx, "a", "kid-1")
+	require.NoError(t, err)
+	assert.Empty(t, previous)
+
+	previous, err = history.SwapKeyID(ctx, "a", "kid-2")
+	require.NoError(t, err)
+	assert.Equal(t, "kid-1", previous)
+
+	previous, err = history.SwapKeyID(ctx, "b", "kid-3")
+	require.NoError(t, err)
+	assert.Empty(t, previous)
+}
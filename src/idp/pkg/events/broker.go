@@ -0,0 +1,92 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// PermissionEvent notifies a client that its roles on a scope have changed.
+type PermissionEvent struct {
+	Client string   `json:"client"`
+	Scope  string   `json:"scope"`
+	Roles  []string `json:"roles"`
+	// Version and MinVersion are the permissions versions after the change,
+	// tokens of older versions than MinVersion are no longer accepted.
+	Version    int64     `json:"version,omitempty"`
+	MinVersion int64     `json:"min_version,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Broker fans permission events out to the subscribers of the changed client.
+// Slow subscribers lose events rather than block the publisher, they are
+// expected to refresh everything after reconnecting.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[string]map[*subscription]struct{}
+	buffer int
+}
+
+type subscription struct {
+	ch chan PermissionEvent
+}
+
+func NewBroker(buffer int) *Broker {
+	return &Broker{
+		subs:   make(map[string]map[*subscription]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Subscribe returns the events of client until cancel is called.
+func (b *Broker) Subscribe(client string) (<-chan PermissionEvent, func()) {
+	sub := &subscription{ch: make(chan PermissionEvent, b.buffer)}
+
+	b.mu.Lock()
+	if b.subs[client] == nil {
+		b.subs[client] = make(map[*subscription]struct{})
+	}
+	b.subs[client][sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subs[client], sub)
+			if len(b.subs[client]) == 0 {
+				delete(b.subs, client)
+			}
+			close(sub.ch)
+		})
+	}
+
+	return sub.ch, cancel
+}
+
+// Publish delivers the event to every subscriber of event.Client and returns
+// the number of subscribers it was delivered to.
+func (b *Broker) Publish(event PermissionEvent) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delivered := 0
+	for sub := range b.subs[event.Client] {
+		select {
+		case sub.ch <- event:
+			delivered++
+		default:
+		}
+	}
+
+	return delivered
+}
+
+// Subscribers returns the number of active subscriptions of client.
+func (b *Broker) Subscribers(client string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs[client])
+}
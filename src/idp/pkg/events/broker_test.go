@@ -0,0 +1,47 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker_FiltersByClient(t *testing.T) {
+	b := NewBroker(1)
+
+	eventsA, cancelA := b.Subscribe("service-a")
+	defer cancelA()
+	eventsB, cancelB := b.Subscribe("service-b")
+	defer cancelB()
+
+	assert.Equal(t, 1, b.Publish(PermissionEvent{Client: "service-a", Scope: "postgres-a", Roles: []string{"RW"}}))
+
+	assert.Equal(t, "postgres-a", (<-eventsA).Scope)
+	assert.Empty(t, eventsB)
+}
+
+func TestBroker_SlowSubscriberDoesNotBlock(t *testing.T) {
+	b := NewBroker(1)
+
+	events, cancel := b.Subscribe("service-a")
+	defer cancel()
+
+	assert.Equal(t, 1, b.Publish(PermissionEvent{Client: "service-a", Scope: "first"}))
+	assert.Equal(t, 0, b.Publish(PermissionEvent{Client: "service-a", Scope: "second"}))
+	assert.Equal(t, "first", (<-events).Scope)
+}
+
+func TestBroker_Cancel(t *testing.T) {
+	b := NewBroker(1)
+
+	events, cancel := b.Subscribe("service-a")
+	assert.Equal(t, 1, b.Subscribers("service-a"))
+
+	cancel()
+	cancel()
+
+	_, ok := <-events
+	assert.False(t, ok)
+	assert.Equal(t, 0, b.Subscribers("service-a"))
+	assert.Equal(t, 0, b.Publish(PermissionEvent{Client: "service-a"}))
+}
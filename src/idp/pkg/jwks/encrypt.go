@@ -0,0 +1,75 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// NewEncrypter reads the PEM encoded public key (PKIX) or certificate of a
+// resource server. Tokens are encrypted with A256GCM, the content key is
+// wrapped with RSA-OAEP-256 or ECDH-ES+A256KW, and the key id is the RFC 7638
+// thumbprint of the public key.
+func NewEncrypter(publicKeyFile string) (jose.Encrypter, error) {
+	raw, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", publicKeyFile)
+	}
+
+	var publicKey any
+	switch block.Type {
+	case "PUBLIC KEY":
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			publicKey = cert.PublicKey
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	var alg jose.KeyAlgorithm
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	keyID, err := thumbprint(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient := jose.Recipient{Algorithm: alg, Key: publicKey, KeyID: keyID}
+	opts := (&jose.EncrypterOptions{}).WithContentType("JWT")
+
+	return jose.NewEncrypter(jose.A256GCM, recipient, opts)
+}
+
+// EncryptJWT nests the signed token in a JWE (RFC 7519 section 5.2), only the
+// holder of the private key of the encrypter reads the claims.
+func EncryptJWT(encrypter jose.Encrypter, signedToken string) (string, error) {
+	jwe, err := encrypter.Encrypt([]byte(signedToken))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt token: %w", err)
+	}
+
+	return jwe.CompactSerialize()
+}
@@ -1,6 +1,7 @@
 package jwks
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -9,11 +10,13 @@ import (
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"math/big"
+	"os"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
-	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/tokens"
 )
 
 type Signer interface {
@@ -22,13 +25,85 @@ type Signer interface {
 }
 
 type KeyPair struct {
-	PrivateKey  *rsa.PrivateKey
+	// PrivateKey is an RSA key of the process, or a handle of a key held by
+	// Vault or an HSM.
+	PrivateKey  crypto.Signer
 	Certificate *x509.Certificate
 	KeyID       string
 }
 
 func GenerateKeyPair() *KeyPair {
 	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys, _ := newKeyPair(privateKey, generateKeyID())
+
+	return keys
+}
+
+// NewKeyPair wraps an RSA key held outside of the process, the key id is the
+// RFC 7638 thumbprint and the certificate is signed by the key itself.
+func NewKeyPair(privateKey crypto.Signer) (*KeyPair, error) {
+	keyID, err := thumbprint(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return newKeyPair(privateKey, keyID)
+}
+
+// LoadKeyPair reads a PEM encoded RSA private key (PKCS#1 or PKCS#8), the key
+// id is the RFC 7638 thumbprint, so it stays the same across restarts.
+func LoadKeyPair(privateKeyFile string) (*KeyPair, error) {
+	raw, err := os.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", privateKeyFile)
+	}
+
+	var privateKey *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key any
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if privateKey, ok = key.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("unsupported private key type %T", key)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	keyID, err := thumbprint(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return newKeyPair(privateKey, keyID)
+}
+
+func thumbprint(publicKey crypto.PublicKey) (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: publicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to calc key thumbprint: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+func newKeyPair(privateKey crypto.Signer, keyID string) (*KeyPair, error) {
+	if _, ok := privateKey.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, only RSA keys are supported", privateKey.Public())
+	}
 
 	now := time.Now()
 	template := &x509.Certificate{
@@ -40,21 +115,27 @@ func GenerateKeyPair() *KeyPair {
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 	}
 
-	certDER, _ := x509.CreateCertificate(
+	certDER, err := x509.CreateCertificate(
 		rand.Reader,
 		template,
 		template,
 		privateKey.Public(),
 		privateKey,
 	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
 
-	cert, _ := x509.ParseCertificate(certDER)
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
 
 	return &KeyPair{
 		PrivateKey:  privateKey,
 		Certificate: cert,
-		KeyID:       generateKeyID(),
-	}
+		KeyID:       keyID,
+	}, nil
 }
 
 func (k *KeyPair) JWKS() jose.JSONWebKeySet {
@@ -77,7 +158,9 @@ func generateKeyID() string {
 	return base64.RawURLEncoding.EncodeToString(buf)
 }
 
-func GenerateJWT(signer Signer, claims tokens.Claims) (string, error) {
+// GenerateJWT signs the claims, which are tokens.Claims or, for realms
+// issuing v1 tokens, tokens.LegacyClaims.
+func GenerateJWT(signer Signer, claims any) (string, error) {
 	payload, err := json.Marshal(claims)
 	if err != nil {
 		return "", err
@@ -96,7 +179,9 @@ func getX5t(cert *x509.Certificate) string {
 	return base64.RawURLEncoding.EncodeToString(h[:])
 }
 
-func getX5tS256(cert *x509.Certificate) string {
+// GetX5tS256 returns the base64url SHA-256 thumbprint of the DER certificate,
+// as used by the x5t#S256 header and the RFC 8705 cnf claim.
+func GetX5tS256(cert *x509.Certificate) string {
 	h := sha256.Sum256(cert.Raw)
 	return base64.RawURLEncoding.EncodeToString(h[:])
 }
@@ -0,0 +1,63 @@
+//go:build cgo
+
+package jwks
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// PKCS11Signer signs with an RSA key pair of a PKCS#11 token, the private key
+// never leaves the HSM. It holds a session of the token until closed.
+type PKCS11Signer struct {
+	crypto.Signer
+
+	ctx *crypto11.Context
+}
+
+func NewPKCS11Signer(cfg config.PKCS11KeyConfig) (*PKCS11Signer, error) {
+	pin := cfg.PIN
+	if cfg.PINFile != "" {
+		raw, err := os.ReadFile(cfg.PINFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pkcs11 pin: %w", err)
+		}
+		pin = strings.TrimSpace(string(raw))
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       cfg.Module,
+		TokenLabel: cfg.TokenLabel,
+		Pin:        pin,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pkcs11 token %s: %w", cfg.TokenLabel, err)
+	}
+
+	signer, err := ctx.FindKeyPair(nil, []byte(cfg.KeyLabel))
+	if err == nil && signer == nil {
+		err = errors.New("key pair not found")
+	}
+	if err != nil {
+		ctx.Close()
+		return nil, fmt.Errorf("failed to find pkcs11 key %s: %w", cfg.KeyLabel, err)
+	}
+
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		ctx.Close()
+		return nil, fmt.Errorf("unsupported pkcs11 key type %T, only RSA keys are supported", signer.Public())
+	}
+
+	return &PKCS11Signer{Signer: signer, ctx: ctx}, nil
+}
+
+func (s *PKCS11Signer) Close() error {
+	return s.ctx.Close()
+}
@@ -0,0 +1,24 @@
+//go:build !cgo
+
+package jwks
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// PKCS11Signer needs the PKCS#11 library of the HSM, which is only loaded by
+// builds with cgo.
+type PKCS11Signer struct {
+	crypto.Signer
+}
+
+func NewPKCS11Signer(cfg config.PKCS11KeyConfig) (*PKCS11Signer, error) {
+	return nil, errors.New("pkcs11 keys are not supported by builds without cgo")
+}
+
+func (s *PKCS11Signer) Close() error {
+	return nil
+}
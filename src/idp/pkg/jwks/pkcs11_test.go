@@ -0,0 +1,73 @@
+//go:build cgo
+
+package jwks
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/go-jose/go-jose/v3"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPKCS11Signer_SignsVerifiableTokens runs against a SoftHSM token, e.g.
+//
+//	softhsm2-util --init-token --free --label idp-test --pin 1234 --so-pin 1234
+//	IDP_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so \
+//	IDP_TEST_PKCS11_TOKEN_LABEL=idp-test IDP_TEST_PKCS11_PIN=1234 go test ./pkg/jwks
+func TestPKCS11Signer_SignsVerifiableTokens(t *testing.T) {
+	cfg := config.PKCS11KeyConfig{
+		Module:     os.Getenv("IDP_TEST_PKCS11_MODULE"),
+		TokenLabel: os.Getenv("IDP_TEST_PKCS11_TOKEN_LABEL"),
+		PIN:        os.Getenv("IDP_TEST_PKCS11_PIN"),
+		KeyLabel:   "idp-test-" + generateKeyID(),
+	}
+	if cfg.Module == "" {
+		t.Skip("IDP_TEST_PKCS11_MODULE is not set")
+	}
+
+	hsm, err := crypto11.Configure(&crypto11.Config{Path: cfg.Module, TokenLabel: cfg.TokenLabel, Pin: cfg.PIN})
+	require.NoError(t, err)
+	generated, err := hsm.GenerateRSAKeyPairWithLabel([]byte(cfg.KeyLabel[:16]), []byte(cfg.KeyLabel), 2048)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		generated.Delete()
+		hsm.Close()
+	})
+
+	signer, err := NewPKCS11Signer(cfg)
+	require.NoError(t, err)
+	defer signer.Close()
+
+	keys, err := NewKeyPair(signer)
+	require.NoError(t, err)
+
+	jwtSigner, err := NewSigner(keys)
+	require.NoError(t, err)
+
+	rawToken, err := GenerateJWT(jwtSigner, tokens.Claims{Sub: "service-a"})
+	require.NoError(t, err)
+
+	jws, err := jose.ParseSigned(rawToken)
+	require.NoError(t, err)
+
+	payload, err := jws.Verify(generated.Public())
+	require.NoError(t, err)
+
+	var claims tokens.Claims
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "service-a", claims.Sub)
+
+	_, err = NewPKCS11Signer(config.PKCS11KeyConfig{
+		Module:     cfg.Module,
+		TokenLabel: cfg.TokenLabel,
+		PIN:        cfg.PIN,
+		KeyLabel:   "missing",
+	})
+	assert.ErrorContains(t, err, "failed to find pkcs11 key missing")
+}
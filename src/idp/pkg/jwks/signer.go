@@ -0,0 +1,58 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+)
+
+// NewSigner returns the RS256 signer of access tokens of the key pair, the
+// payload is hashed in the process and only the digest is sent to keys held by
+// Vault or an HSM.
+func NewSigner(keys *KeyPair) (Signer, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{
+			Algorithm: jose.RS256,
+			Key:       &opaqueSigner{keys: keys},
+		},
+		(&jose.SignerOptions{}).WithType(tokens.AccessTokenType),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	return signer, nil
+}
+
+// opaqueSigner adapts a crypto.Signer to go-jose, which only signs with
+// in-process keys otherwise.
+type opaqueSigner struct {
+	keys *KeyPair
+}
+
+func (s *opaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{
+		Key:       s.keys.PrivateKey.Public(),
+		KeyID:     s.keys.KeyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}
+}
+
+func (s *opaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.RS256}
+}
+
+func (s *opaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != jose.RS256 {
+		return nil, fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(payload)
+
+	return s.keys.PrivateKey.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+}
@@ -0,0 +1,202 @@
+package jwks
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// vaultTimeout bounds a Vault request, crypto.Signer has no context.
+const vaultTimeout = 5 * time.Second
+
+var vaultHashAlgorithms = map[crypto.Hash]string{
+	crypto.SHA256: "sha2-256",
+	crypto.SHA384: "sha2-384",
+	crypto.SHA512: "sha2-512",
+}
+
+// VaultSigner signs with an RSA key of the Vault Transit secrets engine, the
+// private key never leaves Vault. The latest key version at creation is used,
+// so a key rotated in Vault is picked up on restart along with its public key.
+type VaultSigner struct {
+	cfg        config.VaultKeyConfig
+	httpClient *http.Client
+
+	version   int
+	publicKey *rsa.PublicKey
+}
+
+func NewVaultSigner(ctx context.Context, cfg config.VaultKeyConfig, httpClient *http.Client) (*VaultSigner, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: vaultTimeout}
+	}
+
+	s := &VaultSigner{cfg: cfg, httpClient: httpClient}
+
+	var key struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}
+	if err := s.do(ctx, http.MethodGet, "keys", nil, &key); err != nil {
+		return nil, fmt.Errorf("failed to read vault transit key %s: %w", cfg.KeyName, err)
+	} else if !strings.HasPrefix(key.Type, "rsa-") {
+		return nil, fmt.Errorf("unsupported vault transit key type %q, only RSA keys are supported", key.Type)
+	}
+
+	version, ok := key.Keys[strconv.Itoa(key.LatestVersion)]
+	if !ok {
+		return nil, fmt.Errorf("vault transit key %s has no version %d", cfg.KeyName, key.LatestVersion)
+	}
+
+	publicKey, err := parseRSAPublicKey(version.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key of vault transit key %s: %w", cfg.KeyName, err)
+	}
+
+	s.version = key.LatestVersion
+	s.publicKey = publicKey
+
+	return s, nil
+}
+
+func (s *VaultSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a digest with PKCS #1 v1.5, PSS is not supported.
+func (s *VaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("rsa pss signatures are not supported")
+	}
+
+	hashAlgorithm, ok := vaultHashAlgorithms[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %s", opts.HashFunc())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	req := map[string]any{
+		"input":               base64.StdEncoding.EncodeToString(digest),
+		"prehashed":           true,
+		"hash_algorithm":      hashAlgorithm,
+		"signature_algorithm": "pkcs1v15",
+		"key_version":         s.version,
+	}
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.do(ctx, http.MethodPost, "sign", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to sign with vault transit key %s: %w", s.cfg.KeyName, err)
+	}
+
+	// signatures are formatted as vault:v<version>:<base64 signature>
+	parts := strings.SplitN(resp.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("unexpected vault signature format %q", resp.Signature)
+	}
+
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// do calls the transit endpoint of the key, data receives the data field of
+// the response.
+func (s *VaultSigner) do(ctx context.Context, method, endpoint string, body, data any) error {
+	token, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	reqURL := strings.TrimSuffix(s.cfg.Address, "/") + "/v1/" + strings.Trim(s.cfg.Mount, "/") + "/" + endpoint + "/" + url.PathEscape(s.cfg.KeyName)
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var vaultResp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vaultResp); err != nil {
+		return fmt.Errorf("failed to decode vault response with status %d: %w", resp.StatusCode, err)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault responded with status %d: %s", resp.StatusCode, strings.Join(vaultResp.Errors, "; "))
+	}
+
+	if err := json.Unmarshal(vaultResp.Data, data); err != nil {
+		return fmt.Errorf("failed to decode vault response data: %w", err)
+	}
+
+	return nil
+}
+
+func (s *VaultSigner) token() (string, error) {
+	if s.cfg.TokenFile == "" {
+		return s.cfg.Token, nil
+	}
+
+	raw, err := os.ReadFile(s.cfg.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault token: %w", err)
+	}
+
+	return strings.TrimSpace(string(raw)), nil
+}
+
+func parseRSAPublicKey(rawPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(rawPEM))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	return publicKey, nil
+}
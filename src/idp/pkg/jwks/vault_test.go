@@ -0,0 +1,144 @@
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testVaultToken = "root"
+
+// newTransitServer stands in for a Vault dev server with the transit engine
+// mounted on /v1/transit and a single key.
+func newTransitServer(t *testing.T, keyName, keyType string) (*httptest.Server, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	respond := func(w http.ResponseWriter, status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/transit/keys/"+keyName, func(w http.ResponseWriter, r *http.Request) {
+		respond(w, http.StatusOK, map[string]any{"data": map[string]any{
+			"type":           keyType,
+			"latest_version": 2,
+			"keys": map[string]any{
+				"2": map[string]any{"public_key": string(publicPEM)},
+			},
+		}})
+	})
+	mux.HandleFunc("POST /v1/transit/sign/"+keyName, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input              string `json:"input"`
+			Prehashed          bool   `json:"prehashed"`
+			HashAlgorithm      string `json:"hash_algorithm"`
+			SignatureAlgorithm string `json:"signature_algorithm"`
+			KeyVersion         int    `json:"key_version"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.Prehashed)
+		assert.Equal(t, "sha2-256", req.HashAlgorithm)
+		assert.Equal(t, "pkcs1v15", req.SignatureAlgorithm)
+		assert.Equal(t, 2, req.KeyVersion)
+
+		digest, err := base64.StdEncoding.DecodeString(req.Input)
+		require.NoError(t, err)
+
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+		require.NoError(t, err)
+
+		respond(w, http.StatusOK, map[string]any{"data": map[string]any{
+			"signature": "vault:v2:" + base64.StdEncoding.EncodeToString(signature),
+		}})
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			respond(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, key
+}
+
+func TestVaultSigner_SignsVerifiableTokens(t *testing.T) {
+	server, key := newTransitServer(t, "idp", "rsa-2048")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(testVaultToken+"\n"), 0o600))
+
+	signer, err := NewVaultSigner(context.Background(), config.VaultKeyConfig{
+		Address:   server.URL,
+		Mount:     "transit",
+		KeyName:   "idp",
+		TokenFile: tokenFile,
+	}, server.Client())
+	require.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, signer.Public())
+
+	keys, err := NewKeyPair(signer)
+	require.NoError(t, err)
+	cert := keys.Certificate
+	require.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+
+	jwtSigner, err := NewSigner(keys)
+	require.NoError(t, err)
+
+	rawToken, err := GenerateJWT(jwtSigner, tokens.Claims{Sub: "service-a"})
+	require.NoError(t, err)
+
+	jws, err := jose.ParseSigned(rawToken)
+	require.NoError(t, err)
+	assert.Equal(t, keys.KeyID, jws.Signatures[0].Header.KeyID)
+
+	payload, err := jws.Verify(keys.JWKS().Keys[0].Key)
+	require.NoError(t, err)
+
+	var claims tokens.Claims
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "service-a", claims.Sub)
+}
+
+func TestVaultSigner_Errors(t *testing.T) {
+	server, _ := newTransitServer(t, "idp", "rsa-2048")
+	cfg := config.VaultKeyConfig{Address: server.URL, Mount: "transit", KeyName: "idp", Token: "wrong"}
+
+	_, err := NewVaultSigner(context.Background(), cfg, server.Client())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "vault responded with status 403: permission denied")
+
+	ecServer, _ := newTransitServer(t, "idp", "ecdsa-p256")
+	cfg = config.VaultKeyConfig{Address: ecServer.URL, Mount: "transit", KeyName: "idp", Token: testVaultToken}
+
+	_, err = NewVaultSigner(context.Background(), cfg, ecServer.Client())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unsupported vault transit key type "ecdsa-p256"`)
+}
@@ -1,6 +1,7 @@
 package k8s
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -10,8 +11,13 @@ import (
 	"fmt"
 	"math/big"
 	"net/http"
+	"time"
 )
 
+// jwksTimeout bounds a JWKS fetch from the api server, callers without a
+// deadline, like NewVerifier, would otherwise hang on an unresponsive one.
+const jwksTimeout = 10 * time.Second
+
 type JWKS struct {
 	Keys []JWK `json:"keys"`
 }
@@ -42,6 +48,7 @@ func (k *K8sClient) setup() error {
 	caCertPool.AppendCertsFromPEM(caCert)
 
 	client := &http.Client{
+		Timeout: jwksTimeout,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				RootCAs: caCertPool,
@@ -55,13 +62,13 @@ func (k *K8sClient) setup() error {
 	return nil
 }
 
-func (k *K8sClient) GetPublicKey() (*rsa.PublicKey, error) {
+func (k *K8sClient) GetPublicKey(ctx context.Context) (*rsa.PublicKey, error) {
 	token, err := k.readSecrets("/var/run/secrets/kubernetes.io/serviceaccount/token")
 	if err != nil {
 		return nil, fmt.Errorf("error reading token: %w", err)
 	}
 
-	req, err := http.NewRequest("GET", k.jwksURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.jwksURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating k8s jwks request: %w", err)
 	}
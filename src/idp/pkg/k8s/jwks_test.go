@@ -1,6 +1,7 @@
 package k8s
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
@@ -123,7 +124,7 @@ func TestGetPublicKey(t *testing.T) {
 
 		k8sClient.jwksURL = ts.URL
 
-		key, err := k8sClient.GetPublicKey()
+		key, err := k8sClient.GetPublicKey(context.Background())
 		assert.NoError(t, err)
 		assert.IsType(t, &rsa.PublicKey{}, key)
 	})
@@ -145,7 +146,7 @@ func TestGetPublicKey(t *testing.T) {
 		// URL не важен, так как запрос не дойдет до него
 		k8sClient.jwksURL = "http://invalid"
 
-		_, err = k8sClient.GetPublicKey()
+		_, err = k8sClient.GetPublicKey(context.Background())
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "error reading token")
 	})
@@ -326,3 +327,41 @@ func generateTestToken(t *testing.T, key *rsa.PrivateKey, claims privateClaims)
 	require.NoError(t, err)
 	return tokenString
 }
+
+func TestVerifier_Ready(t *testing.T) {
+	available := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"keys":[{"kty":"RSA","kid":"test","use":"sig","alg":"RS256","n":"AQAB","e":"AQAB"}]}`))
+	}))
+	defer ts.Close()
+
+	publicKey := &rsa.PublicKey{N: big.NewInt(12345), E: 65537}
+	verifier := &Verifier{
+		publicKey: publicKey,
+		k8sClient: &K8sClient{
+			readSecrets: func(string) ([]byte, error) { return []byte("test-token"), nil },
+			client:      ts.Client(),
+			jwksURL:     ts.URL,
+		},
+	}
+
+	require.NoError(t, verifier.Ready(context.Background()))
+	assert.Same(t, publicKey, verifier.publicKey, "probes must not replace the key")
+
+	available = false
+	err := verifier.Ready(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no keys in JWKS")
+	assert.Same(t, publicKey, verifier.publicKey)
+
+	available = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, verifier.Ready(ctx), context.Canceled)
+}
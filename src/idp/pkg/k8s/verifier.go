@@ -3,6 +3,7 @@ package k8s
 import (
 	"context"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -12,9 +13,11 @@ import (
 
 type Verifier struct {
 	publicKey *rsa.PublicKey
+
+	k8sClient *K8sClient
 }
 
-func NewVerifier(_ context.Context) (*Verifier, error) {
+func NewVerifier(ctx context.Context) (*Verifier, error) {
 	k8sClient := &K8sClient{
 		readSecrets: os.ReadFile,
 	}
@@ -23,16 +26,33 @@ func NewVerifier(_ context.Context) (*Verifier, error) {
 		return nil, fmt.Errorf("failed to setup k8s client: %w", err)
 	}
 
-	publicKey, err := k8sClient.GetPublicKey()
+	publicKey, err := k8sClient.GetPublicKey(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get k8s public key: %w", err)
 	}
 
 	return &Verifier{
 		publicKey: publicKey,
+		k8sClient: k8sClient,
 	}, nil
 }
 
+// Ready fails while the api server JWKS is unavailable. The key fetched at
+// startup is kept, probes only read the JWKS.
+func (v *Verifier) Ready(ctx context.Context) error {
+	if v.publicKey == nil {
+		return errors.New("no k8s public key")
+	} else if v.k8sClient == nil {
+		return nil
+	}
+
+	if _, err := v.k8sClient.GetPublicKey(ctx); err != nil {
+		return fmt.Errorf("failed to get k8s public key: %w", err)
+	}
+
+	return nil
+}
+
 func (v *Verifier) VerifyWithClient(k8sToken string) (string, jwt.Claims, error) {
 	var claims privateClaims
 	token, err := jwt.ParseWithClaims(k8sToken, &claims, func(token *jwt.Token) (interface{}, error) {
@@ -0,0 +1,224 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+
+	// clockLeeway tolerates clock skew between the issuer and the IdP.
+	clockLeeway = time.Minute
+	// minKeysRefresh limits JWKS refetches triggered by unknown key ids.
+	minKeysRefresh = 10 * time.Second
+)
+
+// remoteKeys verifies tokens of an external issuer, its keys are fetched
+// lazily and refetched when a token is signed with an unknown key. Tokens of
+// a SPIFFE trust domain are checked by their sub, JWT-SVIDs may omit iss.
+type remoteKeys struct {
+	issuer     string
+	httpClient *http.Client
+	now        func() time.Time
+
+	// fetchMu serializes the fetches and guards jwksURI, mu only guards the
+	// fetched keys, so tokens of known keys are verified during a fetch.
+	fetchMu sync.Mutex
+	jwksURI string
+
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+func newRemoteKeys(issuer, jwksURI string, httpClient *http.Client) *remoteKeys {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	return &remoteKeys{
+		issuer:     issuer,
+		httpClient: httpClient,
+		now:        time.Now,
+		jwksURI:    jwksURI,
+	}
+}
+
+// verify checks the signature, the issuer, the expiry and that the token is
+// issued to one of the audiences, it returns all claims of the token.
+func (k *remoteKeys) verify(ctx context.Context, rawToken string, audiences []string) (map[string]any, error) {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+	if len(token.Headers) != 1 {
+		return nil, errors.New("token must have a single signature")
+	}
+
+	key, err := k.key(ctx, token.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var std jwt.Claims
+	var raw map[string]any
+	if err := token.Claims(key, &std, &raw); err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	expected := jwt.Expected{Issuer: k.issuer, Time: k.now()}
+	if isSPIFFE(k.issuer) {
+		expected.Issuer = ""
+		if issuer := tokenIssuer(&std); issuer != k.issuer {
+			return nil, fmt.Errorf("token of unexpected trust domain %s", issuer)
+		}
+	}
+
+	if err := std.ValidateWithLeeway(expected, clockLeeway); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	} else if std.Expiry == nil {
+		return nil, errors.New("token has no exp")
+	} else if !slices.ContainsFunc(audiences, std.Audience.Contains) {
+		return nil, fmt.Errorf("invalid audience %v", []string(std.Audience))
+	}
+
+	return raw, nil
+}
+
+// ready fetches the keys until they are fetched once, so a realm is not ready
+// before the issuer has been reached. Probes do not refetch them.
+func (k *remoteKeys) ready(ctx context.Context) error {
+	return k.refresh(ctx, func(keys *jose.JSONWebKeySet, _ time.Time) bool {
+		return keys == nil
+	})
+}
+
+func (k *remoteKeys) key(ctx context.Context, keyID string) (*jose.JSONWebKey, error) {
+	stale := func(keys *jose.JSONWebKeySet, fetchedAt time.Time) bool {
+		return keys == nil || (len(keys.Key(keyID)) == 0 && k.now().Sub(fetchedAt) > minKeysRefresh)
+	}
+	if err := k.refresh(ctx, stale); err != nil {
+		return nil, err
+	}
+
+	keys, _ := k.fetched()
+	found := keys.Key(keyID)
+	if len(found) == 0 {
+		return nil, fmt.Errorf("unknown key %q of issuer %s", keyID, k.issuer)
+	}
+
+	return &found[0], nil
+}
+
+func (k *remoteKeys) fetched() (*jose.JSONWebKeySet, time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.keys, k.fetchedAt
+}
+
+// refresh fetches the keys if they are stale. Callers waiting for a fetch
+// check again, the keys of the fetch before them are likely fresh.
+func (k *remoteKeys) refresh(ctx context.Context, stale func(keys *jose.JSONWebKeySet, fetchedAt time.Time) bool) error {
+	if !stale(k.fetched()) {
+		return nil
+	}
+
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	if !stale(k.fetched()) {
+		return nil
+	}
+
+	if k.jwksURI == "" {
+		var metadata struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := k.getJSON(ctx, strings.TrimSuffix(k.issuer, "/")+discoveryPath, &metadata); err != nil {
+			return fmt.Errorf("failed to discover issuer: %w", err)
+		}
+		if metadata.Issuer != k.issuer {
+			return fmt.Errorf("issuer metadata mismatch: %s", metadata.Issuer)
+		} else if metadata.JWKSURI == "" {
+			return errors.New("issuer metadata has no jwks_uri")
+		}
+		k.jwksURI = metadata.JWKSURI
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := k.getJSON(ctx, k.jwksURI, &keys); err != nil {
+		return fmt.Errorf("failed to fetch issuer keys: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = &keys
+	k.fetchedAt = k.now()
+
+	return nil
+}
+
+func (k *remoteKeys) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// UnverifiedIssuer reads the issuer of a token without verifying it, only to
+// pick the verifier of the token.
+func UnverifiedIssuer(rawToken string) (string, error) {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	var claims jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", fmt.Errorf("failed to read token claims: %w", err)
+	}
+
+	return tokenIssuer(&claims), nil
+}
+
+// tokenIssuer is the iss claim, or the trust domain of a SPIFFE ID in sub.
+func tokenIssuer(claims *jwt.Claims) string {
+	if isSPIFFE(claims.Subject) {
+		trustDomain, _, _ := strings.Cut(strings.TrimPrefix(claims.Subject, spiffeScheme), "/")
+		return spiffeScheme + trustDomain
+	}
+
+	return claims.Issuer
+}
+
+const spiffeScheme = "spiffe://"
+
+func isSPIFFE(id string) bool {
+	return strings.HasPrefix(id, spiffeScheme)
+}
@@ -0,0 +1,68 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// TrustedVerifier checks workload tokens of a federated issuer and maps their
+// claims to a client of the permission model.
+type TrustedVerifier struct {
+	cfg    *config.TrustedIssuer
+	keys   *remoteKeys
+	client *template.Template
+}
+
+func NewTrustedVerifier(cfg *config.TrustedIssuer, httpClient *http.Client) (*TrustedVerifier, error) {
+	client, err := template.New(cfg.Name).Option("missingkey=error").Parse(cfg.ClientTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client template of trusted issuer %s: %w", cfg.Name, err)
+	}
+
+	return &TrustedVerifier{
+		cfg:    cfg,
+		keys:   newRemoteKeys(cfg.Issuer, cfg.JWKSURI, httpClient),
+		client: client,
+	}, nil
+}
+
+// Issuer is the iss, or the SPIFFE trust domain, of the accepted tokens.
+func (v *TrustedVerifier) Issuer() string {
+	return v.cfg.Issuer
+}
+
+// SubjectTokenType the accepted tokens are exchanged as.
+func (v *TrustedVerifier) SubjectTokenType() string {
+	return v.cfg.SubjectTokenType
+}
+
+// Verify returns the client a valid token of the issuer maps to.
+func (v *TrustedVerifier) Verify(ctx context.Context, rawToken string) (string, error) {
+	claims, err := v.keys.verify(ctx, rawToken, v.cfg.Audiences)
+	if err != nil {
+		return "", fmt.Errorf("invalid token of trusted issuer %s: %w", v.cfg.Name, err)
+	}
+
+	var client strings.Builder
+	if err := v.client.Execute(&client, claims); err != nil {
+		return "", fmt.Errorf("failed to map token of trusted issuer %s to client: %w", v.cfg.Name, err)
+	}
+
+	// index of a missing nested claim renders as "<no value>"
+	clientID := strings.TrimSpace(client.String())
+	if clientID == "" || strings.Contains(clientID, "<no value>") {
+		return "", fmt.Errorf("token of trusted issuer %s maps to no client", v.cfg.Name)
+	}
+
+	return clientID, nil
+}
+
+// Ready fetches the issuer keys.
+func (v *TrustedVerifier) Ready(ctx context.Context) error {
+	return v.keys.ready(ctx)
+}
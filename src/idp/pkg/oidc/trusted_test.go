@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedVerifier_MapsClaimsToClient(t *testing.T) {
+	upstream := newFakeUpstream(t)
+
+	v, err := NewTrustedVerifier(&config.TrustedIssuer{
+		Name:             "cluster-b",
+		Issuer:           upstream.URL,
+		SubjectTokenType: config.TokenTypeK8s,
+		Audiences:        []string{"https://kubernetes.default.svc", "idp-cli"},
+		ClientTemplate:   `cluster-b:{{index . "kubernetes.io" "serviceaccount" "name"}}`,
+	}, upstream.Client())
+	require.NoError(t, err)
+
+	clientID, err := v.Verify(context.Background(), upstream.idToken(t, map[string]any{
+		"kubernetes.io": map[string]any{
+			"namespace":      "service-a",
+			"serviceaccount": map[string]any{"name": "service-a"},
+		},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-b:service-a", clientID)
+	assert.NoError(t, v.Ready(context.Background()))
+}
+
+func TestTrustedVerifier_SPIFFE(t *testing.T) {
+	upstream := newFakeUpstream(t)
+
+	v, err := NewTrustedVerifier(&config.TrustedIssuer{
+		Name:             "spire",
+		Issuer:           "spiffe://cluster-b.example",
+		SubjectTokenType: config.TokenTypeJWTSPIFFE,
+		JWKSURI:          upstream.URL + "/keys",
+		Audiences:        []string{"idp"},
+		ClientTemplate:   `{{.sub}}`,
+	}, upstream.Client())
+	require.NoError(t, err)
+
+	svid := upstream.idToken(t, map[string]any{
+		"iss": nil,
+		"aud": "idp",
+		"sub": "spiffe://cluster-b.example/ns/ci/sa/runner",
+	})
+
+	issuer, err := UnverifiedIssuer(svid)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://cluster-b.example", issuer)
+
+	clientID, err := v.Verify(context.Background(), svid)
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://cluster-b.example/ns/ci/sa/runner", clientID)
+
+	_, err = v.Verify(context.Background(), upstream.idToken(t, map[string]any{
+		"iss": nil,
+		"aud": "idp",
+		"sub": "spiffe://evil.example/ns/ci/sa/runner",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected trust domain")
+}
+
+func TestTrustedVerifier_Rejects(t *testing.T) {
+	upstream := newFakeUpstream(t)
+
+	v, err := NewTrustedVerifier(&config.TrustedIssuer{
+		Name:           "ci",
+		Issuer:         upstream.URL,
+		Audiences:      []string{"idp"},
+		ClientTemplate: `ci:{{.project}}`,
+	}, upstream.Client())
+	require.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), upstream.idToken(t, map[string]any{"project": "service-a"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid audience")
+
+	_, err = v.Verify(context.Background(), upstream.idToken(t, map[string]any{"aud": "idp"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `map has no entry for key "project"`)
+
+	clientID, err := v.Verify(context.Background(), upstream.idToken(t, map[string]any{"aud": "idp", "project": "service-a"}))
+	require.NoError(t, err)
+	assert.Equal(t, "ci:service-a", clientID)
+}
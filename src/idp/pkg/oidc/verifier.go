@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// Identity is the user an upstream ID token was issued to.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// ClientID is the client of the permission model the user acts as.
+func (i *Identity) ClientID() string {
+	return config.UserClientPrefix + i.User
+}
+
+// GroupClientIDs are the clients of the permission model the user inherits
+// roles from.
+func (i *Identity) GroupClientIDs() []string {
+	clients := make([]string, 0, len(i.Groups))
+	for _, group := range i.Groups {
+		clients = append(clients, config.GroupClientPrefix+group)
+	}
+
+	return clients
+}
+
+// Verifier checks ID tokens of the upstream OIDC provider.
+type Verifier struct {
+	cfg  *config.UpstreamConfig
+	keys *remoteKeys
+}
+
+func NewVerifier(cfg *config.UpstreamConfig, httpClient *http.Client) *Verifier {
+	return &Verifier{
+		cfg:  cfg,
+		keys: newRemoteKeys(cfg.Issuer, cfg.JWKSURI, httpClient),
+	}
+}
+
+// Verify returns the identity of a valid ID token issued to the configured
+// audience.
+func (v *Verifier) Verify(ctx context.Context, rawIDToken string) (*Identity, error) {
+	raw, err := v.keys.verify(ctx, rawIDToken, []string{v.cfg.Audience})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	user, _ := raw[v.cfg.UserClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("id token has no %s claim", v.cfg.UserClaim)
+	}
+
+	groups, err := stringsClaim(raw[v.cfg.GroupsClaim])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s claim: %w", v.cfg.GroupsClaim, err)
+	}
+
+	return &Identity{User: user, Groups: groups}, nil
+}
+
+// Ready fetches the upstream keys.
+func (v *Verifier) Ready(ctx context.Context) error {
+	return v.keys.ready(ctx)
+}
+
+// stringsClaim accepts a list of strings or a single string.
+func stringsClaim(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected value %v", v)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unexpected type %T", value)
+	}
+}
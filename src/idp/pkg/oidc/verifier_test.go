@@ -0,0 +1,252 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpstream is a local OIDC provider serving discovery and keys.
+type fakeUpstream struct {
+	*httptest.Server
+
+	key      *rsa.PrivateKey
+	keyID    string
+	jwksHits int
+	// hold delays the keys response until it is closed, held is signalled
+	// once a request waits
+	hold, held chan struct{}
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	u := &fakeUpstream{key: key, keyID: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   u.URL,
+			"jwks_uri": u.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, _ *http.Request) {
+		if u.hold != nil {
+			u.held <- struct{}{}
+			<-u.hold
+		}
+		u.jwksHits++
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: u.key.Public(), KeyID: u.keyID, Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+
+	u.Server = httptest.NewServer(mux)
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+func (u *fakeUpstream) idToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: u.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", u.keyID),
+	)
+	require.NoError(t, err)
+
+	std := jwt.Claims{
+		Issuer:   u.URL,
+		Subject:  "00u1",
+		Audience: jwt.Audience{"idp-cli"},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	raw, err := jwt.Signed(signer).Claims(std).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+
+	return raw
+}
+
+func (u *fakeUpstream) config() *config.UpstreamConfig {
+	return &config.UpstreamConfig{
+		Issuer:      u.URL,
+		Audience:    "idp-cli",
+		UserClaim:   "email",
+		GroupsClaim: "groups",
+		TokenTTL:    time.Minute,
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	v := NewVerifier(upstream.config(), upstream.Client())
+
+	identity, err := v.Verify(context.Background(), upstream.idToken(t, map[string]any{
+		"email":  "alice@example.com",
+		"groups": []string{"dba", "oncall"},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "user:alice@example.com", identity.ClientID())
+	assert.Equal(t, []string{"group:dba", "group:oncall"}, identity.GroupClientIDs())
+
+	_, err = v.Verify(context.Background(), upstream.idToken(t, map[string]any{"email": "bob@example.com"}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, upstream.jwksHits, "keys are cached")
+}
+
+func TestVerifier_Rejects(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	other := newFakeUpstream(t)
+
+	for name, tc := range map[string]struct {
+		token   func() string
+		wantErr string
+	}{
+		"wrong audience": {
+			token: func() string {
+				return upstream.idToken(t, map[string]any{"email": "alice@example.com", "aud": "other-app"})
+			},
+			wantErr: "invalid audience",
+		},
+		"wrong issuer": {
+			token: func() string {
+				return upstream.idToken(t, map[string]any{"email": "alice@example.com", "iss": "https://evil.example.com"})
+			},
+			wantErr: "invalid issuer",
+		},
+		"expired": {
+			token: func() string {
+				return upstream.idToken(t, map[string]any{"email": "alice@example.com", "exp": time.Now().Add(-time.Hour).Unix()})
+			},
+			wantErr: "expired",
+		},
+		"no user claim": {
+			token: func() string {
+				return upstream.idToken(t, map[string]any{"name": "Alice"})
+			},
+			wantErr: "no email claim",
+		},
+		"malformed groups": {
+			token: func() string {
+				return upstream.idToken(t, map[string]any{"email": "alice@example.com", "groups": 42})
+			},
+			wantErr: "invalid groups claim",
+		},
+		"foreign key": {
+			token: func() string {
+				return other.idToken(t, map[string]any{"email": "alice@example.com", "iss": upstream.URL})
+			},
+			wantErr: "failed to verify token",
+		},
+		"garbage": {
+			token:   func() string { return "not-a-token" },
+			wantErr: "failed to parse token",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			v := NewVerifier(upstream.config(), upstream.Client())
+
+			_, err := v.Verify(context.Background(), tc.token())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestVerifier_RefetchesRotatedKeys(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	v := NewVerifier(upstream.config(), upstream.Client())
+	now := time.Now()
+	v.keys.now = func() time.Time { return now }
+
+	require.NoError(t, v.Ready(context.Background()))
+
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	upstream.key, upstream.keyID = newKey, "key-2"
+	rotated := upstream.idToken(t, map[string]any{"email": "alice@example.com"})
+
+	_, err = v.Verify(context.Background(), rotated)
+	require.Error(t, err, "keys are not refetched too often")
+
+	now = now.Add(time.Minute)
+	_, err = v.Verify(context.Background(), rotated)
+	require.NoError(t, err)
+}
+
+func TestVerifier_ReadyFetchesKeysOnce(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	v := NewVerifier(upstream.config(), upstream.Client())
+
+	for range 3 {
+		require.NoError(t, v.Ready(context.Background()))
+	}
+	assert.Equal(t, 1, upstream.jwksHits)
+}
+
+func TestVerifier_VerifiesKnownKeysDuringFetch(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	v := NewVerifier(upstream.config(), upstream.Client())
+	now := time.Now()
+	v.keys.now = func() time.Time { return now }
+	require.NoError(t, v.Ready(context.Background()))
+	known := upstream.idToken(t, map[string]any{"email": "alice@example.com"})
+
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	upstream.key, upstream.keyID = newKey, "key-2"
+	rotated := upstream.idToken(t, map[string]any{"email": "bob@example.com"})
+
+	upstream.hold, upstream.held = make(chan struct{}), make(chan struct{})
+	release := sync.OnceFunc(func() { close(upstream.hold) })
+	t.Cleanup(release)
+	now = now.Add(time.Minute)
+	fetched := make(chan error)
+	go func() {
+		_, err := v.Verify(context.Background(), rotated)
+		fetched <- err
+	}()
+	<-upstream.held
+
+	verified := make(chan error)
+	go func() {
+		_, err := v.Verify(context.Background(), known)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("verification of a known key waits for the fetch")
+	}
+
+	release()
+	require.NoError(t, <-fetched)
+}
+
+func TestVerifier_ReadyFailsWhenUpstreamIsDown(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	v := NewVerifier(upstream.config(), upstream.Client())
+	upstream.Close()
+
+	assert.Error(t, v.Ready(context.Background()))
+}
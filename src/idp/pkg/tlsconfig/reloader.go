@@ -0,0 +1,199 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+)
+
+// Reloader keeps the server certificate and the client CA bundle in sync with
+// the files on disk, so rotated certificates are served without a restart.
+type Reloader struct {
+	cfg        config.TLSConfig
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func NewReloader(cfg config.TLSConfig) (*Reloader, error) {
+	clientAuth, err := parseClientAuth(cfg.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reloader{
+		cfg:        cfg,
+		clientAuth: clientAuth,
+		modTimes:   make(map[string]time.Time),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate, key and client CA files unconditionally.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls key pair: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		if clientCAs, err = LoadCertPool(r.cfg.ClientCAFile); err != nil {
+			return fmt.Errorf("failed to load client ca: %w", err)
+		}
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, path := range r.files() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Run polls the files and reloads them on change until ctx is done, a failed
+// reload keeps serving the previous certificate.
+func (r *Reloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			log.Printf("failed to reload tls certificates: %v", err)
+			continue
+		}
+
+		log.Printf("tls certificates reloaded from %s", r.cfg.CertFile)
+	}
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+
+	return files
+}
+
+// TLSConfig returns a server config which resolves the current certificate and
+// client CAs on every handshake. The per handshake config is a clone of the
+// returned one, so ALPN protocols negotiated by it are kept.
+func (r *Reloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		clientCfg := base.Clone()
+		clientCfg.Certificates = []tls.Certificate{*r.cert}
+		clientCfg.ClientAuth = r.clientAuth
+		clientCfg.ClientCAs = r.clientCAs
+
+		return clientCfg, nil
+	}
+
+	return cfg
+}
+
+// Ready fails when the served certificate has expired.
+func (r *Reloader) Ready(_ context.Context) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil || len(r.cert.Certificate) == 0 {
+		return errors.New("no tls certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(r.cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse tls certificate: %w", err)
+	} else if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("tls certificate expired at %s", leaf.NotAfter)
+	}
+
+	return nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+func parseClientAuth(clientAuth string) (tls.ClientAuthType, error) {
+	switch clientAuth {
+	case "", config.ClientAuthNone:
+		return tls.NoClientCert, nil
+	case config.ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven, nil
+	case config.ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth %q", clientAuth)
+	}
+}
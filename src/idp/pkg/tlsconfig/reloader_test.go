@@ -0,0 +1,212 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/testpki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+}
+
+type testPKI struct {
+	*testpki.PKI
+	tlsCfg config.TLSConfig
+}
+
+func newTestPKI(t *testing.T, clientAuth string) *testPKI {
+	t.Helper()
+
+	pki := testpki.New(t)
+	certPEM, keyPEM := pki.Issue(t, "idp-1", x509.ExtKeyUsageServerAuth)
+
+	tlsCfg := config.TLSConfig{
+		CertFile:       filepath.Join(pki.Dir, "tls.crt"),
+		KeyFile:        filepath.Join(pki.Dir, "tls.key"),
+		ClientCAFile:   pki.CAFile,
+		ClientAuth:     clientAuth,
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	writeFile(t, tlsCfg.CertFile, certPEM)
+	writeFile(t, tlsCfg.KeyFile, keyPEM)
+
+	return &testPKI{PKI: pki, tlsCfg: tlsCfg}
+}
+
+func startServer(t *testing.T, reloader *Reloader) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	ts.TLS = reloader.TLSConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func (p *testPKI) client(t *testing.T, withCert bool) *http.Client {
+	t.Helper()
+
+	tlsCfg := &tls.Config{RootCAs: p.CertPool()}
+
+	if withCert {
+		certPEM, keyPEM := p.Issue(t, "service-a", x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		require.NoError(t, err)
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}, Timeout: 5 * time.Second}
+}
+
+func serverCN(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloader_ServesHTTPS(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthNone)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	ts := startServer(t, reloader)
+
+	assert.Equal(t, "idp-1", serverCN(t, pki.client(t, false), ts.URL))
+
+	_, err = http.Get(ts.URL)
+	assert.Error(t, err, "server must not be trusted without the CA bundle")
+}
+
+func TestReloader_NegotiatesHTTP2(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthNone)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	ts.TLS = reloader.TLSConfig()
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pki.CertPool()},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+	assert.Equal(t, 2, resp.ProtoMajor)
+}
+
+func TestReloader_RequireClientCert(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthRequire)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	ts := startServer(t, reloader)
+
+	_, err = pki.client(t, false).Get(ts.URL)
+	assert.Error(t, err)
+
+	resp, err := pki.client(t, true).Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReloader_RequestClientCert(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthRequest)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	ts := startServer(t, reloader)
+
+	resp, err := pki.client(t, false).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = pki.client(t, true).Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReloader_ReloadsChangedCertificate(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthNone)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx)
+
+	ts := startServer(t, reloader)
+	assert.Equal(t, "idp-1", serverCN(t, pki.client(t, false), ts.URL))
+
+	certPEM, keyPEM := pki.Issue(t, "idp-2", x509.ExtKeyUsageServerAuth)
+	writeFile(t, pki.tlsCfg.KeyFile, keyPEM)
+	writeFile(t, pki.tlsCfg.CertFile, certPEM)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(pki.tlsCfg.CertFile, future, future))
+	require.NoError(t, os.Chtimes(pki.tlsCfg.KeyFile, future, future))
+
+	assert.Eventually(t, func() bool {
+		// new client per attempt, so the handshake is not reused
+		return serverCN(t, pki.client(t, false), ts.URL) == "idp-2"
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestReloader_BrokenReloadKeepsCertificate(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthNone)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+
+	writeFile(t, pki.tlsCfg.CertFile, []byte("garbage"))
+	require.Error(t, reloader.Reload())
+
+	ts := startServer(t, reloader)
+	assert.Equal(t, "idp-1", serverCN(t, pki.client(t, false), ts.URL))
+}
+
+func TestReloader_Ready(t *testing.T) {
+	pki := newTestPKI(t, config.ClientAuthNone)
+	reloader, err := NewReloader(pki.tlsCfg)
+	require.NoError(t, err)
+	assert.NoError(t, reloader.Ready(context.Background()))
+
+	certPEM, keyPEM := pki.IssueUntil(t, "idp-expired", time.Now().Add(-time.Minute), x509.ExtKeyUsageServerAuth)
+	writeFile(t, pki.tlsCfg.CertFile, certPEM)
+	writeFile(t, pki.tlsCfg.KeyFile, keyPEM)
+	require.NoError(t, reloader.Reload())
+
+	err = reloader.Ready(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+func TestSetup_FileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), config.TracingConfig{
+		Exporter:    config.TracingExporterFile,
+		File:        path,
+		SampleRatio: 1,
+	}, "idp-test")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/token", nil)
+	req.Header.Set("traceparent", traceparent)
+
+	_, span := StartServerSpan(req, "TokenHandler")
+	assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+	span.End()
+
+	require.NoError(t, shutdown(context.Background()))
+
+	spans, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(spans), `"Name":"TokenHandler"`)
+	assert.Contains(t, string(spans), traceID)
+	assert.Contains(t, string(spans), "idp-test")
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), config.TracingConfig{Exporter: "jaeger"}, "idp-test")
+	assert.ErrorContains(t, err, "unknown tracing exporter")
+}
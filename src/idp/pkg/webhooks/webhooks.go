@@ -0,0 +1,399 @@
+// Package webhooks posts IdP events to the configured endpoints. Payloads are
+// signed with HMAC-SHA256 of the endpoint secret, failed deliveries are
+// retried with exponential backoff and dead-lettered after the last attempt.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+)
+
+// Headers of a delivery. The signature is "sha256=" and the hex HMAC of the
+// timestamp, a dot and the body, see Sign.
+const (
+	EventHeader     = "X-IdP-Event"
+	DeliveryHeader  = "X-IdP-Delivery"
+	TimestampHeader = "X-IdP-Timestamp"
+	SignatureHeader = "X-IdP-Signature"
+)
+
+const (
+	deliveryWorkers = 4
+	// deadLetterTimeout bounds storing a dead letter, it is also done on
+	// shutdown when the dispatcher context is already done.
+	deadLetterTimeout = 5 * time.Second
+	// clientTimeout bounds a delivery of the default client, the timeout of
+	// the endpoint is usually shorter.
+	clientTimeout = 30 * time.Second
+)
+
+// Event is the payload of a delivery, receivers deduplicate redeliveries by
+// its id.
+type Event struct {
+	ID    string    `json:"id"`
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Realm string    `json:"realm"`
+	Data  any       `json:"data"`
+}
+
+// DeadLetterStore keeps the deliveries which ran out of attempts.
+type DeadLetterStore interface {
+	Add(ctx context.Context, delivery *db.WebhookDelivery) error
+	List(ctx context.Context, limit int) ([]db.WebhookDelivery, error)
+	Take(ctx context.Context, id string) (*db.WebhookDelivery, error)
+}
+
+type endpoint struct {
+	cfg    *config.WebhookConfig
+	secret []byte
+}
+
+// permanentError is a response which is not retried, e.g. 400 or 404.
+type permanentError struct {
+	status int
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("endpoint rejected the delivery with status %d", e.status)
+}
+
+// Dispatcher queues the deliveries of published events in memory of the
+// replica, only dead letters are shared by the store.
+type Dispatcher struct {
+	endpoints   []*endpoint
+	deadLetters DeadLetterStore
+	client      *http.Client
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	queue chan *db.WebhookDelivery
+
+	mu       sync.Mutex
+	stopped  bool
+	retrying map[*db.WebhookDelivery]*time.Timer
+}
+
+// NewDispatcher returns a dispatcher sending with the client, the default one
+// does not follow redirects: a 3xx response is a rejected delivery.
+func NewDispatcher(cfg config.WebhooksConfig, deadLetters DeadLetterStore, client *http.Client) (*Dispatcher, error) {
+	if client == nil {
+		client = &http.Client{
+			Timeout: clientTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	endpoints := make([]*endpoint, 0, len(cfg.Endpoints))
+	for _, endpointCfg := range cfg.Endpoints {
+		secret := endpointCfg.Secret
+		if endpointCfg.SecretFile != "" {
+			raw, err := os.ReadFile(endpointCfg.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read secret of webhook %s: %w", endpointCfg.Name, err)
+			}
+			secret = strings.TrimSpace(string(raw))
+		}
+
+		endpoints = append(endpoints, &endpoint{cfg: endpointCfg, secret: []byte(secret)})
+	}
+
+	return &Dispatcher{
+		endpoints:   endpoints,
+		deadLetters: deadLetters,
+		client:      client,
+		minBackoff:  cfg.MinBackoff,
+		maxBackoff:  cfg.MaxBackoff,
+		queue:       make(chan *db.WebhookDelivery, cfg.QueueSize),
+		retrying:    make(map[*db.WebhookDelivery]*time.Timer),
+	}, nil
+}
+
+// Sign returns the signature header of the body sent at the timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a received delivery. Receivers should
+// also reject timestamps too far in the past to prevent replays.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Publish queues the event for every endpoint it is sent to, it never blocks.
+func (d *Dispatcher) Publish(event Event) {
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	var payload []byte
+	for _, endpoint := range d.endpoints {
+		if !endpoint.cfg.Sends(event.Type, event.Realm) {
+			continue
+		}
+
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(event); err != nil {
+				log.Printf("failed to marshal webhook event %s: %v", event.Type, err)
+				return
+			}
+		}
+
+		d.enqueue(&db.WebhookDelivery{
+			ID:        newID(),
+			Webhook:   endpoint.cfg.Name,
+			Event:     event.Type,
+			Payload:   payload,
+			CreatedAt: time.Now(),
+		})
+	}
+}
+
+// Run sends the queued deliveries until ctx is done. Deliveries still queued
+// or waiting for a retry then are dead-lettered, so they can be redelivered
+// after a restart.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range deliveryWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	d.stopped = true
+	var pending []*db.WebhookDelivery
+	for delivery, timer := range d.retrying {
+		if timer.Stop() {
+			pending = append(pending, delivery)
+		}
+	}
+	clear(d.retrying)
+	d.mu.Unlock()
+
+drain:
+	for {
+		select {
+		case delivery := <-d.queue:
+			pending = append(pending, delivery)
+		default:
+			break drain
+		}
+	}
+
+	for _, delivery := range pending {
+		d.deadLetter(delivery, "dispatcher stopped")
+	}
+	if len(pending) > 0 {
+		log.Printf("webhooks stopped, %d pending deliveries dead-lettered", len(pending))
+	}
+}
+
+// DeadLetters returns up to limit latest dead-lettered deliveries.
+func (d *Dispatcher) DeadLetters(ctx context.Context, limit int) ([]db.WebhookDelivery, error) {
+	return d.deadLetters.List(ctx, limit)
+}
+
+// Redeliver moves the dead-lettered delivery back to the queue, it gets all
+// the attempts of the webhook again.
+func (d *Dispatcher) Redeliver(ctx context.Context, id string) (*db.WebhookDelivery, error) {
+	delivery, err := d.deadLetters.Take(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.FailedAt = nil
+	// the queued copy is updated by the workers while the caller reads this one
+	queued := *delivery
+	d.enqueue(&queued)
+
+	return delivery, nil
+}
+
+// enqueue checks the stop and queues the delivery under the lock, Run drains
+// the queue only after the stop, so a queued delivery is never lost.
+func (d *Dispatcher) enqueue(delivery *db.WebhookDelivery) {
+	d.mu.Lock()
+	reason := "dispatcher stopped"
+	if !d.stopped {
+		select {
+		case d.queue <- delivery:
+			reason = ""
+		default:
+			reason = "delivery queue is full"
+		}
+	}
+	d.mu.Unlock()
+
+	if reason != "" {
+		d.deadLetter(delivery, reason)
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *db.WebhookDelivery) {
+	var endpoint *endpoint
+	for _, candidate := range d.endpoints {
+		if candidate.cfg.Name == delivery.Webhook {
+			endpoint = candidate
+		}
+	}
+	if endpoint == nil {
+		// the webhook of a redelivered dead letter was removed from the config
+		d.deadLetter(delivery, "webhook is not configured")
+		return
+	}
+
+	delivery.Attempts++
+	err := d.send(ctx, endpoint, delivery)
+	if err == nil {
+		log.Printf("webhook delivered, webhook: %s, event: %s, attempt: %d", delivery.Webhook, delivery.Event, delivery.Attempts)
+		return
+	}
+
+	log.Printf("failed to deliver webhook, webhook: %s, event: %s, attempt: %d: %v", delivery.Webhook, delivery.Event, delivery.Attempts, err)
+	delivery.LastError = err.Error()
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || delivery.Attempts >= endpoint.cfg.MaxAttempts {
+		d.deadLetter(delivery, "")
+		return
+	}
+
+	d.retry(delivery, d.backoff(delivery.Attempts))
+}
+
+func (d *Dispatcher) send(ctx context.Context, endpoint *endpoint, delivery *db.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, endpoint.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.cfg.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "idp-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(endpoint.secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	default:
+		return &permanentError{status: resp.StatusCode}
+	}
+}
+
+// backoff returns the delay after the attempt: the minimum backoff doubled
+// with every previous attempt, up to the maximum one.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.minBackoff
+	for range attempt - 1 {
+		if delay >= d.maxBackoff/2 {
+			return d.maxBackoff
+		}
+		delay *= 2
+	}
+
+	return min(delay, d.maxBackoff)
+}
+
+func (d *Dispatcher) retry(delivery *db.WebhookDelivery, delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		go d.deadLetter(delivery, "dispatcher stopped")
+		return
+	}
+
+	d.retrying[delivery] = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		_, ok := d.retrying[delivery]
+		delete(d.retrying, delivery)
+		d.mu.Unlock()
+
+		if ok {
+			d.enqueue(delivery)
+		}
+	})
+}
+
+func (d *Dispatcher) deadLetter(delivery *db.WebhookDelivery, reason string) {
+	if reason != "" {
+		delivery.LastError = reason
+	}
+	failedAt := time.Now()
+	delivery.FailedAt = &failedAt
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+
+	if err := d.deadLetters.Add(ctx, delivery); err != nil {
+		log.Printf("failed to dead-letter webhook delivery %s of %s: %v", delivery.ID, delivery.Webhook, err)
+		return
+	}
+	log.Printf("webhook delivery dead-lettered, webhook: %s, event: %s, attempts: %d: %s", delivery.Webhook, delivery.Event, delivery.Attempts, delivery.LastError)
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,280 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+)
+
+const testSecret = "s3cr3t"
+
+type received struct {
+	event    string
+	delivery string
+	body     []byte
+}
+
+// receiver is a webhook endpoint answering with the statuses in order, the
+// last one is repeated.
+type receiver struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	received []received
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	rcv := &receiver{t: t, statuses: statuses}
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+
+	return rcv, server
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(rcv.t, err)
+	assert.True(rcv.t, Verify([]byte(testSecret), r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)), "signature must be valid")
+
+	rcv.mu.Lock()
+	rcv.received = append(rcv.received, received{event: r.Header.Get(EventHeader), delivery: r.Header.Get(DeliveryHeader), body: body})
+	status := rcv.statuses[min(len(rcv.received), len(rcv.statuses))-1]
+	rcv.mu.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (rcv *receiver) requests() []received {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return append([]received(nil), rcv.received...)
+}
+
+func (rcv *receiver) respond(statuses ...int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.statuses = append(make([]int, len(rcv.received)), statuses...)
+}
+
+func testConfig(endpoints ...*config.WebhookConfig) config.WebhooksConfig {
+	for _, endpoint := range endpoints {
+		endpoint.Secret = testSecret
+		endpoint.Timeout = time.Second
+		if endpoint.MaxAttempts == 0 {
+			endpoint.MaxAttempts = 3
+		}
+	}
+
+	return config.WebhooksConfig{
+		Endpoints:  endpoints,
+		QueueSize:  10,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+	}
+}
+
+func startDispatcher(t *testing.T, cfg config.WebhooksConfig) (*Dispatcher, *db.DeadLetters) {
+	deadLetters := db.NewDeadLetters()
+	dispatcher, err := NewDispatcher(cfg, deadLetters, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return dispatcher, deadLetters
+}
+
+func waitDeadLetters(t *testing.T, deadLetters *db.DeadLetters, n int) []db.WebhookDelivery {
+	var deliveries []db.WebhookDelivery
+	require.Eventually(t, func() bool {
+		deliveries, _ = deadLetters.List(context.Background(), 10)
+		return len(deliveries) >= n
+	}, 5*time.Second, 5*time.Millisecond)
+
+	return deliveries
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"e1"}`)
+	signature := Sign([]byte(testSecret), "1767225600", body)
+
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+	assert.True(t, Verify([]byte(testSecret), "1767225600", body, signature))
+	assert.False(t, Verify([]byte("other"), "1767225600", body, signature))
+	assert.False(t, Verify([]byte(testSecret), "1767225601", body, signature))
+	assert.False(t, Verify([]byte(testSecret), "1767225600", []byte(`{"id":"e2"}`), signature))
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	rcv, server := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent)
+	dispatcher, deadLetters := startDispatcher(t, testConfig(&config.WebhookConfig{Name: "chat", URL: server.URL}))
+
+	dispatcher.Publish(Event{Type: config.WebhookEventKeyRotated, Realm: "a", Data: map[string]string{"key_id": "kid-2"}})
+
+	require.Eventually(t, func() bool { return len(rcv.requests()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	requests := rcv.requests()
+	for _, req := range requests {
+		assert.Equal(t, config.WebhookEventKeyRotated, req.event)
+		assert.Equal(t, requests[0].delivery, req.delivery)
+		assert.Equal(t, requests[0].body, req.body)
+	}
+
+	var event map[string]any
+	require.NoError(t, json.Unmarshal(requests[0].body, &event))
+	assert.NotEmpty(t, event["id"])
+	assert.Equal(t, config.WebhookEventKeyRotated, event["type"])
+	assert.Equal(t, "a", event["realm"])
+	assert.Equal(t, map[string]any{"key_id": "kid-2"}, event["data"])
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, rcv.requests(), 3)
+	deliveries, err := deadLetters.List(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func TestDispatcher_DeadLetters(t *testing.T) {
+	failing, failingServer := newReceiver(t, http.StatusInternalServerError)
+	rejecting, rejectingServer := newReceiver(t, http.StatusBadRequest)
+	dispatcher, deadLetters := startDispatcher(t, testConfig(
+		&config.WebhookConfig{Name: "failing", URL: failingServer.URL, MaxAttempts: 2},
+		&config.WebhookConfig{Name: "rejecting", URL: rejectingServer.URL},
+	))
+
+	dispatcher.Publish(Event{Type: config.WebhookEventTokenDenied, Realm: "a"})
+
+	deliveries := waitDeadLetters(t, deadLetters, 2)
+	byWebhook := make(map[string]db.WebhookDelivery)
+	for _, delivery := range deliveries {
+		byWebhook[delivery.Webhook] = delivery
+	}
+
+	assert.Equal(t, 2, byWebhook["failing"].Attempts)
+	assert.Equal(t, "endpoint responded with status 500", byWebhook["failing"].LastError)
+	assert.Len(t, failing.requests(), 2)
+
+	// a rejected delivery is not retried
+	assert.Equal(t, 1, byWebhook["rejecting"].Attempts)
+	assert.Equal(t, "endpoint rejected the delivery with status 400", byWebhook["rejecting"].LastError)
+	assert.Len(t, rejecting.requests(), 1)
+	assert.NotNil(t, byWebhook["rejecting"].FailedAt)
+
+	failing.respond(http.StatusOK)
+	redelivered, err := dispatcher.Redeliver(context.Background(), byWebhook["failing"].ID)
+	require.NoError(t, err)
+	assert.Zero(t, redelivered.Attempts)
+
+	require.Eventually(t, func() bool { return len(failing.requests()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, failing.requests()[0].body, failing.requests()[2].body)
+
+	_, err = dispatcher.Redeliver(context.Background(), byWebhook["failing"].ID)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	deliveries, err = dispatcher.DeadLetters(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "rejecting", deliveries[0].Webhook)
+}
+
+func TestDispatcher_Filters(t *testing.T) {
+	rcv, server := newReceiver(t, http.StatusOK)
+	dispatcher, _ := startDispatcher(t, testConfig(&config.WebhookConfig{
+		Name:   "chat",
+		URL:    server.URL,
+		Events: []string{config.WebhookEventPermissionsUpdated},
+		Realms: []string{"a"},
+	}))
+
+	dispatcher.Publish(Event{Type: config.WebhookEventTokenDenied, Realm: "a"})
+	dispatcher.Publish(Event{Type: config.WebhookEventPermissionsUpdated, Realm: "b"})
+	dispatcher.Publish(Event{Type: config.WebhookEventPermissionsUpdated, Realm: "a"})
+
+	require.Eventually(t, func() bool { return len(rcv.requests()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	requests := rcv.requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, config.WebhookEventPermissionsUpdated, requests[0].event)
+}
+
+func TestDispatcher_Redirect(t *testing.T) {
+	target, targetServer := newReceiver(t, http.StatusOK)
+	redirecting := httptest.NewServer(http.RedirectHandler(targetServer.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirecting.Close)
+
+	dispatcher, deadLetters := startDispatcher(t, testConfig(&config.WebhookConfig{Name: "chat", URL: redirecting.URL}))
+	dispatcher.Publish(Event{Type: config.WebhookEventTokenRevoked, Realm: "a"})
+
+	deliveries := waitDeadLetters(t, deadLetters, 1)
+	assert.Equal(t, "endpoint rejected the delivery with status 307", deliveries[0].LastError)
+	assert.Empty(t, target.requests(), "redirects are not followed")
+}
+
+func TestDispatcher_Stop(t *testing.T) {
+	_, server := newReceiver(t, http.StatusServiceUnavailable)
+	cfg := testConfig(&config.WebhookConfig{Name: "chat", URL: server.URL, MaxAttempts: 5})
+	cfg.MinBackoff, cfg.MaxBackoff = time.Hour, time.Hour
+	deadLetters := db.NewDeadLetters()
+	dispatcher, err := NewDispatcher(cfg, deadLetters, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(done)
+	}()
+
+	dispatcher.Publish(Event{Type: config.WebhookEventTokenRevoked, Realm: "a"})
+	// the first attempt fails and the delivery waits for a retry
+	require.Eventually(t, func() bool {
+		dispatcher.mu.Lock()
+		defer dispatcher.mu.Unlock()
+		return len(dispatcher.retrying) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+
+	deliveries, err := deadLetters.List(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "dispatcher stopped", deliveries[0].LastError)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+
+	// events published after the stop are dead-lettered right away
+	dispatcher.Publish(Event{Type: config.WebhookEventTokenRevoked, Realm: "a"})
+	deliveries, err = deadLetters.List(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+}
+
+func TestDispatcher_Backoff(t *testing.T) {
+	dispatcher := &Dispatcher{minBackoff: time.Second, maxBackoff: 5 * time.Second}
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1))
+	assert.Equal(t, 2*time.Second, dispatcher.backoff(2))
+	assert.Equal(t, 4*time.Second, dispatcher.backoff(3))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(4))
+	assert.Equal(t, 5*time.Second, dispatcher.backoff(100))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/perpetua1g0d/bmstu-diploma/idp/handlers"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/config"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/db"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/events"
+	"github.com/perpetua1g0d/bmstu-diploma/idp/pkg/webhooks"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/dpop"
+	"github.com/redis/go-redis/v9"
+)
+
+// stores builds the state of the configured backend: with redis it is shared
+// by all replicas, in memory every replica has its own.
+type stores struct {
+	cfg   *config.Config
+	redis *redis.Client
+
+	repositories map[string]handlers.Repository
+	brokers      map[string]*events.Broker
+	requests     map[string]handlers.AccessRequestStore
+	audits       map[string]handlers.AuditLog
+	usages       map[string]handlers.GrantUsage
+	snapshots    map[string]handlers.SnapshotStore
+}
+
+func newStores(ctx context.Context, cfg *config.Config) (*stores, error) {
+	s := &stores{
+		cfg:          cfg,
+		repositories: make(map[string]handlers.Repository),
+		brokers:      make(map[string]*events.Broker),
+		requests:     make(map[string]handlers.AccessRequestStore),
+		audits:       make(map[string]handlers.AuditLog),
+		usages:       make(map[string]handlers.GrantUsage),
+		snapshots:    make(map[string]handlers.SnapshotStore),
+	}
+
+	if cfg.Store.Backend == config.StoreBackendRedis {
+		client, err := db.NewRedisClient(cfg.Store.DSN)
+		if err != nil {
+			return nil, err
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, cfg.Server.ReadinessTimeout)
+		defer cancel()
+		if err := client.Ping(pingCtx).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to connect to redis: %w", err)
+		}
+
+		s.redis = client
+	}
+
+	return s, nil
+}
+
+// Namespace returns the repository and the events broker shared by the realms
+// of a permissions namespace.
+func (s *stores) Namespace(ctx context.Context, namespace string) (handlers.Repository, *events.Broker, error) {
+	if repository, ok := s.repositories[namespace]; ok {
+		return repository, s.brokers[namespace], nil
+	}
+
+	nsPermissions := s.cfg.Store.Permissions[namespace]
+	if nsPermissions == nil {
+		nsPermissions = make(map[string]map[string][]string)
+	}
+
+	broker := handlers.NewEventsBroker()
+
+	var repository handlers.Repository
+	if s.redis == nil {
+		repository = db.NewRepository(nsPermissions)
+	} else {
+		redisRepository := db.NewRedisRepository(s.redis, namespace)
+		if err := redisRepository.Seed(ctx, nsPermissions); err != nil {
+			return nil, nil, err
+		}
+
+		// changes made on other replicas reach the subscribers of this one
+		go redisRepository.Run(ctx, func(change db.PermissionChange) {
+			broker.Publish(events.PermissionEvent{
+				Client:     change.Client,
+				Scope:      change.Scope,
+				Roles:      change.Roles,
+				Version:    change.Version,
+				MinVersion: change.MinVersion,
+				Time:       time.Now(),
+			})
+		})
+		repository = redisRepository
+	}
+
+	s.repositories[namespace] = repository
+	s.brokers[namespace] = broker
+
+	return repository, broker, nil
+}
+
+// AccessRequests returns the access requests and the audit trail shared by
+// the realms of a permissions namespace.
+func (s *stores) AccessRequests(namespace string) (handlers.AccessRequestStore, handlers.AuditLog) {
+	if requests, ok := s.requests[namespace]; ok {
+		return requests, s.audits[namespace]
+	}
+
+	var requests handlers.AccessRequestStore
+	var audit handlers.AuditLog
+	if s.redis == nil {
+		requests, audit = db.NewAccessRequests(), db.NewAuditLog()
+	} else {
+		requests, audit = db.NewRedisAccessRequests(s.redis, namespace), db.NewRedisAuditLog(s.redis, namespace)
+	}
+
+	s.requests[namespace] = requests
+	s.audits[namespace] = audit
+
+	return requests, audit
+}
+
+// Usage returns the grants usage shared by the realms of a permissions
+// namespace.
+func (s *stores) Usage(namespace string) handlers.GrantUsage {
+	if usage, ok := s.usages[namespace]; ok {
+		return usage
+	}
+
+	var usage handlers.GrantUsage
+	if s.redis == nil {
+		usage = db.NewGrantUsage()
+	} else {
+		usage = db.NewRedisGrantUsage(s.redis, namespace)
+	}
+	s.usages[namespace] = usage
+
+	return usage
+}
+
+// Snapshots returns the permission snapshots shared by the realms of a
+// permissions namespace.
+func (s *stores) Snapshots(namespace string) handlers.SnapshotStore {
+	if snapshots, ok := s.snapshots[namespace]; ok {
+		return snapshots
+	}
+
+	var snapshots handlers.SnapshotStore
+	if s.redis == nil {
+		snapshots = db.NewSnapshots()
+	} else {
+		snapshots = db.NewRedisSnapshots(s.redis, namespace)
+	}
+	s.snapshots[namespace] = snapshots
+
+	return snapshots
+}
+
+// DeadLetters returns the dead-lettered webhook deliveries, they are shared
+// by all realms.
+func (s *stores) DeadLetters() webhooks.DeadLetterStore {
+	if s.redis == nil {
+		return db.NewDeadLetters()
+	}
+
+	return db.NewRedisDeadLetters(s.redis)
+}
+
+// KeyHistory returns nil for the in-memory backend, a replica does not know
+// the keys of its previous runs then.
+func (s *stores) KeyHistory() handlers.KeyHistory {
+	if s.redis == nil {
+		return nil
+	}
+
+	return db.NewRedisKeyHistory(s.redis)
+}
+
+// Revocations returns nil for the in-memory backend, the controller keeps its
+// own list then.
+func (s *stores) Revocations(realm *config.Realm) handlers.RevocationList {
+	if s.redis == nil {
+		return nil
+	}
+
+	return db.NewRedisRevocationList(s.redis, realm.Name)
+}
+
+// DPoPReplays returns nil for the in-memory backend, the controller remembers
+// the proofs it accepted itself then.
+func (s *stores) DPoPReplays(realm *config.Realm) dpop.ReplayCache {
+	if s.redis == nil {
+		return nil
+	}
+
+	return db.NewRedisDPoPReplays(s.redis, realm.Name)
+}
+
+// ReferenceTokens returns nil for the in-memory backend, the controller keeps
+// the opaque tokens of the realm itself then.
+func (s *stores) ReferenceTokens(realm *config.Realm) handlers.ReferenceTokenStore {
+	if s.redis == nil {
+		return nil
+	}
+
+	return db.NewRedisReferenceTokens(s.redis, realm.Name)
+}
+
+// RateLimiter returns nil for the in-memory backend or a disabled limit.
+func (s *stores) RateLimiter() handlers.RateLimiter {
+	if s.redis == nil || s.cfg.Limits.TokenRequestsPerMinute <= 0 {
+		return nil
+	}
+
+	return db.NewRedisRateLimiter(s.redis, s.cfg.Limits.TokenRequestsPerMinute, time.Minute)
+}
+
+func (s *stores) Close() {
+	if s.redis == nil {
+		return
+	}
+
+	if err := s.redis.Close(); err != nil {
+		log.Printf("failed to close redis client: %v", err)
+	}
+}
@@ -17,6 +17,20 @@ type Config struct {
 	PostgresUser      string
 	PostgresPassword  string
 	PostgresDB        string
+
+	// TLS to the IdP is opt-in: IdPAddress switches to https, IdPCABundleFile
+	// verifies the IdP certificate and the client certificate answers mTLS.
+	IdPAddress        string
+	IdPCABundleFile   string
+	IdPClientCertFile string
+	IdPClientKeyFile  string
+
+	// TLSCertFile and TLSKeyFile serve the sidecar over https, TLSClientCAFile
+	// verifies the client certificates callers of certificate-bound tokens
+	// present. Without a certificate the sidecar serves plain http.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
 }
 
 var (
@@ -37,6 +51,15 @@ func NewConfig() *Config {
 			PostgresUser:      getEnv("POSTGRES_USER", "not_found_env_db_user"),
 			PostgresPassword:  getEnv("POSTGRES_PASSWORD", ""),
 			PostgresDB:        getEnv("POSTGRES_DB", "not_found_postgres_db"),
+
+			IdPAddress:        getEnv("IDP_ADDRESS", ""),
+			IdPCABundleFile:   getEnv("IDP_CA_BUNDLE_FILE", ""),
+			IdPClientCertFile: getEnv("IDP_CLIENT_CERT_FILE", ""),
+			IdPClientKeyFile:  getEnv("IDP_CLIENT_KEY_FILE", ""),
+
+			TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+			TLSClientCAFile: getEnv("TLS_CLIENT_CA_FILE", ""),
 		}
 	})
 	log.Printf("sidecar config: %+v", instance)
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/perpetua1g0d/bmstu-diploma/postgres-sidecar/config"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
 	auth_verifier "github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/verifier"
 
 	_ "github.com/lib/pq"
@@ -25,8 +26,15 @@ func NewQueryHandler(ctx context.Context, cfg *config.Config, db *sql.DB, tokenV
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		// log.Printf("start process /query request")
 
+		// the request context carries the caller trace, see VerifySQLMiddleware
+		queryCtx, span := tracing.Tracer().Start(r.Context(), "QueryHandler")
+		var err error
+		defer func() {
+			tracing.End(span, err)
+		}()
+
 		var req QueryRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
 			respondError(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
 			return
 		}
@@ -34,7 +42,7 @@ func NewQueryHandler(ctx context.Context, cfg *config.Config, db *sql.DB, tokenV
 		// log.Printf("decoded request body: %+v", req)
 
 		start := time.Now()
-		rows, err := db.Query(req.SQL, req.Params...)
+		rows, err := db.QueryContext(queryCtx, req.SQL, req.Params...)
 		if err != nil {
 			respondError(w, fmt.Sprintf("query failed: %v", err), http.StatusBadRequest)
 			return
@@ -48,7 +56,7 @@ func NewQueryHandler(ctx context.Context, cfg *config.Config, db *sql.DB, tokenV
 		dbQueryDuration.WithLabelValues(operation, cfg.ServiceName).Observe(durationMs)
 		dbQueryTypes.WithLabelValues(operation, cfg.ServiceName).Inc()
 
-		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		if err = json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":  "success",
 			"latency": time.Since(start).String(),
 		}); err != nil {
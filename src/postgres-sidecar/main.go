@@ -10,6 +10,7 @@ import (
 
 	"github.com/perpetua1g0d/bmstu-diploma/postgres-sidecar/config"
 	"github.com/perpetua1g0d/bmstu-diploma/postgres-sidecar/handlers"
+	"github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/tracing"
 	auth_verifier "github.com/perpetua1g0d/bmstu-diploma/src/auth-client/pkg/verifier"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -39,7 +40,17 @@ func main() {
 
 	cfg := config.NewConfig()
 
-	verifier, err := auth_verifier.NewVerifier(ctx, cfg.ServiceName, cfg.VerifyAuthEnabled)
+	tracingCfg, err := tracing.ConfigFromEnv(cfg.ServiceName)
+	if err != nil {
+		log.Fatalf("failed to read tracing config: %v", err)
+	}
+	shutdownTracing, err := tracing.Setup(ctx, tracingCfg)
+	if err != nil {
+		log.Fatalf("failed to setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	verifier, err := auth_verifier.NewVerifier(ctx, cfg.ServiceName, cfg.VerifyAuthEnabled, verifierOptions(cfg)...)
 	if err != nil {
 		log.Fatalf("failed to create verifier: %v", err)
 	}
@@ -66,8 +77,27 @@ func main() {
 
 	mux.HandleFunc(cfg.ServiceEndpoint, handlers.NewQueryHandler(ctx, cfg, db, verifier))
 
-	log.Printf("Starting %s on :8080 (verify: %v)", cfg.ServiceName, cfg.VerifyAuthEnabled)
-	log.Fatal(http.ListenAndServe(":8080", mux)) // root handler promhttp.Handler()
+	log.Printf("Starting %s on :8080 (verify: %v, tls: %v)", cfg.ServiceName, cfg.VerifyAuthEnabled, cfg.TLSCertFile != "")
+	log.Fatal(serve(cfg, mux))
+}
+
+// serve listens on :8080, over TLS if a certificate is configured. Tokens
+// bound to a client certificate are only accepted over TLS, where the caller
+// presents the certificate.
+func serve(cfg *config.Config, handler http.Handler) error {
+	srv := &http.Server{Addr: ":8080", Handler: handler}
+	if cfg.TLSCertFile == "" {
+		log.Printf("no tls certificate is configured, certificate-bound tokens are rejected")
+		return srv.ListenAndServe()
+	}
+
+	tlsCfg, err := auth_verifier.ServerTLSConfig(cfg.TLSClientCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to setup tls: %w", err)
+	}
+	srv.TLSConfig = tlsCfg
+
+	return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
 }
 
 func collectDBMetrics(db *sql.DB, dbName, service string) {
@@ -93,3 +123,19 @@ func updateDBMetrics(db *sql.DB, dbName, service string) {
 
 	// log.Printf("db metrics updated (sz=%d, idle=%d, open=%d).", size, idle, opened)
 }
+
+// verifierOptions enables TLS to the IdP when it is configured.
+func verifierOptions(cfg *config.Config) []auth_verifier.Option {
+	var opts []auth_verifier.Option
+	if cfg.IdPAddress != "" {
+		opts = append(opts, auth_verifier.WithIdPAddress(cfg.IdPAddress))
+	}
+	if cfg.IdPCABundleFile != "" {
+		opts = append(opts, auth_verifier.WithCABundle(cfg.IdPCABundleFile))
+	}
+	if cfg.IdPClientCertFile != "" {
+		opts = append(opts, auth_verifier.WithClientCertificate(cfg.IdPClientCertFile, cfg.IdPClientKeyFile))
+	}
+
+	return opts
+}
@@ -18,17 +18,17 @@ k3d cluster create bmstucluster \
 # This is useful for keeping the Docker tools and images associated with the cluster for later use.
 
 # services
-docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/business-service:latest ./business-service
+docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/business-service:latest -f ./business-service/Dockerfile .
 docker push ghcr.io/perpetua1g0d/bmstu-diploma/business-service:latest
 k3d image import ghcr.io/perpetua1g0d/bmstu-diploma/business-service:latest -c bmstucluster --keep-tools
 
 # idp
-docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/idp:latest ./idp
+docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/idp:latest -f ./idp/Dockerfile .
 docker push ghcr.io/perpetua1g0d/bmstu-diploma/idp:latest
 k3d image import ghcr.io/perpetua1g0d/bmstu-diploma/idp:latest -c bmstucluster --keep-tools
 
 # main infra servies with sidecars:
-docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/postgres-sidecar:latest ./postgres-sidecar
+docker build -t ghcr.io/perpetua1g0d/bmstu-diploma/postgres-sidecar:latest -f ./postgres-sidecar/Dockerfile .
 docker push ghcr.io/perpetua1g0d/bmstu-diploma/postgres-sidecar:latest
 k3d image import ghcr.io/perpetua1g0d/bmstu-diploma/postgres-sidecar:latest -c bmstucluster --keep-tools
 
@@ -40,7 +40,7 @@ kubectl apply -f .k8s/namespaces/
 
 kubectl apply -f .k8s/monitoring/grafana-dashboards.yaml
 
-namespaces=("postgres-a" "postgres-b" "idp" "admin-panel" "monitoring" "service-a" "service-b")
+namespaces=("postgres-a" "postgres-b" "idp" "auth-ui" "monitoring" "service-a" "service-b")
 for ns in "${namespaces[@]}"; do
   if ! kubectl get secret ghcr-secret -n "$ns" >/dev/null 2>&1; then
     kubectl create secret docker-registry ghcr-secret \
@@ -99,7 +99,7 @@ kubectl apply -f .k8s/admin-panel/
 #   prometheus.io/scrape=true \
 #   prometheus.io/port=9187
 
-echo "- Админ-панель: kubectl port-forward -n admin-panel svc/admin-panel 8080:80"
+echo "- Админ-панель: kubectl port-forward -n auth-ui svc/auth-ui 8080:80"
 echo "- PostgreSQL: kubectl port-forward -n postgresql svc/postgresql 5434:5434"
 echo "- Sidecar: kubectl port-forward -n postgresql svc/postgresql 8080:8080"
 echo "Grafana: http://localhost:30091"
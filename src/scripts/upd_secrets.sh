@@ -1,4 +1,4 @@
-namespaces=("postgres-a" "postgres-b" "idp" "admin-panel" "monitoring" "service-a" "service-b")
+namespaces=("postgres-a" "postgres-b" "idp" "auth-ui" "monitoring" "service-a" "service-b")
 for ns in "${namespaces[@]}"; do
     # kubectl delete secret ghcr-secret -n $ns
     kubectl create secret docker-registry ghcr-secret \